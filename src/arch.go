@@ -1,6 +1,9 @@
 package dndbot
 
-import "strings"
+import (
+	"context"
+	"strings"
+)
 
 // Configuration struct for API and other settings
 type Config struct {
@@ -9,6 +12,81 @@ type Config struct {
 	MaxRetries int
 }
 
+// ImageSettings chooses the model and sampling parameters used for every
+// illustration and cover. Zero fields take the backend's defaults.
+type ImageSettings struct {
+	Model          string
+	Steps          int
+	NegativePrompt string
+	Sampler        string
+	CFGScale       float64
+	// Sizes picks the width and height of an image from its category.
+	// Categories without a size take the backend's defaults.
+	Sizes map[ImageCategory]ImageSize
+	// ReferenceDenoise enables reference mode: portraits of a recurring
+	// character start from their first portrait, changed by this
+	// denoising strength between 0 and 1. Zero disables it.
+	ReferenceDenoise float64
+	// PostProcess is applied to every image before it is saved.
+	PostProcess PostProcessing
+	// SkipFailed leaves out the images that cannot be generated, keeping
+	// their captions, instead of failing the adventure.
+	SkipFailed bool
+	// Context cancels the image requests, as when the generation is
+	// cancelled. Nil never cancels.
+	Context context.Context
+}
+
+// DefaultImageSettings are the image settings used when none are configured.
+var DefaultImageSettings = ImageSettings{Model: "Dreamshaper XL", Steps: 30, Sizes: DefaultImageSizes}
+
+// ImageCategory is the kind of picture an image is, which decides its shape.
+type ImageCategory string
+
+const (
+	// CategoryCover is a book cover.
+	CategoryCover ImageCategory = "cover"
+	// CategoryMap is an area map or location layout.
+	CategoryMap ImageCategory = "map"
+	// CategoryPortrait is a character or monster portrait.
+	CategoryPortrait ImageCategory = "portrait"
+	// CategoryScene is any other illustration, such as a dramatic moment.
+	CategoryScene ImageCategory = "scene"
+)
+
+// ImageSize is the width and height of an image in pixels. Stable Horde
+// only accepts multiples of 64.
+type ImageSize struct {
+	Width  int
+	Height int
+}
+
+// DefaultImageSizes are close to a megapixel, which SDXL models are trained
+// on: covers at a book's 3:4, square maps whose sides divide into grid
+// squares, tall 2:3 portraits and wide 16:9 scene banners.
+var DefaultImageSizes = map[ImageCategory]ImageSize{
+	CategoryCover:    {Width: 768, Height: 1024},
+	CategoryMap:      {Width: 1024, Height: 1024},
+	CategoryPortrait: {Width: 640, Height: 960},
+	CategoryScene:    {Width: 1024, Height: 576},
+}
+
+// request builds the ImageRequest for one image of the given category.
+func (s ImageSettings) request(prompt string, category ImageCategory) ImageRequest {
+	size := s.Sizes[category]
+	return ImageRequest{
+		Prompt:         prompt,
+		NegativePrompt: s.NegativePrompt,
+		Model:          s.Model,
+		Steps:          s.Steps,
+		Width:          size.Width,
+		Height:         size.Height,
+		Sampler:        s.Sampler,
+		CFGScale:       s.CFGScale,
+		Context:        s.Context,
+	}
+}
+
 // Adventure represents the complete story structure
 type Adventure struct {
 	Title           string
@@ -16,8 +94,11 @@ type Adventure struct {
 	TableOfContents string
 	OriginalPrompt  string
 	Covers          []IllustrationPrompt
-	Setting         string "PROMPT.md"
-	Style           string "STYLE.md"
+	Setting         string
+	Style           string
+	// Cast is the registry of recurring characters; see
+	// GenerateCharacterRegistry.
+	Cast []Character
 }
 
 // Episode represents a single adventure episode
@@ -30,6 +111,9 @@ type Episode struct {
 	OnePageDungeon string
 	FullAdventure  string
 	Illustrations  []IllustrationPrompt
+	// Map is the procedural play map drawn from the one-page dungeon; nil
+	// until GenerateDungeonMaps runs, or when it numbers no locations.
+	Map *DungeonMap
 }
 
 func (e *Episode) Text() string {
@@ -43,9 +127,46 @@ func (e *Episode) Text() string {
 
 // IllustrationPrompt represents a Stable Diffusion prompt
 type IllustrationPrompt struct {
+	// Title is the illustration title from the prompt's heading.
+	Title       string
 	Description string
 	Style       string
 	IsMap       bool
+	// Category is read from the prompt's Type line. It is empty for
+	// adventures checkpointed before it existed; see category.
+	Category ImageCategory
+	// Image is the file generated for the illustration and Backend the
+	// image backend that generated it. Both are empty until then, or when
+	// the image could not be generated.
+	Image   string
+	Backend string
+}
+
+// category returns the category the illustration is drawn at.
+func (p IllustrationPrompt) category() ImageCategory {
+	if p.Category != "" {
+		return p.Category
+	}
+	if p.IsMap {
+		return CategoryMap
+	}
+	return CategoryScene
+}
+
+// illustrationCategory maps the free-form Type of an illustration prompt to
+// its category.
+func illustrationCategory(kind string) ImageCategory {
+	kind = strings.ToLower(kind)
+	switch {
+	case strings.Contains(kind, "map"), strings.Contains(kind, "layout"):
+		return CategoryMap
+	case strings.Contains(kind, "portrait"), strings.Contains(kind, "portait"),
+		strings.Contains(kind, "character"), strings.Contains(kind, "monster"):
+		return CategoryPortrait
+	case strings.Contains(kind, "cover"):
+		return CategoryCover
+	}
+	return CategoryScene
 }
 
 // ClaudeRequest represents the API request structure
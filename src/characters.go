@@ -0,0 +1,162 @@
+package dndbot
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Character is a recurring non-player character of an adventure, drawn
+// alike in every illustration that mentions them.
+type Character struct {
+	Name string
+	// Appearance is the canonical visual description added to the prompt
+	// of every image featuring the character.
+	Appearance string
+	// Seed is the fixed seed of the images featuring the character.
+	Seed int64
+	// Reference is the image file of the character's first portrait. In
+	// reference mode later portraits start from it.
+	Reference string
+}
+
+// honorifics are name words that identify nobody on their own.
+var honorifics = map[string]bool{
+	"lord": true, "lady": true, "king": true, "queen": true, "prince": true,
+	"princess": true, "duke": true, "baron": true, "count": true, "captain": true,
+	"commander": true, "general": true, "father": true, "mother": true,
+	"brother": true, "sister": true, "master": true, "mistress": true,
+	"elder": true, "high": true, "the": true, "old": true, "young": true,
+}
+
+// GenerateCharacterRegistry builds the cast of the adventure from the
+// characters listed in its table of contents: every named character gets
+// a canonical appearance, asked of the text model, and a fixed seed derived
+// from the adventure title and the name.
+//
+// Parameters:
+//   - client: text model asked for the appearances
+//   - adventure: adventure whose Cast is replaced
+//
+// Returns:
+//   - error: any error from the text model
+func GenerateCharacterRegistry(client Client, adventure *Adventure) error {
+	var names []string
+	seen := map[string]bool{}
+	for _, episode := range adventure.Episodes {
+		for _, name := range episode.Characters {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[strings.ToLower(name)] {
+				continue
+			}
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	adventure.Cast = nil
+	if len(names) == 0 {
+		return nil
+	}
+
+	prompt := fmt.Sprintf("Describe the appearance of these characters:\n%s\n\nThis is the adventure they appear in:\n%s\n",
+		strings.Join(names, "\n"), adventure.TableOfContents)
+	response, err := client.SendMessage(GetCharacterPrompt(), prompt)
+	if err != nil {
+		return fmt.Errorf("describing characters: %w", err)
+	}
+	loggerOf(client).Debug("character registry", "response", response)
+	appearances := parseCharacters(response)
+	for _, name := range names {
+		adventure.Cast = append(adventure.Cast, Character{
+			Name:       name,
+			Appearance: appearances[strings.ToLower(name)],
+			Seed:       characterSeed(adventure.Title, name),
+		})
+	}
+	return nil
+}
+
+// characterSeed derives a stable seed below 2^32 from the adventure title
+// and a character's name.
+func characterSeed(title, name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(title + "\x00" + name)))
+	return int64(h.Sum32()%(1<<32-1)) + 1
+}
+
+// featuring returns the indexes in Cast of the characters text mentions,
+// by full name or by a distinctive part of it.
+func (a *Adventure) featuring(text string) []int {
+	var cast []int
+	for i, character := range a.Cast {
+		if mentions(text, character.Name) {
+			cast = append(cast, i)
+		}
+	}
+	return cast
+}
+
+// mentions reports whether text names the character name, ignoring case,
+// either in full or by one of its words that is neither a title nor
+// shorter than four letters.
+func mentions(text, name string) bool {
+	words := []string{name}
+	for _, word := range strings.Fields(name) {
+		if len(word) >= 4 && !honorifics[strings.ToLower(word)] {
+			words = append(words, word)
+		}
+	}
+	for _, word := range words {
+		re, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(word) + `\b`)
+		if err == nil && re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// castPrompt adds the canonical appearance of each featured character to
+// prompt.
+func (a *Adventure) castPrompt(prompt string, cast []int) string {
+	for _, i := range cast {
+		if character := a.Cast[i]; character.Appearance != "" {
+			prompt += fmt.Sprintf("\n%s: %s", character.Name, character.Appearance)
+		}
+	}
+	return prompt
+}
+
+// castRequest applies the character registry to req for an image whose
+// description is desc: it describes the featured characters, fixes the seed
+// to that of the first one and, in reference mode, starts portraits of a
+// single character from that character's reference portrait.
+//
+// Returns:
+//   - ImageRequest: the request to send
+//   - *Character: the character whose reference portrait the image becomes
+//     if it has none yet, or nil
+func (a *Adventure) castRequest(req ImageRequest, desc string, category ImageCategory, settings ImageSettings) (ImageRequest, *Character) {
+	cast := a.featuring(desc)
+	if len(cast) == 0 {
+		return req, nil
+	}
+	req.Prompt = a.castPrompt(req.Prompt, cast)
+	req.Seed = a.Cast[cast[0]].Seed
+	if settings.ReferenceDenoise <= 0 || category != CategoryPortrait || len(cast) != 1 {
+		return req, nil
+	}
+	character := &a.Cast[cast[0]]
+	if character.Reference == "" {
+		return req, character
+	}
+	data, err := os.ReadFile(character.Reference)
+	if err != nil {
+		return req, character
+	}
+	req.InitImage = data
+	req.Reference = character.Reference
+	req.Denoise = settings.ReferenceDenoise
+	return req, nil
+}
@@ -3,7 +3,10 @@ package dndbot
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -13,6 +16,9 @@ type ClaudeClient struct {
 	Client     *anthropic.Client
 	httpClient http.Client
 	apiKey     string
+	ctx        context.Context
+	tokens     *atomic.Int64
+	logger     *slog.Logger
 }
 
 func NewClaudeClient(apiKey string) *ClaudeClient {
@@ -25,8 +31,54 @@ func NewClaudeClient(apiKey string) *ClaudeClient {
 	}
 }
 
-func (c *ClaudeClient) SendMessage(systemPrompt, userPrompt string) (string, error) {
-	ctx := context.Background()
+// WithContext returns a copy of the client whose requests are bound to ctx,
+// so cancelling ctx aborts any message in flight.
+func (c *ClaudeClient) WithContext(ctx context.Context) *ClaudeClient {
+	cc := *c
+	cc.ctx = ctx
+	return &cc
+}
+
+// WithTokenCounter returns a copy of the client that adds the input and
+// output tokens of every successful message to counter.
+func (c *ClaudeClient) WithTokenCounter(counter *atomic.Int64) *ClaudeClient {
+	cc := *c
+	cc.tokens = counter
+	return &cc
+}
+
+// Ping checks that the API accepts the client's key by looking up the model
+// used for messages. It does not consume any tokens.
+func (c *ClaudeClient) Ping(ctx context.Context) error {
+	_, err := c.Client.Models.Get(ctx, string(anthropic.ModelClaude3_5SonnetLatest), option.WithMaxRetries(0))
+	if err != nil {
+		return fmt.Errorf("claude api error: %w", err)
+	}
+	return nil
+}
+
+// WithLogger returns a copy of the client that logs its requests to logger.
+func (c *ClaudeClient) WithLogger(logger *slog.Logger) *ClaudeClient {
+	cc := *c
+	cc.logger = logger
+	return &cc
+}
+
+// Logger returns the client's logger, or the default logger if none was set.
+func (c *ClaudeClient) Logger() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+func (c *ClaudeClient) SendMessage(systemPrompt, userPrompt string) (reply string, err error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	start := time.Now()
+	defer func() { observeCall("claude", start, err) }()
 	tries := 0
 	var message *anthropic.Message
 	for {
@@ -46,14 +98,22 @@ func (c *ClaudeClient) SendMessage(systemPrompt, userPrompt string) (string, err
 				}),
 			},
 		)
-		if tries > 4 {
-			if err != nil {
-				return "", fmt.Errorf("claude api error: %w", err)
-			}
-		}
 		if err == nil {
 			break
 		}
+		tries++
+		if tries > 4 || ctx.Err() != nil {
+			return "", fmt.Errorf("claude api error: %w", err)
+		}
+		c.Logger().Warn("claude request failed, retrying", "attempt", tries, "error", err)
+		observer.BackendRetry("claude")
+	}
+	c.Logger().Debug("claude response", "attempt", tries+1,
+		"input_tokens", message.Usage.InputTokens, "output_tokens", message.Usage.OutputTokens)
+
+	observer.Tokens("claude", message.Usage.InputTokens, message.Usage.OutputTokens)
+	if c.tokens != nil {
+		c.tokens.Add(message.Usage.InputTokens + message.Usage.OutputTokens)
 	}
 
 	if len(message.Content) == 0 {
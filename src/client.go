@@ -1,6 +1,9 @@
 package dndbot
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 )
 
@@ -8,6 +11,38 @@ type Client interface {
 	SendMessage(systemPrompt, userPrompt string) (string, error)
 }
 
+// Pinger is implemented by clients that can cheaply check that their
+// backend is up and accepts their credentials.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// loggerOf returns the logger carried by v, such as a ClaudeClient
+// configured with WithLogger, or the default logger.
+func loggerOf(v any) *slog.Logger {
+	if l, ok := v.(interface{ Logger() *slog.Logger }); ok {
+		return l.Logger()
+	}
+	return slog.Default()
+}
+
+// httpPing sends a GET request to url and expects a 200 response.
+func httpPing(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
 type LLMClient struct {
 	// client     *anthropic.Client
 	http.Client
@@ -0,0 +1,418 @@
+package dndbot
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultComfyUIWorkflow is a plain text-to-image workflow in the ComfyUI API
+// format, used when no workflow template is configured.
+//
+//go:embed comfyui_workflow.json
+var DefaultComfyUIWorkflow []byte
+
+// Defaults for the ComfyUIClient fields left zero.
+const (
+	comfyUIPollInterval = time.Second
+	comfyUITimeout      = 10 * time.Minute
+	comfyUISampler      = "euler"
+)
+
+// ComfyUIClient generates images with a ComfyUI server. It queues a workflow
+// on /prompt, polls /history until the workflow has run and downloads the
+// first image it saved from /view.
+//
+// Workflow is a template in the ComfyUI API format ("Save (API Format)" in
+// the ComfyUI menu). Any string value in it may contain the placeholders
+// {{prompt}}, {{negative_prompt}}, {{model}} and {{sampler}}; a value that is
+// exactly {{seed}}, {{steps}}, {{cfg}}, {{width}}, {{height}} or
+// {{batch_size}} is replaced by the number. DefaultComfyUIWorkflow is used
+// when Workflow is empty.
+type ComfyUIClient struct {
+	URL      string
+	Workflow []byte
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// PollInterval is how often /history is checked; default 1s.
+	PollInterval time.Duration
+	// Timeout bounds each image, including time spent queued; default 10m.
+	Timeout time.Duration
+}
+
+// NewComfyUIClient creates a client for the ComfyUI server at baseURL.
+//
+// Parameters:
+//   - baseURL: address of the ComfyUI server, e.g. http://127.0.0.1:8188
+//   - workflow: workflow template, or nil for DefaultComfyUIWorkflow
+//
+// Returns:
+//   - *ComfyUIClient: the client
+//   - error: if the workflow is not a JSON object
+func NewComfyUIClient(baseURL string, workflow []byte) (*ComfyUIClient, error) {
+	c := &ComfyUIClient{URL: strings.TrimRight(baseURL, "/"), Workflow: workflow}
+	if _, err := c.render(map[string]any{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Ping checks that the ComfyUI server is up.
+func (c *ComfyUIClient) Ping(ctx context.Context) error {
+	return httpPing(ctx, c.URL+"/system_stats")
+}
+
+// comfyUIQueued is the response to POST /prompt.
+type comfyUIQueued struct {
+	PromptID   string          `json:"prompt_id"`
+	Number     int             `json:"number"`
+	NodeErrors json.RawMessage `json:"node_errors"`
+}
+
+// comfyUIHistory is one entry of the response to GET /history/{prompt_id}.
+type comfyUIHistory struct {
+	Outputs map[string]struct {
+		Images []comfyUIImage `json:"images"`
+	} `json:"outputs"`
+	Status struct {
+		StatusStr string `json:"status_str"`
+		Completed bool   `json:"completed"`
+		// Messages are [type, details] pairs.
+		Messages [][]json.RawMessage `json:"messages"`
+	} `json:"status"`
+}
+
+// comfyUIImage locates a saved image for GET /view.
+type comfyUIImage struct {
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// comfyUIQueue is the response to GET /queue. Each entry starts with the
+// queue number and prompt ID.
+type comfyUIQueue struct {
+	Running [][]json.RawMessage `json:"queue_running"`
+	Pending [][]json.RawMessage `json:"queue_pending"`
+}
+
+func (c *ComfyUIClient) ImageGenerate(req ImageRequest, progress progressor) (images []GeneratedImage, err error) {
+	start := time.Now()
+	defer func() { observeCall("comfyui", start, err) }()
+	var pr progressor
+	if progress != nil {
+		pr = progress
+	} else {
+		pr = &nullProgressor{}
+	}
+
+	// Apply defaults and log them
+	req = req.withDefaults(pr, comfyUISampler)
+	if len(req.InitImage) > 0 {
+		// Workflow templates are text-to-image only.
+		pr.UpdateOutput("ComfyUI does not take reference images, generating from the prompt alone")
+		req.InitImage, req.Reference, req.Denoise = nil, "", 0
+	}
+	pr.UpdateOutput(fmt.Sprintf("Starting image generation: prompt=%q, steps=%d, width=%d, height=%d, seed=%d",
+		req.Prompt, req.Steps, req.Width, req.Height, req.Seed))
+
+	workflow, err := c.render(map[string]any{
+		"prompt":          req.Prompt,
+		"negative_prompt": req.NegativePrompt,
+		"model":           req.Model,
+		"sampler":         req.Sampler,
+		"seed":            req.Seed,
+		"steps":           req.Steps,
+		"cfg":             req.CFGScale,
+		"width":           req.Width,
+		"height":          req.Height,
+		"batch_size":      req.BatchSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = comfyUITimeout
+	}
+	ctx, cancel := context.WithTimeout(req.context(), timeout)
+	defer cancel()
+
+	pr.UpdateOutput("Submitting workflow to ComfyUI...")
+	queued, err := c.queuePrompt(ctx, workflow)
+	if err != nil {
+		return nil, err
+	}
+	pr.UpdateOutput(fmt.Sprintf("Workflow queued with ID: %s", queued.PromptID))
+
+	saved, err := c.waitForImages(ctx, queued.PromptID, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole batch shares one seed; Index tells its images apart.
+	for i, image := range saved {
+		if i >= req.BatchSize {
+			break
+		}
+		pr.UpdateOutput("Downloading generated image...")
+		imageData, err := c.view(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		pr.UpdateOutput(fmt.Sprintf("Successfully downloaded image: %d bytes", len(imageData)))
+		images = append(images, GeneratedImage{Data: imageData, Backend: "comfyui", Request: req, Index: i, Seed: req.Seed})
+	}
+	return images, nil
+}
+
+// render substitutes values into the workflow template.
+func (c *ComfyUIClient) render(values map[string]any) (map[string]any, error) {
+	template := c.Workflow
+	if len(template) == 0 {
+		template = DefaultComfyUIWorkflow
+	}
+	var workflow map[string]any
+	if err := json.Unmarshal(template, &workflow); err != nil {
+		return nil, fmt.Errorf("parsing ComfyUI workflow: %w", err)
+	}
+	return substitute(workflow, values).(map[string]any), nil
+}
+
+// substitute replaces the {{name}} placeholders in the strings below v.
+func substitute(v any, values map[string]any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, elem := range v {
+			v[key] = substitute(elem, values)
+		}
+		return v
+	case []any:
+		for i, elem := range v {
+			v[i] = substitute(elem, values)
+		}
+		return v
+	case string:
+		if strings.HasPrefix(v, "{{") && strings.HasSuffix(v, "}}") {
+			if value, ok := values[v[2:len(v)-2]]; ok {
+				if _, isString := value.(string); !isString {
+					return value
+				}
+			}
+		}
+		for name, value := range values {
+			v = strings.ReplaceAll(v, "{{"+name+"}}", fmt.Sprint(value))
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// queuePrompt submits a workflow to /prompt.
+func (c *ComfyUIClient) queuePrompt(ctx context.Context, workflow map[string]any) (*comfyUIQueued, error) {
+	body, err := json.Marshal(map[string]any{
+		"prompt":    workflow,
+		"client_id": uuid.New().String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/prompt", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var queued comfyUIQueued
+	if err := c.do(req, &queued); err != nil {
+		return nil, fmt.Errorf("queueing workflow: %w", err)
+	}
+	if queued.PromptID == "" {
+		return nil, fmt.Errorf("queueing workflow: no prompt ID in response (node errors: %s)", queued.NodeErrors)
+	}
+	return &queued, nil
+}
+
+// waitForImages polls /history until the workflow has run, reporting its
+// place in the ComfyUI queue as it changes, and returns the images it saved.
+func (c *ComfyUIClient) waitForImages(ctx context.Context, promptID string, pr progressor) ([]comfyUIImage, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = comfyUIPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pr.UpdateOutput("Waiting for generation to complete...")
+	lastStatus := ""
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/history/"+url.PathEscape(promptID), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		var history map[string]comfyUIHistory
+		if err := c.do(req, &history); err != nil {
+			return nil, fmt.Errorf("polling history: %w", err)
+		}
+		if entry, ok := history[promptID]; ok {
+			return entry.images()
+		}
+
+		if status := c.queueStatus(ctx, promptID); status != "" && status != lastStatus {
+			pr.UpdateOutput(status)
+			lastStatus = status
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for ComfyUI workflow %s: %w", promptID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// images returns the images saved by a finished workflow, in the order of
+// their output nodes, or the error it failed with.
+func (h comfyUIHistory) images() ([]comfyUIImage, error) {
+	if h.Status.StatusStr == "error" {
+		for _, msg := range h.Status.Messages {
+			if len(msg) < 2 || string(msg[0]) != `"execution_error"` {
+				continue
+			}
+			var details struct {
+				NodeType         string `json:"node_type"`
+				ExceptionMessage string `json:"exception_message"`
+			}
+			if json.Unmarshal(msg[1], &details) == nil {
+				return nil, fmt.Errorf("ComfyUI workflow failed in %s: %s", details.NodeType, strings.TrimSpace(details.ExceptionMessage))
+			}
+		}
+		return nil, fmt.Errorf("ComfyUI workflow failed")
+	}
+	nodes := make([]string, 0, len(h.Outputs))
+	for node := range h.Outputs {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	var images []comfyUIImage
+	for _, node := range nodes {
+		for _, image := range h.Outputs[node].Images {
+			if image.Type != "temp" {
+				images = append(images, image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images generated")
+	}
+	return images, nil
+}
+
+// queueStatus describes where a workflow is in the ComfyUI queue, or returns
+// an empty string if the queue cannot be read or no longer holds it.
+func (c *ComfyUIClient) queueStatus(ctx context.Context, promptID string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/queue", nil)
+	if err != nil {
+		return ""
+	}
+	var queue comfyUIQueue
+	if c.do(req, &queue) != nil {
+		return ""
+	}
+	for _, entry := range queue.Running {
+		if _, id := queueEntry(entry); id == promptID {
+			return "Generating image..."
+		}
+	}
+	// Pending entries run in order of their queue number.
+	ours := -1.0
+	for _, entry := range queue.Pending {
+		if number, id := queueEntry(entry); id == promptID {
+			ours = number
+		}
+	}
+	if ours < 0 {
+		return ""
+	}
+	ahead := len(queue.Running)
+	for _, entry := range queue.Pending {
+		if number, _ := queueEntry(entry); number < ours {
+			ahead++
+		}
+	}
+	return fmt.Sprintf("Queued in ComfyUI, %d ahead", ahead)
+}
+
+// queueEntry returns the queue number and prompt ID of a /queue entry.
+func queueEntry(entry []json.RawMessage) (number float64, promptID string) {
+	if len(entry) < 2 {
+		return -1, ""
+	}
+	json.Unmarshal(entry[0], &number)
+	json.Unmarshal(entry[1], &promptID)
+	return number, promptID
+}
+
+// view downloads a saved image.
+func (c *ComfyUIClient) view(ctx context.Context, image comfyUIImage) ([]byte, error) {
+	query := url.Values{
+		"filename":  {image.Filename},
+		"subfolder": {image.Subfolder},
+		"type":      {image.Type},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/view?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading image: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading image: unexpected status code: %d, body: %s", resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+// do sends req and decodes its JSON response into v.
+func (c *ComfyUIClient) do(req *http.Request, v any) error {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+func (c *ComfyUIClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,288 @@
+package dndbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingProgressor keeps the messages reported to it.
+type recordingProgressor struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *recordingProgressor) UpdateOutput(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, message)
+}
+
+func (p *recordingProgressor) contains(substr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range p.messages {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeComfyUI imitates the ComfyUI endpoints used by ComfyUIClient. The
+// workflow is reported pending on /history for the first polls, then
+// history is returned as its entry.
+type fakeComfyUI struct {
+	*httptest.Server
+	pendingPolls int
+	history      string
+
+	mu       sync.Mutex
+	workflow map[string]any
+	polls    int
+	views    []string
+}
+
+const fakePromptID = "8f0c6a4e-prompt"
+
+func newFakeComfyUI(t *testing.T, pendingPolls int, history string) *fakeComfyUI {
+	t.Helper()
+	f := &fakeComfyUI{pendingPolls: pendingPolls, history: history}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /prompt", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Prompt   map[string]any `json:"prompt"`
+			ClientID string         `json:"client_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ClientID == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.workflow = body.Prompt
+		f.mu.Unlock()
+		fmt.Fprintf(w, `{"prompt_id": %q, "number": 7, "node_errors": {}}`, fakePromptID)
+	})
+	mux.HandleFunc("GET /history/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.polls++
+		pending := f.polls <= f.pendingPolls
+		f.mu.Unlock()
+		if pending || r.PathValue("id") != fakePromptID {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprintf(w, `{%q: %s}`, fakePromptID, f.history)
+	})
+	mux.HandleFunc("GET /queue", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"queue_running": [[6, "other-prompt", {}]], "queue_pending": [[7, %q, {}], [8, "later", {}]]}`, fakePromptID)
+	})
+	mux.HandleFunc("GET /view", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("type") != "output" {
+			http.NotFound(w, r)
+			return
+		}
+		f.mu.Lock()
+		f.views = append(f.views, query.Get("subfolder")+"/"+query.Get("filename"))
+		f.mu.Unlock()
+		fmt.Fprint(w, "image:"+query.Get("filename"))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// requests returns how often /history was polled and the images viewed.
+func (f *fakeComfyUI) requests() (polls int, views []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.polls, append([]string(nil), f.views...)
+}
+
+// node returns the inputs of a node of the submitted workflow.
+func (f *fakeComfyUI) node(t *testing.T, id string) map[string]any {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.workflow[id].(map[string]any)
+	if !ok {
+		t.Fatalf("workflow has no node %s: %v", id, f.workflow)
+	}
+	return node["inputs"].(map[string]any)
+}
+
+const succeededHistory = `{
+	"outputs": {
+		"9": {"images": [{"filename": "dndbot_00001_.png", "subfolder": "runs", "type": "output"}]},
+		"12": {"images": [{"filename": "preview_00001_.png", "subfolder": "", "type": "temp"}]}
+	},
+	"status": {"status_str": "success", "completed": true, "messages": [["execution_start", {}], ["execution_success", {}]]}
+}`
+
+func TestComfyUIGenerate(t *testing.T) {
+	fake := newFakeComfyUI(t, 2, succeededHistory)
+	client, err := NewComfyUIClient(fake.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.PollInterval = time.Millisecond
+	progress := &recordingProgressor{}
+
+	images, err := client.ImageGenerate(ImageRequest{
+		Prompt:         "a flooded crypt",
+		NegativePrompt: "blurry",
+		Model:          "dreamshaper_8.safetensors",
+		Steps:          25,
+		Width:          768,
+		Height:         512,
+		Seed:           1234,
+		CFGScale:       6.5,
+	}, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(images) != 1 {
+		t.Fatalf("got %d images, want 1", len(images))
+	}
+	image := images[0]
+	if string(image.Data) != "image:dndbot_00001_.png" || image.Backend != "comfyui" || image.Seed != 1234 {
+		t.Errorf("image = %q from %s with seed %d", image.Data, image.Backend, image.Seed)
+	}
+	if image.Request.Sampler != comfyUISampler || image.Request.BatchSize != 1 {
+		t.Errorf("request defaults = %+v", image.Request)
+	}
+	polls, views := fake.requests()
+	if len(views) != 1 || views[0] != "runs/dndbot_00001_.png" {
+		t.Errorf("viewed %v, want only the saved output", views)
+	}
+	if polls != 3 {
+		t.Errorf("polled /history %d times, want 3", polls)
+	}
+	if !progress.contains("Queued in ComfyUI, 1 ahead") || !progress.contains(fakePromptID) {
+		t.Error("progress does not report the prompt ID and queue position")
+	}
+
+	// The default workflow gets every value, numbers as numbers.
+	sampler := fake.node(t, "3")
+	for key, want := range map[string]any{"seed": 1234.0, "steps": 25.0, "cfg": 6.5, "sampler_name": comfyUISampler} {
+		if sampler[key] != want {
+			t.Errorf("KSampler %s = %#v, want %#v", key, sampler[key], want)
+		}
+	}
+	latent := fake.node(t, "5")
+	for key, want := range map[string]any{"width": 768.0, "height": 512.0, "batch_size": 1.0} {
+		if latent[key] != want {
+			t.Errorf("EmptyLatentImage %s = %#v, want %#v", key, latent[key], want)
+		}
+	}
+	if got := fake.node(t, "4")["ckpt_name"]; got != "dreamshaper_8.safetensors" {
+		t.Errorf("ckpt_name = %#v", got)
+	}
+	if got := fake.node(t, "6")["text"]; got != "a flooded crypt" {
+		t.Errorf("positive text = %#v", got)
+	}
+	if got := fake.node(t, "7")["text"]; got != "blurry" {
+		t.Errorf("negative text = %#v", got)
+	}
+}
+
+func TestComfyUIWorkflowTemplate(t *testing.T) {
+	fake := newFakeComfyUI(t, 0, succeededHistory)
+	workflow := `{
+		"1": {"class_type": "Custom", "inputs": {
+			"text": "{{prompt}}, highly detailed, not {{negative_prompt}}",
+			"ckpt": "models/{{model}}",
+			"sampler": "{{sampler}}",
+			"label": "seed {{seed}} at {{width}}x{{height}}",
+			"seed": "{{seed}}",
+			"size": ["{{width}}", "{{height}}"],
+			"unknown": "{{unknown}}",
+			"fixed": 3
+		}}
+	}`
+	client, err := NewComfyUIClient(fake.URL, []byte(workflow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.PollInterval = time.Millisecond
+
+	if _, err := client.ImageGenerate(ImageRequest{
+		Prompt: "a lich", NegativePrompt: "text", Model: "sdxl", Sampler: "dpmpp_2m",
+		Steps: 20, Width: 1024, Height: 640, Seed: 99,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := fake.node(t, "1")
+	for key, want := range map[string]any{
+		"text":    "a lich, highly detailed, not text",
+		"ckpt":    "models/sdxl",
+		"sampler": "dpmpp_2m",
+		"label":   "seed 99 at 1024x640",
+		"seed":    99.0,
+		"unknown": "{{unknown}}",
+		"fixed":   3.0,
+	} {
+		if inputs[key] != want {
+			t.Errorf("%s = %#v, want %#v", key, inputs[key], want)
+		}
+	}
+	if size, _ := inputs["size"].([]any); len(size) != 2 || size[0] != 1024.0 || size[1] != 640.0 {
+		t.Errorf("size = %#v, want [1024 640]", inputs["size"])
+	}
+}
+
+func TestComfyUIInvalidWorkflow(t *testing.T) {
+	if _, err := NewComfyUIClient("http://127.0.0.1:8188", []byte(`["not", "an", "object"]`)); err == nil {
+		t.Error("NewComfyUIClient accepted a workflow that is not an object")
+	}
+}
+
+func TestComfyUIExecutionError(t *testing.T) {
+	fake := newFakeComfyUI(t, 1, `{
+		"outputs": {},
+		"status": {"status_str": "error", "completed": false, "messages": [
+			["execution_start", {"prompt_id": "8f0c6a4e-prompt"}],
+			["execution_error", {"node_id": "3", "node_type": "KSampler", "exception_message": "CUDA out of memory. Tried to allocate 2.00 GiB\n"}]
+		]}
+	}`)
+	client, err := NewComfyUIClient(fake.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.PollInterval = time.Millisecond
+
+	images, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt"}, nil)
+	if err == nil {
+		t.Fatalf("got %d images from a failed workflow, want an error", len(images))
+	}
+	if want := "ComfyUI workflow failed in KSampler: CUDA out of memory. Tried to allocate 2.00 GiB"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+	if _, views := fake.requests(); len(views) != 0 {
+		t.Errorf("downloaded %v from a failed workflow", views)
+	}
+}
+
+func TestComfyUIQueueRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"type": "prompt_outputs_failed_validation"}}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+	client, err := NewComfyUIClient(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "queueing workflow") || !strings.Contains(err.Error(), "400") {
+		t.Errorf("error = %v, want the rejected queueing", err)
+	}
+}
@@ -0,0 +1,489 @@
+package dndbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DungeonMap is a procedurally generated top-down dungeon on a square grid,
+// keyed to the numbered locations of a one-page dungeon.
+type DungeonMap struct {
+	// Width and Height are in grid cells.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Floor marks the walkable cells, row by row.
+	Floor [][]bool  `json:"floor"`
+	Rooms []MapRoom `json:"rooms"`
+	// Doors are the cell edges where a corridor enters a room.
+	Doors []MapSegment `json:"doors"`
+	// Seed reproduces the layout.
+	Seed int64 `json:"seed"`
+}
+
+// MapRoom is a rectangular room, in grid cells.
+type MapRoom struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	W      int    `json:"w"`
+	H      int    `json:"h"`
+}
+
+// MapSegment is a horizontal or vertical line along cell edges, in grid
+// units from the top left corner of the map.
+type MapSegment struct {
+	X1 int `json:"x1"`
+	Y1 int `json:"y1"`
+	X2 int `json:"x2"`
+	Y2 int `json:"y2"`
+}
+
+// MapLocation is a numbered key location of a one-page dungeon.
+type MapLocation struct {
+	Number int
+	Name   string
+}
+
+// maxMapLocations bounds the rooms of a map.
+const maxMapLocations = 20
+
+// locationItem matches a numbered item, e.g. "### 1. The Gate",
+// "**2) Guard Room**: ..." or "- Room 3 - Crypt".
+var locationItem = regexp.MustCompile(`(?i)^(#{1,6}\s*)?(?:[-*+]\s+)?(?:\*\*|__)?\s*(?:(?:room|area|location)\s+(\d{1,2})\s*[.):]?|(\d{1,2})\s*[.):])\s*(?:\*\*|__)?\s*(?:[-–—:]\s*)?(.*)$`)
+
+// ParseMapLocations extracts the numbered key locations of a one-page
+// dungeon, preferring those under a heading mentioning locations, rooms or
+// areas. Elsewhere only numbered headings and bold items count, so that
+// the numbered entries of encounter and treasure tables are not taken for
+// locations.
+//
+// Parameters:
+//   - onePage: one-page dungeon markdown
+//
+// Returns:
+//   - []MapLocation: the locations in order, at most 20, without repeated
+//     numbers
+func ParseMapLocations(onePage string) []MapLocation {
+	var section, anywhere []MapLocation
+	sectionLevel := 0
+	for _, line := range strings.Split(onePage, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "|") {
+			continue
+		}
+		level := len(line) - len(strings.TrimLeft(line, "#"))
+		m := locationItem.FindStringSubmatch(line)
+		if level > 0 && m == nil {
+			lower := strings.ToLower(line)
+			switch {
+			case strings.Contains(lower, "location") || strings.Contains(lower, "room") || strings.Contains(lower, "area"):
+				sectionLevel = level
+			case sectionLevel > 0 && level <= sectionLevel:
+				sectionLevel = 0
+			}
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(m[2] + m[3])
+		location := MapLocation{Number: number, Name: locationName(m[4])}
+		if number == 0 {
+			continue
+		}
+		if sectionLevel > 0 {
+			section = append(section, location)
+		} else if m[1] != "" || strings.Contains(line, "**") || strings.Contains(line, "__") {
+			anywhere = append(anywhere, location)
+		}
+	}
+	if len(section) == 0 {
+		section = anywhere
+	}
+	var locations []MapLocation
+	seen := map[int]bool{}
+	for _, location := range section {
+		if seen[location.Number] || len(locations) == maxMapLocations {
+			continue
+		}
+		seen[location.Number] = true
+		locations = append(locations, location)
+	}
+	return locations
+}
+
+// locationName shortens the text after a location's number to its name.
+func locationName(text string) string {
+	text = strings.NewReplacer("**", "", "__", "", "*", "", "`", "").Replace(text)
+	for _, sep := range []string{":", " - ", " – ", " — ", ". ", "("} {
+		if i := strings.Index(text, sep); i > 0 {
+			text = text[:i]
+		}
+	}
+	text = strings.TrimFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r > 0x7f && r < 0x2000)
+	})
+	if runes := []rune(text); len(runes) > 40 {
+		text = strings.TrimSpace(string(runes[:40])) + "…"
+	}
+	return text
+}
+
+// Room sizes and spacing, in grid cells.
+const (
+	mapRoomMin    = 4
+	mapRoomMax    = 8
+	mapRoomMargin = 2
+)
+
+// NewDungeonMap lays out one room per location on a grid and joins them in
+// key order with corridors, plus a loop from the last room back to an
+// earlier one when there are enough rooms. The layout depends only on the
+// locations and seed.
+//
+// Parameters:
+//   - locations: the rooms to place, numbered
+//   - seed: seeds the layout
+//
+// Returns:
+//   - *DungeonMap: the map, or nil when there are no locations
+func NewDungeonMap(locations []MapLocation, seed int64) *DungeonMap {
+	if len(locations) == 0 {
+		return nil
+	}
+	side := 10*int(math.Ceil(math.Sqrt(float64(len(locations))))) + 8
+	for {
+		if m := layoutDungeon(locations, seed, side*4/3, side); m != nil {
+			return m
+		}
+		side += 6
+	}
+}
+
+// layoutDungeon tries to lay out locations on a width by height grid. It
+// returns nil when the rooms do not fit.
+func layoutDungeon(locations []MapLocation, seed int64, width, height int) *DungeonMap {
+	rng := rand.New(rand.NewSource(seed))
+	m := &DungeonMap{Width: width, Height: height, Seed: seed}
+	for _, location := range locations {
+		placed := false
+		for attempt := 0; attempt < 200 && !placed; attempt++ {
+			w := mapRoomMin + rng.Intn(mapRoomMax-mapRoomMin+1)
+			h := mapRoomMin + rng.Intn(mapRoomMax-mapRoomMin)
+			room := MapRoom{
+				Number: location.Number,
+				Name:   location.Name,
+				X:      1 + rng.Intn(width-w-1),
+				Y:      1 + rng.Intn(height-h-1),
+				W:      w,
+				H:      h,
+			}
+			if !m.overlaps(room) {
+				m.Rooms = append(m.Rooms, room)
+				placed = true
+			}
+		}
+		if !placed {
+			return nil
+		}
+	}
+
+	m.Floor = make([][]bool, height)
+	for y := range m.Floor {
+		m.Floor[y] = make([]bool, width)
+	}
+	for _, room := range m.Rooms {
+		for y := room.Y; y < room.Y+room.H; y++ {
+			for x := room.X; x < room.X+room.W; x++ {
+				m.Floor[y][x] = true
+			}
+		}
+	}
+	for i := 1; i < len(m.Rooms); i++ {
+		m.carveCorridor(m.Rooms[i-1], m.Rooms[i], rng.Intn(2) == 0)
+	}
+	if n := len(m.Rooms); n >= 4 {
+		m.carveCorridor(m.Rooms[n-1], m.Rooms[rng.Intn(n-2)], rng.Intn(2) == 0)
+	}
+	m.Doors = m.findDoors()
+	return m
+}
+
+// overlaps reports whether room comes within mapRoomMargin cells of a room
+// already placed.
+func (m *DungeonMap) overlaps(room MapRoom) bool {
+	for _, other := range m.Rooms {
+		if room.X < other.X+other.W+mapRoomMargin && other.X < room.X+room.W+mapRoomMargin &&
+			room.Y < other.Y+other.H+mapRoomMargin && other.Y < room.Y+room.H+mapRoomMargin {
+			return true
+		}
+	}
+	return false
+}
+
+// center returns the middle cell of room.
+func (r MapRoom) center() (int, int) {
+	return r.X + r.W/2, r.Y + r.H/2
+}
+
+// contains reports whether cell (x, y) is inside room.
+func (r MapRoom) contains(x, y int) bool {
+	return x >= r.X && x < r.X+r.W && y >= r.Y && y < r.Y+r.H
+}
+
+// carveCorridor digs a one cell wide, L-shaped corridor between the
+// centers of a and b, horizontal first when horizontalFirst is set.
+func (m *DungeonMap) carveCorridor(a, b MapRoom, horizontalFirst bool) {
+	x1, y1 := a.center()
+	x2, y2 := b.center()
+	if horizontalFirst {
+		m.carveLine(x1, y1, x2, y1)
+		m.carveLine(x2, y1, x2, y2)
+	} else {
+		m.carveLine(x1, y1, x1, y2)
+		m.carveLine(x1, y2, x2, y2)
+	}
+}
+
+// carveLine marks the cells of a horizontal or vertical line as floor.
+func (m *DungeonMap) carveLine(x1, y1, x2, y2 int) {
+	dx, dy := sign(x2-x1), sign(y2-y1)
+	for x, y := x1, y1; ; x, y = x+dx, y+dy {
+		m.Floor[y][x] = true
+		if x == x2 && y == y2 {
+			return
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// room returns the room containing cell (x, y), or nil.
+func (m *DungeonMap) room(x, y int) *MapRoom {
+	for i := range m.Rooms {
+		if m.Rooms[i].contains(x, y) {
+			return &m.Rooms[i]
+		}
+	}
+	return nil
+}
+
+// isFloor reports whether cell (x, y) is on the map and walkable.
+func (m *DungeonMap) isFloor(x, y int) bool {
+	return x >= 0 && y >= 0 && x < m.Width && y < m.Height && m.Floor[y][x]
+}
+
+// findDoors places a door on each room edge where a one cell wide corridor
+// leads straight away from the room. Wider openings, where a corridor runs
+// along a room, stay open archways.
+func (m *DungeonMap) findDoors() []MapSegment {
+	var doors []MapSegment
+	seen := map[MapSegment]bool{}
+	for _, room := range m.Rooms {
+		for y := room.Y; y < room.Y+room.H; y++ {
+			for x := room.X; x < room.X+room.W; x++ {
+				for _, d := range [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+					ox, oy := x+d[0], y+d[1]
+					if !m.isFloor(ox, oy) || m.room(ox, oy) != nil {
+						continue
+					}
+					// The cells beside the corridor, along the wall.
+					if m.isFloor(ox+d[1], oy+d[0]) || m.isFloor(ox-d[1], oy-d[0]) {
+						continue
+					}
+					door := edgeBetween(x, y, ox, oy)
+					if !seen[door] {
+						seen[door] = true
+						doors = append(doors, door)
+					}
+				}
+			}
+		}
+	}
+	return doors
+}
+
+// edgeBetween returns the edge shared by two orthogonally adjacent cells.
+func edgeBetween(x1, y1, x2, y2 int) MapSegment {
+	switch {
+	case x2 > x1:
+		return MapSegment{X1: x2, Y1: y1, X2: x2, Y2: y1 + 1}
+	case x2 < x1:
+		return MapSegment{X1: x1, Y1: y1, X2: x1, Y2: y1 + 1}
+	case y2 > y1:
+		return MapSegment{X1: x1, Y1: y2, X2: x1 + 1, Y2: y2}
+	}
+	return MapSegment{X1: x1, Y1: y1, X2: x1 + 1, Y2: y1}
+}
+
+// Walls returns the edges between floor and rock, merged into the longest
+// straight segments.
+func (m *DungeonMap) Walls() []MapSegment {
+	horizontal := map[int][]int{} // y of the edge: x of each unit edge
+	vertical := map[int][]int{}   // x of the edge: y of each unit edge
+	for y := 0; y < m.Height; y++ {
+		for x := 0; x < m.Width; x++ {
+			if !m.Floor[y][x] {
+				continue
+			}
+			if !m.isFloor(x, y-1) {
+				horizontal[y] = append(horizontal[y], x)
+			}
+			if !m.isFloor(x, y+1) {
+				horizontal[y+1] = append(horizontal[y+1], x)
+			}
+			if !m.isFloor(x-1, y) {
+				vertical[x] = append(vertical[x], y)
+			}
+			if !m.isFloor(x+1, y) {
+				vertical[x+1] = append(vertical[x+1], y)
+			}
+		}
+	}
+	var walls []MapSegment
+	for _, y := range sortedKeys(horizontal) {
+		for _, run := range runs(horizontal[y]) {
+			walls = append(walls, MapSegment{X1: run[0], Y1: y, X2: run[1], Y2: y})
+		}
+	}
+	for _, x := range sortedKeys(vertical) {
+		for _, run := range runs(vertical[x]) {
+			walls = append(walls, MapSegment{X1: x, Y1: run[0], X2: x, Y2: run[1]})
+		}
+	}
+	return walls
+}
+
+// runs merges unit edges starting at each of starts into [from, to) runs.
+func runs(starts []int) [][2]int {
+	sort.Ints(starts)
+	var out [][2]int
+	for _, s := range starts {
+		if n := len(out); n > 0 && out[n-1][1] == s {
+			out[n-1][1] = s + 1
+			continue
+		} else if n > 0 && out[n-1][1] > s {
+			continue
+		}
+		out = append(out, [2]int{s, s + 1})
+	}
+	return out
+}
+
+func sortedKeys(m map[int][]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// mapSeed derives the seed of an episode's map from the adventure and
+// episode titles.
+func mapSeed(adventure, episode string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(adventure + "\x00" + episode))
+	return int64(h.Sum64() >> 1)
+}
+
+// GenerateDungeonMaps draws the play map of every episode from the numbered
+// key locations of its one-page dungeon and records it on the episode. Each
+// map is written to its episode's directory as SVG and PNG, with its layout
+// as JSON, a Universal VTT export for virtual tabletops and a caption keying
+// the room numbers. Episodes whose one-page dungeon numbers no locations
+// get no map.
+//
+// Parameters:
+//   - adventure: adventure whose episodes get a Map
+//   - path: output directory holding the episode directories
+//   - progress: progress reporter
+//
+// Returns:
+//   - error: any error rendering or writing a map
+func GenerateDungeonMaps(adventure *Adventure, path string, progress progressor) error {
+	var pr progressor
+	if progress != nil {
+		pr = progress
+	} else {
+		pr = &nullProgressor{}
+	}
+	for i := range adventure.Episodes {
+		episode := &adventure.Episodes[i]
+		locations := ParseMapLocations(episode.OnePageDungeon)
+		if len(locations) == 0 {
+			episode.Map = nil
+			pr.UpdateOutput(fmt.Sprintf("The one-page dungeon of %s numbers no locations, skipping its map", episode.Title))
+			continue
+		}
+		episode.Map = NewDungeonMap(locations, mapSeed(adventure.Title, episode.Title))
+		dir := filepath.Join(path, fmt.Sprintf("%02d_Episode", i+1))
+		if err := episode.Map.save(dir, mapFileName(i+1), episode.Title); err != nil {
+			return fmt.Errorf("writing map of episode %d: %w", i+1, err)
+		}
+		pr.UpdateOutput(fmt.Sprintf("Drew a %d room map for %s", len(episode.Map.Rooms), episode.Title))
+	}
+	return nil
+}
+
+// mapFileName returns the base name of an episode's play map files. It
+// follows the illustration names with index 00, so the map comes first in
+// its episode; there is one map per episode, so it needs no hash.
+func mapFileName(episode int) string {
+	return fmt.Sprintf("%02d_00_%s_play-map", episode, CategoryMap)
+}
+
+// save writes the map to dir as name.svg, name.png, name.json, name.dd2vtt
+// and the caption name.md, which shows the PNG and lists the key.
+func (m *DungeonMap) save(dir, name, title string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := m.PNG()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".png"), data, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".svg"), m.SVG(), 0o644); err != nil {
+		return err
+	}
+	layout, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), layout, 0o644); err != nil {
+		return err
+	}
+	vtt, err := m.UniversalVTT()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".dd2vtt"), vtt, 0o644); err != nil {
+		return err
+	}
+	caption := fmt.Sprintf(" - [Play map: %s](%s)\n\n", title, name+".png")
+	for _, room := range m.Rooms {
+		caption += fmt.Sprintf("   - **%d.** %s\n", room.Number, room.Name)
+	}
+	return os.WriteFile(filepath.Join(dir, name+".md"), []byte(caption), 0o644)
+}
@@ -0,0 +1,156 @@
+package dndbot
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// MapCellPixels is the size of a grid cell in rendered maps.
+const MapCellPixels = 50
+
+// Map colours: rock, floor, grid lines, walls, doors and room labels.
+var (
+	mapRock  = color.RGBA{0x3b, 0x38, 0x33, 0xff}
+	mapFloor = color.RGBA{0xf4, 0xec, 0xd8, 0xff}
+	mapGrid  = color.RGBA{0xc9, 0xbd, 0xa2, 0xff}
+	mapWall  = color.RGBA{0x1a, 0x17, 0x14, 0xff}
+	mapDoor  = color.RGBA{0x8b, 0x5a, 0x2b, 0xff}
+	mapLabel = color.RGBA{0x9b, 0x1c, 0x1c, 0xff}
+)
+
+// Line widths in pixels.
+const (
+	mapWallWidth = 6
+	mapDoorWidth = 10
+)
+
+// hex returns c as an SVG colour.
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// SVG renders the map: rock, floor with its grid, walls, doors and a
+// numbered marker in each room, with the room's name as its tooltip.
+func (m *DungeonMap) SVG() []byte {
+	const px = MapCellPixels
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		m.Width*px, m.Height*px, m.Width*px, m.Height*px)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hex(mapRock))
+	fmt.Fprintf(&b, `<g fill="%s" stroke="%s" stroke-width="1">`+"\n", hex(mapFloor), hex(mapGrid))
+	for y := 0; y < m.Height; y++ {
+		for x := 0; x < m.Width; x++ {
+			if m.Floor[y][x] {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d"/>`+"\n", x*px, y*px, px, px)
+			}
+		}
+	}
+	b.WriteString("</g>\n")
+	fmt.Fprintf(&b, `<g stroke="%s" stroke-width="%d" stroke-linecap="square">`+"\n", hex(mapWall), mapWallWidth)
+	for _, w := range m.Walls() {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d"/>`+"\n", w.X1*px, w.Y1*px, w.X2*px, w.Y2*px)
+	}
+	b.WriteString("</g>\n")
+	fmt.Fprintf(&b, `<g stroke="%s" stroke-width="%d">`+"\n", hex(mapDoor), mapDoorWidth)
+	for _, d := range m.Doors {
+		x1, y1, x2, y2 := doorPixels(d)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d"/>`+"\n", x1, y1, x2, y2)
+	}
+	b.WriteString("</g>\n")
+	fmt.Fprintf(&b, `<g font-family="serif" font-size="%d" font-weight="bold" text-anchor="middle">`+"\n", px/2)
+	for _, r := range m.Rooms {
+		cx, cy := labelCenter(r)
+		fmt.Fprintf(&b, `<g><title>%d. %s</title><circle cx="%d" cy="%d" r="%d" fill="%s" stroke="%s" stroke-width="3"/><text x="%d" y="%d" fill="%s">%d</text></g>`+"\n",
+			r.Number, html.EscapeString(r.Name), cx, cy, px/2, hex(mapFloor), hex(mapLabel), cx, cy+px/6, hex(mapLabel), r.Number)
+	}
+	b.WriteString("</g>\n</svg>\n")
+	return b.Bytes()
+}
+
+// PNG renders the map like SVG, for the PDF book and virtual tabletops.
+func (m *DungeonMap) PNG() ([]byte, error) {
+	const px = MapCellPixels
+	img := image.NewRGBA(image.Rect(0, 0, m.Width*px, m.Height*px))
+	draw.Draw(img, img.Bounds(), image.NewUniform(mapRock), image.Point{}, draw.Src)
+	for y := 0; y < m.Height; y++ {
+		for x := 0; x < m.Width; x++ {
+			if !m.Floor[y][x] {
+				continue
+			}
+			cell := image.Rect(x*px, y*px, (x+1)*px, (y+1)*px)
+			draw.Draw(img, cell, image.NewUniform(mapGrid), image.Point{}, draw.Src)
+			draw.Draw(img, cell.Inset(1), image.NewUniform(mapFloor), image.Point{}, draw.Src)
+		}
+	}
+	for _, w := range m.Walls() {
+		fillLine(img, w.X1*px, w.Y1*px, w.X2*px, w.Y2*px, mapWallWidth, mapWall)
+	}
+	for _, d := range m.Doors {
+		x1, y1, x2, y2 := doorPixels(d)
+		fillLine(img, x1, y1, x2, y2, mapDoorWidth, mapDoor)
+	}
+	for _, r := range m.Rooms {
+		cx, cy := labelCenter(r)
+		fillDisc(img, cx, cy, px/2, mapLabel)
+		fillDisc(img, cx, cy, px/2-3, mapFloor)
+		label := strconv.Itoa(r.Number)
+		d := font.Drawer{Dst: img, Src: image.NewUniform(mapLabel), Face: basicfont.Face7x13}
+		width := d.MeasureString(label)
+		d.Dot = fixed.Point26_6{X: fixed.I(cx) - width/2, Y: fixed.I(cy + 5)}
+		d.DrawString(label)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encoding map: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// doorPixels returns the pixel line of a door: the middle of its edge.
+func doorPixels(d MapSegment) (x1, y1, x2, y2 int) {
+	const px, inset = MapCellPixels, MapCellPixels / 5
+	if d.X1 == d.X2 {
+		return d.X1 * px, d.Y1*px + inset, d.X2 * px, d.Y2*px - inset
+	}
+	return d.X1*px + inset, d.Y1 * px, d.X2*px - inset, d.Y2 * px
+}
+
+// labelCenter returns the pixel centre of a room's number marker: the
+// middle of its top left cell, clear of the corridors through its centre.
+func labelCenter(r MapRoom) (int, int) {
+	const px = MapCellPixels
+	return r.X*px + px/2 + px/4, r.Y*px + px/2 + px/4
+}
+
+// fillLine draws a horizontal or vertical line width pixels thick.
+func fillLine(img *image.RGBA, x1, y1, x2, y2, width int, c color.RGBA) {
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+	r := image.Rect(x1-width/2, y1-width/2, x2+width/2, y2+width/2)
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// fillDisc draws a filled circle.
+func fillDisc(img *image.RGBA, cx, cy, radius int, c color.RGBA) {
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if x*x+y*y <= radius*radius {
+				img.SetRGBA(cx+x, cy+y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package dndbot
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// universalVTTFormat is the version of the Universal VTT format written,
+// as exported by Dungeondraft and imported by Foundry VTT and Owlbear Rodeo.
+const universalVTTFormat = 0.3
+
+// Light cast in every room of an exported map: warm torchlight.
+const (
+	vttLightColor     = "ffffd9a0"
+	vttLightIntensity = 1.0
+)
+
+// universalVTT is a Universal VTT (.dd2vtt) document. Positions are in grid
+// cells from the top left corner of the map.
+type universalVTT struct {
+	Format     float64 `json:"format"`
+	Resolution struct {
+		MapOrigin     vttPoint `json:"map_origin"`
+		MapSize       vttPoint `json:"map_size"`
+		PixelsPerGrid int      `json:"pixels_per_grid"`
+	} `json:"resolution"`
+	LineOfSight        [][]vttPoint `json:"line_of_sight"`
+	ObjectsLineOfSight [][]vttPoint `json:"objects_line_of_sight"`
+	Portals            []vttPortal  `json:"portals"`
+	Environment        struct {
+		BakedLighting bool   `json:"baked_lighting"`
+		AmbientLight  string `json:"ambient_light"`
+	} `json:"environment"`
+	Lights []vttLight `json:"lights"`
+	// Image is the rendered map, base64 encoded by encoding/json.
+	Image []byte `json:"image"`
+}
+
+type vttPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// vttPortal is a door: it blocks sight while closed.
+type vttPortal struct {
+	Position     vttPoint   `json:"position"`
+	Bounds       []vttPoint `json:"bounds"`
+	Rotation     float64    `json:"rotation"`
+	Closed       bool       `json:"closed"`
+	Freestanding bool       `json:"freestanding"`
+}
+
+type vttLight struct {
+	Position  vttPoint `json:"position"`
+	Range     float64  `json:"range"`
+	Intensity float64  `json:"intensity"`
+	Color     string   `json:"color"`
+	Shadows   bool     `json:"shadows"`
+}
+
+// UniversalVTT exports the map in the Universal VTT (.dd2vtt) format read
+// by Foundry VTT, through its Universal Battlemap Importer, and Owlbear
+// Rodeo: the PNG rendering with its grid size, the walls as line of sight
+// segments, the doors as closed portals and a light in the middle of each
+// room, on a dark ambient so that the rooms are lit by those lights.
+//
+// Returns:
+//   - []byte: the .dd2vtt JSON
+//   - error: any error rendering the map
+func (m *DungeonMap) UniversalVTT() ([]byte, error) {
+	image, err := m.PNG()
+	if err != nil {
+		return nil, err
+	}
+	vtt := universalVTT{
+		Format:             universalVTTFormat,
+		LineOfSight:        [][]vttPoint{},
+		ObjectsLineOfSight: [][]vttPoint{},
+		Portals:            []vttPortal{},
+		Lights:             []vttLight{},
+		Image:              image,
+	}
+	vtt.Resolution.MapSize = vttPoint{X: float64(m.Width), Y: float64(m.Height)}
+	vtt.Resolution.PixelsPerGrid = MapCellPixels
+	vtt.Environment.AmbientLight = "ff404040"
+
+	for _, wall := range m.Walls() {
+		vtt.LineOfSight = append(vtt.LineOfSight, []vttPoint{
+			{X: float64(wall.X1), Y: float64(wall.Y1)},
+			{X: float64(wall.X2), Y: float64(wall.Y2)},
+		})
+	}
+	for _, door := range m.Doors {
+		rotation := 0.0
+		if door.X1 == door.X2 {
+			rotation = math.Pi / 2
+		}
+		vtt.Portals = append(vtt.Portals, vttPortal{
+			Position: vttPoint{X: float64(door.X1+door.X2) / 2, Y: float64(door.Y1+door.Y2) / 2},
+			Bounds: []vttPoint{
+				{X: float64(door.X1), Y: float64(door.Y1)},
+				{X: float64(door.X2), Y: float64(door.Y2)},
+			},
+			Rotation: rotation,
+			Closed:   true,
+		})
+	}
+	for _, room := range m.Rooms {
+		vtt.Lights = append(vtt.Lights, vttLight{
+			Position:  vttPoint{X: float64(room.X) + float64(room.W)/2, Y: float64(room.Y) + float64(room.H)/2},
+			Range:     math.Hypot(float64(room.W), float64(room.H)) / 2,
+			Intensity: vttLightIntensity,
+			Color:     vttLightColor,
+			Shadows:   true,
+		})
+	}
+	return json.Marshal(vtt)
+}
@@ -0,0 +1,245 @@
+package dndbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrNoImageBackend is returned by FailoverClient when no backend produced
+// an image.
+var ErrNoImageBackend = errors.New("no image backend available")
+
+// ErrNoUpscaler is returned by FailoverClient.Upscale when no backend of
+// the chain can upscale.
+var ErrNoUpscaler = errors.New("no image backend can upscale")
+
+// FailoverClient is an ImageClient that tries several backends in order
+// until one produces an image. A backend that fails Threshold times in a
+// row is skipped for Cooldown, after which it gets one more try; it is
+// used normally again once it succeeds. It is safe for concurrent use and
+// meant to be shared, so that every generation benefits from what the
+// others learned about the backends.
+type FailoverClient struct {
+	// Threshold is the number of consecutive failures that takes a backend
+	// out of rotation; three when zero.
+	Threshold int
+	// Cooldown is how long a failing backend is skipped; five minutes when
+	// zero.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	backends []*failoverBackend
+}
+
+type failoverBackend struct {
+	name      string
+	client    ImageClient
+	overrides BackendOverrides
+	failures  int
+	openUntil time.Time
+}
+
+// BackendOverrides replace request fields on one backend of a
+// FailoverClient, as backends name models and spell samplers differently.
+// Empty fields keep the request's.
+type BackendOverrides struct {
+	Model   string
+	Sampler string
+}
+
+// apply returns req with the overrides applied.
+func (o BackendOverrides) apply(req ImageRequest) ImageRequest {
+	if o.Model != "" {
+		req.Model = o.Model
+	}
+	if o.Sampler != "" {
+		req.Sampler = o.Sampler
+	}
+	return req
+}
+
+// Defaults of the FailoverClient fields left zero.
+const (
+	failoverThreshold = 3
+	failoverCooldown  = 5 * time.Minute
+)
+
+// Add appends a backend to the chain, tried after those added before it.
+//
+// Parameters:
+//   - name: names the backend in progress messages and logs
+//   - client: the backend
+func (f *FailoverClient) Add(name string, client ImageClient) {
+	f.AddWithOverrides(name, client, BackendOverrides{})
+}
+
+// AddWithOverrides appends a backend to the chain like Add, sending it the
+// requests with overrides applied.
+//
+// Parameters:
+//   - name: names the backend in progress messages and logs
+//   - client: the backend
+//   - overrides: model and sampler to use on this backend
+func (f *FailoverClient) AddWithOverrides(name string, client ImageClient, overrides BackendOverrides) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backends = append(f.backends, &failoverBackend{name: name, client: client, overrides: overrides})
+}
+
+// ImageGenerate runs req on the first backend in rotation that succeeds,
+// with that backend's overrides applied. The images record the backend
+// that generated them and the request as it sent it.
+//
+// Returns:
+//   - []GeneratedImage: the images of the first backend that succeeded
+//   - error: wrapping ErrNoImageBackend and every backend's failure
+func (f *FailoverClient) ImageGenerate(req ImageRequest, progress progressor) ([]GeneratedImage, error) {
+	var pr progressor
+	if progress != nil {
+		pr = progress
+	} else {
+		pr = &nullProgressor{}
+	}
+	errs := []error{ErrNoImageBackend}
+	for _, backend := range f.snapshot() {
+		if wait := time.Until(f.openUntil(backend)); wait > 0 {
+			pr.UpdateOutput(fmt.Sprintf("Skipping %s, which keeps failing, for another %s", backend.name, wait.Round(time.Second)))
+			errs = append(errs, fmt.Errorf("%s: skipped after repeated failures", backend.name))
+			continue
+		}
+		images, err := backend.client.ImageGenerate(backend.overrides.apply(req), pr)
+		if err == nil && len(images) == 0 {
+			err = fmt.Errorf("no images generated")
+		}
+		if err != nil && req.context().Err() != nil {
+			// The request was cancelled, not failed: neither count it
+			// against the backend nor try the next one.
+			return nil, fmt.Errorf("%s: %w", backend.name, err)
+		}
+		f.record(backend, err)
+		if err == nil {
+			return images, nil
+		}
+		pr.UpdateOutput(fmt.Sprintf("Image generation with %s failed, trying the next backend: %v", backend.name, err))
+		errs = append(errs, fmt.Errorf("%s: %w", backend.name, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Upscale enlarges img with the backend that generated it, named by
+// img.Backend, when that backend can upscale. Otherwise, or if it fails,
+// the other backends that can upscale are tried in order, skipping those
+// out of rotation.
+//
+// Parameters:
+//   - img: the image, as returned by ImageGenerate
+//   - factor: how many times larger to make it
+//   - name: upscaler model, the backend's default when empty
+//   - progress: progress reporter, may be nil
+//
+// Returns:
+//   - []byte: the enlarged image
+//   - error: wrapping ErrNoUpscaler and every upscaler's failure
+func (f *FailoverClient) Upscale(img GeneratedImage, factor float64, name string, progress progressor) ([]byte, error) {
+	var pr progressor
+	if progress != nil {
+		pr = progress
+	} else {
+		pr = &nullProgressor{}
+	}
+	backends := f.snapshot()
+	// The generating backend goes first, whatever its place in the chain.
+	for i, backend := range backends {
+		if backend.name == img.Backend {
+			backends = append([]*failoverBackend{backend}, append(backends[:i:i], backends[i+1:]...)...)
+			break
+		}
+	}
+	errs := []error{ErrNoUpscaler}
+	for _, backend := range backends {
+		upscaler, ok := backend.client.(Upscaler)
+		if !ok {
+			continue
+		}
+		if backend.name != img.Backend && time.Until(f.openUntil(backend)) > 0 {
+			errs = append(errs, fmt.Errorf("%s: skipped after repeated failures", backend.name))
+			continue
+		}
+		if backend.name != img.Backend {
+			pr.UpdateOutput(fmt.Sprintf("Upscaling with %s", backend.name))
+		}
+		data, err := upscaler.Upscale(img, factor, name, pr)
+		if err == nil {
+			return data, nil
+		}
+		if img.Request.context().Err() != nil {
+			return nil, fmt.Errorf("%s: %w", backend.name, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", backend.name, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Ping succeeds when any backend that can be checked responds.
+func (f *FailoverClient) Ping(ctx context.Context) error {
+	var errs []error
+	for _, backend := range f.snapshot() {
+		pinger, ok := backend.client.(Pinger)
+		if !ok {
+			continue
+		}
+		err := pinger.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", backend.name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// snapshot returns the backends in order.
+func (f *FailoverClient) snapshot() []*failoverBackend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*failoverBackend(nil), f.backends...)
+}
+
+// openUntil returns when backend goes back into rotation.
+func (f *FailoverClient) openUntil(backend *failoverBackend) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return backend.openUntil
+}
+
+// record updates the health of backend after a call that ended with err.
+func (f *FailoverClient) record(backend *failoverBackend, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		if backend.failures >= f.threshold() {
+			slog.Info("image backend recovered", "backend", backend.name)
+		}
+		backend.failures, backend.openUntil = 0, time.Time{}
+		return
+	}
+	backend.failures++
+	if backend.failures >= f.threshold() {
+		cooldown := f.Cooldown
+		if cooldown <= 0 {
+			cooldown = failoverCooldown
+		}
+		backend.openUntil = time.Now().Add(cooldown)
+		slog.Warn("image backend taken out of rotation", "backend", backend.name, "failures", backend.failures, "cooldown", cooldown, "error", err)
+	}
+}
+
+func (f *FailoverClient) threshold() int {
+	if f.Threshold <= 0 {
+		return failoverThreshold
+	}
+	return f.Threshold
+}
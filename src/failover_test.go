@@ -0,0 +1,135 @@
+package dndbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// stubImageClient returns err, or one image, counting its calls and
+// keeping the last request.
+type stubImageClient struct {
+	err   error
+	calls int
+	last  ImageRequest
+}
+
+func (s *stubImageClient) ImageGenerate(req ImageRequest, progress progressor) ([]GeneratedImage, error) {
+	s.calls++
+	s.last = req
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []GeneratedImage{{Data: []byte("image"), Request: req}}, nil
+}
+
+// stubUpscaler is a stubImageClient that can upscale, failing with
+// upscaleErr or tagging the data with its name.
+type stubUpscaler struct {
+	stubImageClient
+	name       string
+	upscaleErr error
+	upscaled   []string
+}
+
+func (s *stubUpscaler) Upscale(img GeneratedImage, factor float64, name string, progress progressor) ([]byte, error) {
+	s.upscaled = append(s.upscaled, img.Backend)
+	if s.upscaleErr != nil {
+		return nil, s.upscaleErr
+	}
+	return []byte(fmt.Sprintf("%s %gx %s", s.name, factor, img.Data)), nil
+}
+
+func TestFailoverStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	first := &stubImageClient{err: fmt.Errorf("waiting: %w", context.Canceled)}
+	second := &stubImageClient{}
+	chain := &FailoverClient{Threshold: 1}
+	chain.Add("first", first)
+	chain.Add("second", second)
+
+	_, err := chain.ImageGenerate(ImageRequest{Prompt: "a lich", Context: ctx}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if second.calls != 0 {
+		t.Error("a cancelled request was tried on the next backend")
+	}
+
+	// The cancellation did not open the first backend's circuit.
+	first.err = nil
+	if _, err := chain.ImageGenerate(ImageRequest{Prompt: "a lich"}, nil); err != nil || first.calls != 2 {
+		t.Errorf("after a cancellation: error %v, first backend called %d times", err, first.calls)
+	}
+}
+
+func TestFailoverUpscaleRoutesToGenerator(t *testing.T) {
+	first := &stubUpscaler{name: "first"}
+	second := &stubUpscaler{name: "second"}
+	chain := &FailoverClient{}
+	chain.Add("first", first)
+	chain.Add("horde", &stubImageClient{})
+	chain.Add("second", second)
+	var _ Upscaler = chain
+
+	data, err := chain.Upscale(GeneratedImage{Data: []byte("img"), Backend: "second"}, 2, "", nil)
+	if err != nil || string(data) != "second 2x img" {
+		t.Errorf("Upscale = %q, %v; want it upscaled by the generating backend", data, err)
+	}
+	if len(first.upscaled) != 0 {
+		t.Errorf("first backend upscaled %v", first.upscaled)
+	}
+
+	// An image from a backend without upscaler goes to the first that has one.
+	data, err = chain.Upscale(GeneratedImage{Data: []byte("img"), Backend: "horde"}, 4, "", nil)
+	if err != nil || string(data) != "first 4x img" {
+		t.Errorf("Upscale = %q, %v; want it upscaled by the first upscaler", data, err)
+	}
+
+	// A failing generator falls back to the others.
+	second.upscaleErr = errors.New("out of memory")
+	data, err = chain.Upscale(GeneratedImage{Data: []byte("img"), Backend: "second"}, 2, "", nil)
+	if err != nil || string(data) != "first 2x img" {
+		t.Errorf("Upscale = %q, %v; want the fallback upscaler", data, err)
+	}
+}
+
+func TestFailoverUpscaleWithoutUpscaler(t *testing.T) {
+	chain := &FailoverClient{}
+	chain.Add("comfyui", &stubImageClient{})
+	chain.Add("horde", &stubImageClient{})
+
+	_, err := chain.Upscale(GeneratedImage{Data: []byte("img"), Backend: "comfyui"}, 2, "", nil)
+	if !errors.Is(err, ErrNoUpscaler) {
+		t.Errorf("error = %v, want ErrNoUpscaler", err)
+	}
+
+	failing := &stubUpscaler{name: "sdwebui", upscaleErr: errors.New("connection refused")}
+	chain.Add("sdwebui", failing)
+	_, err = chain.Upscale(GeneratedImage{Data: []byte("img"), Backend: "comfyui"}, 2, "", nil)
+	if !errors.Is(err, ErrNoUpscaler) || len(failing.upscaled) != 1 {
+		t.Errorf("error = %v after %d attempts, want ErrNoUpscaler after 1", err, len(failing.upscaled))
+	}
+}
+
+func TestFailoverBackendOverrides(t *testing.T) {
+	failing := &stubImageClient{err: errors.New("connection refused")}
+	tuned := &stubImageClient{}
+	chain := &FailoverClient{}
+	chain.AddWithOverrides("comfyui", failing, BackendOverrides{Model: "dreamshaperXL.safetensors", Sampler: "dpmpp_2m"})
+	chain.AddWithOverrides("horde", tuned, BackendOverrides{Sampler: "k_dpmpp_2m"})
+
+	images, err := chain.ImageGenerate(ImageRequest{Prompt: "a lich", Model: "Dreamshaper XL", Sampler: "euler"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failing.last.Model != "dreamshaperXL.safetensors" || failing.last.Sampler != "dpmpp_2m" {
+		t.Errorf("comfyui got model %q and sampler %q, want its own", failing.last.Model, failing.last.Sampler)
+	}
+	// The request as the backend got it is recorded with the image.
+	if got := images[0].Request; got.Model != "Dreamshaper XL" || got.Sampler != "k_dpmpp_2m" {
+		t.Errorf("horde got model %q and sampler %q, want the request's model and its own sampler", got.Model, got.Sampler)
+	}
+}
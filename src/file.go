@@ -23,9 +23,9 @@ func SaveToFiles(adventure *Adventure, outputDir string) error {
 		return fmt.Errorf("saving episode: %w", err)
 	}
 	for i, cover := range adventure.Covers {
-		illusPath := filepath.Join(contentPath, fmt.Sprintf("z_Caption_%02d.md", i+1))
-		content := fmt.Sprintf("Description: %s\nStyle: %s\nIs Map: %v",
-			cover.Description, cover.Style, cover.IsMap)
+		illusPath := filepath.Join(contentPath, "z_"+cover.fileName(0, i+1, CategoryCover)+".md")
+		content := fmt.Sprintf("Description: %s\nStyle: %s\nIs Map: %v\nCategory: %s\nBackend: %s",
+			cover.Description, cover.Style, cover.IsMap, CategoryCover, cover.Backend)
 		if err := ioutil.WriteFile(illusPath, []byte(content), 0o644); err != nil {
 			return fmt.Errorf("saving illustration prompt: %w", err)
 		}
@@ -55,9 +55,9 @@ func SaveToFiles(adventure *Adventure, outputDir string) error {
 
 		// Save illustration prompts
 		for j, illus := range episode.Illustrations {
-			illusPath := filepath.Join(episodeDir, fmt.Sprintf("z_Caption_%02d.md", j+1))
-			content := fmt.Sprintf("Description: %s\nStyle: %s\nIs Map: %v",
-				illus.Description, illus.Style, illus.IsMap)
+			illusPath := filepath.Join(episodeDir, "z_"+illus.fileName(i+1, j+1, illus.category())+".md")
+			content := fmt.Sprintf("Description: %s\nStyle: %s\nIs Map: %v\nCategory: %s\nBackend: %s",
+				illus.Description, illus.Style, illus.IsMap, illus.category(), illus.Backend)
 			if err := ioutil.WriteFile(illusPath, []byte(content), 0o644); err != nil {
 				return fmt.Errorf("saving illustration prompt: %w", err)
 			}
@@ -1,24 +1,106 @@
 package dndbot
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/opd-ai/horde"
 )
 
+// HordeClient generates images on Stable Horde, a crowdsourced cluster.
 type HordeClient struct {
 	*horde.Client
+	apiKey string
+	// URL is the Stable Horde REST API; hordeAPI when empty.
+	URL string
+	// HTTPClient defaults to a client with a 30 second timeout.
+	HTTPClient *http.Client
+	// Timeout bounds the wait for each submitted generation; ten minutes
+	// when zero. PollInterval is how often its status is checked; five
+	// seconds when zero.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// FallbackModels are tried in order when a generation with the
+	// requested model fails, is censored or times out.
+	FallbackModels []string
+	// Placeholder returns a placeholder image instead of an error once
+	// every model has failed, so the adventure can still be finished.
+	Placeholder bool
 }
 
+// NewHordeClient creates a Stable Horde client authenticated with the
+// HORDE_API_KEY environment variable.
 func NewHordeClient() *HordeClient {
+	return NewHordeClientWithKey(os.Getenv("HORDE_API_KEY"))
+}
+
+// NewHordeClientWithKey creates a Stable Horde client authenticated with apiKey.
+func NewHordeClientWithKey(apiKey string) *HordeClient {
 	hc := &HordeClient{
-		Client: horde.NewClient(os.Getenv("HORDE_API_KEY")),
+		Client: horde.NewClient(apiKey),
+		apiKey: apiKey,
 	}
 	return hc
 }
 
-func (c *HordeClient) ImageGenerate(prompt string, steps, width, height int, modelName string, progress progressor) ([]byte, error) {
+// hordeAPI is the Stable Horde REST API.
+const hordeAPI = "https://stablehorde.net/api/v2"
+
+// hordeSampler is the Stable Horde default sampler.
+const hordeSampler = "k_euler_a"
+
+// hordeRequest is the body of POST /generate/async. The horde package's
+// GenerationRequest lacks most parameters, so requests are sent directly.
+type hordeRequest struct {
+	// Prompt carries the negative prompt after a "###" separator.
+	Prompt string      `json:"prompt"`
+	Params hordeParams `json:"params"`
+	Models []string    `json:"models,omitempty"`
+	// SourceImage is the base64 starting image of an img2img request.
+	SourceImage      string `json:"source_image,omitempty"`
+	SourceProcessing string `json:"source_processing,omitempty"`
+}
+
+type hordeParams struct {
+	SamplerName string  `json:"sampler_name,omitempty"`
+	CFGScale    float64 `json:"cfg_scale"`
+	// Seed is sent as a string; SeedVariation 1 gives the images of a
+	// batch consecutive seeds.
+	Seed          string `json:"seed"`
+	SeedVariation int    `json:"seed_variation,omitempty"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	Steps         int    `json:"steps"`
+	N             int    `json:"n"`
+	// DenoisingStrength applies to img2img requests only.
+	DenoisingStrength float64 `json:"denoising_strength,omitempty"`
+}
+
+// Ping checks that the Stable Horde API is up.
+func (c *HordeClient) Ping(ctx context.Context) error {
+	return httpPing(ctx, c.api()+"/status/heartbeat")
+}
+
+// ImageGenerate generates images on Stable Horde. A generation that
+// faults, is censored, cannot be served or outlasts Timeout is resubmitted
+// with each of FallbackModels in turn. When every model fails, the error
+// is returned, or a placeholder image if Placeholder is set. Cancelling
+// req.Context withdraws the generation and returns at once, without
+// fallbacks or placeholder.
+func (c *HordeClient) ImageGenerate(req ImageRequest, progress progressor) (images []GeneratedImage, err error) {
+	start := time.Now()
+	var failure error
+	defer func() { observeCall("horde", start, failure) }()
 	var pr progressor
 	if progress != nil {
 		pr = progress
@@ -27,65 +109,301 @@ func (c *HordeClient) ImageGenerate(prompt string, steps, width, height int, mod
 	}
 
 	// Apply defaults and log them
-	if steps == 0 {
-		steps = horde.DefaultSteps
-		pr.UpdateOutput(fmt.Sprintf("Using default steps: %d", steps))
+	req = req.withDefaults(pr, hordeSampler)
+	if req.Model == "" {
+		req.Model = horde.DefaultModel
+		pr.UpdateOutput(fmt.Sprintf("Using default model: %s", req.Model))
 	}
-	if width == 0 {
-		width = horde.DefaultWidth
-		pr.UpdateOutput(fmt.Sprintf("Using default width: %d", width))
+	pr.UpdateOutput(fmt.Sprintf("Starting image generation: prompt=%q, steps=%d, width=%d, height=%d, seed=%d",
+		req.Prompt, req.Steps, req.Width, req.Height, req.Seed))
+
+	models := []string{req.Model}
+	for _, model := range c.FallbackModels {
+		if !slices.Contains(models, model) {
+			models = append(models, model)
+		}
 	}
-	if height == 0 {
-		height = horde.DefaultHeight
-		pr.UpdateOutput(fmt.Sprintf("Using default height: %d", height))
+	var errs []error
+	for i, model := range models {
+		if i > 0 {
+			observer.BackendRetry("horde")
+			pr.UpdateOutput(fmt.Sprintf("Resubmitting with fallback model %s", model))
+		}
+		attempt := req
+		attempt.Model = model
+		images, err := c.generate(attempt, pr)
+		if err == nil {
+			return images, nil
+		}
+		if req.context().Err() != nil {
+			failure = err
+			return nil, err
+		}
+		pr.UpdateOutput(fmt.Sprintf("Generation with %s failed: %v", model, err))
+		errs = append(errs, fmt.Errorf("%s: %w", model, err))
 	}
-	if modelName == "" {
-		modelName = horde.DefaultModel
-		pr.UpdateOutput(fmt.Sprintf("Using default model: %s", modelName))
+	failure = errors.Join(errs...)
+	if c.Placeholder {
+		pr.UpdateOutput("Every Stable Horde attempt failed, recording a placeholder image instead")
+		placeholder, err := placeholderImage("horde", req, failure)
+		if err != nil {
+			return nil, err
+		}
+		return []GeneratedImage{placeholder}, nil
 	}
-	pr.UpdateOutput(fmt.Sprintf("Starting image generation: prompt=%q, steps=%d, width=%d, height=%d",
-		prompt, steps, width, height))
+	return nil, failure
+}
 
+// generate submits req once and downloads its images, skipping those that
+// were censored or faulted.
+func (c *HordeClient) generate(req ImageRequest, pr progressor) ([]GeneratedImage, error) {
 	// Create generation request
-	req := horde.GenerationRequest{
+	prompt := req.Prompt
+	if req.NegativePrompt != "" {
+		prompt += " ### " + req.NegativePrompt
+	}
+	body := hordeRequest{
 		Prompt: prompt,
-		Params: horde.Params{
-			Steps:     steps,
-			Width:     width,
-			Height:    height,
-			ModelName: modelName,
+		Params: hordeParams{
+			SamplerName:   req.Sampler,
+			CFGScale:      req.CFGScale,
+			Seed:          strconv.FormatInt(req.Seed, 10),
+			SeedVariation: 1,
+			Width:         req.Width,
+			Height:        req.Height,
+			Steps:         req.Steps,
+			N:             req.BatchSize,
 		},
+		Models: []string{req.Model},
+	}
+	if len(req.InitImage) > 0 {
+		body.SourceImage = base64.StdEncoding.EncodeToString(req.InitImage)
+		body.SourceProcessing = "img2img"
+		body.Params.DenoisingStrength = req.Denoise
+		pr.UpdateOutput(fmt.Sprintf("Starting from reference image %s, denoising strength %g", req.Reference, req.Denoise))
 	}
 
 	// Request generation
+	ctx := req.context()
 	pr.UpdateOutput("Submitting generation request...")
-	resp, err := c.RequestGeneration(req)
+	resp, err := c.requestGeneration(ctx, body)
 	if err != nil {
 		return nil, fmt.Errorf("requesting generation: %w", err)
 	}
-	pr.UpdateOutput(fmt.Sprintf("Request accepted, got response: %v", resp))
 	pr.UpdateOutput(fmt.Sprintf("Request accepted, got ID: %s", resp.ID))
 
 	// Wait for completion
 	pr.UpdateOutput("Waiting for generation to complete...")
-	status, err := c.WaitForCompletion(resp.ID)
+	accepted := time.Now()
+	status, err := c.waitForCompletion(ctx, resp.ID, pr)
 	if err != nil {
-		return nil, fmt.Errorf("waiting for completion: %w", err)
+		return nil, err
 	}
+	observer.QueueWait("horde", time.Since(accepted))
 
-	pr.UpdateOutput(fmt.Sprintf("Status: %v", status.Generation[0].Image))
-	// Verify we have results
-	/*if len(status.Generation) != 0 {
-		return nil, fmt.Errorf("no results returned")
-	}*/
+	// Download the images
+	var images []GeneratedImage
+	var censored, faulted int
+	for i, generation := range status.Generations {
+		switch {
+		case generation.Censored || generation.State == "censored":
+			censored++
+			continue
+		case generation.State == "faulted":
+			faulted++
+			continue
+		}
+		pr.UpdateOutput("Downloading generated image...")
+		imageData, err := c.DownloadImage(generation.Img)
+		if err != nil {
+			return nil, fmt.Errorf("downloading image: %w", err)
+		}
+		pr.UpdateOutput(fmt.Sprintf("Successfully downloaded image: %d bytes", len(imageData)))
+		seed, err := strconv.ParseInt(generation.Seed, 10, 64)
+		if err != nil {
+			seed = req.Seed + int64(i)
+		}
+		images = append(images, GeneratedImage{Data: imageData, Backend: "horde", Request: req, Index: i, Seed: seed})
+	}
+	switch {
+	case len(images) > 0:
+		return images, nil
+	case censored > 0:
+		return nil, errHordeCensored
+	case faulted > 0:
+		return nil, errHordeFaulted
+	}
+	return nil, fmt.Errorf("no images generated")
+}
+
+// Reasons a Stable Horde generation yields no image.
+var (
+	errHordeCensored   = errors.New("every image was censored by the worker's safety filter")
+	errHordeFaulted    = errors.New("the generation faulted")
+	errHordeImpossible = errors.New("no worker can serve the request")
+)
+
+// hordeCheck is the response to GET /generate/check/{id}.
+type hordeCheck struct {
+	Done          bool  `json:"done"`
+	Faulted       bool  `json:"faulted"`
+	IsPossible    *bool `json:"is_possible"`
+	QueuePosition int   `json:"queue_position"`
+	WaitTime      int   `json:"wait_time"`
+	Processing    int   `json:"processing"`
+}
+
+// hordeStatus is the response to GET /generate/status/{id}.
+type hordeStatus struct {
+	Faulted     bool              `json:"faulted"`
+	Generations []hordeGeneration `json:"generations"`
+}
+
+type hordeGeneration struct {
+	Img      string `json:"img"`
+	Seed     string `json:"seed"`
+	Model    string `json:"model"`
+	State    string `json:"state"`
+	Censored bool   `json:"censored"`
+}
 
-	// Download the image
-	pr.UpdateOutput("Downloading generated image...")
-	imageData, err := c.DownloadImage(status.Generation[0].Image)
+// Defaults of the HordeClient fields left zero.
+const (
+	hordeTimeout      = 10 * time.Minute
+	hordePollInterval = 5 * time.Second
+)
+
+// waitForCompletion polls generation id until it is done, reporting its
+// queue position and estimated wait when they change. A generation that
+// outlasts Timeout, or whose ctx is cancelled, is withdrawn, so it stops
+// costing kudos.
+func (c *HordeClient) waitForCompletion(ctx context.Context, id string, pr progressor) (*hordeStatus, error) {
+	timeout, interval := c.Timeout, c.PollInterval
+	if timeout <= 0 {
+		timeout = hordeTimeout
+	}
+	if interval <= 0 {
+		interval = hordePollInterval
+	}
+	deadline := time.Now().Add(timeout)
+	lastPosition, lastWait := -1, -1
+	for {
+		var check hordeCheck
+		if err := c.getJSON(ctx, c.api()+"/generate/check/"+id, &check); err != nil {
+			if ctx.Err() != nil {
+				c.cancel(id)
+			}
+			return nil, fmt.Errorf("checking generation: %w", err)
+		}
+		switch {
+		case check.Faulted:
+			return nil, errHordeFaulted
+		case check.IsPossible != nil && !*check.IsPossible:
+			c.cancel(id)
+			return nil, errHordeImpossible
+		case check.Done:
+			var status hordeStatus
+			if err := c.getJSON(ctx, c.api()+"/generate/status/"+id, &status); err != nil {
+				return nil, fmt.Errorf("fetching generation: %w", err)
+			}
+			if status.Faulted {
+				return nil, errHordeFaulted
+			}
+			return &status, nil
+		}
+		if check.QueuePosition != lastPosition || check.WaitTime != lastWait {
+			lastPosition, lastWait = check.QueuePosition, check.WaitTime
+			if check.Processing > 0 {
+				pr.UpdateOutput(fmt.Sprintf("Generating, about %ds remaining", check.WaitTime))
+			} else {
+				pr.UpdateOutput(fmt.Sprintf("Queue position %d, about %ds remaining", check.QueuePosition, check.WaitTime))
+			}
+		}
+		if time.Now().After(deadline) {
+			c.cancel(id)
+			return nil, fmt.Errorf("generation not done after %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			c.cancel(id)
+			return nil, fmt.Errorf("waiting for generation: %w", ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// getJSON decodes the response to a GET of url into v.
+func (c *HordeClient) getJSON(ctx context.Context, url string, v any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// api returns the base URL of the Stable Horde REST API.
+func (c *HordeClient) api() string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return hordeAPI
+}
+
+func (c *HordeClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// cancel withdraws generation id; failures are ignored, as the generation
+// is abandoned either way. It does not take the request's context, which
+// is usually the reason for cancelling and already done.
+func (c *HordeClient) cancel(id string) {
+	request, err := http.NewRequest(http.MethodDelete, c.api()+"/generate/status/"+id, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := c.httpClient().Do(request); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// requestGeneration submits an asynchronous generation request.
+func (c *HordeClient) requestGeneration(ctx context.Context, body hordeRequest) (*horde.GenerationResponse, error) {
+	data, err := json.Marshal(body)
 	if err != nil {
-		return nil, fmt.Errorf("downloading image: %w", err)
+		return nil, fmt.Errorf("marshaling request: %w", err)
 	}
-	pr.UpdateOutput(fmt.Sprintf("Successfully downloaded image: %d bytes", len(imageData)))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.api()+"/generate/async", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("apikey", c.apiKey)
 
-	return imageData, nil
+	resp, err := c.httpClient().Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	var genResp horde.GenerationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&genResp); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &genResp, nil
 }
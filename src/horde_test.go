@@ -0,0 +1,154 @@
+package dndbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHorde imitates the Stable Horde endpoints polled by HordeClient,
+// keeping every generation queued and recording the requests it gets.
+type fakeHorde struct {
+	*httptest.Server
+	// checked is called on every /generate/check request.
+	checked func()
+
+	mu        sync.Mutex
+	submitted int
+	checks    int
+	deleted   []string
+}
+
+func newFakeHorde(t *testing.T) *fakeHorde {
+	t.Helper()
+	f := &fakeHorde{checked: func() {}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /generate/async", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.submitted++
+		id := fmt.Sprintf("gen-%d", f.submitted)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"id": %q}`, id)
+	})
+	mux.HandleFunc("GET /generate/check/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.checks++
+		f.mu.Unlock()
+		f.checked()
+		fmt.Fprint(w, `{"done": false, "is_possible": true, "queue_position": 3, "wait_time": 40}`)
+	})
+	mux.HandleFunc("DELETE /generate/status/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.PathValue("id"))
+		f.mu.Unlock()
+		fmt.Fprint(w, `{"generations": []}`)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHorde) requests() (submitted, checks int, deleted []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.submitted, f.checks, append([]string(nil), f.deleted...)
+}
+
+func newTestHordeClient(f *fakeHorde) *HordeClient {
+	client := NewHordeClientWithKey("0000000000")
+	client.URL = f.URL
+	client.HTTPClient = f.Client()
+	client.FallbackModels = []string{"stable_diffusion"}
+	client.Placeholder = true
+	return client
+}
+
+func TestHordeCancelWithdrawsGeneration(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// cancelOnCheck cancels the request when its status is checked.
+		cancelOnCheck func(cancel context.CancelFunc)
+	}{
+		{"while checking", func(cancel context.CancelFunc) { cancel() }},
+		{"between checks", func(cancel context.CancelFunc) { time.AfterFunc(20*time.Millisecond, cancel) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeHorde(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fake.checked = func() { tc.cancelOnCheck(cancel) }
+			client := newTestHordeClient(fake)
+			// Only the cancellation can end the wait.
+			client.PollInterval = time.Hour
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt", Context: ctx}, nil)
+				done <- err
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("ImageGenerate kept polling after its context was cancelled")
+			}
+
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("error = %v, want context.Canceled", err)
+			}
+			submitted, checks, deleted := fake.requests()
+			if submitted != 1 {
+				t.Errorf("submitted %d generations, want 1 without fallbacks", submitted)
+			}
+			if checks != 1 {
+				t.Errorf("checked %d times, want 1", checks)
+			}
+			if len(deleted) != 1 || deleted[0] != "gen-1" {
+				t.Errorf("deleted %v, want [gen-1]", deleted)
+			}
+		})
+	}
+}
+
+func TestHordeReportsQueuePosition(t *testing.T) {
+	fake := newFakeHorde(t)
+	client := newTestHordeClient(fake)
+	client.Placeholder = false
+	client.FallbackModels = nil
+	client.Timeout = 20 * time.Millisecond
+	client.PollInterval = time.Millisecond
+	progress := &recordingProgressor{}
+
+	if _, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt"}, progress); err == nil {
+		t.Fatal("ImageGenerate succeeded without an image")
+	}
+	if !progress.contains("Queue position 3, about 40s remaining") {
+		t.Error("progress does not report the queue position")
+	}
+}
+
+func TestHordeTimeoutFallsBack(t *testing.T) {
+	fake := newFakeHorde(t)
+	client := newTestHordeClient(fake)
+	client.Placeholder = false
+	client.Timeout = time.Nanosecond
+	client.PollInterval = time.Millisecond
+
+	_, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt"}, nil)
+	if err == nil {
+		t.Fatal("ImageGenerate succeeded without an image")
+	}
+	submitted, _, deleted := fake.requests()
+	if submitted != 2 {
+		t.Errorf("submitted %d generations, want the model and its fallback", submitted)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted %v, want both timed out generations", deleted)
+	}
+}
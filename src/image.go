@@ -2,34 +2,192 @@ package dndbot
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/opd-ai/horde"
 )
 
+// ImageClient generates images with one backend.
 type ImageClient interface {
-	ImageGenerate(prompt string, steps, width, height int, modelName string, progress progressor) ([]byte, error)
+	// ImageGenerate runs req, reporting progress to progress, which may be
+	// nil. It returns BatchSize images, or a single one when BatchSize is
+	// zero.
+	ImageGenerate(req ImageRequest, progress progressor) ([]GeneratedImage, error)
 }
 
-type LocalClient struct{}
+// ImageRequest describes the images to generate. Zero fields take the
+// backend's defaults; Sampler names are passed through to the backend,
+// which has its own spelling for them.
+type ImageRequest struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	// Model names the checkpoint or, on Stable Horde, the worker model.
+	Model string `json:"model,omitempty"`
+	Steps int    `json:"steps"`
+	Width int    `json:"width"`
+	// Height is in pixels, like Width.
+	Height int `json:"height"`
+	// Seed fixes the noise the images start from; zero picks one at random.
+	Seed      int64   `json:"seed"`
+	Sampler   string  `json:"sampler,omitempty"`
+	CFGScale  float64 `json:"cfg_scale"`
+	BatchSize int     `json:"batch_size"`
+	// InitImage makes the backend start from this image (img2img) instead
+	// of noise, changing it by the Denoise strength between 0 and 1.
+	// Reference records where it was read from. Backends without img2img
+	// support clear all three.
+	InitImage []byte  `json:"-"`
+	Reference string  `json:"reference,omitempty"`
+	Denoise   float64 `json:"denoise,omitempty"`
+	// Context cancels the request; backends stop waiting on it and
+	// withdraw any queued work. Nil never cancels.
+	Context context.Context `json:"-"`
+}
+
+// context returns r.Context, or context.Background when it is nil.
+func (r ImageRequest) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+	return r.Context
+}
+
+// Defaults applied to the zero fields of an ImageRequest.
+const (
+	defaultCFGScale  = 7.0
+	defaultBatchSize = 1
+)
+
+// withDefaults fills in the zero fields of r, picking a random seed, and
+// reports each default to pr.
+func (r ImageRequest) withDefaults(pr progressor, sampler string) ImageRequest {
+	if r.Steps == 0 {
+		r.Steps = horde.DefaultSteps
+		pr.UpdateOutput(fmt.Sprintf("Using default steps: %d", r.Steps))
+	}
+	if r.Width == 0 {
+		r.Width = horde.DefaultWidth
+		pr.UpdateOutput(fmt.Sprintf("Using default width: %d", r.Width))
+	}
+	if r.Height == 0 {
+		r.Height = horde.DefaultHeight
+		pr.UpdateOutput(fmt.Sprintf("Using default height: %d", r.Height))
+	}
+	if r.Sampler == "" {
+		r.Sampler = sampler
+	}
+	if r.CFGScale == 0 {
+		r.CFGScale = defaultCFGScale
+	}
+	if r.BatchSize == 0 {
+		r.BatchSize = defaultBatchSize
+	}
+	if r.Seed == 0 {
+		// Seeds stay below 2^32 so every backend accepts them.
+		r.Seed = rand.Int63n(1<<32-1) + 1
+	}
+	return r
+}
+
+// GeneratedImage is one image returned by an ImageClient, with what is
+// needed to reproduce it.
+type GeneratedImage struct {
+	Data []byte `json:"-"`
+	// Backend names the ImageClient that generated the image.
+	Backend string `json:"backend"`
+	// Request is the request as sent, with its defaults and seed filled in.
+	// Sending it again regenerates the whole batch.
+	Request ImageRequest `json:"request"`
+	// Index is the image's position in the batch and Seed the seed the
+	// backend used for it, which differs from Request.Seed on backends that
+	// vary the seed across a batch.
+	Index int   `json:"index"`
+	Seed  int64 `json:"seed"`
+	// Upscale is the factor the image was enlarged by after generation.
+	Upscale float64 `json:"upscale,omitempty"`
+	// Placeholder marks an image drawn in place of one that could not be
+	// generated, and Error records why.
+	Placeholder bool   `json:"placeholder,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// placeholderImage stands in for an image backend could not generate: a
+// plain parchment-coloured PNG of the requested size with a dark frame and
+// a diagonal cross, recording cause.
+func placeholderImage(backend string, req ImageRequest, cause error) (GeneratedImage, error) {
+	width, height := req.Width, req.Height
+	if width <= 0 || height <= 0 {
+		width, height = horde.DefaultWidth, horde.DefaultHeight
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	paper, ink := color.RGBA{0xe8, 0xdc, 0xc0, 0xff}, color.RGBA{0x8a, 0x7a, 0x5c, 0xff}
+	const frame = 8
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := paper
+			if x < frame || y < frame || x >= width-frame || y >= height-frame {
+				c = ink
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	for x := 0; x < width; x++ {
+		y := x * height / width
+		for d := -1; d <= 1; d++ {
+			img.SetRGBA(x, y+d, ink)
+			img.SetRGBA(x, height-1-y+d, ink)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return GeneratedImage{}, fmt.Errorf("drawing placeholder: %w", err)
+	}
+	return GeneratedImage{
+		Data:        buf.Bytes(),
+		Backend:     backend,
+		Request:     req,
+		Seed:        req.Seed,
+		Placeholder: true,
+		Error:       cause.Error(),
+	}, nil
+}
+
+// LocalClient generates images with an AUTOMATIC1111 Stable Diffusion WebUI
+// server. URL defaults to the SD_WEBUI_URL environment variable.
+type LocalClient struct {
+	URL string
+}
 
-// SDWebUIRequest represents the request structure for the Stable Diffusion WebUI API
 // SDWebUIRequest represents the request structure for the Stable Diffusion WebUI API
 type SDWebUIRequest struct {
-	Prompt           string                 `json:"prompt"`
-	NegativePrompt   string                 `json:"negative_prompt,omitempty"`
-	Steps            int                    `json:"steps"`
-	Width            int                    `json:"width"`
-	Height           int                    `json:"height"`
-	CFGScale         float64                `json:"cfg_scale,omitempty"`
-	BatchSize        int                    `json:"batch_size,omitempty"`
-	OverrideSettings map[string]interface{} `json:"override_settings,omitempty"`
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	Steps          int     `json:"steps"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	Seed           int64   `json:"seed"`
+	SamplerName    string  `json:"sampler_name,omitempty"`
+	CFGScale       float64 `json:"cfg_scale,omitempty"`
+	BatchSize      int     `json:"batch_size,omitempty"`
+	// InitImages and DenoisingStrength are sent to /sdapi/v1/img2img only.
+	InitImages        []string               `json:"init_images,omitempty"`
+	DenoisingStrength float64                `json:"denoising_strength,omitempty"`
+	OverrideSettings  map[string]interface{} `json:"override_settings,omitempty"`
+	// OverrideSettingsRestoreAfterwards false keeps an overridden
+	// checkpoint loaded, so consecutive requests do not reload it.
+	OverrideSettingsRestoreAfterwards bool `json:"override_settings_restore_afterwards"`
 }
 
 // SDWebUIResponse represents the response structure from the Stable Diffusion WebUI API
@@ -39,7 +197,89 @@ type SDWebUIResponse struct {
 	Error  string   `json:"error,omitempty"`
 }
 
-func (l *LocalClient) ImageGenerate(prompt string, steps, width, height int, modelName string, progress progressor) ([]byte, error) {
+// sdWebUIInfo is the part of SDWebUIResponse.Info that records what was
+// actually used.
+type sdWebUIInfo struct {
+	AllSeeds    []int64 `json:"all_seeds"`
+	SDModelName string  `json:"sd_model_name"`
+}
+
+// sdWebUISampler is the SD-WebUI default sampler.
+const sdWebUISampler = "Euler a"
+
+// sdWebUIModel is an entry of GET /sdapi/v1/sd-models.
+type sdWebUIModel struct {
+	Title     string `json:"title"`
+	ModelName string `json:"model_name"`
+	Hash      string `json:"hash"`
+	SHA256    string `json:"sha256"`
+	Filename  string `json:"filename"`
+}
+
+// checkpoint finds the checkpoint named model among those the SD-WebUI
+// server has. SD-WebUI quietly loads another checkpoint when asked for one
+// it does not know, so the name is checked first.
+//
+// Parameters:
+//   - ctx: bounds the request
+//   - client: HTTP client to use
+//   - baseURL: SD-WebUI server URL
+//   - model: checkpoint title, file name, name without extension or hash
+//
+// Returns:
+//   - string: the checkpoint's title, to send as sd_model_checkpoint
+//   - error: an unknown checkpoint, or any error reaching the server
+func checkpoint(ctx context.Context, client *http.Client, baseURL, model string) (string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/sdapi/v1/sd-models", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("listing checkpoints: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("listing checkpoints: unexpected status code: %d", resp.StatusCode)
+	}
+	var models []sdWebUIModel
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		return "", fmt.Errorf("listing checkpoints: %w", err)
+	}
+	titles := make([]string, len(models))
+	for i, m := range models {
+		// The server may run on Windows, so both separators are cut.
+		file := m.Filename[strings.LastIndexAny(m.Filename, `/\`)+1:]
+		for _, name := range []string{m.Title, m.ModelName, m.Hash, m.SHA256, file} {
+			if name != "" && name == model {
+				return m.Title, nil
+			}
+		}
+		titles[i] = m.Title
+	}
+	return "", fmt.Errorf("SD-WebUI has no checkpoint %q (available: %s)", model, strings.Join(titles, ", "))
+}
+
+// Ping checks that the SD-WebUI server is up.
+func (l *LocalClient) Ping(ctx context.Context) error {
+	sdWebUIURL := l.URL
+	if sdWebUIURL == "" {
+		sdWebUIURL = os.Getenv("SD_WEBUI_URL")
+	}
+	if sdWebUIURL == "" {
+		return fmt.Errorf("no SD-WebUI URL configured and SD_WEBUI_URL environment variable not set")
+	}
+	return httpPing(ctx, sdWebUIURL+"/internal/ping")
+}
+
+// ImageGenerate generates images with the SD-WebUI /sdapi/v1/txt2img
+// endpoint, or /sdapi/v1/img2img when req has an InitImage. The server
+// switches to the checkpoint named by req.Model, or keeps its loaded one
+// when req.Model is empty; either way req.Model is replaced by the name the
+// server reports, so it is recorded correctly.
+func (l *LocalClient) ImageGenerate(req ImageRequest, progress progressor) (images []GeneratedImage, err error) {
+	start := time.Now()
+	defer func() { observeCall("sdwebui", start, err) }()
 	var pr progressor
 	if progress != nil {
 		pr = progress
@@ -47,37 +287,50 @@ func (l *LocalClient) ImageGenerate(prompt string, steps, width, height int, mod
 		pr = &nullProgressor{}
 	}
 
-	// Apply defaults and log them
-	if steps == 0 {
-		steps = horde.DefaultSteps
-		pr.UpdateOutput(fmt.Sprintf("Using default steps: %d", steps))
-	}
-	if width == 0 {
-		width = horde.DefaultWidth
-		pr.UpdateOutput(fmt.Sprintf("Using default width: %d", width))
-	}
-	if height == 0 {
-		height = horde.DefaultHeight
-		pr.UpdateOutput(fmt.Sprintf("Using default height: %d", height))
-	}
+	req = req.withDefaults(pr, sdWebUISampler)
+	pr.UpdateOutput(fmt.Sprintf("Starting image generation: prompt=%q, steps=%d, width=%d, height=%d, seed=%d",
+		req.Prompt, req.Steps, req.Width, req.Height, req.Seed))
 
-	pr.UpdateOutput(fmt.Sprintf("Starting image generation: prompt=%q, steps=%d, width=%d, height=%d",
-		prompt, steps, width, height))
-
-	sdWebUIURL := os.Getenv("SD_WEBUI_URL")
+	sdWebUIURL := l.URL
+	if sdWebUIURL == "" {
+		sdWebUIURL = os.Getenv("SD_WEBUI_URL")
+	}
 	if sdWebUIURL == "" {
-		return nil, fmt.Errorf("SD_WEBUI_URL environment variable not set")
+		return nil, fmt.Errorf("no SD-WebUI URL configured and SD_WEBUI_URL environment variable not set")
 	}
 	pr.UpdateOutput(fmt.Sprintf("Using local SD-WebUI URL: %s", sdWebUIURL))
 
+	// Create HTTP client with timeout
+	client := &http.Client{
+		Timeout: 5 * time.Minute, // SD generation can take a while
+	}
+
 	// Prepare the request payload
 	requestData := SDWebUIRequest{
-		Prompt:    prompt,
-		Steps:     steps,
-		Width:     width,
-		Height:    height,
-		CFGScale:  3.0,
-		BatchSize: 1,
+		Prompt:         req.Prompt,
+		NegativePrompt: req.NegativePrompt,
+		Steps:          req.Steps,
+		Width:          req.Width,
+		Height:         req.Height,
+		Seed:           req.Seed,
+		SamplerName:    req.Sampler,
+		CFGScale:       req.CFGScale,
+		BatchSize:      req.BatchSize,
+	}
+	if req.Model != "" {
+		title, err := checkpoint(req.context(), client, sdWebUIURL, req.Model)
+		if err != nil {
+			return nil, err
+		}
+		requestData.OverrideSettings = map[string]interface{}{"sd_model_checkpoint": title}
+		pr.UpdateOutput(fmt.Sprintf("Using checkpoint %s", title))
+	}
+	endpoint := "/sdapi/v1/txt2img"
+	if len(req.InitImage) > 0 {
+		endpoint = "/sdapi/v1/img2img"
+		requestData.InitImages = []string{base64.StdEncoding.EncodeToString(req.InitImage)}
+		requestData.DenoisingStrength = req.Denoise
+		pr.UpdateOutput(fmt.Sprintf("Starting from reference image %s, denoising strength %g", req.Reference, req.Denoise))
 	}
 
 	// Convert request to JSON
@@ -86,21 +339,16 @@ func (l *LocalClient) ImageGenerate(prompt string, steps, width, height int, mod
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 5 * time.Minute, // SD generation can take a while
-	}
-
 	// Prepare the request
-	req, err := http.NewRequest("POST", sdWebUIURL+"/sdapi/v1/txt2img", bytes.NewBuffer(jsonData))
+	httpReq, err := http.NewRequestWithContext(req.context(), "POST", sdWebUIURL+endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Content-Type", "application/json")
 
 	// Make the request
 	pr.UpdateOutput("Sending request to SD-WebUI...")
-	resp, err := client.Do(req)
+	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
@@ -128,12 +376,98 @@ func (l *LocalClient) ImageGenerate(prompt string, steps, width, height int, mod
 		return nil, fmt.Errorf("no images generated")
 	}
 
-	// Convert base64 image to bytes
-	imageBytes, err := base64.StdEncoding.DecodeString(sdResponse.Images[0])
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+	var info sdWebUIInfo
+	if err := json.Unmarshal([]byte(sdResponse.Info), &info); err != nil {
+		pr.UpdateOutput(fmt.Sprintf("Could not read generation info: %v", err))
+	}
+	req.Model = info.SDModelName
+
+	// Convert base64 images to bytes. Scripts may append extra images
+	// such as grids beyond the batch.
+	for i, encoded := range sdResponse.Images {
+		if i >= req.BatchSize {
+			break
+		}
+		imageBytes, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		seed := req.Seed + int64(i)
+		if i < len(info.AllSeeds) {
+			seed = info.AllSeeds[i]
+		}
+		images = append(images, GeneratedImage{Data: imageBytes, Backend: "sdwebui", Request: req, Index: i, Seed: seed})
 	}
 
 	pr.UpdateOutput("Image generation completed successfully")
-	return imageBytes, nil
+	return images, nil
+}
+
+// sdWebUIExtrasRequest is the body of POST /sdapi/v1/extra-single-image.
+type sdWebUIExtrasRequest struct {
+	Image           string  `json:"image"`
+	UpscalingResize float64 `json:"upscaling_resize"`
+	Upscaler1       string  `json:"upscaler_1"`
+}
+
+// sdWebUIUpscaler is the SD-WebUI upscaler used when none is named.
+const sdWebUIUpscaler = "R-ESRGAN 4x+"
+
+// Upscale enlarges an image with the SD-WebUI extras endpoint.
+//
+// Parameters:
+//   - img: the image to enlarge, in any format the server reads
+//   - factor: how many times larger to make it
+//   - name: upscaler model, "R-ESRGAN 4x+" when empty
+//   - progress: progress reporter, may be nil
+//
+// Returns:
+//   - []byte: the enlarged image as PNG
+//   - error: any error reaching the server or decoding its response
+func (l *LocalClient) Upscale(img GeneratedImage, factor float64, name string, progress progressor) (upscaled []byte, err error) {
+	start := time.Now()
+	defer func() { observeCall("sdwebui", start, err) }()
+	if progress != nil {
+		progress.UpdateOutput(fmt.Sprintf("Upscaling image %gx...", factor))
+	}
+	sdWebUIURL := l.URL
+	if sdWebUIURL == "" {
+		sdWebUIURL = os.Getenv("SD_WEBUI_URL")
+	}
+	if sdWebUIURL == "" {
+		return nil, fmt.Errorf("no SD-WebUI URL configured and SD_WEBUI_URL environment variable not set")
+	}
+	if name == "" {
+		name = sdWebUIUpscaler
+	}
+	body, err := json.Marshal(sdWebUIExtrasRequest{
+		Image:           base64.StdEncoding.EncodeToString(img.Data),
+		UpscalingResize: factor,
+		Upscaler1:       name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	request, err := http.NewRequestWithContext(img.Request.context(), http.MethodPost, sdWebUIURL+"/sdapi/v1/extra-single-image", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(msg))
+	}
+	var result struct {
+		Image string `json:"image"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(result.Image)
 }
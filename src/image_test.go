@@ -0,0 +1,117 @@
+package dndbot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSDWebUI imitates the SD-WebUI endpoints used by LocalClient, with
+// one checkpoint installed, and records the generation requests it gets.
+type fakeSDWebUI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []map[string]any
+}
+
+func newFakeSDWebUI(t *testing.T) *fakeSDWebUI {
+	t.Helper()
+	f := &fakeSDWebUI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sdapi/v1/sd-models", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"title": "dreamshaperXL.safetensors [4496b36d48]", "model_name": "dreamshaperXL", "hash": "4496b36d48",
+			"filename": "C:\\sd\\models\\Stable-diffusion\\dreamshaperXL.safetensors"}]`)
+	})
+	mux.HandleFunc("POST /sdapi/v1/txt2img", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, body)
+		f.mu.Unlock()
+		model := "loadedModel"
+		if overrides, ok := body["override_settings"].(map[string]any); ok {
+			model = strings.TrimSuffix(overrides["sd_model_checkpoint"].(string), ".safetensors [4496b36d48]")
+		}
+		info, _ := json.Marshal(map[string]any{"all_seeds": []int64{42}, "sd_model_name": model})
+		json.NewEncoder(w).Encode(SDWebUIResponse{
+			Images: []string{base64.StdEncoding.EncodeToString([]byte("png"))},
+			Info:   string(info),
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSDWebUI) generations() []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]any(nil), f.requests...)
+}
+
+func TestSDWebUIModelOverride(t *testing.T) {
+	for _, model := range []string{"dreamshaperXL.safetensors", "dreamshaperXL", "4496b36d48", "dreamshaperXL.safetensors [4496b36d48]"} {
+		t.Run(model, func(t *testing.T) {
+			fake := newFakeSDWebUI(t)
+			client := &LocalClient{URL: fake.URL}
+
+			images, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt", Model: model, Seed: 42}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requests := fake.generations()
+			if len(requests) != 1 {
+				t.Fatalf("got %d generation requests, want 1", len(requests))
+			}
+			overrides, _ := requests[0]["override_settings"].(map[string]any)
+			if got := overrides["sd_model_checkpoint"]; got != "dreamshaperXL.safetensors [4496b36d48]" {
+				t.Errorf("sd_model_checkpoint = %#v, want the checkpoint title", got)
+			}
+			if restore := requests[0]["override_settings_restore_afterwards"]; restore != false {
+				t.Errorf("override_settings_restore_afterwards = %#v, want false", restore)
+			}
+			if len(images) != 1 || images[0].Request.Model != "dreamshaperXL" {
+				t.Errorf("images = %+v, want one recorded with the model the server used", images)
+			}
+		})
+	}
+}
+
+func TestSDWebUIKeepsLoadedModel(t *testing.T) {
+	fake := newFakeSDWebUI(t)
+	client := &LocalClient{URL: fake.URL}
+
+	images, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.generations()[0]["override_settings"]; ok {
+		t.Error("override_settings sent without a model")
+	}
+	if images[0].Request.Model != "loadedModel" {
+		t.Errorf("recorded model %q, want the loaded one", images[0].Request.Model)
+	}
+}
+
+func TestSDWebUIUnknownModel(t *testing.T) {
+	fake := newFakeSDWebUI(t)
+	client := &LocalClient{URL: fake.URL}
+
+	_, err := client.ImageGenerate(ImageRequest{Prompt: "a flooded crypt", Model: "Dreamshaper XL"}, nil)
+	if err == nil || !strings.Contains(err.Error(), `no checkpoint "Dreamshaper XL"`) || !strings.Contains(err.Error(), "dreamshaperXL.safetensors [4496b36d48]") {
+		t.Errorf("error = %v, want the unknown checkpoint and those available", err)
+	}
+	if requests := fake.generations(); len(requests) != 0 {
+		t.Errorf("generated %d images with another checkpoint", len(requests))
+	}
+}
@@ -0,0 +1,42 @@
+package dndbot
+
+import "time"
+
+// Observer receives measurements of the calls the clients in this package
+// make to their backends. Implementations must be safe for concurrent use.
+type Observer interface {
+	// BackendCall reports a finished call, including all of its retries.
+	// backend is "claude", "horde", "sdwebui" or "comfyui"; err is nil on success.
+	BackendCall(backend string, duration time.Duration, err error)
+	// BackendRetry reports a failed attempt that is about to be retried.
+	BackendRetry(backend string)
+	// Tokens reports the tokens consumed by one LLM message.
+	Tokens(backend string, input, output int64)
+	// QueueWait reports how long an accepted request waited on a shared
+	// backend before its result was ready.
+	QueueWait(backend string, wait time.Duration)
+}
+
+type nullObserver struct{}
+
+func (nullObserver) BackendCall(string, time.Duration, error) {}
+func (nullObserver) BackendRetry(string)                      {}
+func (nullObserver) Tokens(string, int64, int64)              {}
+func (nullObserver) QueueWait(string, time.Duration)          {}
+
+var observer Observer = nullObserver{}
+
+// SetObserver installs o to receive backend measurements. It should be
+// called once at startup, before any client is used; nil restores the
+// default observer, which discards everything.
+func SetObserver(o Observer) {
+	if o == nil {
+		o = nullObserver{}
+	}
+	observer = o
+}
+
+// observeCall reports a call that started at start and ended with err.
+func observeCall(backend string, start time.Time, err error) {
+	observer.BackendCall(backend, time.Since(start), err)
+}
@@ -0,0 +1,228 @@
+package dndbot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Stable Horde returns WebP
+)
+
+// PostProcessing configures what is done to every generated image before
+// it is saved.
+type PostProcessing struct {
+	// Format is "png" or "jpeg"; PNG when empty. PNG files carry their
+	// generation parameters as text chunks.
+	Format string
+	// JPEGQuality is the quality of JPEG images, 1 to 100; 90 when zero.
+	JPEGQuality int
+	// ThumbnailWidth is the width of the JPEG thumbnail written beside
+	// each image; zero writes none.
+	ThumbnailWidth int
+	// Upscale enlarges images by this factor with the backend's upscaler,
+	// on backends that have one; 1 or less leaves them as generated.
+	Upscale float64
+	// Upscaler names the upscaler model; the backend's default when empty.
+	Upscaler string
+}
+
+// Upscaler is implemented by the ImageClients with an upscaling endpoint.
+type Upscaler interface {
+	// Upscale enlarges the data of img by factor with the named upscaler
+	// model, or the backend's default when name is empty. img tells which
+	// backend generated it and carries its request's context.
+	Upscale(img GeneratedImage, factor float64, name string, progress progressor) ([]byte, error)
+}
+
+// Image formats written by saveImage.
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+)
+
+// thumbnailSuffix replaces the extension of an image for its thumbnail.
+const thumbnailSuffix = ".thumb.jpg"
+
+// ThumbnailPath returns the path of the thumbnail of the image at path.
+func ThumbnailPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + thumbnailSuffix
+}
+
+// IsThumbnail reports whether path names a thumbnail written by saveImage.
+func IsThumbnail(path string) bool {
+	return strings.HasSuffix(path, thumbnailSuffix)
+}
+
+// saveImage post-processes a generated image and writes it as base with the
+// extension of its format: it is upscaled if configured, converted to the
+// configured format whatever the backend returned, and given a thumbnail.
+// Its parameters are written beside it as JSON, with the same name and a
+// .json extension, so the image can be reproduced or deliberately re-rolled
+// with another seed.
+//
+// Parameters:
+//   - client: backend that generated the image, used for upscaling
+//   - img: the image and its parameters
+//   - base: path of the image without extension
+//   - pp: post-processing settings
+//   - pr: progress reporter
+//
+// Returns:
+//   - string: the path of the image written
+//   - error: any error decoding, encoding or writing the image
+func saveImage(client ImageClient, img GeneratedImage, base string, pp PostProcessing, pr progressor) (string, error) {
+	data := img.Data
+	if pp.Upscale > 1 {
+		if upscaler, ok := client.(Upscaler); !ok {
+			pr.UpdateOutput("This image backend cannot upscale, keeping the generated size")
+		} else if upscaled, err := upscaler.Upscale(img, pp.Upscale, pp.Upscaler, pr); err != nil {
+			pr.UpdateOutput(fmt.Sprintf("Upscaling failed, keeping the generated size: %v", err))
+		} else {
+			data = upscaled
+			img.Upscale = pp.Upscale
+		}
+	}
+
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("decoding %s image: %w", http.DetectContentType(data), err)
+	}
+	params, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	ext := ".png"
+	switch pp.Format {
+	case FormatJPEG:
+		ext = ".jpg"
+		quality := pp.JPEGQuality
+		if quality == 0 {
+			quality = 90
+		}
+		if format == FormatJPEG {
+			out.Write(data)
+		} else if err := jpeg.Encode(&out, decoded, &jpeg.Options{Quality: quality}); err != nil {
+			return "", fmt.Errorf("encoding JPEG: %w", err)
+		}
+	default:
+		if format == FormatPNG {
+			out.Write(data)
+		} else if err := png.Encode(&out, decoded); err != nil {
+			return "", fmt.Errorf("encoding PNG: %w", err)
+		}
+		withText, err := addPNGText(out.Bytes(), map[string]string{
+			"parameters": img.Request.parameters(),
+			"dndbot":     string(params),
+		})
+		if err != nil {
+			return "", err
+		}
+		out.Reset()
+		out.Write(withText)
+	}
+
+	path := base + ext
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	if pp.ThumbnailWidth > 0 {
+		if err := writeThumbnail(decoded, ThumbnailPath(path), pp.ThumbnailWidth); err != nil {
+			return "", err
+		}
+	}
+	if err := os.WriteFile(base+".json", params, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// parameters renders r the way AUTOMATIC1111 embeds generation parameters
+// in its PNG files, which image viewers and other tools understand.
+func (r ImageRequest) parameters() string {
+	var b strings.Builder
+	b.WriteString(r.Prompt)
+	if r.NegativePrompt != "" {
+		b.WriteString("\nNegative prompt: " + r.NegativePrompt)
+	}
+	fmt.Fprintf(&b, "\nSteps: %d, Sampler: %s, CFG scale: %g, Seed: %d, Size: %dx%d",
+		r.Steps, r.Sampler, r.CFGScale, r.Seed, r.Width, r.Height)
+	if r.Model != "" {
+		b.WriteString(", Model: " + r.Model)
+	}
+	if r.Denoise > 0 {
+		fmt.Fprintf(&b, ", Denoising strength: %g", r.Denoise)
+	}
+	return b.String()
+}
+
+// addPNGText inserts a tEXt chunk for each of text after the IHDR chunk of
+// the PNG data. Keys are written in sorted order.
+func addPNGText(data []byte, text map[string]string) ([]byte, error) {
+	const signature = 8
+	if len(data) < signature+8 {
+		return nil, fmt.Errorf("PNG too short")
+	}
+	ihdrEnd := signature + 12 + int(binary.BigEndian.Uint32(data[signature:]))
+	if ihdrEnd > len(data) {
+		return nil, fmt.Errorf("PNG header truncated")
+	}
+	keys := make([]string, 0, len(text))
+	for key := range text {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out bytes.Buffer
+	out.Write(data[:ihdrEnd])
+	for _, key := range keys {
+		chunk := append([]byte("tEXt"+key+"\x00"), latin1(text[key])...)
+		binary.Write(&out, binary.BigEndian, uint32(len(chunk)-4))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	}
+	out.Write(data[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+// latin1 encodes s in ISO 8859-1, the encoding of PNG tEXt chunks,
+// replacing the characters it lacks with question marks.
+func latin1(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			r = '?'
+		}
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// writeThumbnail writes img scaled down to width as a JPEG. Images no wider
+// than width are written at their own size.
+func writeThumbnail(img image.Image, path string, width int) error {
+	bounds := img.Bounds()
+	if bounds.Dx() > width {
+		height := bounds.Dy() * width / bounds.Dx()
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 80}); err != nil {
+		return fmt.Errorf("encoding thumbnail: %w", err)
+	}
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
@@ -1,16 +1,21 @@
 package dndbot
 
 import (
+	"crypto/sha256"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/opd-ai/horde"
 )
 
 func GenerateTableOfContents(client Client, prompt string, p progressor, setting, style string) (Adventure, error) {
+	return GenerateTableOfContentsN(client, prompt, p, setting, style, 0)
+}
+
+// GenerateTableOfContentsN is GenerateTableOfContents for a series of exactly
+// episodes episodes. Extra episodes in the response are dropped; zero lets the
+// model choose the length of the series.
+func GenerateTableOfContentsN(client Client, prompt string, p progressor, setting, style string, episodes int) (Adventure, error) {
 	var pr progressor
 	if p != nil {
 		pr = p
@@ -57,19 +62,26 @@ Characters: Character One, Character Two, Characther Three... (All one line)
 	}
 
 	systemPrompt += adventure.getSettingDetails()
+	if episodes > 0 {
+		systemPrompt += fmt.Sprintf("\nThe series must have exactly %d episodes.\n", episodes)
+	}
 
 	response, err := client.SendMessage(systemPrompt, "This is the story prompt, it is very important that you follow this prompt:"+prompt)
 	if err != nil {
 		return Adventure{}, fmt.Errorf("generating ToC: %w", err)
 	}
-	log.Println(response)
+	loggerOf(client).Debug("table of contents", "response", response)
 	pr.UpdateOutput(response)
 
 	// Parse the response into Adventure struct
 	adventure.TableOfContents = response
 
 	// Parse episodes from the response
+	adventure.Title = parseTitle(response)
 	adventure.Episodes = parseEpisodes(response)
+	if episodes > 0 && len(adventure.Episodes) > episodes {
+		adventure.Episodes = adventure.Episodes[:episodes]
+	}
 
 	return adventure, nil
 }
@@ -88,7 +100,7 @@ func GenerateOnePageDungeons(client Client, adventure *Adventure) error {
 		if err != nil {
 			return fmt.Errorf("generating one-page dungeon for episode %d: %w", i, err)
 		}
-		log.Println(response)
+		loggerOf(client).Debug("one-page dungeon", "episode", i+1, "response", response)
 		if err := SaveToFiles(adventure, "tmp"); err != nil {
 			return fmt.Errorf("writing Episode %d %w", i, err)
 		}
@@ -145,7 +157,7 @@ func ExpandAdventures(client Client, adventure *Adventure, p progressor) error {
 				adventure.Episodes[i].FullAdventure += "\n\n"
 			}
 			adventure.Episodes[i].FullAdventure += response
-			log.Println(adventure.Episodes[i].FullAdventure)
+			loggerOf(client).Debug("expanded episode section", "episode", i+1, "section", index, "response", response)
 
 			// Check if Claude indicates it's continuing
 			if !strings.Contains(strings.ToLower(response), "continue") {
@@ -172,7 +184,7 @@ func GenerateIllustrationPrompts(client Client, adventure *Adventure) error {
 		if err != nil {
 			return fmt.Errorf("generating illustration prompts for episode %d: %w", i, err)
 		}
-		log.Println(response)
+		loggerOf(client).Debug("illustration prompts", "episode", i+1, "response", response)
 		adventure.Episodes[i].Illustrations = parseIllustrationPrompts(response)
 		if err := SaveToFiles(adventure, "tmp"); err != nil {
 			return fmt.Errorf("writing Episode %d %w", i, err)
@@ -241,44 +253,22 @@ func amap(s bool) string {
 	return "Illustration"
 }
 
-func GenerateIllustrationsFromPrompts(client ImageClient, adventure *Adventure, path string, progress progressor) error {
+func GenerateIllustrationsFromPrompts(client ImageClient, adventure *Adventure, path string, settings ImageSettings, progress progressor) error {
 	var pr progressor
 	if progress != nil {
 		pr = progress
 	} else {
 		pr = &nullProgressor{}
 	}
-	for index, episode := range adventure.Episodes {
+	for index := range adventure.Episodes {
 		indexString := fmt.Sprintf("%02d", index+1)
 		dir := filepath.Join(path, indexString+"_Episode")
-		for index2, illustration := range episode.Illustrations {
-			prompt := fmt.Sprintf("%s\n%s\n%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
-			pr.UpdateOutput("Generating illustration image by prompting SDXL(This will take a while): " + prompt)
-			data, err := client.ImageGenerate(prompt, 30, 0, 0, "Dreamshaper XL", progress)
-			if err != nil {
-				return err
-			}
-			os.MkdirAll(dir, 0o755)
-			outPath := filepath.Join(dir, filenamer(illustration.Description))
-			pngPath := strings.TrimSuffix(outPath, filepath.Ext(outPath))
-			if err := os.WriteFile(outPath, data, 0o644); err != nil {
-				return err
-			} else {
-				if os.Getenv("SD_WEBUI_URL") == "" {
-					if err := horde.Webp2PNG(outPath); err != nil {
-						return err
-					} else {
-						if err := os.Remove(outPath); err != nil {
-							return err
-						}
-					}
-				}
-			}
-			caption := fmt.Sprintf("%s:%s:%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
-			fields := fmt.Sprintf("\n  * Category: %s\n  * Description: %s\n  * Style: %s\n", amap(illustration.IsMap), illustration.Description, illustration.Style)
-			captionFile := fmt.Sprintf(" - [%s](%s) `%s`\n", caption, pngPath, fields)
-			indexString2 := fmt.Sprintf("%02d", index2)
-			if err := os.WriteFile(filepath.Join(dir, indexString2+"_Illustration.md"), []byte(captionFile), 0o644); err != nil {
+		for index2 := range adventure.Episodes[index].Illustrations {
+			illustration := &adventure.Episodes[index].Illustrations[index2]
+			category := illustration.category()
+			pr.UpdateOutput("Generating illustration image by prompting SDXL(This will take a while): " + illustration.Description)
+			name := illustration.fileName(index+1, index2+1, category)
+			if err := illustrate(client, adventure, illustration, category, dir, name, settings, pr); err != nil {
 				return err
 			}
 			pr.UpdateOutput("Generated illustration image. Proceeding...\n")
@@ -287,41 +277,18 @@ func GenerateIllustrationsFromPrompts(client ImageClient, adventure *Adventure,
 	return nil
 }
 
-func GenerateCoversFromPrompts(client ImageClient, adventure *Adventure, path string, progress progressor) error {
+func GenerateCoversFromPrompts(client ImageClient, adventure *Adventure, path string, settings ImageSettings, progress progressor) error {
 	var pr progressor
 	if progress != nil {
 		pr = progress
 	} else {
 		pr = &nullProgressor{}
 	}
-	for index2, illustration := range adventure.Covers {
-		prompt := fmt.Sprintf("%s\n%s\n%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
-		pr.UpdateOutput("Generating cover image by prompting SDXL(This will take a while): " + prompt)
-		data, err := client.ImageGenerate(prompt, 30, 0, 0, "Dreamshaper XL", progress)
-		if err != nil {
-			return err
-		}
-		os.MkdirAll(path, 0o755)
-		outPath := filepath.Join(path, filenamer(illustration.Description))
-		pngPath := strings.TrimSuffix(outPath, filepath.Ext(outPath))
-		if err := os.WriteFile(outPath, data, 0o644); err != nil {
-			return err
-		} else {
-			if os.Getenv("SD_WEBUI_URL") == "" {
-				if err := horde.Webp2PNG(outPath); err != nil {
-					return err
-				} else {
-					if err := os.Remove(outPath); err != nil {
-						return err
-					}
-				}
-			}
-		}
-		caption := fmt.Sprintf("%s:%s:%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
-		fields := fmt.Sprintf("\n  * Category: %s\n  * Description: %s\n  * Style: %s\n", amap(illustration.IsMap), illustration.Description, illustration.Style)
-		captionFile := fmt.Sprintf(" - [%s](%s) `%s`\n", caption, pngPath, fields)
-		indexString2 := fmt.Sprintf("%02d", index2)
-		if err := os.WriteFile(filepath.Join(path, indexString2+"_CoverIllustration.md"), []byte(captionFile), 0o644); err != nil {
+	for index2 := range adventure.Covers {
+		illustration := &adventure.Covers[index2]
+		pr.UpdateOutput("Generating cover image by prompting SDXL(This will take a while): " + illustration.Description)
+		name := illustration.fileName(0, index2+1, CategoryCover)
+		if err := illustrate(client, adventure, illustration, CategoryCover, path, name, settings, pr); err != nil {
 			return err
 		}
 		pr.UpdateOutput("Generated cover image. Proceeding...\n")
@@ -329,11 +296,118 @@ func GenerateCoversFromPrompts(client ImageClient, adventure *Adventure, path st
 	return nil
 }
 
-func filenamer(desc string) string {
-	split := strings.Split(desc, " ")
-	result := ""
-	for _, str := range split {
-		result += string(str[0])
+// illustrate generates the image of one illustration of adventure, records
+// it and its backend on the illustration and writes its caption to dir as
+// name.md. With settings.SkipFailed an image that cannot be generated is
+// left out, keeping its caption, instead of failing the adventure; a
+// cancelled request fails it regardless.
+func illustrate(client ImageClient, adventure *Adventure, illustration *IllustrationPrompt, category ImageCategory, dir, name string, settings ImageSettings, pr progressor) error {
+	prompt := fmt.Sprintf("%s\n%s\n%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
+	req, sitter := adventure.castRequest(settings.request(prompt, category), illustration.Description, category, settings)
+	imagePath, image, err := generateImage(client, req, dir, name, settings.PostProcess, pr)
+	switch {
+	case err != nil && (!settings.SkipFailed || req.context().Err() != nil):
+		return err
+	case err != nil:
+		pr.UpdateOutput(fmt.Sprintf("Image generation failed, keeping only the caption: %v", err))
+		illustration.Image, illustration.Backend = "", ""
+	default:
+		illustration.Image, illustration.Backend = imagePath, image.Backend
+		if sitter != nil && !image.Placeholder {
+			sitter.Reference = imagePath
+		}
+	}
+
+	caption := fmt.Sprintf("%s:%s:%s", amap(illustration.IsMap), illustration.Description, illustration.Style)
+	fields := fmt.Sprintf("\n  * Category: %s\n  * Description: %s\n  * Style: %s\n", amap(illustration.IsMap), illustration.Description, illustration.Style)
+	captionFile := fmt.Sprintf(" - %s `%s`\n", caption, fields)
+	if illustration.Image != "" {
+		captionFile = fmt.Sprintf(" - [%s](%s) `%s`\n", caption, filepath.Base(imagePath), fields)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".md"), []byte(captionFile), 0o644)
+}
+
+// generateImage generates the first image of req and saves it in dir as
+// name, post-processed according to pp; see saveImage.
+//
+// Returns:
+//   - string: the path of the image written
+//   - GeneratedImage: the image as generated, with its parameters
+//   - error: any error generating or writing the image
+func generateImage(client ImageClient, req ImageRequest, dir, name string, pp PostProcessing, progress progressor) (string, GeneratedImage, error) {
+	var pr progressor = &nullProgressor{}
+	if progress != nil {
+		pr = progress
+	}
+	images, err := client.ImageGenerate(req, pr)
+	if err != nil {
+		return "", GeneratedImage{}, err
+	}
+	if len(images) == 0 {
+		return "", GeneratedImage{}, fmt.Errorf("no images generated")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", GeneratedImage{}, err
+	}
+	path, err := saveImage(client, images[0], filepath.Join(dir, name), pp, pr)
+	return path, images[0], err
+}
+
+// fileName returns the base name shared by an illustration's image, its
+// caption and its prompt: episode and illustration numbers, category, a
+// slug of its title and a short hash of its prompt, such as
+// 01_02_portrait_the-ferryman_1a2b3c4d. Covers are episode 00. The name
+// depends only on the prompt, so a resumed generation overwrites rather
+// than duplicates its images, and two illustrations never share one.
+//
+// Parameters:
+//   - episode: episode number counting from 1, or 0 for covers
+//   - index: illustration number within the episode counting from 1
+//   - category: category the image is drawn at
+func (p IllustrationPrompt) fileName(episode, index int, category ImageCategory) string {
+	title := p.Title
+	if title == "" {
+		words := strings.Fields(p.Description)
+		if len(words) > 6 {
+			words = words[:6]
+		}
+		title = strings.Join(words, " ")
+	}
+	sum := sha256.Sum256([]byte(string(category) + "\x00" + p.Title + "\x00" + p.Description + "\x00" + p.Style))
+	return fmt.Sprintf("%02d_%02d_%s_%s_%x", episode, index, category, slugify(title), sum[:4])
+}
+
+// slugify turns s into lower-case ASCII words joined by hyphens, at most
+// 40 characters long, for use in file names.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		case r == '\'', r == '’':
+			// Keep possessives and contractions in one word.
+		default:
+			hyphen = true
+		}
+	}
+	slug := b.String()
+	if len(slug) > 40 {
+		slug = slug[:40]
+		if cut := strings.LastIndexByte(slug, '-'); cut > 0 {
+			slug = slug[:cut]
+		}
+	}
+	if slug == "" {
+		return "untitled"
 	}
-	return result + ".webp"
+	return slug
 }
@@ -42,7 +42,7 @@ func GetOnePageDungeonPrompt(settingDetails string) string {
     2. List key NPCs and their motivations
     3. Include a random encounter table (1d6)
     4. Add a treasure table (1d6)
-    5. Describe key locations within the dungeon
+    5. Describe key locations within the dungeon under a "Key Locations" heading, numbered 1, 2, 3... in the order they are explored; the numbers key the dungeon map
     6. Include any relevant traps or puzzles
     7. Provide monster statistics in abbreviated format
 	8. Game-system agnostic
@@ -116,7 +116,28 @@ func GetIllustrationPrompt() string {
 	prompt += `## Illustration: Number - Episode Title - Illustration Title
 Description: 3-8 sentence description of the scene optimized for Stable Diffusion XL
 Style: Stylistic description of the art
-Type: Map OR Portait OR Scene etc...
+Type: Map OR Portrait OR Scene
+
+`
+	prompt += "```\n"
+	return prompt
+}
+
+// GetCharacterPrompt asks for the canonical appearance of each recurring
+// character, so every illustration draws them alike.
+func GetCharacterPrompt() string {
+	prompt := `Describe how each of the listed non-player characters of this adventure looks, for an illustrator who must draw them identically in every picture.
+    For each character, give one line covering:
+    - Apparent age, build and skin tone
+    - Face, hair and eye colour
+    - Clothing, armour and equipment
+    - One or two distinguishing features
+    Describe only what can be seen. Avoid text elements and names of real people.
+
+	Follow this example format exactly for each character:`
+	prompt += "```\n"
+	prompt += `## Character: Character Name
+Appearance: 1-3 sentence visual description optimized for Stable Diffusion XL (All one line)
 
 `
 	prompt += "```\n"
@@ -156,6 +177,18 @@ func GetCopyrightRemovalPrompt() string {
 	`
 }
 
+// parseTitle returns the first top-level markdown heading of the table of
+// contents, or an empty string if there is none.
+func parseTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "# ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "# "))
+		}
+	}
+	return ""
+}
+
 func parseEpisodes(content string) []Episode {
 	var episodes []Episode
 	lines := strings.Split(content, "\n")
@@ -201,13 +234,14 @@ func parseIllustrationPrompts(content string) []IllustrationPrompt {
 			if currentPrompt.Description != "" {
 				prompts = append(prompts, currentPrompt)
 			}
-			currentPrompt = IllustrationPrompt{}
+			currentPrompt = IllustrationPrompt{Title: illustrationTitle(line)}
 		case strings.HasPrefix(line, "Description:"):
 			currentPrompt.Description = strings.TrimPrefix(line, "Description: ")
 		case strings.HasPrefix(line, "Style:"):
 			currentPrompt.Style = strings.TrimPrefix(line, "Style: ")
 		case strings.HasPrefix(line, "Type:"):
 			currentPrompt.IsMap = strings.Contains(strings.ToLower(line), "map")
+			currentPrompt.Category = illustrationCategory(strings.TrimPrefix(line, "Type:"))
 		}
 	}
 
@@ -217,3 +251,34 @@ func parseIllustrationPrompts(content string) []IllustrationPrompt {
 
 	return prompts
 }
+
+// parseCharacters reads the appearances of a GetCharacterPrompt response,
+// keyed by lower-case character name.
+func parseCharacters(content string) map[string]string {
+	appearances := map[string]string{}
+	var name string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "## Character:"):
+			name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "## Character:")))
+		case strings.HasPrefix(line, "Appearance:") && name != "":
+			appearances[name] = strings.TrimSpace(strings.TrimPrefix(line, "Appearance:"))
+		}
+	}
+	return appearances
+}
+
+// illustrationTitle returns the illustration title of a heading in the
+// format "## Illustration: Number - Episode Title - Illustration Title".
+func illustrationTitle(heading string) string {
+	title := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(heading, "## Illustration"), ":"))
+	if i := strings.LastIndex(title, " - "); i >= 0 {
+		title = title[i+len(" - "):]
+	}
+	title = strings.TrimSpace(title)
+	if strings.TrimLeft(title, "0123456789. ") == "" {
+		return "" // only a number
+	}
+	return title
+}
@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyPrefix starts every API key, so keys are recognizable in
+// Authorization headers and secret scanners.
+const APIKeyPrefix = "dnd_"
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	// ScopeGenerate allows starting and cancelling generations.
+	ScopeGenerate Scope = "generate"
+	// ScopeRead allows reading messages, the library and usage.
+	ScopeRead Scope = "read"
+	// ScopeDelete allows deleting adventures from the library.
+	ScopeDelete Scope = "delete"
+)
+
+// Scopes lists every scope, in display order.
+var Scopes = []Scope{ScopeGenerate, ScopeRead, ScopeDelete}
+
+// Default quotas for new API keys. A limit of zero means unlimited.
+var (
+	DefaultDailyAdventures       = 5
+	DefaultMonthlyTokens   int64 = 2_000_000
+)
+
+// ErrQuotaExceeded is returned by ReserveAdventure when a key has used up
+// its daily adventures or monthly tokens.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// APIKey is a credential issued to an account for programmatic access.
+// Jobs submitted with a key run in the key's own SessionID and belong to
+// its account.
+type APIKey struct {
+	ID              int64
+	AccountID       int64
+	SessionID       string
+	Name            string
+	Prefix          string
+	Scopes          []Scope
+	DailyAdventures int
+	MonthlyTokens   int64
+	CreatedAt       time.Time
+	LastUsedAt      time.Time
+}
+
+// Allows reports whether the key was granted scope.
+func (k *APIKey) Allows(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is an API key's consumption in the current quota periods. Days and
+// months are counted in UTC.
+type Usage struct {
+	Adventures      int       `json:"adventures"`
+	AdventuresLimit int       `json:"adventures_limit"`
+	AdventuresReset time.Time `json:"adventures_reset"`
+	Tokens          int64     `json:"tokens"`
+	TokensLimit     int64     `json:"tokens_limit"`
+	TokensReset     time.Time `json:"tokens_reset"`
+}
+
+// AdventuresRemaining returns how many adventures may still be started
+// today, or -1 when unlimited.
+func (u Usage) AdventuresRemaining() int {
+	if u.AdventuresLimit <= 0 {
+		return -1
+	}
+	return max(u.AdventuresLimit-u.Adventures, 0)
+}
+
+// TokensRemaining returns how many tokens are left this month, or -1 when
+// unlimited.
+func (u Usage) TokensRemaining() int64 {
+	if u.TokensLimit <= 0 {
+		return -1
+	}
+	return max(u.TokensLimit-u.Tokens, 0)
+}
+
+const apiKeySchema = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	account_id       INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+	session_id       TEXT    NOT NULL,
+	name             TEXT    NOT NULL,
+	prefix           TEXT    NOT NULL,
+	key_hash         TEXT    NOT NULL UNIQUE,
+	scopes           TEXT    NOT NULL,
+	daily_adventures INTEGER NOT NULL,
+	monthly_tokens   INTEGER NOT NULL,
+	created_at       INTEGER NOT NULL,
+	last_used_at     INTEGER NOT NULL DEFAULT 0,
+	revoked_at       INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS api_keys_account ON api_keys(account_id);
+CREATE TABLE IF NOT EXISTS api_usage (
+	key_id     INTEGER NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+	period     TEXT    NOT NULL,
+	adventures INTEGER NOT NULL DEFAULT 0,
+	tokens     INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (key_id, period)
+);
+`
+
+const apiKeyColumns = `id, account_id, session_id, name, prefix, scopes, daily_adventures, monthly_tokens, created_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var scopes string
+	var created, used int64
+	err := row.Scan(&key.ID, &key.AccountID, &key.SessionID, &key.Name, &key.Prefix, &scopes,
+		&key.DailyAdventures, &key.MonthlyTokens, &created, &used)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(scopes, ",") {
+		if s != "" {
+			key.Scopes = append(key.Scopes, Scope(s))
+		}
+	}
+	key.CreatedAt = time.Unix(0, created)
+	if used != 0 {
+		key.LastUsedAt = time.Unix(0, used)
+	}
+	return key, nil
+}
+
+// CreateAPIKey issues a new key with the default quotas.
+//
+// Parameters:
+//   - accountID: owning account
+//   - name: label shown to the owner
+//   - scopes: permissions granted; unknown scopes are ignored
+//
+// Returns:
+//   - *APIKey: the stored key
+//   - string: the secret, shown to the owner once and never stored
+//   - error: any storage error
+func (s *Store) CreateAPIKey(accountID int64, name string, scopes []Scope) (*APIKey, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	secret := APIKeyPrefix + token
+
+	key := &APIKey{
+		AccountID:       accountID,
+		SessionID:       uuid.New().String(),
+		Name:            name,
+		Prefix:          secret[:len(APIKeyPrefix)+6],
+		DailyAdventures: s.DailyAdventures,
+		MonthlyTokens:   s.MonthlyTokens,
+		CreatedAt:       time.Now(),
+	}
+	var granted []string
+	for _, scope := range Scopes {
+		for _, requested := range scopes {
+			if requested == scope {
+				key.Scopes = append(key.Scopes, scope)
+				granted = append(granted, string(scope))
+				break
+			}
+		}
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO api_keys (account_id, session_id, name, prefix, key_hash, scopes, daily_adventures, monthly_tokens, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.AccountID, key.SessionID, key.Name, key.Prefix, hashToken(secret), strings.Join(granted, ","),
+		key.DailyAdventures, key.MonthlyTokens, key.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating api key: %w", err)
+	}
+	if key.ID, err = res.LastInsertId(); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// APIKey looks up an active key by its secret and records that it was used.
+//
+// Returns:
+//   - *APIKey: the key
+//   - error: ErrNotFound if the secret is unknown or revoked
+func (s *Store) APIKey(secret string) (*APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRow(
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ? AND revoked_at = 0`,
+		hashToken(secret),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading api key: %w", err)
+	}
+	key.LastUsedAt = time.Now()
+	if _, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, key.LastUsedAt.UnixNano(), key.ID); err != nil {
+		return nil, fmt.Errorf("updating api key: %w", err)
+	}
+	return key, nil
+}
+
+// APIKeys lists an account's active keys, newest first.
+func (s *Store) APIKeys(accountID int64) ([]APIKey, error) {
+	rows, err := s.db.Query(
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE account_id = ? AND revoked_at = 0 ORDER BY id DESC`,
+		accountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey permanently disables one of an account's keys.
+//
+// Returns:
+//   - error: ErrNotFound if the account has no such active key
+func (s *Store) RevokeAPIKey(accountID, keyID int64) error {
+	res, err := s.db.Exec(
+		`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND account_id = ? AND revoked_at = 0`,
+		time.Now().UnixNano(), keyID, accountID,
+	)
+	if err != nil {
+		return fmt.Errorf("revoking api key: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Usage reports a key's consumption in the current day and month.
+func (s *Store) Usage(key *APIKey) (Usage, error) {
+	return usage(s.db, key, time.Now())
+}
+
+// ReserveAdventure counts one adventure against a key's daily quota. The
+// check and the increment happen in one transaction, so concurrent requests
+// cannot overrun the quota. Keys that have spent their monthly tokens
+// cannot start new adventures either.
+//
+// Returns:
+//   - Usage: the key's usage including this adventure
+//   - error: ErrQuotaExceeded, with the unchanged usage, if either quota is spent
+func (s *Store) ReserveAdventure(key *APIKey) (Usage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Usage{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	u, err := usage(tx, key, now)
+	if err != nil {
+		return Usage{}, err
+	}
+	if u.AdventuresRemaining() == 0 || u.TokensRemaining() == 0 {
+		return u, ErrQuotaExceeded
+	}
+	_, err = tx.Exec(
+		`INSERT INTO api_usage (key_id, period, adventures) VALUES (?, ?, 1)
+		ON CONFLICT(key_id, period) DO UPDATE SET adventures = adventures + 1`,
+		key.ID, dayPeriod(now),
+	)
+	if err != nil {
+		return Usage{}, fmt.Errorf("recording usage: %w", err)
+	}
+	u.Adventures++
+	return u, tx.Commit()
+}
+
+// ReleaseAdventure returns an adventure reserved by ReserveAdventure that
+// was never started.
+func (s *Store) ReleaseAdventure(key *APIKey) error {
+	_, err := s.db.Exec(
+		`UPDATE api_usage SET adventures = adventures - 1 WHERE key_id = ? AND period = ? AND adventures > 0`,
+		key.ID, dayPeriod(time.Now()),
+	)
+	if err != nil {
+		return fmt.Errorf("releasing usage: %w", err)
+	}
+	return nil
+}
+
+// AddTokens counts Claude tokens against a key's monthly quota.
+func (s *Store) AddTokens(keyID, tokens int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO api_usage (key_id, period, tokens) VALUES (?, ?, ?)
+		ON CONFLICT(key_id, period) DO UPDATE SET tokens = tokens + excluded.tokens`,
+		keyID, monthPeriod(time.Now()), tokens,
+	)
+	if err != nil {
+		return fmt.Errorf("recording tokens: %w", err)
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func usage(db queryRower, key *APIKey, now time.Time) (Usage, error) {
+	now = now.UTC()
+	u := Usage{
+		AdventuresLimit: key.DailyAdventures,
+		AdventuresReset: time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		TokensLimit:     key.MonthlyTokens,
+		TokensReset:     time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	err := db.QueryRow(
+		`SELECT
+			COALESCE(SUM(CASE WHEN period = ? THEN adventures END), 0),
+			COALESCE(SUM(CASE WHEN period = ? THEN tokens END), 0)
+		FROM api_usage WHERE key_id = ?`,
+		dayPeriod(now), monthPeriod(now), key.ID,
+	).Scan(&u.Adventures, &u.Tokens)
+	if err != nil {
+		return Usage{}, fmt.Errorf("reading usage: %w", err)
+	}
+	return u, nil
+}
+
+func dayPeriod(t time.Time) string {
+	return "day:" + t.UTC().Format("2006-01-02")
+}
+
+func monthPeriod(t time.Time) string {
+	return "month:" + t.UTC().Format("2006-01")
+}
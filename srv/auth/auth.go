@@ -0,0 +1,434 @@
+// Package auth provides optional user accounts for the DND bot server:
+// email/password and passkey (WebAuthn) credentials, and the server-side
+// sessions that tie a browser to an anonymous session ID and, once logged in,
+// to an account.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+
+	_ "modernc.org/sqlite"
+)
+
+// SessionLifetime is how long a server-side session stays valid.
+const SessionLifetime = 30 * 24 * time.Hour
+
+var (
+	// ErrEmailTaken is returned when registering an email that already has an account.
+	ErrEmailTaken = errors.New("an account with that email already exists")
+	// ErrInvalidCredentials is returned when an email/password pair does not match.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrNotFound is returned when a session, account or credential does not exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// Account is a registered user. It implements webauthn.User.
+type Account struct {
+	ID          int64
+	Email       string
+	Handle      []byte
+	CreatedAt   time.Time
+	Credentials []webauthn.Credential
+}
+
+// WebAuthnID implements webauthn.User.
+func (a *Account) WebAuthnID() []byte { return a.Handle }
+
+// WebAuthnName implements webauthn.User.
+func (a *Account) WebAuthnName() string { return a.Email }
+
+// WebAuthnDisplayName implements webauthn.User.
+func (a *Account) WebAuthnDisplayName() string { return a.Email }
+
+// WebAuthnCredentials implements webauthn.User.
+func (a *Account) WebAuthnCredentials() []webauthn.Credential { return a.Credentials }
+
+// Session is a server-side browser session. ID is the anonymous session
+// identifier that owns generation jobs; AccountID is zero until the browser
+// logs in.
+type Session struct {
+	// Token is the bearer value stored in the session cookie. Only its hash
+	// is persisted, so Token is set only on sessions returned by NewSession
+	// and Login.
+	Token     string
+	ID        string
+	AccountID int64
+	CSRF      string
+	// Ceremony holds the WebAuthn challenge of a registration or login in
+	// progress, if any.
+	Ceremony  *webauthn.SessionData
+	ExpiresAt time.Time
+}
+
+// Store persists accounts, passkey credentials and sessions in SQLite.
+type Store struct {
+	db *sql.DB
+	// DailyAdventures and MonthlyTokens are the quotas given to new API
+	// keys. Open sets them to DefaultDailyAdventures and DefaultMonthlyTokens.
+	DailyAdventures int
+	MonthlyTokens   int64
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS accounts (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password_hash TEXT    NOT NULL DEFAULT '',
+	handle        BLOB    NOT NULL UNIQUE,
+	created_at    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS credentials (
+	id         BLOB    PRIMARY KEY,
+	account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+	data       TEXT    NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS credentials_account ON credentials(account_id);
+CREATE TABLE IF NOT EXISTS sessions (
+	token_hash TEXT    PRIMARY KEY,
+	session_id TEXT    NOT NULL,
+	account_id INTEGER NOT NULL DEFAULT 0,
+	csrf       TEXT    NOT NULL,
+	ceremony   TEXT    NOT NULL DEFAULT '',
+	expires_at INTEGER NOT NULL
+);
+`
+
+// Open opens (or creates) the account database at path.
+//
+// Parameters:
+//   - path: filesystem location of the SQLite database
+//
+// Returns:
+//   - *Store: ready-to-use store
+//   - error: any error opening or migrating the database
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("opening account database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema + apiKeySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating account schema: %w", err)
+	}
+	return &Store{db: db, DailyAdventures: DefaultDailyAdventures, MonthlyTokens: DefaultMonthlyTokens}, nil
+}
+
+// Ping checks that the database is reachable.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close releases the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// NormalizeEmail lower-cases and trims an email address so lookups are
+// case-insensitive.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CreateAccount registers a new account. An empty password creates an
+// account that can only log in with passkeys.
+//
+// Parameters:
+//   - email: login email, normalized with NormalizeEmail
+//   - password: plaintext password, hashed with argon2id
+//
+// Returns:
+//   - *Account: the new account
+//   - error: ErrEmailTaken if the email is registered, or any storage error
+func (s *Store) CreateAccount(email, password string) (*Account, error) {
+	email = NormalizeEmail(email)
+	hash := ""
+	if password != "" {
+		var err error
+		if hash, err = HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	handle, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &Account{Email: email, Handle: handle, CreatedAt: time.Now()}
+	res, err := s.db.Exec(
+		`INSERT INTO accounts (email, password_hash, handle, created_at) VALUES (?, ?, ?, ?)`,
+		email, hash, handle, account.CreatedAt.UnixNano(),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("creating account: %w", err)
+	}
+	if account.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Authenticate checks an email/password pair.
+//
+// Returns:
+//   - *Account: the matching account
+//   - error: ErrInvalidCredentials if the pair does not match
+func (s *Store) Authenticate(email, password string) (*Account, error) {
+	var id int64
+	var hash string
+	err := s.db.QueryRow(`SELECT id, password_hash FROM accounts WHERE email = ?`, NormalizeEmail(email)).Scan(&id, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Spend the same effort as a real check so response times do not
+		// reveal which emails are registered.
+		HashPassword(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading account: %w", err)
+	}
+	if hash == "" {
+		return nil, ErrInvalidCredentials
+	}
+	ok, err := VerifyPassword(password, hash)
+	if err != nil || !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return s.Account(id)
+}
+
+// Account loads an account and its passkey credentials by ID.
+func (s *Store) Account(id int64) (*Account, error) {
+	return s.loadAccount(`SELECT id, email, handle, created_at FROM accounts WHERE id = ?`, id)
+}
+
+// AccountByHandle loads an account by its WebAuthn user handle.
+func (s *Store) AccountByHandle(handle []byte) (*Account, error) {
+	return s.loadAccount(`SELECT id, email, handle, created_at FROM accounts WHERE handle = ?`, handle)
+}
+
+func (s *Store) loadAccount(query string, arg any) (*Account, error) {
+	account := &Account{}
+	var created int64
+	err := s.db.QueryRow(query, arg).Scan(&account.ID, &account.Email, &account.Handle, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading account: %w", err)
+	}
+	account.CreatedAt = time.Unix(0, created)
+
+	rows, err := s.db.Query(`SELECT data FROM credentials WHERE account_id = ? ORDER BY created_at`, account.ID)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var cred webauthn.Credential
+		if err := json.Unmarshal([]byte(data), &cred); err != nil {
+			return nil, fmt.Errorf("decoding credential: %w", err)
+		}
+		account.Credentials = append(account.Credentials, cred)
+	}
+	return account, rows.Err()
+}
+
+// SaveCredential stores a new passkey credential for an account, or updates
+// an existing one after a login bumped its signature counter.
+//
+// Parameters:
+//   - accountID: owning account
+//   - cred: credential returned by the WebAuthn ceremony
+func (s *Store) SaveCredential(accountID int64, cred *webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO credentials (id, account_id, data, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET data = excluded.data WHERE account_id = excluded.account_id`,
+		cred.ID, accountID, string(data), time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("saving credential: %w", err)
+	}
+	return nil
+}
+
+// NewSession starts a server-side session for an anonymous browser.
+//
+// Parameters:
+//   - sessionID: anonymous session identifier that will own the browser's jobs
+//
+// Returns:
+//   - *Session: the session, with Token set for the cookie
+//   - error: any storage error
+func (s *Store) NewSession(sessionID string) (*Session, error) {
+	return s.createSession(sessionID, 0)
+}
+
+// Login replaces a browser's session with a new one bound to an account. The
+// old token is revoked so a token planted before login cannot be reused.
+//
+// Parameters:
+//   - old: the browser's current session
+//   - accountID: account that just authenticated
+//
+// Returns:
+//   - *Session: the replacement session, with Token set for the cookie
+//   - error: any storage error
+func (s *Store) Login(old *Session, accountID int64) (*Session, error) {
+	if err := s.Revoke(old); err != nil {
+		return nil, err
+	}
+	return s.createSession(old.ID, accountID)
+}
+
+// Logout replaces an account session with a fresh anonymous one. The new
+// session gets a new session ID, so the next person using the browser
+// cannot reach the adventures created under the old one.
+func (s *Store) Logout(old *Session) (*Session, error) {
+	if err := s.Revoke(old); err != nil {
+		return nil, err
+	}
+	return s.createSession(uuid.New().String(), 0)
+}
+
+func (s *Store) createSession(sessionID string, accountID int64) (*Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		Token:     token,
+		ID:        sessionID,
+		AccountID: accountID,
+		CSRF:      csrf,
+		ExpiresAt: time.Now().Add(SessionLifetime),
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO sessions (token_hash, session_id, account_id, csrf, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), sess.ID, sess.AccountID, sess.CSRF, sess.ExpiresAt.UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating session: %w", err)
+	}
+	return sess, nil
+}
+
+// Session looks up an unexpired session by its cookie token.
+//
+// Returns:
+//   - *Session: the session; its Token field is set to token
+//   - error: ErrNotFound if the token is unknown or expired
+func (s *Store) Session(token string) (*Session, error) {
+	sess := &Session{Token: token}
+	var ceremony string
+	var expires int64
+	err := s.db.QueryRow(
+		`SELECT session_id, account_id, csrf, ceremony, expires_at FROM sessions WHERE token_hash = ? AND expires_at > ?`,
+		hashToken(token), time.Now().UnixNano(),
+	).Scan(&sess.ID, &sess.AccountID, &sess.CSRF, &ceremony, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading session: %w", err)
+	}
+	sess.ExpiresAt = time.Unix(0, expires)
+	if ceremony != "" {
+		sess.Ceremony = &webauthn.SessionData{}
+		if err := json.Unmarshal([]byte(ceremony), sess.Ceremony); err != nil {
+			return nil, fmt.Errorf("decoding ceremony: %w", err)
+		}
+	}
+	return sess, nil
+}
+
+// SetCeremony records (or, with nil, clears) the WebAuthn challenge of a
+// registration or login in progress.
+func (s *Store) SetCeremony(sess *Session, ceremony *webauthn.SessionData) error {
+	data := ""
+	if ceremony != nil {
+		b, err := json.Marshal(ceremony)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	if _, err := s.db.Exec(`UPDATE sessions SET ceremony = ? WHERE token_hash = ?`, data, hashToken(sess.Token)); err != nil {
+		return fmt.Errorf("saving ceremony: %w", err)
+	}
+	sess.Ceremony = ceremony
+	return nil
+}
+
+// Revoke deletes a session so its token stops working.
+func (s *Store) Revoke(sess *Session) error {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(sess.Token)); err != nil {
+		return fmt.Errorf("revoking session: %w", err)
+	}
+	return nil
+}
+
+// PruneSessions deletes expired sessions.
+//
+// Returns:
+//   - int: number of sessions removed
+//   - error: any database error
+func (s *Store) PruneSessions() (int, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("pruning sessions: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("reading random bytes: %w", err)
+	}
+	return b, nil
+}
+
+func randomToken() (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is the form in which session tokens are stored, so a leaked
+// database does not hand out live sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
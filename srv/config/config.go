@@ -0,0 +1,901 @@
+// Package config defines the server configuration: a typed structure loaded
+// from a YAML file, overridden by environment variables and validated once
+// at startup.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration.
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Storage   Storage   `yaml:"storage"`
+	Retention Retention `yaml:"retention"`
+	Limits    Limits    `yaml:"limits"`
+	Generator Generator `yaml:"generator"`
+	Paywall   Paywall   `yaml:"paywall"`
+	Webhooks  Webhooks  `yaml:"webhooks"`
+	Email     Email     `yaml:"email"`
+	Log       Log       `yaml:"log"`
+}
+
+// Server configures the listener and HTTP behaviour.
+type Server struct {
+	// Domain is the host name to listen on and request certificates for.
+	Domain string `yaml:"domain"`
+	// Port to listen on when TLS is off; "0" picks a free port.
+	Port string `yaml:"port"`
+	// TLS obtains a certificate automatically and serves HTTPS.
+	TLS bool `yaml:"tls"`
+	// Mail is the contact address given to the certificate authority.
+	Mail string `yaml:"mail"`
+	// CertDir stores the automatically obtained certificates.
+	CertDir string `yaml:"cert_dir"`
+	// Origin is the public URL of the site; passkeys are bound to it.
+	// Derived from Domain, Port and TLS when empty.
+	Origin string `yaml:"origin"`
+	// Workers is the number of adventures generated concurrently.
+	Workers int `yaml:"workers"`
+	// AdminToken enables the /admin endpoints for bearers of the token.
+	AdminToken string `yaml:"admin_token" secret:"true"`
+	// AdminAccounts lists the IDs of the accounts allowed into the /admin
+	// dashboard from the browser once logged in. Accounts are matched by
+	// ID rather than email because registering does not prove that the
+	// address belongs to the registrant.
+	AdminAccounts []int64 `yaml:"admin_accounts"`
+	// MetricsToken, when set, is required as a bearer token on /metrics.
+	MetricsToken string `yaml:"metrics_token" secret:"true"`
+	// ReadyCheckBackends makes /readyz also check that the LLM and image
+	// backends respond, not just the local databases.
+	ReadyCheckBackends bool `yaml:"ready_check_backends"`
+	// ShutdownTimeout is how long running generations may take to reach
+	// the end of their current step after SIGINT or SIGTERM. Generations
+	// still running then are interrupted; either way they resume from
+	// their last finished step on the next start.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// CSP is the Content-Security-Policy, sent only when EnforceCSP is set.
+	CSP        string `yaml:"csp"`
+	EnforceCSP bool   `yaml:"enforce_csp"`
+}
+
+// Storage locates databases and files on disk.
+type Storage struct {
+	JobsDB     string `yaml:"jobs_db"`
+	HistoryDB  string `yaml:"history_db"`
+	AccountsDB string `yaml:"accounts_db"`
+	WebhooksDB string `yaml:"webhooks_db"`
+	// LegacyHistory is the JSON history file imported on first start.
+	LegacyHistory string `yaml:"legacy_history"`
+	Outputs       string `yaml:"outputs"`
+	Archive       string `yaml:"archive"`
+	Static        string `yaml:"static"`
+	// MetricsFile, when set, receives a final snapshot of the metrics in
+	// the Prometheus text format at shutdown, for example for the
+	// node_exporter textfile collector.
+	MetricsFile string `yaml:"metrics_file"`
+	// HistoryRetention is how long messages are kept after a session's last activity.
+	HistoryRetention time.Duration `yaml:"history_retention"`
+	// CleanupInterval is how often expired history, sessions and rate
+	// limit records are pruned.
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+}
+
+// Retention bounds the disk space used by generated adventures. Adventures
+// are archived and then deleted as they age, and the oldest are deleted
+// early when a user or the server exceeds its quota. Zero disables a limit.
+type Retention struct {
+	// ArchiveAfter moves finished adventures from the outputs directory to
+	// the public archive once they are this old. Only complete, paid
+	// adventures are archived; the others are deleted instead.
+	ArchiveAfter time.Duration `yaml:"archive_after"`
+	// DeleteAfter deletes adventures, archived or not, once they are this old.
+	DeleteAfter time.Duration `yaml:"delete_after"`
+	// PaidArchiveAfter and PaidDeleteAfter replace ArchiveAfter and
+	// DeleteAfter for adventures that were paid for.
+	PaidArchiveAfter time.Duration `yaml:"paid_archive_after"`
+	PaidDeleteAfter  time.Duration `yaml:"paid_delete_after"`
+	// MaxUserMB caps the space used by each user's adventures; a user is an
+	// account, or a browser session when not logged in.
+	MaxUserMB int64 `yaml:"max_user_mb"`
+	// MaxTotalMB caps the space used by every adventure together.
+	MaxTotalMB int64 `yaml:"max_total_mb"`
+	// TmpAfter deletes the scratch files left in tmp/ by generations once
+	// they are this old.
+	TmpAfter time.Duration `yaml:"tmp_after"`
+	// DryRun only logs what the periodic run would archive and delete.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// Limits throttles clients.
+type Limits struct {
+	// RequestsPerMinute caps requests per client IP and endpoint.
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	// GenerationsPerWindow caps anonymous generations per client IP in
+	// each GenerationWindow.
+	GenerationsPerWindow int           `yaml:"generations_per_window"`
+	GenerationWindow     time.Duration `yaml:"generation_window"`
+	// APIKeyDailyAdventures and APIKeyMonthlyTokens are the quotas given
+	// to new API keys; zero means unlimited.
+	APIKeyDailyAdventures int   `yaml:"api_key_daily_adventures"`
+	APIKeyMonthlyTokens   int64 `yaml:"api_key_monthly_tokens"`
+}
+
+// Generator configures the text and image backends.
+type Generator struct {
+	ClaudeAPIKey string `yaml:"claude_api_key" secret:"true"`
+	HordeAPIKey  string `yaml:"horde_api_key" secret:"true"`
+	// HordeTimeout bounds the wait for each Stable Horde generation, which
+	// is then resubmitted with the next of HordeFallbackModels. Once every
+	// model has failed, HordePlaceholder records a placeholder image
+	// instead of failing the adventure.
+	HordeTimeout        time.Duration `yaml:"horde_timeout"`
+	HordeFallbackModels []string      `yaml:"horde_fallback_models"`
+	HordePlaceholder    bool          `yaml:"horde_placeholder"`
+	// ImageBackends lists the image backends to try in order, falling back
+	// to the next when one fails: sdwebui, comfyui and horde, each with its
+	// own model and sampler if needed. When empty it is comfyui and sdwebui
+	// if their URLs are set, then horde.
+	ImageBackends []ImageBackend `yaml:"image_backends"`
+	// ImageCircuitThreshold consecutive failures take a backend out of
+	// rotation for ImageCircuitCooldown.
+	ImageCircuitThreshold int           `yaml:"image_circuit_threshold"`
+	ImageCircuitCooldown  time.Duration `yaml:"image_circuit_cooldown"`
+	// ImageFailure is what happens when no backend can generate an image:
+	// skip leaves it out of the book, keeping its caption, and abort fails
+	// the adventure.
+	ImageFailure string `yaml:"image_failure"`
+	// SDWebUIURL selects a local AUTOMATIC1111 server instead of Stable
+	// Horde. Its model must name one of its checkpoints, which it switches to.
+	SDWebUIURL string `yaml:"sd_webui_url"`
+	// ComfyUIURL selects a ComfyUI server instead of Stable Horde or
+	// AUTOMATIC1111. ImageModel must then name one of its checkpoints.
+	ComfyUIURL string `yaml:"comfyui_url"`
+	// ComfyUIWorkflow is a workflow template file in the ComfyUI API
+	// format; a plain text-to-image workflow is used when empty.
+	ComfyUIWorkflow string `yaml:"comfyui_workflow"`
+	// ImageModel and ImageSteps are passed to the image backend.
+	// ImageModel is the default of the backends that set no model.
+	ImageModel string `yaml:"image_model"`
+	ImageSteps int    `yaml:"image_steps"`
+	// ImageNegativePrompt lists what the images should not show.
+	ImageNegativePrompt string `yaml:"image_negative_prompt"`
+	// ImageSampler names the sampler in the backend's own spelling, e.g.
+	// k_euler_a on Stable Horde, "Euler a" on AUTOMATIC1111 or euler on
+	// ComfyUI; the backend's default when empty. It applies to the
+	// backends that set no sampler.
+	ImageSampler string `yaml:"image_sampler"`
+	// ImageCFGScale is how closely the images follow the prompt.
+	ImageCFGScale float64 `yaml:"image_cfg_scale"`
+	// ImageSizes sets the shape of each kind of image.
+	ImageSizes ImageSizes `yaml:"image_sizes"`
+	// CharacterReferences starts each portrait of a recurring character
+	// from their first portrait on the backends that support img2img,
+	// Stable Horde and AUTOMATIC1111. CharacterReferenceDenoise, between 0
+	// and 1, is how far a portrait may stray from that reference.
+	CharacterReferences       bool    `yaml:"character_references"`
+	CharacterReferenceDenoise float64 `yaml:"character_reference_denoise"`
+	// ImageFormat is png or jpeg; whatever the backend returns is converted
+	// to it. ImageJPEGQuality applies to jpeg only.
+	ImageFormat      string `yaml:"image_format"`
+	ImageJPEGQuality int    `yaml:"image_jpeg_quality"`
+	// ThumbnailWidth is the width of the web thumbnails written beside every
+	// image; zero disables them.
+	ThumbnailWidth int `yaml:"thumbnail_width"`
+	// Upscale enlarges every image by this factor with the upscaler of the
+	// backend that generated it, or of the first in the chain that has one
+	// (AUTOMATIC1111 only); 1 disables it. Upscaler names the upscaler
+	// model, the backend's default when empty.
+	Upscale  float64 `yaml:"upscale"`
+	Upscaler string  `yaml:"upscaler"`
+	// DungeonMaps draws a gridded play map of each episode from the
+	// numbered locations of its one-page dungeon.
+	DungeonMaps bool `yaml:"dungeon_maps"`
+	// Timeout bounds a whole generation run.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ImageSizes holds the size of each image category: book covers, area
+// maps, character portraits and other scenes.
+type ImageSizes struct {
+	Cover    ImageSize `yaml:"cover"`
+	Map      ImageSize `yaml:"map"`
+	Portrait ImageSize `yaml:"portrait"`
+	Scene    ImageSize `yaml:"scene"`
+}
+
+// Image backend names, as listed in Generator.ImageBackends.
+const (
+	BackendSDWebUI = "sdwebui"
+	BackendComfyUI = "comfyui"
+	BackendHorde   = "horde"
+)
+
+// ImageBackend is one entry of the image backend chain. Backends name
+// models and spell samplers differently, so each may set its own.
+type ImageBackend struct {
+	Name string `yaml:"name"`
+	// Model replaces Generator.ImageModel on this backend: a Stable Horde
+	// model name, a ComfyUI checkpoint file, or an AUTOMATIC1111
+	// checkpoint's title, file name or hash.
+	Model string `yaml:"model,omitempty"`
+	// Sampler replaces Generator.ImageSampler on this backend.
+	Sampler string `yaml:"sampler,omitempty"`
+}
+
+// UnmarshalYAML reads an entry either as a mapping or as a bare backend
+// name, as written before entries had settings.
+func (b *ImageBackend) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*b = ImageBackend{}
+		return node.Decode(&b.Name)
+	}
+	// Decoding through a node loses the decoder's KnownFields check.
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Value != "name" && key.Value != "model" && key.Value != "sampler" {
+				return fmt.Errorf("line %d: field %s not found in image backend", key.Line, key.Value)
+			}
+		}
+	}
+	type plain ImageBackend
+	return node.Decode((*plain)(b))
+}
+
+// hordeSamplers are the sampler names Stable Horde accepts.
+var hordeSamplers = []string{
+	"k_lms", "k_heun", "k_euler", "k_euler_a", "k_dpm_2", "k_dpm_2_a",
+	"k_dpm_fast", "k_dpm_adaptive", "k_dpmpp_2s_a", "k_dpmpp_2m",
+	"k_dpmpp_sde", "dpmsolver", "lcm", "DDIM",
+}
+
+// comfyUISampler matches the spelling of ComfyUI's KSampler sampler names,
+// such as euler_ancestral or dpmpp_2m_sde.
+var comfyUISampler = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// comfyUICheckpoint matches the checkpoint files ComfyUI loads.
+var comfyUICheckpoint = regexp.MustCompile(`(?i)\.(safetensors|ckpt|pt|pth|bin|sft|gguf)$`)
+
+// Values of Generator.ImageFailure.
+const (
+	ImageFailureSkip  = "skip"
+	ImageFailureAbort = "abort"
+)
+
+// ImageBackendOrder returns the image backends to try, in order; see
+// ImageBackends. Their model and sampler default to ImageModel and
+// ImageSampler.
+func (g Generator) ImageBackendOrder() []ImageBackend {
+	backends := g.ImageBackends
+	if len(backends) == 0 {
+		if g.ComfyUIURL != "" {
+			backends = append(backends, ImageBackend{Name: BackendComfyUI})
+		}
+		if g.SDWebUIURL != "" {
+			backends = append(backends, ImageBackend{Name: BackendSDWebUI})
+		}
+		backends = append(backends, ImageBackend{Name: BackendHorde})
+	}
+	order := make([]ImageBackend, len(backends))
+	for i, b := range backends {
+		if b.Model == "" {
+			b.Model = g.ImageModel
+		}
+		if b.Sampler == "" {
+			b.Sampler = g.ImageSampler
+		}
+		order[i] = b
+	}
+	return order
+}
+
+// ImageSize is an image's width and height in pixels.
+type ImageSize struct {
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+}
+
+// Webhooks configures the notifications POSTed to the URL registered with a
+// job when its generation completes, fails or is cancelled.
+type Webhooks struct {
+	// Enabled lets clients register webhooks.
+	Enabled bool `yaml:"enabled"`
+	// AllowPrivateNetworks permits webhooks to loopback, private and
+	// link-local addresses. Leave it off on public servers, or clients can
+	// make the server probe its own network.
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+	// MaxAttempts is how many times a delivery is tried before it is given up.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the delay before the first retry; each further retry
+	// waits twice as long, up to an hour.
+	Backoff time.Duration `yaml:"backoff"`
+	// Timeout bounds each delivery attempt.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Email configures the message sent to users who leave an address with
+// their request once their adventure is ready.
+type Email struct {
+	// SMTPHost is the relay that sends the messages. Leaving it empty
+	// disables email notifications and hides the address field.
+	SMTPHost string `yaml:"smtp_host"`
+	SMTPPort int    `yaml:"smtp_port"`
+	// ImplicitTLS connects with TLS from the start, as on port 465.
+	// Otherwise STARTTLS is used whenever the relay offers it.
+	ImplicitTLS bool `yaml:"implicit_tls"`
+	// Username and Password authenticate with the relay, if it needs it.
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	// From is the sender address, optionally with a display name.
+	From string `yaml:"from"`
+	// LinkSecret signs the download links in the messages, so they work
+	// without the browser session that requested the adventure.
+	LinkSecret string `yaml:"link_secret" secret:"true"`
+	// LinkTTL is how long the download links stay valid.
+	LinkTTL time.Duration `yaml:"link_ttl"`
+}
+
+// Enabled reports whether email notifications are configured.
+func (e Email) Enabled() bool {
+	return e.SMTPHost != ""
+}
+
+// Log configures the server log.
+type Log struct {
+	// Level is debug, info, warn or error. Except at debug, prompts and LLM
+	// responses are logged as their length only.
+	Level string `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+	// SessionFiles writes each generation's log to generation.log in its
+	// output directory, so it is included in the zip download.
+	SessionFiles bool `yaml:"session_files"`
+}
+
+// Paywall controls whether and how adventures are paid for.
+type Paywall struct {
+	// Enabled requires payment for adventures.
+	Enabled bool `yaml:"enabled"`
+	// Currency is "btc" or "xmr". The payment page offers a single currency.
+	Currency string `yaml:"currency"`
+	// TestNet uses the Bitcoin test network.
+	TestNet bool `yaml:"testnet"`
+	// MinConfirmations is the number of blockchain confirmations a payment needs.
+	MinConfirmations int `yaml:"min_confirmations"`
+	// PaymentTimeout is how long a payment address stays valid.
+	PaymentTimeout time.Duration `yaml:"payment_timeout"`
+	// Store is the directory payments are tracked in. Each tier keeps its
+	// payments in a subdirectory so a cheap payment cannot unlock a dearer tier.
+	Store string `yaml:"store"`
+	// FreePreview generates only the table of contents and covers of an
+	// adventure for free; the rest is generated once it is unlocked.
+	FreePreview bool `yaml:"free_preview"`
+	// XMRRPC, XMRUser and XMRPassword reach the monero-wallet-rpc daemon.
+	XMRRPC      string `yaml:"xmr_rpc"`
+	XMRUser     string `yaml:"xmr_user"`
+	XMRPassword string `yaml:"xmr_password" secret:"true"`
+	// Tiers lists the price points. A request is charged the cheapest tier
+	// that covers its options.
+	Tiers []PriceTier `yaml:"tiers"`
+}
+
+// PriceTier is one price point, covering adventures up to its limits.
+type PriceTier struct {
+	Name string `yaml:"name"`
+	// MaxEpisodes is the longest series the tier covers; zero means any length.
+	MaxEpisodes int `yaml:"max_episodes"`
+	// Images and PDF report whether the tier includes artwork and the PDF book.
+	Images bool `yaml:"images"`
+	PDF    bool `yaml:"pdf"`
+	// BTC and XMR are the prices in each currency.
+	BTC float64 `yaml:"btc"`
+	XMR float64 `yaml:"xmr"`
+}
+
+// Price returns the tier's price in currency.
+func (t PriceTier) Price(currency string) float64 {
+	if currency == "xmr" {
+		return t.XMR
+	}
+	return t.BTC
+}
+
+// MaxEpisodes caps the length of a requested series.
+const MaxEpisodes = 10
+
+// Smallest prices the paywall will accept in each currency.
+const (
+	minPriceBTC = 0.00001
+	minPriceXMR = 0.0001
+)
+
+// defaultCSP allows the page's own scripts plus the CDNs it loads from.
+const defaultCSP = `default-src 'self'; script-src 'self' {{nonce}} 'sha256-6O8L648x8Xhmzia0qI/zQdbTlpVaGehLozFzz/i2dIE=' 'sha256-EekPIHyJRz0hoIvCnNHdTpzW+jhqMbyTyTu2nXJO7b0=' 'sha256-UI0Byo+Bdsa/9HfswzVRrNuMaEt5s26sucqVpf8iPxw=' 'sha256-61RzUnEfEIq/j80eD9kxIi6+FHZECO1+ZjF5aAkRgcI=' 'sha256-2j5Uk7r3oOJ3KJIcT7QE7NrJ0DmojlDl0qjjoQbPsz8=' https://cdnjs.cloudflare.com https://cdn.jsdelivr.net; style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://fonts.googleapis.com; font-src 'self' https://fonts.gstatic.com; img-src 'self' data:;`
+
+// Default returns the built-in configuration, matching the behaviour of
+// releases that had no configuration file.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Domain:          "localhost",
+			Port:            "0",
+			Mail:            "example@example.com",
+			CertDir:         "./",
+			Workers:         1,
+			CSP:             defaultCSP,
+			ShutdownTimeout: 2 * time.Minute,
+		},
+		Storage: Storage{
+			JobsDB:           "jobs.db",
+			HistoryDB:        "history.db",
+			AccountsDB:       "accounts.db",
+			WebhooksDB:       "webhooks.db",
+			LegacyHistory:    "session_history.json",
+			Outputs:          "outputs",
+			Archive:          "archive",
+			Static:           "static",
+			HistoryRetention: 30 * 24 * time.Hour,
+			CleanupInterval:  100 * time.Minute,
+		},
+		Retention: Retention{
+			TmpAfter: 7 * 24 * time.Hour,
+		},
+		Limits: Limits{
+			RequestsPerMinute:     40,
+			GenerationsPerWindow:  3,
+			GenerationWindow:      4 * time.Hour,
+			APIKeyDailyAdventures: 5,
+			APIKeyMonthlyTokens:   2_000_000,
+		},
+		Generator: Generator{
+			ImageCircuitThreshold: 3,
+			ImageCircuitCooldown:  5 * time.Minute,
+			ImageFailure:          ImageFailureSkip,
+			HordeTimeout:          10 * time.Minute,
+			HordeFallbackModels:   []string{"AlbedoBase XL (SDXL)", "stable_diffusion"},
+			HordePlaceholder:      true,
+			ImageModel:            "Dreamshaper XL",
+			ImageSteps:            30,
+			ImageNegativePrompt:   "blurry, lowres, watermark, text, signature",
+			ImageCFGScale:         7,
+			ImageSizes: ImageSizes{
+				Cover:    ImageSize{Width: 768, Height: 1024},
+				Map:      ImageSize{Width: 1024, Height: 1024},
+				Portrait: ImageSize{Width: 640, Height: 960},
+				Scene:    ImageSize{Width: 1024, Height: 576},
+			},
+			CharacterReferenceDenoise: 0.55,
+			ImageFormat:               "png",
+			ImageJPEGQuality:          90,
+			ThumbnailWidth:            320,
+			Upscale:                   1,
+			DungeonMaps:               true,
+			Timeout:                   24 * time.Hour,
+		},
+		Webhooks: Webhooks{
+			Enabled:     true,
+			MaxAttempts: 8,
+			Backoff:     30 * time.Second,
+			Timeout:     10 * time.Second,
+		},
+		Email: Email{
+			SMTPPort: 587,
+			LinkTTL:  30 * 24 * time.Hour,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Paywall: Paywall{
+			Currency:         "btc",
+			MinConfirmations: 1,
+			PaymentTimeout:   24 * time.Hour,
+			Store:            "./paywallet",
+			XMRRPC:           "http://127.0.0.1:18081",
+			Tiers: []PriceTier{
+				{Name: "basic", MaxEpisodes: 3, BTC: 0.00005, XMR: 0.01},
+				{Name: "standard", MaxEpisodes: 5, Images: true, PDF: true, BTC: 0.0001, XMR: 0.02},
+				{Name: "deluxe", MaxEpisodes: MaxEpisodes, Images: true, PDF: true, BTC: 0.0002, XMR: 0.04},
+			},
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, an optional YAML file
+// and the environment, in increasing order of precedence. The result is not
+// validated, so that callers can apply command line flags first.
+//
+// Parameters:
+//   - path: YAML file to read, or "" to use the defaults
+//
+// Returns:
+//   - *Config: the merged configuration
+//   - error: unreadable file, unknown keys or malformed environment variables
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	cfg.Paywall.Currency = strings.ToLower(cfg.Paywall.Currency)
+	cfg.Log.Level = strings.ToLower(cfg.Log.Level)
+	cfg.Log.Format = strings.ToLower(cfg.Log.Format)
+	return cfg, nil
+}
+
+// SiteOrigin returns the URL browsers use to reach the server. Passkeys are
+// bound to it, and an https origin makes session cookies Secure.
+func (c *Config) SiteOrigin() string {
+	s := c.Server
+	if s.Origin != "" {
+		return s.Origin
+	}
+	if s.TLS {
+		return "https://" + s.Domain
+	}
+	if s.Port == "0" || s.Port == "80" {
+		return "http://" + s.Domain
+	}
+	return "http://" + s.Domain + ":" + s.Port
+}
+
+var tierName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Validate reports every problem with the configuration, each prefixed with
+// the YAML path of the offending setting.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Server.Domain == "" {
+		fail("server.domain", "is required")
+	}
+	if c.Server.TLS && c.Server.Mail == "" {
+		fail("server.mail", "is required with server.tls")
+	}
+	if c.Server.Workers < 1 {
+		fail("server.workers", "must be at least 1, got %d", c.Server.Workers)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		fail("server.shutdown_timeout", "must be positive")
+	}
+	for i, id := range c.Server.AdminAccounts {
+		if id < 1 {
+			fail(fmt.Sprintf("server.admin_accounts[%d]", i), "%d is not an account ID", id)
+		}
+	}
+	if c.Server.Origin != "" {
+		if u, err := url.Parse(c.Server.Origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("server.origin", "%q is not an http or https URL", c.Server.Origin)
+		}
+	}
+
+	for field, value := range map[string]string{
+		"storage.jobs_db":     c.Storage.JobsDB,
+		"storage.history_db":  c.Storage.HistoryDB,
+		"storage.accounts_db": c.Storage.AccountsDB,
+		"storage.webhooks_db": c.Storage.WebhooksDB,
+		"storage.outputs":     c.Storage.Outputs,
+		"storage.archive":     c.Storage.Archive,
+		"storage.static":      c.Storage.Static,
+	} {
+		if value == "" {
+			fail(field, "is required")
+		}
+	}
+	if c.Storage.HistoryRetention <= 0 {
+		fail("storage.history_retention", "must be positive")
+	}
+	if c.Storage.CleanupInterval <= 0 {
+		fail("storage.cleanup_interval", "must be positive")
+	}
+
+	errs = append(errs, c.Retention.validate()...)
+
+	if c.Limits.RequestsPerMinute < 1 {
+		fail("limits.requests_per_minute", "must be at least 1")
+	}
+	if c.Limits.GenerationsPerWindow < 1 {
+		fail("limits.generations_per_window", "must be at least 1")
+	}
+	if c.Limits.GenerationWindow <= 0 {
+		fail("limits.generation_window", "must be positive")
+	}
+	if c.Limits.APIKeyDailyAdventures < 0 {
+		fail("limits.api_key_daily_adventures", "cannot be negative")
+	}
+	if c.Limits.APIKeyMonthlyTokens < 0 {
+		fail("limits.api_key_monthly_tokens", "cannot be negative")
+	}
+
+	if c.Generator.ClaudeAPIKey == "" {
+		fail("generator.claude_api_key", "is required (or set CLAUDE_API_KEY)")
+	}
+	if c.Generator.SDWebUIURL != "" {
+		if u, err := url.Parse(c.Generator.SDWebUIURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("generator.sd_webui_url", "%q is not a URL", c.Generator.SDWebUIURL)
+		}
+	}
+	if c.Generator.ComfyUIURL != "" {
+		if u, err := url.Parse(c.Generator.ComfyUIURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("generator.comfyui_url", "%q is not a URL", c.Generator.ComfyUIURL)
+		}
+	}
+	if path := c.Generator.ComfyUIWorkflow; path != "" {
+		if c.Generator.ComfyUIURL == "" {
+			fail("generator.comfyui_workflow", "requires generator.comfyui_url")
+		}
+		if data, err := os.ReadFile(path); err != nil {
+			fail("generator.comfyui_workflow", "%v", err)
+		} else if !json.Valid(data) {
+			fail("generator.comfyui_workflow", "%s is not JSON", path)
+		}
+	}
+	if c.Generator.ImageModel == "" {
+		fail("generator.image_model", "is required")
+	}
+	if c.Generator.ImageSteps < 1 || c.Generator.ImageSteps > 150 {
+		fail("generator.image_steps", "must be between 1 and 150, got %d", c.Generator.ImageSteps)
+	}
+	if c.Generator.ImageCFGScale < 1 || c.Generator.ImageCFGScale > 30 {
+		fail("generator.image_cfg_scale", "must be between 1 and 30, got %g", c.Generator.ImageCFGScale)
+	}
+	errs = append(errs, c.Generator.ImageSizes.validate()...)
+	if c.Generator.CharacterReferences && (c.Generator.CharacterReferenceDenoise <= 0 || c.Generator.CharacterReferenceDenoise > 1) {
+		fail("generator.character_reference_denoise", "must be above 0 and at most 1, got %g", c.Generator.CharacterReferenceDenoise)
+	}
+	if c.Generator.ImageFormat != "png" && c.Generator.ImageFormat != "jpeg" {
+		fail("generator.image_format", "%q must be png or jpeg", c.Generator.ImageFormat)
+	}
+	if c.Generator.ImageJPEGQuality < 1 || c.Generator.ImageJPEGQuality > 100 {
+		fail("generator.image_jpeg_quality", "must be between 1 and 100, got %d", c.Generator.ImageJPEGQuality)
+	}
+	if c.Generator.ThumbnailWidth < 0 {
+		fail("generator.thumbnail_width", "must not be negative")
+	}
+	if c.Generator.Upscale < 1 || c.Generator.Upscale > 4 {
+		fail("generator.upscale", "must be between 1 and 4, got %g", c.Generator.Upscale)
+	}
+	errs = append(errs, c.Generator.validateImageBackends()...)
+	if c.Generator.ImageCircuitThreshold < 1 {
+		fail("generator.image_circuit_threshold", "must be at least 1")
+	}
+	if c.Generator.ImageCircuitCooldown <= 0 {
+		fail("generator.image_circuit_cooldown", "must be positive")
+	}
+	if c.Generator.ImageFailure != ImageFailureSkip && c.Generator.ImageFailure != ImageFailureAbort {
+		fail("generator.image_failure", "%q must be skip or abort", c.Generator.ImageFailure)
+	}
+	if c.Generator.HordeTimeout <= 0 {
+		fail("generator.horde_timeout", "must be positive")
+	}
+	if c.Generator.Timeout <= 0 {
+		fail("generator.timeout", "must be positive")
+	}
+
+	if c.Webhooks.Enabled {
+		if c.Webhooks.MaxAttempts < 1 {
+			fail("webhooks.max_attempts", "must be at least 1")
+		}
+		if c.Webhooks.Backoff <= 0 {
+			fail("webhooks.backoff", "must be positive")
+		}
+		if c.Webhooks.Timeout <= 0 {
+			fail("webhooks.timeout", "must be positive")
+		}
+	}
+
+	if c.Email.Enabled() {
+		if c.Email.SMTPPort < 1 || c.Email.SMTPPort > 65535 {
+			fail("email.smtp_port", "must be between 1 and 65535, got %d", c.Email.SMTPPort)
+		}
+		if _, err := mail.ParseAddress(c.Email.From); err != nil {
+			fail("email.from", "%q is not an email address", c.Email.From)
+		}
+		if len(c.Email.LinkSecret) < 16 {
+			fail("email.link_secret", "must be at least 16 characters")
+		}
+		if c.Email.LinkTTL <= 0 {
+			fail("email.link_ttl", "must be positive")
+		}
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("log.level", "%q must be debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format", "%q must be text or json", c.Log.Format)
+	}
+
+	if c.Paywall.Enabled {
+		errs = append(errs, c.Paywall.validate()...)
+	}
+	return errors.Join(errs...)
+}
+
+func (r Retention) validate() []error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("retention.%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	for field, value := range map[string]time.Duration{
+		"archive_after":      r.ArchiveAfter,
+		"delete_after":       r.DeleteAfter,
+		"paid_archive_after": r.PaidArchiveAfter,
+		"paid_delete_after":  r.PaidDeleteAfter,
+		"tmp_after":          r.TmpAfter,
+	} {
+		if value < 0 {
+			fail(field, "cannot be negative")
+		}
+	}
+	if r.ArchiveAfter > 0 && r.DeleteAfter > 0 && r.DeleteAfter <= r.ArchiveAfter {
+		fail("delete_after", "must be longer than archive_after")
+	}
+	if r.PaidArchiveAfter > 0 && r.PaidDeleteAfter > 0 && r.PaidDeleteAfter <= r.PaidArchiveAfter {
+		fail("paid_delete_after", "must be longer than paid_archive_after")
+	}
+	if r.MaxUserMB < 0 {
+		fail("max_user_mb", "cannot be negative")
+	}
+	if r.MaxTotalMB < 0 {
+		fail("max_total_mb", "cannot be negative")
+	}
+	return errs
+}
+
+func (p Paywall) validate() []error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("paywall.%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	if p.Currency != "btc" && p.Currency != "xmr" {
+		fail("currency", "%q must be btc or xmr", p.Currency)
+	}
+	if p.MinConfirmations < 1 {
+		fail("min_confirmations", "must be at least 1")
+	}
+	if p.PaymentTimeout <= 0 {
+		fail("payment_timeout", "must be positive")
+	}
+	if p.Store == "" {
+		fail("store", "is required")
+	}
+	if p.Currency == "xmr" && len(p.XMRPassword) < 8 {
+		fail("xmr_password", "must be at least 8 characters when the currency is xmr")
+	}
+	if len(p.Tiers) == 0 {
+		fail("tiers", "at least one pricing tier is required")
+	}
+	seen := map[string]bool{}
+	for i, t := range p.Tiers {
+		field := fmt.Sprintf("tiers[%d]", i)
+		if !tierName.MatchString(t.Name) {
+			fail(field+".name", "%q must be lowercase letters, digits, - or _", t.Name)
+		}
+		if seen[t.Name] {
+			fail(field+".name", "%q is listed twice", t.Name)
+		}
+		seen[t.Name] = true
+		if t.MaxEpisodes < 0 || t.MaxEpisodes > MaxEpisodes {
+			fail(field+".max_episodes", "must be between 0 and %d", MaxEpisodes)
+		}
+		switch {
+		case p.Currency == "btc" && t.BTC < minPriceBTC:
+			fail(field+".btc", "must be at least %g", minPriceBTC)
+		case p.Currency == "xmr" && t.XMR < minPriceXMR:
+			fail(field+".xmr", "must be at least %g", minPriceXMR)
+		}
+	}
+	return errs
+}
+
+// validateImageBackends checks the backend chain, including the model and
+// sampler each backend inherits from image_model and image_sampler, as a
+// name spelled for one backend is usually wrong for the others. Problems
+// with an inherited value are reported against the global setting.
+func (g Generator) validateImageBackends() []error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("generator.%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	// The ComfyUI model only matters if the workflow loads it.
+	comfyUIModel := true
+	if g.ComfyUIWorkflow != "" {
+		data, err := os.ReadFile(g.ComfyUIWorkflow)
+		comfyUIModel = err == nil && bytes.Contains(data, []byte("{{model}}"))
+	}
+
+	seen := map[string]bool{}
+	for i, b := range g.ImageBackendOrder() {
+		field := fmt.Sprintf("image_backends[%d]", i)
+		modelField, samplerField := field+".model", field+".sampler"
+		if len(g.ImageBackends) == 0 || g.ImageBackends[i].Model == "" {
+			modelField = "image_model"
+		}
+		if len(g.ImageBackends) == 0 || g.ImageBackends[i].Sampler == "" {
+			samplerField = "image_sampler"
+		}
+		if seen[b.Name] {
+			fail(field+".name", "%q is listed twice", b.Name)
+		}
+		seen[b.Name] = true
+
+		switch b.Name {
+		case BackendSDWebUI:
+			if g.SDWebUIURL == "" {
+				fail(field+".name", "sdwebui requires generator.sd_webui_url")
+			}
+		case BackendComfyUI:
+			if g.ComfyUIURL == "" {
+				fail(field+".name", "comfyui requires generator.comfyui_url")
+			}
+			if comfyUIModel && !comfyUICheckpoint.MatchString(b.Model) {
+				fail(modelField, "%q is not a ComfyUI checkpoint file such as dreamshaperXL.safetensors; set model on the comfyui backend", b.Model)
+			}
+			if b.Sampler != "" && (!comfyUISampler.MatchString(b.Sampler) || strings.HasPrefix(b.Sampler, "k_")) {
+				fail(samplerField, "%q is not a ComfyUI sampler name such as euler or dpmpp_2m; set sampler on the comfyui backend", b.Sampler)
+			}
+		case BackendHorde:
+			if b.Model == "" {
+				fail(modelField, "Stable Horde needs a model")
+			}
+			if b.Sampler != "" && !slices.Contains(hordeSamplers, b.Sampler) {
+				fail(samplerField, "%q is not a Stable Horde sampler (%s); set sampler on the horde backend", b.Sampler, strings.Join(hordeSamplers, ", "))
+			}
+		default:
+			fail(field+".name", "%q must be sdwebui, comfyui or horde", b.Name)
+		}
+	}
+	return errs
+}
+
+// validate checks that every size is one all image backends accept: Stable
+// Horde wants multiples of 64.
+func (s ImageSizes) validate() []error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("generator.image_sizes.%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	for _, c := range []struct {
+		name string
+		size ImageSize
+	}{{"cover", s.Cover}, {"map", s.Map}, {"portrait", s.Portrait}, {"scene", s.Scene}} {
+		for _, d := range []struct {
+			name string
+			px   int
+		}{{"width", c.size.Width}, {"height", c.size.Height}} {
+			if d.px < 64 || d.px > 2048 || d.px%64 != 0 {
+				fail(c.name+"."+d.name, "must be a multiple of 64 between 64 and 2048, got %d", d.px)
+			}
+		}
+	}
+	return errs
+}
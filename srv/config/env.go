@@ -0,0 +1,170 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides a
+// setting. The rest of the name is the setting's YAML path in upper case,
+// for example DNDBOT_SERVER_WORKERS or DNDBOT_PAYWALL_PAYMENT_TIMEOUT.
+const EnvPrefix = "DNDBOT_"
+
+// envAliases maps the environment variables read by earlier releases, and by
+// the paywall package, to the settings they configure. The DNDBOT_ names
+// take precedence when both are set.
+var envAliases = map[string]string{
+	"CLAUDE_API_KEY":  "DNDBOT_GENERATOR_CLAUDE_API_KEY",
+	"HORDE_API_KEY":   "DNDBOT_GENERATOR_HORDE_API_KEY",
+	"SD_WEBUI_URL":    "DNDBOT_GENERATOR_SD_WEBUI_URL",
+	"ADMIN_TOKEN":     "DNDBOT_SERVER_ADMIN_TOKEN",
+	"XMR_WALLET_RPC":  "DNDBOT_PAYWALL_XMR_RPC",
+	"XMR_WALLET_USER": "DNDBOT_PAYWALL_XMR_USER",
+	"XMR_WALLET_PASS": "DNDBOT_PAYWALL_XMR_PASSWORD",
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides every scalar setting that has a non-empty environment
+// variable. Lists such as paywall.tiers can only be set in the file.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	aliases := map[string]string{}
+	for alias, name := range envAliases {
+		aliases[name] = alias
+	}
+	var errs []error
+	walk(reflect.ValueOf(c).Elem(), EnvPrefix, func(name string, field reflect.Value) {
+		value, _ := lookup(name)
+		if value == "" {
+			if value, _ = lookup(aliases[name]); value == "" {
+				return
+			}
+			name = aliases[name]
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// walk calls fn for every scalar field below v with the environment variable
+// name derived from its YAML path.
+func walk(v reflect.Value, prefix string, fn func(name string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			walk(field, name+"_", fn)
+		case reflect.Slice, reflect.Map:
+			continue
+		default:
+			fn(name, field)
+		}
+	}
+}
+
+// setField parses value into field according to the field's type.
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML in the configuration file format.
+// Secrets are masked, so a saved copy needs them filled in again.
+//
+// Parameters:
+//   - w: destination for the YAML document
+//
+// Returns:
+//   - error: any encoding or write error
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	redacted.Paywall.Tiers = append([]PriceTier(nil), c.Paywall.Tiers...)
+	redact(reflect.ValueOf(&redacted).Elem())
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&redacted); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Secrets returns the values of the non-empty secret settings, so they can
+// be masked wherever they might be logged.
+func (c *Config) Secrets() []string {
+	var secrets []string
+	collectSecrets(reflect.ValueOf(c).Elem(), &secrets)
+	return secrets
+}
+
+func collectSecrets(v reflect.Value, secrets *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			collectSecrets(field, secrets)
+		case t.Field(i).Tag.Get("secret") == "true" && field.String() != "":
+			*secrets = append(*secrets, field.String())
+		}
+	}
+}
+
+// redact masks the non-empty fields tagged secret:"true".
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			redact(field)
+		case t.Field(i).Tag.Get("secret") == "true" && field.String() != "":
+			field.SetString("REDACTED")
+		}
+	}
+}
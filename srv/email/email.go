@@ -0,0 +1,313 @@
+// Package email sends notification messages through an SMTP relay. Messages
+// carry an HTML body with a plain-text alternative and may embed images.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/config"
+)
+
+// Message is an email to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	// Text is the plain-text body shown by clients without HTML support.
+	Text string
+	// HTML is the rich body. Inline images are referenced from it as
+	// cid:<ContentID>.
+	HTML   string
+	Inline []Inline
+}
+
+// Inline is an image embedded in a message.
+type Inline struct {
+	ContentID   string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Attempts made to send a queued message, and the delay before the first
+// retry; each further retry waits twice as long.
+const (
+	attempts     = 4
+	retryBackoff = time.Minute
+	dialTimeout  = 30 * time.Second
+)
+
+// Sender delivers messages through the configured relay. Without a relay it
+// drops them.
+type Sender struct {
+	cfg  config.Email
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// New creates a Sender.
+//
+// Parameters:
+//   - cfg: relay settings; if cfg.Enabled() is false, messages are skipped
+//
+// Returns:
+//   - *Sender: sender ready to queue messages
+func New(cfg config.Email) *Sender {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Sender{cfg: cfg, ctx: ctx, stop: stop}
+}
+
+// Queue sends msg in the background, retrying with backoff if the relay
+// fails. Failures are logged.
+func (s *Sender) Queue(msg Message) {
+	if !s.cfg.Enabled() {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		delay := retryBackoff
+		for attempt := 1; ; attempt++ {
+			err := s.Send(msg)
+			if err == nil {
+				slog.Info("email sent", "attempt", attempt)
+				return
+			}
+			if attempt == attempts {
+				slog.Error("sending email, giving up", "attempt", attempt, "error", err)
+				return
+			}
+			slog.Warn("sending email, will retry", "attempt", attempt, "error", err)
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}()
+}
+
+// Close abandons pending retries and waits for messages being sent.
+func (s *Sender) Close() error {
+	s.stop()
+	s.wg.Wait()
+	return nil
+}
+
+// Send delivers msg now. It does nothing when no relay is configured.
+//
+// Parameters:
+//   - msg: the message
+//
+// Returns:
+//   - error: any error building the message or talking to the relay
+func (s *Sender) Send(msg Message) error {
+	if !s.cfg.Enabled() {
+		slog.Debug("email notifications disabled, skipping message")
+		return nil
+	}
+	from, err := mail.ParseAddress(s.cfg.From)
+	if err != nil {
+		return fmt.Errorf("parsing sender: %w", err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("parsing recipient: %w", err)
+	}
+	raw, err := Build(from, to, msg)
+	if err != nil {
+		return fmt.Errorf("building message: %w", err)
+	}
+
+	host := s.cfg.SMTPHost
+	addr := net.JoinHostPort(host, strconv.Itoa(s.cfg.SMTPPort))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	if s.cfg.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.cfg.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return fmt.Errorf("starting TLS: %w", err)
+			}
+		}
+	}
+	if s.cfg.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection to anything but localhost.
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Build encodes msg as a MIME message: a multipart/alternative text and
+// HTML body, wrapped in multipart/related when it has inline images.
+//
+// Parameters:
+//   - from: sender
+//   - to: recipient
+//   - msg: the message
+//
+// Returns:
+//   - []byte: the message with CRLF line endings, ready for SMTP DATA
+//   - error: any encoding error
+func Build(from, to *mail.Address, msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+randomID()+"@"+domainOf(from.Address)+">")
+	header("MIME-Version", "1.0")
+
+	related := len(msg.Inline) > 0
+	outer := multipart.NewWriter(&buf)
+	if related {
+		header("Content-Type", mime.FormatMediaType("multipart/related", map[string]string{"boundary": outer.Boundary(), "type": "multipart/alternative"}))
+	} else {
+		header("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": outer.Boundary()}))
+	}
+	buf.WriteString("\r\n")
+
+	if related {
+		var body bytes.Buffer
+		alternative := multipart.NewWriter(&body)
+		if err := writeAlternative(alternative, msg); err != nil {
+			return nil, err
+		}
+		part, err := outer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternative.Boundary()})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(body.Bytes()); err != nil {
+			return nil, err
+		}
+		for _, img := range msg.Inline {
+			if err := writeInline(outer, img); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := writeAlternative(outer, msg); err != nil {
+		return nil, err
+	}
+	if err := outer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternative writes the text and HTML bodies and closes w.
+func writeAlternative(w *multipart.Writer, msg Message) error {
+	for _, body := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := io.WriteString(qp, body.text); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// writeInline writes an embedded image as a base64 part.
+func writeInline(w *multipart.Writer, img Inline) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {img.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-ID":                {"<" + img.ContentID + ">"},
+		"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": img.Filename})},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(img.Data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
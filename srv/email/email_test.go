@@ -0,0 +1,363 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/config"
+)
+
+// captured is one message received by a capture server.
+type captured struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// captureServer is a minimal SMTP server on the loopback interface that
+// accepts every message and records it.
+type captureServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []captured
+	conns    int
+	wg       sync.WaitGroup
+}
+
+func newCaptureServer(t *testing.T) *captureServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &captureServer{listener: listener}
+	srv.wg.Add(1)
+	go srv.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		srv.wg.Wait()
+	})
+	return srv
+}
+
+// config returns relay settings pointing at the server.
+func (srv *captureServer) config() config.Email {
+	addr := srv.listener.Addr().(*net.TCPAddr)
+	return config.Email{
+		SMTPHost: addr.IP.String(),
+		SMTPPort: addr.Port,
+		From:     "Dungeon Bot <bot@example.com>",
+	}
+}
+
+func (srv *captureServer) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns++
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.session(conn)
+		}()
+	}
+}
+
+// session speaks just enough SMTP for net/smtp: no STARTTLS, no AUTH.
+func (srv *captureServer) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var msg captured
+	tp.PrintfLine("220 localhost ESMTP capture")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			msg = captured{from: addressArg(arg)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, addressArg(arg))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = data
+			srv.mu.Lock()
+			srv.messages = append(srv.messages, msg)
+			srv.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// addressArg extracts the address from "FROM:<a@b>" or "TO:<a@b>".
+func addressArg(arg string) string {
+	start, end := strings.Index(arg, "<"), strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
+
+func (srv *captureServer) received() ([]captured, int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]captured(nil), srv.messages...), srv.conns
+}
+
+// sendOne sends msg through a new capture server and returns what it got.
+func sendOne(t *testing.T, msg Message) (captured, *mail.Message) {
+	t.Helper()
+	srv := newCaptureServer(t)
+	if err := New(srv.config()).Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := srv.received()
+	if len(messages) != 1 {
+		t.Fatalf("server got %d messages, want 1", len(messages))
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(messages[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages[0], parsed
+}
+
+// parts decodes a multipart body into its leaf parts, descending into
+// nested multiparts, keyed by media type.
+func parts(t *testing.T, contentType string, body io.Reader) map[string][]byte {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		t.Fatalf("body is %s, want multipart", mediaType)
+	}
+	found := map[string][]byte{}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return found
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType := part.Header.Get("Content-Type")
+		if strings.HasPrefix(partType, "multipart/") {
+			for k, v := range parts(t, partType, part) {
+				found[k] = v
+			}
+			continue
+		}
+		var decoded io.Reader = part
+		if part.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+			decoded = quotedprintable.NewReader(part)
+		}
+		data, err := io.ReadAll(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(partType)
+		found[mediaType] = data
+	}
+}
+
+func decodeSubject(t *testing.T, msg *mail.Message) string {
+	t.Helper()
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subject
+}
+
+func TestSendReady(t *testing.T) {
+	expires := time.Date(2030, 7, 14, 0, 0, 0, 0, time.UTC)
+	msg, err := Ready("Player One <player@example.org>", Adventure{
+		Title:    "The Sunken Crypt",
+		Download: "https://dndbot.example.com/download/adv-1?expires=1&sig=abc",
+		Expires:  expires,
+		Library:  "https://dndbot.example.com/library",
+		Cover: &Inline{
+			ContentID:   "cover@adv-1",
+			Filename:    "cover.png",
+			ContentType: "image/png",
+			Data:        []byte("\x89PNG fake image data"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, parsed := sendOne(t, msg)
+
+	if envelope.from != "bot@example.com" {
+		t.Errorf("MAIL FROM = %q", envelope.from)
+	}
+	if len(envelope.to) != 1 || envelope.to[0] != "player@example.org" {
+		t.Errorf("RCPT TO = %q, want player@example.org", envelope.to)
+	}
+	if from, err := parsed.Header.AddressList("From"); err != nil || from[0].Address != "bot@example.com" || from[0].Name != "Dungeon Bot" {
+		t.Errorf("From = %q (%v)", parsed.Header.Get("From"), err)
+	}
+	if to, err := parsed.Header.AddressList("To"); err != nil || to[0].Address != "player@example.org" {
+		t.Errorf("To = %q (%v)", parsed.Header.Get("To"), err)
+	}
+	if got := decodeSubject(t, parsed); got != "Your adventure is ready: The Sunken Crypt" {
+		t.Errorf("Subject = %q", got)
+	}
+	if parsed.Header.Get("MIME-Version") != "1.0" || !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("headers = %v", parsed.Header)
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type")); mediaType != "multipart/related" {
+		t.Errorf("Content-Type = %s, want multipart/related with the cover", mediaType)
+	}
+
+	body := parts(t, parsed.Header.Get("Content-Type"), parsed.Body)
+	text, html := string(body["text/plain"]), string(body["text/html"])
+	for _, want := range []string{"The Sunken Crypt", "https://dndbot.example.com/download/adv-1?expires=1&sig=abc", "July 14, 2030", "https://dndbot.example.com/library"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text body lacks %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "free preview") {
+		t.Error("text body mentions a free preview for a paid adventure")
+	}
+	for _, want := range []string{"The Sunken Crypt", `src="cid:cover@adv-1"`, `href="https://dndbot.example.com/download/adv-1?expires=1&amp;sig=abc"`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML body lacks %q:\n%s", want, html)
+		}
+	}
+	if _, ok := body["image/png"]; !ok {
+		t.Errorf("cover not embedded, parts: %v", keys(body))
+	}
+}
+
+func TestSendFailed(t *testing.T) {
+	msg, err := Failed("player@example.org", Adventure{
+		Title: "The Sunken Crypt",
+		Home:  "https://dndbot.example.com/",
+		Error: "generating table of contents: rate limited",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, parsed := sendOne(t, msg)
+
+	if len(envelope.to) != 1 || envelope.to[0] != "player@example.org" {
+		t.Errorf("RCPT TO = %q, want player@example.org", envelope.to)
+	}
+	if to, err := parsed.Header.AddressList("To"); err != nil || to[0].Address != "player@example.org" {
+		t.Errorf("To = %q (%v)", parsed.Header.Get("To"), err)
+	}
+	if got := decodeSubject(t, parsed); got != "Your adventure could not be finished: The Sunken Crypt" {
+		t.Errorf("Subject = %q", got)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type")); mediaType != "multipart/alternative" {
+		t.Errorf("Content-Type = %s, want multipart/alternative", mediaType)
+	}
+
+	body := parts(t, parsed.Header.Get("Content-Type"), parsed.Body)
+	for _, mediaType := range []string{"text/plain", "text/html"} {
+		for _, want := range []string{"The Sunken Crypt", "generating table of contents: rate limited", "https://dndbot.example.com/"} {
+			if !strings.Contains(string(body[mediaType]), want) {
+				t.Errorf("%s body lacks %q:\n%s", mediaType, want, body[mediaType])
+			}
+		}
+	}
+	if len(body) != 2 {
+		t.Errorf("parts = %v, want only the text and HTML bodies", keys(body))
+	}
+}
+
+func TestSendSubjectEncoding(t *testing.T) {
+	msg, err := Ready("player@example.org", Adventure{Title: "Ærendil’s Tomb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, parsed := sendOne(t, msg)
+	if raw := parsed.Header.Get("Subject"); !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Errorf("raw Subject = %q, want it Q-encoded", raw)
+	}
+	if got := decodeSubject(t, parsed); got != "Your adventure is ready: Ærendil’s Tomb" {
+		t.Errorf("Subject = %q", got)
+	}
+}
+
+func TestSkippedWithoutRelay(t *testing.T) {
+	srv := newCaptureServer(t)
+	cfg := srv.config()
+	cfg.SMTPHost = ""
+	if cfg.Enabled() {
+		t.Fatal("relay without a host is enabled")
+	}
+	sender := New(cfg)
+	msg, err := Ready("player@example.org", Adventure{Title: "The Sunken Crypt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(msg); err != nil {
+		t.Errorf("Send = %v, want it skipped", err)
+	}
+	sender.Queue(msg)
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if messages, conns := srv.received(); len(messages) != 0 || conns != 0 {
+		t.Errorf("server got %d messages over %d connections, want none", len(messages), conns)
+	}
+}
+
+func TestSendRejectsBadRecipient(t *testing.T) {
+	srv := newCaptureServer(t)
+	err := New(srv.config()).Send(Message{To: "not an address", Subject: "x"})
+	if err == nil || !strings.Contains(err.Error(), "recipient") {
+		t.Errorf("Send = %v, want a recipient error", err)
+	}
+	if _, conns := srv.received(); conns != 0 {
+		t.Errorf("server got %d connections, want none", conns)
+	}
+}
+
+func keys(m map[string][]byte) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k+"("+strconv.Itoa(len(m[k]))+")")
+	}
+	return out
+}
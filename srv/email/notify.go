@@ -0,0 +1,91 @@
+package email
+
+import (
+	"bytes"
+	_ "embed"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+	"time"
+)
+
+var (
+	//go:embed templates/ready.html
+	readyHTML string
+	//go:embed templates/ready.txt
+	readyText string
+	//go:embed templates/failed.html
+	failedHTML string
+	//go:embed templates/failed.txt
+	failedText string
+)
+
+var (
+	readyHTMLTemplate  = htmltemplate.Must(htmltemplate.New("ready.html").Parse(readyHTML))
+	readyTextTemplate  = texttemplate.Must(texttemplate.New("ready.txt").Parse(readyText))
+	failedHTMLTemplate = htmltemplate.Must(htmltemplate.New("failed.html").Parse(failedHTML))
+	failedTextTemplate = texttemplate.Must(texttemplate.New("failed.txt").Parse(failedText))
+)
+
+// Adventure is the data rendered by the notification templates.
+type Adventure struct {
+	Title string
+	// Cover is embedded in the ready message when set.
+	Cover *Inline
+	// Download is a link to the adventure's archive, valid until Expires.
+	Download string
+	Expires  time.Time
+	// Locked marks a free preview that must be unlocked before download.
+	Locked  bool
+	Library string
+	// Home is the generator form, offered to request a failed adventure
+	// again.
+	Home string
+	// Error is why the generation failed.
+	Error string
+}
+
+// Ready composes the message telling the recipient that their adventure is
+// ready, with its title, cover and download link.
+//
+// Parameters:
+//   - to: recipient
+//   - adventure: the completed adventure
+//
+// Returns:
+//   - Message: the message, ready to queue
+//   - error: any error rendering the templates
+func Ready(to string, adventure Adventure) (Message, error) {
+	msg := Message{To: to, Subject: "Your adventure is ready: " + adventure.Title}
+	if adventure.Cover != nil {
+		msg.Inline = []Inline{*adventure.Cover}
+	}
+	return render(msg, adventure, readyHTMLTemplate, readyTextTemplate)
+}
+
+// Failed composes the message telling the recipient that their adventure
+// could not be generated, with the error.
+//
+// Parameters:
+//   - to: recipient
+//   - adventure: the failed adventure
+//
+// Returns:
+//   - Message: the message, ready to queue
+//   - error: any error rendering the templates
+func Failed(to string, adventure Adventure) (Message, error) {
+	msg := Message{To: to, Subject: "Your adventure could not be finished: " + adventure.Title}
+	return render(msg, adventure, failedHTMLTemplate, failedTextTemplate)
+}
+
+// render fills in the HTML and text bodies of msg.
+func render(msg Message, adventure Adventure, html *htmltemplate.Template, text *texttemplate.Template) (Message, error) {
+	var htmlBody, textBody bytes.Buffer
+	if err := html.Execute(&htmlBody, adventure); err != nil {
+		return Message{}, err
+	}
+	if err := text.Execute(&textBody, adventure); err != nil {
+		return Message{}, err
+	}
+	msg.HTML, msg.Text = htmlBody.String(), textBody.String()
+	return msg, nil
+}
@@ -0,0 +1,78 @@
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	dndbot "github.com/opd-ai/dndbot/src"
+)
+
+// ErrInterrupted reports that a run stopped early because the server is
+// shutting down. Its progress is checkpointed, and running the adventure
+// again resumes from the last finished step.
+var ErrInterrupted = errors.New("generation interrupted by shutdown")
+
+// ErrPreviewReady reports that a preview run stopped once the free preview,
+// the table of contents and covers, was ready. Its progress is checkpointed,
+// and running the adventure again without Preview resumes from there.
+var ErrPreviewReady = errors.New("free preview ready")
+
+// checkpointName is the file in an adventure's output directory that
+// records how far its run got. It is removed once the run completes.
+const checkpointName = "checkpoint.json"
+
+// checkpoint is the state of a run between two pipeline steps.
+type checkpoint struct {
+	// Step is the index of the next step to run.
+	Step      int              `json:"step"`
+	Adventure dndbot.Adventure `json:"adventure"`
+}
+
+// saveCheckpoint records that every step before next has finished. The file
+// is replaced atomically so an interruption cannot leave it half written.
+func saveCheckpoint(outDir string, next int, adventure *dndbot.Adventure) error {
+	data, err := json.Marshal(checkpoint{Step: next, Adventure: *adventure})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(outDir, checkpointName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(outDir, checkpointName))
+}
+
+// loadCheckpoint reads the checkpoint of an interrupted run.
+//
+// Returns:
+//   - *checkpoint: the saved state, or nil if the run starts afresh
+//   - error: if a checkpoint exists but cannot be read
+func loadCheckpoint(outDir string) (*checkpoint, error) {
+	data, err := os.ReadFile(filepath.Join(outDir, checkpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", checkpointName, err)
+	}
+	return &cp, nil
+}
+
+// removeCheckpoint deletes the checkpoint of a finished run.
+func removeCheckpoint(outDir string) error {
+	err := os.Remove(filepath.Join(outDir, checkpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -3,95 +3,347 @@ package generator
 import (
 	"archive/zip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/opd-ai/bookie"
 	dndbot "github.com/opd-ai/dndbot/src"
+	"github.com/opd-ai/dndbot/srv/config"
+	"github.com/opd-ai/dndbot/srv/logging"
+	"github.com/opd-ai/dndbot/srv/metrics"
 	// util "github.com/opd-ai/dndbot/srv/util"
 )
 
-func GenerateAdventure(progress *GenerationProgress, prompt, setting, style string) error {
-	client := dndbot.NewClaudeClient(os.Getenv("CLAUDE_API_KEY"))
-	var imageClient dndbot.ImageClient
-	if os.Getenv("SD_WEBUI_URL") != "" {
-		progress.UpdateOutput("Local SD-Webui detected, image generation will probably be faster")
-		imageClient = &dndbot.LocalClient{}
-	} else {
-		progress.UpdateOutput("Using Stable Horde, speed will be limited by availability")
-		imageClient = dndbot.NewHordeClient()
+// Options selects what a generation run produces.
+type Options struct {
+	// Episodes is the number of episodes in the series; zero lets the
+	// model decide.
+	Episodes int
+	// Images enables cover and illustration artwork.
+	Images bool
+	// PDF enables the compiled PDF book.
+	PDF bool
+	// Preview stops the run once the table of contents and covers are
+	// done; see ErrPreviewReady.
+	Preview bool
+}
+
+// DefaultOptions returns the options of a full adventure: five illustrated
+// episodes and a PDF.
+func DefaultOptions() Options {
+	return Options{Episodes: 5, Images: true, PDF: true}
+}
+
+// Generator runs the generation pipeline with the configured text and image
+// backends, writing each adventure below its outputs directory.
+type Generator struct {
+	cfg         config.Generator
+	outputs     string
+	sessionLogs bool
+	drain       chan struct{}
+	drainOnce   sync.Once
+	// images is the image backend chain, built by imageBackend.
+	imagesM    sync.Mutex
+	images     *dndbot.FailoverClient
+	imagesNote string
+}
+
+// New creates a Generator.
+//
+// Parameters:
+//   - cfg: backend settings
+//   - outputs: directory that receives one subdirectory and zip per adventure
+//   - sessionLogs: also write each run's log to generation.log in its output
+//     directory, so it ships in the zip
+//
+// Returns:
+//   - *Generator: generator ready to run adventures
+func New(cfg config.Generator, outputs string, sessionLogs bool) *Generator {
+	return &Generator{cfg: cfg, outputs: outputs, sessionLogs: sessionLogs, drain: make(chan struct{})}
+}
+
+// Drain makes every run stop before its next step, returning an error
+// wrapping ErrInterrupted. The steps already finished are checkpointed, so
+// the runs can be resumed after a restart.
+func (g *Generator) Drain() {
+	g.drainOnce.Do(func() { close(g.drain) })
+}
+
+// sessionLogName is the per-run log file written when session logs are on.
+const sessionLogName = "generation.log"
+
+// openSessionLog tees the run's logger into the session log file.
+//
+// Returns:
+//   - func(): restores the previous logger and closes the file
+//   - error: if the file cannot be created
+func (g *Generator) openSessionLog(progress *GenerationProgress) (func(), error) {
+	outDir := g.OutputDir(progress.AdventureID)
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(outDir, sessionLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	previous := progress.Logger()
+	handler := logging.Tee(slog.Default().Handler(), logging.FileHandler(file))
+	progress.SetLogger(slog.New(handler).With("session", progress.SessionID, "adventure", progress.AdventureID))
+	return func() {
+		progress.SetLogger(previous)
+		file.Close()
+	}, nil
+}
+
+// OutputDir returns the directory an adventure is written to.
+func (g *Generator) OutputDir(adventureID string) string {
+	return filepath.Join(g.outputs, adventureID)
+}
+
+// zipURL is the download link of an adventure's zip archive.
+func zipURL(adventureID string) string {
+	return "/outputs/" + adventureID + ".zip"
+}
+
+// Check verifies that the configured LLM and image backends respond, without
+// generating anything.
+//
+// Parameters:
+//   - ctx: bounds the checks
+//
+// Returns:
+//   - error: the failures of every backend that did not respond
+func (g *Generator) Check(ctx context.Context) error {
+	var errs []error
+	if err := dndbot.NewClaudeClient(g.cfg.ClaudeAPIKey).Ping(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("llm: %w", err))
+	}
+	image, _, err := g.imageBackend()
+	if err == nil {
+		err = image.Ping(ctx)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("images: %w", err))
 	}
+	return errors.Join(errs...)
+}
 
+// pingableImageClient is an image client that can check its backend.
+type pingableImageClient interface {
+	dndbot.ImageClient
+	dndbot.Pinger
+}
+
+// imageBackend returns the failover chain of the configured image
+// backends, each sent its own model and sampler. It is built on first use
+// and shared by every run, so that all of them skip a backend that keeps
+// failing.
+//
+// Returns:
+//   - pingableImageClient: the chain
+//   - string: a progress note naming the backends
+//   - error: if the ComfyUI workflow template cannot be loaded
+func (g *Generator) imageBackend() (pingableImageClient, string, error) {
+	g.imagesM.Lock()
+	defer g.imagesM.Unlock()
+	if g.images != nil {
+		return g.images, g.imagesNote, nil
+	}
+	chain := &dndbot.FailoverClient{Threshold: g.cfg.ImageCircuitThreshold, Cooldown: g.cfg.ImageCircuitCooldown}
+	backends := g.cfg.ImageBackendOrder()
+	names := make([]string, len(backends))
+	for i, backend := range backends {
+		name := backend.Name
+		names[i] = name
+		overrides := dndbot.BackendOverrides{Model: backend.Model, Sampler: backend.Sampler}
+		switch name {
+		case config.BackendComfyUI:
+			var workflow []byte
+			if g.cfg.ComfyUIWorkflow != "" {
+				var err error
+				if workflow, err = os.ReadFile(g.cfg.ComfyUIWorkflow); err != nil {
+					return nil, "", fmt.Errorf("reading ComfyUI workflow: %w", err)
+				}
+			}
+			client, err := dndbot.NewComfyUIClient(g.cfg.ComfyUIURL, workflow)
+			if err != nil {
+				return nil, "", err
+			}
+			chain.AddWithOverrides(name, client, overrides)
+		case config.BackendSDWebUI:
+			chain.AddWithOverrides(name, &dndbot.LocalClient{URL: g.cfg.SDWebUIURL}, overrides)
+		case config.BackendHorde:
+			client := dndbot.NewHordeClientWithKey(g.cfg.HordeAPIKey)
+			client.Timeout = g.cfg.HordeTimeout
+			client.FallbackModels = g.cfg.HordeFallbackModels
+			// A placeholder would stop the chain from reaching the
+			// backends after Stable Horde.
+			client.Placeholder = g.cfg.HordePlaceholder && i == len(backends)-1
+			chain.AddWithOverrides(name, client, overrides)
+		}
+	}
+	g.images = chain
+	g.imagesNote = "Generating images with " + strings.Join(names, ", then ")
+	return g.images, g.imagesNote, nil
+}
+
+// imageSize converts a configured image size for the dndbot package.
+func imageSize(s config.ImageSize) dndbot.ImageSize {
+	return dndbot.ImageSize{Width: s.Width, Height: s.Height}
+}
+
+// GenerateAdventure runs the full generation pipeline for one session.
+// Steps disabled by opts are skipped. With opts.Preview the run stops with
+// ErrPreviewReady before the first step that is not part of the free
+// preview.
+// Cancelling ctx stops the run at the next opportunity; whatever was produced
+// so far is saved and zipped, and the returned error wraps context.Canceled.
+// If ctx is cancelled with ErrInterrupted as its cause, or Drain is called,
+// the run stops with an error wrapping ErrInterrupted instead, and calling
+// GenerateAdventure again for the same adventure resumes after the last
+// finished step.
+func (g *Generator) GenerateAdventure(ctx context.Context, progress *GenerationProgress, prompt, setting, style string, opts Options) (err error) {
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	ctx, cancel := context.WithTimeout(ctx, g.cfg.Timeout)
 	defer cancel()
 
+	if g.sessionLogs {
+		closeLog, err := g.openSessionLog(progress)
+		if err != nil {
+			progress.Logger().Warn("opening session log", "error", err)
+		} else {
+			defer closeLog()
+		}
+	}
+	logger := progress.Logger()
+
+	baseClient := dndbot.NewClaudeClient(g.cfg.ClaudeAPIKey).WithContext(ctx).WithTokenCounter(&progress.Tokens)
+	client := baseClient
+	var imageClient dndbot.ImageClient
+	if !opts.Images {
+		progress.UpdateOutput("Artwork disabled, skipping image generation")
+	} else {
+		var note string
+		if imageClient, note, err = g.imageBackend(); err != nil {
+			return err
+		}
+		progress.UpdateOutput(note)
+	}
+	images := dndbot.ImageSettings{
+		Model:          g.cfg.ImageModel,
+		Steps:          g.cfg.ImageSteps,
+		NegativePrompt: g.cfg.ImageNegativePrompt,
+		Sampler:        g.cfg.ImageSampler,
+		CFGScale:       g.cfg.ImageCFGScale,
+		Context:        ctx,
+		Sizes: map[dndbot.ImageCategory]dndbot.ImageSize{
+			dndbot.CategoryCover:    imageSize(g.cfg.ImageSizes.Cover),
+			dndbot.CategoryMap:      imageSize(g.cfg.ImageSizes.Map),
+			dndbot.CategoryPortrait: imageSize(g.cfg.ImageSizes.Portrait),
+			dndbot.CategoryScene:    imageSize(g.cfg.ImageSizes.Scene),
+		},
+		SkipFailed: g.cfg.ImageFailure == config.ImageFailureSkip,
+		PostProcess: dndbot.PostProcessing{
+			Format:         g.cfg.ImageFormat,
+			JPEGQuality:    g.cfg.ImageJPEGQuality,
+			ThumbnailWidth: g.cfg.ThumbnailWidth,
+			Upscale:        g.cfg.Upscale,
+			Upscaler:       g.cfg.Upscaler,
+		},
+	}
+	if g.cfg.CharacterReferences {
+		images.ReferenceDenoise = g.cfg.CharacterReferenceDenoise
+	}
+	outDir := g.OutputDir(progress.AdventureID)
+
 	// Initialize adventure structure
 	var adventure dndbot.Adventure
+	defer func() {
+		if errors.Is(err, ErrInterrupted) || errors.Is(err, ErrPreviewReady) {
+			return
+		}
+		if err := removeCheckpoint(outDir); err != nil {
+			logger.Warn("removing checkpoint", "error", err)
+		}
+	}()
 
-	// Define generation steps
+	// Define generation steps. The preview steps make up the free preview.
 	steps := []struct {
 		name     string
+		skip     bool
+		preview  bool
 		function func() error
 	}{
 		{
-			name: "Generating table of contents",
+			name:    "Generating table of contents",
+			preview: true,
 			function: func() error {
-				log.Println("Generating table of Contents")
 				progress.UpdateOutput("🎲 Generating table of contents...")
 				var err error
-				adventure, err = dndbot.GenerateTableOfContents(client, prompt, progress, setting, style)
+				adventure, err = dndbot.GenerateTableOfContentsN(client, prompt, progress, setting, style, opts.Episodes)
 				return err
 			},
 		},
 		{
-			name: "Creating cover pages",
+			name:    "Creating cover pages",
+			skip:    !opts.Images,
+			preview: true,
 			function: func() error {
-				log.Println("Creating cover pages")
+				progress.UpdateOutput("👥 Describing recurring characters...")
+				if err := dndbot.GenerateCharacterRegistry(client, &adventure); err != nil {
+					return err
+				}
 				progress.UpdateOutput("🎨 Creating cover pages...")
 				return dndbot.GenerateCoverPrompts(client, &adventure)
 			},
 		},
 		{
-			name: "Incremental saving files",
+			name:    "Incremental saving files",
+			preview: true,
 			function: func() error {
-				log.Println("Incremental save adventure files")
 				progress.UpdateOutput("💾 Incrementally Saving adventure files...")
-				return dndbot.SaveToFiles(&adventure, filepath.Join("outputs", progress.SessionID))
+				return dndbot.SaveToFiles(&adventure, outDir)
 			},
 		},
 		{
-			name: "",
+			name:    "Generating covers",
+			skip:    !opts.Images,
+			preview: true,
 			function: func() error {
-				log.Println("Generating actual covers")
 				progress.UpdateOutput("Generating actual covers...")
-				return dndbot.GenerateCoversFromPrompts(imageClient, &adventure, filepath.Join("outputs", progress.SessionID, "00_Contents"), progress)
+				return dndbot.GenerateCoversFromPrompts(imageClient, &adventure, filepath.Join(outDir, "00_Contents"), images, progress)
 			},
 		},
 		{
 			name: "Designing dungeons",
 			function: func() error {
-				log.Println("Designing dungeon layouts")
 				progress.UpdateOutput("🗺️ Designing dungeon layouts...")
-				return dndbot.GenerateOnePageDungeons(client, &adventure)
+				if err := dndbot.GenerateOnePageDungeons(client, &adventure); err != nil {
+					return err
+				}
+				if !g.cfg.DungeonMaps {
+					return nil
+				}
+				return dndbot.GenerateDungeonMaps(&adventure, outDir, progress)
 			},
 		},
 		{
 			name: "Incremental saving files",
 			function: func() error {
-				log.Println("Incremental save adventure files")
 				progress.UpdateOutput("💾 Incrementally Saving adventure files...")
-				return dndbot.SaveToFiles(&adventure, filepath.Join("outputs", progress.SessionID))
+				return dndbot.SaveToFiles(&adventure, outDir)
 			},
 		},
 		{
 			name: "Expanding adventure content",
 			function: func() error {
-				log.Println("Expanding adventure content")
 				progress.UpdateOutput("📚 Expanding adventure content...")
 				return dndbot.ExpandAdventures(client, &adventure, progress)
 			},
@@ -99,31 +351,29 @@ func GenerateAdventure(progress *GenerationProgress, prompt, setting, style stri
 		{
 			name: "Incremental saving files",
 			function: func() error {
-				log.Println("Incremental save adventure files")
 				progress.UpdateOutput("💾 Incrementally Saving adventure files...")
-				return dndbot.SaveToFiles(&adventure, filepath.Join("outputs", progress.SessionID))
+				return dndbot.SaveToFiles(&adventure, outDir)
 			},
 		},
 		{
 			name: "Creating illustrations",
+			skip: !opts.Images,
 			function: func() error {
-				log.Println("Creating illustration prompts")
 				progress.UpdateOutput("🖼️ Creating illustration prompts...")
 				return dndbot.GenerateIllustrationPrompts(client, &adventure)
 			},
 		},
 		{
-			name: "",
+			name: "Generating illustration images",
+			skip: !opts.Images,
 			function: func() error {
-				log.Println("Generating actual illustrations")
 				progress.UpdateOutput("Generating actual illustrations...")
-				return dndbot.GenerateIllustrationsFromPrompts(imageClient, &adventure, filepath.Join("outputs", progress.SessionID), progress)
+				return dndbot.GenerateIllustrationsFromPrompts(imageClient, &adventure, outDir, images, progress)
 			},
 		},
 		{
 			name: "Reviewing content",
 			function: func() error {
-				log.Println("Review and adjust content")
 				progress.UpdateOutput("⚖️ Reviewing and adjusting content...")
 				return dndbot.RemoveCopyrightedMaterial(client, &adventure)
 			},
@@ -131,29 +381,26 @@ func GenerateAdventure(progress *GenerationProgress, prompt, setting, style stri
 		{
 			name: "Saving files",
 			function: func() error {
-				log.Println("Save adventure files")
 				progress.UpdateOutput("💾 Saving adventure files...")
-				return dndbot.SaveToFiles(&adventure, filepath.Join("outputs", progress.SessionID))
+				return dndbot.SaveToFiles(&adventure, outDir)
 			},
 		},
 		{
 			name: "Generating PDF Book",
+			skip: !opts.PDF,
 			function: func() error {
-				log.Println("Generating PDF version")
 				progress.UpdateOutput("💾 Generating PDF version...")
-				return bookie.DirectoryToPDFFile(filepath.Join("outputs", progress.SessionID), filepath.Join("outputs", progress.SessionID, "adventure.pdf"))
+				return bookie.DirectoryToPDFFile(outDir, filepath.Join(outDir, "adventure.pdf"))
 			},
 		},
 		{
 			name: "Generating zip",
 			function: func() error {
-				log.Println("Generating zip file")
 				progress.UpdateOutput("💾 Generating zip file...")
-				zipPath, err := ZipOutputDirectory(filepath.Join("outputs", progress.SessionID))
-				if err != nil {
+				if _, err := ZipOutputDirectory(outDir); err != nil {
 					return err
 				}
-				zipHref := fmt.Sprintf("<font size=\"5\">  <a href=\"%s\">Download your archived adventure</a>  </font>", zipPath)
+				zipHref := fmt.Sprintf("<font size=\"5\">  <a href=\"%s\">Download your archived adventure</a>  </font>", zipURL(progress.AdventureID))
 				zipMessage := fmt.Sprintf("💾 Adventure generatation complete! %s", zipHref)
 				progress.UpdateOutput(zipMessage)
 				return nil
@@ -161,19 +408,66 @@ func GenerateAdventure(progress *GenerationProgress, prompt, setting, style stri
 		},
 	}
 
+	start := 0
+	if cp, err := loadCheckpoint(outDir); err != nil {
+		logger.Warn("reading checkpoint, starting over", "error", err)
+	} else if cp != nil && cp.Step < len(steps) {
+		adventure, start = cp.Adventure, cp.Step
+		logger.Info("resuming generation", "step", steps[start].name)
+		progress.UpdateOutput(fmt.Sprintf("⏯️ Resuming your adventure from: %s", steps[start].name))
+	}
+
 	// Execute each step with error handling and progress updates
-	for x, step := range steps {
+	for x, step := range steps[start:] {
+		x += start
+		stepLog := logger.With("step", step.name)
 		select {
+		case <-g.drain:
+			return g.interrupted(progress, step.name)
 		case <-ctx.Done():
-			log.Printf("Generation timeout during step: %d", x)
+			if errors.Is(context.Cause(ctx), ErrInterrupted) {
+				return g.interrupted(progress, step.name)
+			}
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return g.saveCancelled(progress, &adventure, step.name)
+			}
+			stepLog.Error("generation timed out", "step_index", x)
 			return fmt.Errorf("generation timed out during %s", step.name)
 		default:
-			if err := step.function(); err != nil {
+			if opts.Preview && !step.preview {
+				logger.Info("free preview ready", "next_step", step.name)
+				progress.UpdateOutput("🔒 Your free preview is ready. Unlock the full adventure from your library to generate the rest.")
+				return fmt.Errorf("%w before %s", ErrPreviewReady, step.name)
+			}
+			if step.skip {
+				stepLog.Debug("step skipped")
+				continue
+			}
+			client = baseClient.WithLogger(stepLog)
+			progress.SetStep(step.name)
+			stepLog.Info("step started")
+			started := time.Now()
+			err := step.function()
+			elapsed := time.Since(started)
+			metrics.StepDuration.WithLabelValues(step.name).Observe(elapsed.Seconds())
+			if err != nil {
+				if errors.Is(context.Cause(ctx), ErrInterrupted) {
+					return g.interrupted(progress, step.name)
+				}
+				if errors.Is(ctx.Err(), context.Canceled) {
+					return g.saveCancelled(progress, &adventure, step.name)
+				}
+				stepLog.Error("step failed", "duration", elapsed, "error", err)
 				errMsg := fmt.Sprintf("❌ Error during %s: %v", step.name, err)
-				log.Println(errMsg)
 				progress.UpdateOutput(errMsg)
 				return fmt.Errorf("failed during %s: %w", step.name, err)
 			}
+			stepLog.Info("step finished", "duration", elapsed)
+			if x+1 < len(steps) {
+				if err := saveCheckpoint(outDir, x+1, &adventure); err != nil {
+					stepLog.Warn("saving checkpoint", "error", err)
+				}
+			}
 		}
 	}
 
@@ -182,8 +476,46 @@ func GenerateAdventure(progress *GenerationProgress, prompt, setting, style stri
 	return nil
 }
 
+// interrupted reports a run stopped by a shutdown before stepName. The
+// checkpoint of the previous step stays in place for the resumed run.
+func (g *Generator) interrupted(progress *GenerationProgress, stepName string) error {
+	progress.Logger().Info("generation interrupted", "step", stepName)
+	progress.UpdateOutput(fmt.Sprintf("⏸️ The server is restarting. Your adventure will resume from %q once it is back.", stepName))
+	return fmt.Errorf("%w before %s", ErrInterrupted, stepName)
+}
+
+// saveCancelled writes out whatever part of the adventure exists when a run
+// is cancelled and offers it as a zip download.
+func (g *Generator) saveCancelled(progress *GenerationProgress, adventure *dndbot.Adventure, stepName string) error {
+	logger := progress.Logger().With("step", stepName)
+	logger.Info("generation cancelled")
+	cancelled := fmt.Errorf("generation cancelled during %s: %w", stepName, context.Canceled)
+	if adventure.TableOfContents == "" {
+		return cancelled
+	}
+
+	outDir := g.OutputDir(progress.AdventureID)
+	if err := dndbot.SaveToFiles(adventure, outDir); err != nil {
+		logger.Error("saving partial adventure", "error", err)
+		return cancelled
+	}
+	if _, err := ZipOutputDirectory(outDir); err != nil {
+		logger.Error("zipping partial adventure", "error", err)
+		return cancelled
+	}
+	zipHref := fmt.Sprintf("<font size=\"5\">  <a href=\"%s\">Download your partial adventure</a>  </font>", zipURL(progress.AdventureID))
+	progress.UpdateOutput(fmt.Sprintf("🛑 Generation cancelled. %s", zipHref))
+	return cancelled
+}
+
+// ZipOutputDirectory archives outDir into a zip file beside it. Entries are
+// named from the outputs directory down, as in outputs/<adventure>/..., so the
+// archive looks the same wherever the outputs directory lives. Everything in
+// outDir but the checkpoint is included, the play maps' Universal VTT
+// exports among them.
 func ZipOutputDirectory(outDir string) (zipPath string, err error) {
 	zipPath = outDir + ".zip"
+	base := filepath.Dir(filepath.Dir(filepath.Clean(outDir)))
 	file, err := os.Create(zipPath)
 	if err != nil {
 		return
@@ -194,11 +526,15 @@ func ZipOutputDirectory(outDir string) (zipPath string, err error) {
 	defer w.Close()
 
 	walker := func(path string, info os.FileInfo, err error) error {
-		if filepath.IsAbs(path) {
-			return fmt.Errorf("absolute path error: %s", path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return fmt.Errorf("naming zip entry for %s: %w", path, err)
 		}
-		fmt.Printf("Crawling: %#v\n", path)
-		if info.IsDir() {
+		slog.Debug("adding to zip", "path", path)
+		if info.IsDir() || info.Name() == checkpointName {
 			return nil
 		}
 		file, err := os.Open(path)
@@ -207,7 +543,7 @@ func ZipOutputDirectory(outDir string) (zipPath string, err error) {
 		}
 		defer file.Close()
 
-		f, err := w.Create(path)
+		f, err := w.Create(filepath.ToSlash(name))
 		if err != nil {
 			return err
 		}
@@ -1,8 +1,10 @@
 package generator
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,17 +16,44 @@ const (
 	StateGenerating  GenerationState = "generating"
 	StateCompleted   GenerationState = "completed"
 	StateError       GenerationState = "error"
+	StateCancelled   GenerationState = "cancelled"
 )
 
+// GenerationProgress tracks a single generation run. SessionID is the
+// browser session that requested it; AdventureID names the adventure being
+// produced and keys its output directory and message history. Step names
+// the pipeline step running or last run, and Tokens counts the Claude tokens
+// the run has consumed so far.
 type GenerationProgress struct {
-	RWMutex   sync.RWMutex
-	SessionID string
-	State     GenerationState
-	Output    string
-	Error     error
-	Done      chan bool
-	StartTime time.Time
-	IsActive  bool
+	RWMutex     sync.RWMutex
+	SessionID   string
+	AdventureID string
+	State       GenerationState
+	Step        string
+	Output      string
+	Error       error
+	Done        chan bool
+	StartTime   time.Time
+	IsActive    bool
+	Tokens      atomic.Int64
+	cancel      context.CancelFunc
+	logger      atomic.Pointer[slog.Logger]
+}
+
+// Logger returns the logger of the run, which tags every record with the
+// session and adventure IDs.
+func (p *GenerationProgress) Logger() *slog.Logger {
+	if l := p.logger.Load(); l != nil {
+		return l
+	}
+	l := slog.Default().With("session", p.SessionID, "adventure", p.AdventureID)
+	p.logger.CompareAndSwap(nil, l)
+	return p.logger.Load()
+}
+
+// SetLogger replaces the logger of the run.
+func (p *GenerationProgress) SetLogger(l *slog.Logger) {
+	p.logger.Store(l)
 }
 
 // Add these methods to GenerationProgress
@@ -48,8 +77,8 @@ func (p *GenerationProgress) SendUpdate(message string) error {
 
 	// Always emit the message to history first
 	if messageEmitter != nil {
-		if err := messageEmitter(p.SessionID, msg); err != nil {
-			log.Printf("[Session %s] Failed to emit message to history: %v", p.SessionID, err)
+		if err := messageEmitter(p.AdventureID, msg); err != nil {
+			p.Logger().Error("emitting message to history", "error", err)
 		}
 	}
 
@@ -62,7 +91,7 @@ func (p *GenerationProgress) UpdateOutput(output string) {
 	p.Output = output
 	p.Unlock()
 
-	log.Printf("[Session %s] Updating output: %s", p.SessionID, output)
+	p.Logger().Debug("progress", "output", output)
 	p.SendUpdate("Updating adventure content...")
 }
 
@@ -72,7 +101,7 @@ func (p *GenerationProgress) UpdateState(state GenerationState) {
 	p.State = state
 	p.Unlock()
 
-	log.Printf("[Session %s] State transition: %s -> %s", p.SessionID, oldState, state)
+	p.Logger().Info("state transition", "from", oldState, "to", state)
 
 	message := ""
 	switch state {
@@ -82,6 +111,8 @@ func (p *GenerationProgress) UpdateState(state GenerationState) {
 		message = "✨ Adventure generation completed!"
 	case StateError:
 		message = "❌ Error generating adventure"
+	case StateCancelled:
+		message = "🛑 Adventure generation cancelled"
 	}
 
 	if message != "" {
@@ -89,6 +120,30 @@ func (p *GenerationProgress) UpdateState(state GenerationState) {
 	}
 }
 
+// Context derives a cancellable context for the generation run tracked by
+// this progress. Cancel aborts it.
+func (p *GenerationProgress) Context(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	p.Lock()
+	p.cancel = cancel
+	p.Unlock()
+	return ctx
+}
+
+// Cancel aborts the generation run bound with Context. It reports whether
+// there was a run to cancel.
+func (p *GenerationProgress) Cancel() bool {
+	p.Lock()
+	cancel := p.cancel
+	p.Unlock()
+	if cancel == nil {
+		return false
+	}
+	p.Logger().Info("cancellation requested")
+	cancel()
+	return true
+}
+
 func (p *GenerationProgress) SetActive(active bool) {
 	p.Lock()
 	p.IsActive = active
@@ -109,6 +164,20 @@ func (gp *GenerationProgress) GetState() GenerationState {
 	return gp.State
 }
 
+// SetStep records the pipeline step the run has started.
+func (gp *GenerationProgress) SetStep(step string) {
+	gp.Lock()
+	gp.Step = step
+	gp.Unlock()
+}
+
+// CurrentStep returns the pipeline step running or last run.
+func (gp *GenerationProgress) CurrentStep() string {
+	gp.RWMutex.RLock()
+	defer gp.RWMutex.RUnlock()
+	return gp.Step
+}
+
 func (gp *GenerationProgress) IsStillActive() bool {
 	gp.RWMutex.RLock()
 	defer gp.RWMutex.RUnlock()
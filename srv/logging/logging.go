@@ -0,0 +1,186 @@
+// Package logging configures the server's structured log: the level and
+// format of the default slog logger, masking of secrets and user content,
+// and per-generation log files.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/opd-ai/dndbot/srv/config"
+)
+
+// secretKeys name attributes that are always masked.
+var secretKeys = map[string]bool{
+	"api_key":       true,
+	"authorization": true,
+	"password":      true,
+	"token":         true,
+}
+
+// contentKeys name attributes holding user prompts or generated text. They
+// are logged in full only at debug level.
+var contentKeys = map[string]bool{
+	"prompt":   true,
+	"response": true,
+}
+
+// minSecretLen keeps short configured secrets from masking ordinary words.
+const minSecretLen = 8
+
+var (
+	level   = new(slog.LevelVar)
+	masking = strings.NewReplacer()
+)
+
+// Setup installs the default logger described by cfg on stderr. Every
+// string logged afterwards, including through the standard log package,
+// has the given secret values masked.
+//
+// Parameters:
+//   - cfg: validated log settings
+//   - secrets: configured secret values, such as API keys
+func Setup(cfg config.Log, secrets []string) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(cfg.Level)); err == nil {
+		level.Set(lvl)
+	}
+	var pairs []string
+	for _, s := range secrets {
+		if len(s) >= minSecretLen {
+			pairs = append(pairs, s, "REDACTED")
+		}
+	}
+	masking = strings.NewReplacer(pairs...)
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(Redact(h)))
+}
+
+// FileHandler returns a handler writing text records to w at the configured
+// level, with the same masking as the default logger.
+func FileHandler(w io.Writer) slog.Handler {
+	return Redact(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Fatal logs msg at error level and exits with status 1.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Redact wraps next so that secrets are masked and, above debug level, user
+// content is replaced by its length.
+func Redact(next slog.Handler) slog.Handler {
+	return &redactor{next: next}
+}
+
+type redactor struct {
+	next slog.Handler
+}
+
+func (h *redactor) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *redactor) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, masking.Replace(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactor) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactor{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactor) WithGroup(name string) slog.Handler {
+	return &redactor{next: h.next.WithGroup(name)}
+}
+
+// redactAttr masks one attribute according to its key and value.
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch {
+	case secretKeys[a.Key]:
+		if a.Value.String() != "" {
+			a.Value = slog.StringValue("REDACTED")
+		}
+	case contentKeys[a.Key] && level.Level() > slog.LevelDebug:
+		a.Value = slog.StringValue(fmt.Sprintf("[%d chars]", len(a.Value.String())))
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		a = slog.Group(a.Key, redacted...)
+	case a.Value.Kind() == slog.KindString:
+		a.Value = slog.StringValue(masking.Replace(a.Value.String()))
+	case a.Value.Kind() == slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(masking.Replace(err.Error()))
+		}
+	}
+	return a
+}
+
+// Tee returns a handler that passes every record to each of handlers that
+// accepts its level.
+func Tee(handlers ...slog.Handler) slog.Handler {
+	return tee(handlers)
+}
+
+type tee []slog.Handler
+
+func (t tee) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t tee) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t tee) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(tee, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t tee) WithGroup(name string) slog.Handler {
+	out := make(tee, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -2,60 +2,145 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/opd-ai/dndbot/srv/config"
+	"github.com/opd-ai/dndbot/srv/logging"
 	"github.com/opd-ai/dndbot/srv/ui"
 	wileedot "github.com/opd-ai/wileedot"
 )
 
 var (
-	paywall = flag.Bool("paywall", false, "paywall output")
-	tls     = flag.Bool("tls", false, "auto-generate TLS certificate")
-	mail    = flag.String("mail", "example@example.com", "")
-	domain  = flag.String("domain", "localhost", "")
-	port    = flag.String("port", "0", "")
+	configFile  = flag.String("config", "", "YAML configuration file (see config.yaml.example)")
+	printConfig = flag.Bool("print-config", false, "print the effective configuration with secrets masked and exit")
+	paywall     = flag.Bool("paywall", false, "paywall output")
+	tls         = flag.Bool("tls", false, "auto-generate TLS certificate")
+	mail        = flag.String("mail", "example@example.com", "")
+	domain      = flag.String("domain", "localhost", "")
+	port        = flag.String("port", "0", "")
+	workers     = flag.Int("workers", 1, "number of adventures generated concurrently")
+	origin      = flag.String("origin", "", "public URL of the site for passkeys (default derived from -domain, -port and -tls)")
+	logLevel    = flag.String("log-level", "info", "log verbosity: debug, info, warn or error")
 )
 
+// applyFlags overrides cfg with the command line flags that were given
+// explicitly, so that unset flags do not mask the configuration file.
+func applyFlags(cfg *config.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "paywall":
+			cfg.Paywall.Enabled = *paywall
+		case "tls":
+			cfg.Server.TLS = *tls
+		case "mail":
+			cfg.Server.Mail = *mail
+		case "domain":
+			cfg.Server.Domain = *domain
+		case "port":
+			cfg.Server.Port = *port
+		case "workers":
+			cfg.Server.Workers = *workers
+		case "origin":
+			cfg.Server.Origin = *origin
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		}
+	})
+}
+
 func main() {
 	flag.Parse()
-	// Ensure environment variables are set
-	if os.Getenv("CLAUDE_API_KEY") == "" {
-		log.Fatal("CLAUDE_API_KEY environment variable is required")
-	}
 
-	// Create and configure the generator UI
-	generator := ui.NewGeneratorUI(*paywall)
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	applyFlags(cfg)
 
-	cfg := wileedot.Config{
-		Domain:         *domain,
-		AllowedDomains: []string{*domain},
-		CertDir:        "./",
-		Email:          *mail,
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	logging.Setup(cfg.Log, cfg.Secrets())
+
+	// Create and configure the generator UI
+	generator := ui.NewGeneratorUI(cfg)
 
 	var listener net.Listener
 
-	if *tls {
-		var err error
-		listener, err = wileedot.New(cfg)
+	if cfg.Server.TLS {
+		listener, err = wileedot.New(wileedot.Config{
+			Domain:         cfg.Server.Domain,
+			AllowedDomains: []string{cfg.Server.Domain},
+			CertDir:        cfg.Server.CertDir,
+			Email:          cfg.Server.Mail,
+		})
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("obtaining TLS listener", "error", err)
 		}
 	} else {
-		var err error
-		listener, err = net.Listen("tcp", *domain+":"+*port)
+		listener, err = net.Listen("tcp", cfg.Server.Domain+":"+cfg.Server.Port)
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("listening", "error", err)
 		}
 	}
 
 	// Start the server
-	log.Println("Server starting on", listener.Addr())
-	if err := http.Serve(listener, generator); err != nil {
-		log.Fatal(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Handler: generator}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	slog.Info("server starting", "addr", listener.Addr().String())
+
+	select {
+	case err := <-served:
+		logging.Fatal("serving", "error", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process without waiting.
+	stop()
+	shutdown(server, generator, cfg.Server.ShutdownTimeout)
+}
+
+// httpShutdownTimeout bounds how long open requests may take to complete
+// once generations have stopped.
+const httpShutdownTimeout = 10 * time.Second
+
+// shutdown stops the generation workers, giving running steps up to timeout
+// to finish, then stops the HTTP server and flushes the databases. The server
+// keeps answering requests while the workers drain so clients can see why
+// their generation paused.
+func shutdown(server *http.Server, generator *ui.GeneratorUI, timeout time.Duration) {
+	slog.Info("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	generator.Shutdown(ctx)
+
+	ctx, cancel = context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("stopping HTTP server", "error", err)
+	}
+	if err := generator.Close(); err != nil {
+		slog.Error("flushing state", "error", err)
 	}
+	slog.Info("server stopped")
 }
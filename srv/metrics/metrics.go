@@ -0,0 +1,224 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/opd-ai/dndbot/srv/queue"
+)
+
+const namespace = "dndbot"
+
+// registry holds every dndbot metric plus the Go runtime and process
+// collectors. A private registry keeps libraries from adding metrics behind
+// our back.
+var registry = prometheus.NewRegistry()
+
+var (
+	// Generations counts finished generation jobs by result: completed,
+	// failed or cancelled.
+	Generations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "generations_total",
+		Help:      "Generation jobs finished, by result.",
+	}, []string{"result"})
+
+	// StepDuration observes how long each step of the generation pipeline takes.
+	StepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "generation_step_duration_seconds",
+		Help:      "Duration of each generation pipeline step.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2.3h
+	}, []string{"step"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of LLM and image backend calls, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12), // 0.5s to ~17m
+	}, []string{"kind", "backend"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "LLM and image backend calls that failed after all retries.",
+	}, []string{"kind", "backend"})
+
+	backendRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_retries_total",
+		Help:      "Failed LLM and image backend attempts that were retried.",
+	}, []string{"kind", "backend"})
+
+	tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_tokens_total",
+		Help:      "Tokens consumed by LLM calls, by direction.",
+	}, []string{"backend", "direction"})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_queue_wait_seconds",
+		Help:      "Time accepted image requests waited on a shared backend such as Stable Horde.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 10), // 5s to ~43m
+	}, []string{"backend"})
+
+	// PaywallConversions counts payments received, by pricing tier and by
+	// what was paid for: a generation or the unlock of a free preview.
+	PaywallConversions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "paywall_conversions_total",
+		Help:      "Payments received, by pricing tier and purchase.",
+	}, []string{"tier", "purchase"})
+
+	// RetentionAdventures counts adventures archived or deleted by the
+	// retention policy, by action and reason.
+	RetentionAdventures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_adventures_total",
+		Help:      "Adventures archived or deleted by the retention policy, by action and reason.",
+	}, []string{"action", "reason"})
+
+	// RetentionReclaimed counts the bytes freed by the retention policy, by
+	// reason: age, a user or disk quota, or stale scratch files.
+	RetentionReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_reclaimed_bytes_total",
+		Help:      "Disk space freed by the retention policy, by reason.",
+	}, []string{"reason"})
+
+	// RetentionPlanned is the space the last retention run freed or, in a
+	// dry run, would have freed.
+	RetentionPlanned = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retention_planned_reclaim_bytes",
+		Help:      "Disk space the last retention run freed or, in a dry run, would have freed.",
+	})
+
+	// StoredBytes is the space used by stored adventures, including the
+	// archive, as measured by the last retention run.
+	StoredBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "adventure_storage_bytes",
+		Help:      "Disk space used by stored adventures at the last retention run.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Generations,
+		StepDuration,
+		backendDuration,
+		backendErrors,
+		backendRetries,
+		tokens,
+		queueWait,
+		PaywallConversions,
+		RetentionAdventures,
+		RetentionReclaimed,
+		RetentionPlanned,
+		StoredBytes,
+	)
+}
+
+var handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return handler
+}
+
+// WriteFile saves the current value of every metric to path in the
+// Prometheus text format, so the final counts of a stopping server are not
+// lost between scrapes. The file is replaced atomically.
+func WriteFile(path string) error {
+	return prometheus.WriteToTextfile(path, registry)
+}
+
+// backendKinds tells LLM backends from image backends.
+var backendKinds = map[string]string{
+	"claude":  "llm",
+	"horde":   "image",
+	"sdwebui": "image",
+	"comfyui": "image",
+}
+
+func kindOf(backend string) string {
+	if kind, ok := backendKinds[backend]; ok {
+		return kind
+	}
+	return "other"
+}
+
+// Backends records the backend measurements of the dndbot package. Install
+// it with dndbot.SetObserver.
+type Backends struct{}
+
+// BackendCall observes the latency of a call and counts it if it failed.
+func (Backends) BackendCall(backend string, duration time.Duration, err error) {
+	kind := kindOf(backend)
+	backendDuration.WithLabelValues(kind, backend).Observe(duration.Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(kind, backend).Inc()
+	}
+}
+
+// BackendRetry counts a retried attempt.
+func (Backends) BackendRetry(backend string) {
+	backendRetries.WithLabelValues(kindOf(backend), backend).Inc()
+}
+
+// Tokens adds the tokens of one LLM message.
+func (Backends) Tokens(backend string, input, output int64) {
+	tokens.WithLabelValues(backend, "input").Add(float64(input))
+	tokens.WithLabelValues(backend, "output").Add(float64(output))
+}
+
+// QueueWait observes how long an image request waited on a shared backend.
+func (Backends) QueueWait(backend string, wait time.Duration) {
+	queueWait.WithLabelValues(backend).Observe(wait.Seconds())
+}
+
+// queueCollector reports the job queue's gauges, read from the database on
+// every scrape.
+type queueCollector struct {
+	jobs    *queue.Queue
+	active  *prometheus.Desc
+	queued  *prometheus.Desc
+	workers *prometheus.Desc
+}
+
+// WatchQueue exports the number of running and queued generations and the
+// size of the worker pool of jobs.
+func WatchQueue(jobs *queue.Queue) {
+	registry.MustRegister(&queueCollector{
+		jobs:    jobs,
+		active:  prometheus.NewDesc(namespace+"_generations_active", "Generations currently running.", nil, nil),
+		queued:  prometheus.NewDesc(namespace+"_generations_queued", "Generations waiting for a worker.", nil, nil),
+		workers: prometheus.NewDesc(namespace+"_generation_workers", "Size of the generation worker pool.", nil, nil),
+	})
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.queued
+	ch <- c.workers
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.jobs.Stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.active, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(stats.Running))
+	ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(c.workers, prometheus.GaugeValue, float64(stats.Workers))
+}
@@ -0,0 +1,1098 @@
+// Package queue provides a durable, SQLite-backed job queue with a worker pool
+// for adventure generation requests.
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// JobState describes where a job is in its lifecycle.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+	// JobPreview is a free preview that stopped after its preview steps.
+	// Once paid for it is queued again and resumes where it stopped.
+	JobPreview JobState = "preview"
+)
+
+// Priorities used when ordering the queue. Higher values run first.
+const (
+	PriorityNormal = 0
+	PriorityPaid   = 10
+)
+
+// ErrNotQueued is returned by Position when the session has no waiting job.
+var ErrNotQueued = errors.New("no queued job for session")
+
+// ErrSessionBusy is returned when a job would become the second queued or
+// running job of its session. Sessions run one generation at a time.
+var ErrSessionBusy = errors.New("session already has an active job")
+
+// ErrPaymentUsed is returned by Enqueue when the job's payment already paid
+// for another generation or was started to unlock an adventure.
+var ErrPaymentUsed = errors.New("payment already used")
+
+// ErrPreview is wrapped by handlers that stopped an unpaid job once its free
+// preview was ready. The job waits in JobPreview until it is paid for.
+var ErrPreview = errors.New("free preview ready")
+
+// ErrInterrupted is wrapped by handlers that stopped a job early because the
+// pool is shutting down. The job goes back to the queue to be resumed.
+var ErrInterrupted = errors.New("job interrupted by shutdown")
+
+// Job is a single generation request persisted in the queue.
+//
+// SessionID identifies the browser session that owns the job, while
+// AdventureID names the adventure it produces: its output directory and
+// message history. Jobs created before a session could own several
+// adventures use the session ID for both. AccountID is set once the owner
+// logs in and is zero for anonymous jobs. APIKeyID names the API key that
+// submitted the job, if any, Tokens records the Claude tokens it used and
+// Step names the pipeline step it last started, where a failed job stopped.
+// Episodes, Images and PDF are the generation options, Tier names the
+// pricing tier they fall under and Paid reports whether the full adventure
+// may be downloaded. PaymentID names the paywall payment that paid for the
+// generation, if any. Email, if set, is notified once the adventure is ready.
+// Archived reports that the retention policy moved the adventure's files
+// from the outputs directory to the public archive.
+type Job struct {
+	ID          int64
+	SessionID   string
+	AccountID   int64
+	APIKeyID    int64
+	AdventureID string
+	Prompt      string
+	Setting     string
+	Style       string
+	Episodes    int
+	Images      bool
+	PDF         bool
+	Tier        string
+	Paid        bool
+	PaymentID   string
+	Email       string
+	Archived    bool
+	Priority    int
+	State       JobState
+	Error       string
+	Tokens      int64
+	Step        string
+	CreatedAt   time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+}
+
+// Stats summarizes the queue for operators.
+type Stats struct {
+	Queued    int `json:"queued"`
+	Running   int `json:"running"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+	Preview   int `json:"preview"`
+	Workers   int `json:"workers"`
+}
+
+// Handler runs a claimed job. A nil error marks the job completed, an error
+// wrapping ErrInterrupted requeues it, an error wrapping ErrPreview parks it
+// as a preview, an error wrapping context.Canceled marks it cancelled and
+// anything else marks it failed. Handlers report
+// token usage by setting job.Tokens, and how far the job got by setting
+// job.Step; a requeued job keeps both.
+type Handler func(ctx context.Context, job *Job) error
+
+// Queue is a persistent priority queue drained by a fixed pool of workers.
+type Queue struct {
+	db      *sql.DB
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped sync.Once
+	// workers is the pool size set by Start and read by Stats.
+	workers atomic.Int32
+	wg      sync.WaitGroup
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id  TEXT    NOT NULL,
+	prompt      TEXT    NOT NULL,
+	setting     TEXT    NOT NULL DEFAULT '',
+	style       TEXT    NOT NULL DEFAULT '',
+	priority    INTEGER NOT NULL DEFAULT 0,
+	state       TEXT    NOT NULL,
+	error       TEXT    NOT NULL DEFAULT '',
+	created_at  INTEGER NOT NULL,
+	started_at  INTEGER NOT NULL DEFAULT 0,
+	finished_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS jobs_state_priority ON jobs(state, priority DESC, id);
+CREATE INDEX IF NOT EXISTS jobs_session ON jobs(session_id);
+CREATE TABLE IF NOT EXISTS payments (
+	payment_id   TEXT    PRIMARY KEY,
+	adventure_id TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	used_at      INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// migrations bring databases created by earlier releases up to the current
+// schema. Each statement is applied once, when its column is missing.
+var migrations = []struct {
+	column string
+	stmts  []string
+}{
+	{
+		column: "adventure_id",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN adventure_id TEXT NOT NULL DEFAULT ''`,
+			`UPDATE jobs SET adventure_id = session_id WHERE adventure_id = ''`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS jobs_adventure ON jobs(adventure_id)`,
+		},
+	},
+	{
+		column: "account_id",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN account_id INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX IF NOT EXISTS jobs_account ON jobs(account_id)`,
+		},
+	},
+	{
+		column: "api_key_id",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN api_key_id INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		column: "tokens",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN tokens INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		// Earlier jobs were always full, freely downloadable adventures.
+		column: "episodes",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN episodes INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE jobs ADD COLUMN images INTEGER NOT NULL DEFAULT 1`,
+			`ALTER TABLE jobs ADD COLUMN pdf INTEGER NOT NULL DEFAULT 1`,
+			`ALTER TABLE jobs ADD COLUMN tier TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE jobs ADD COLUMN paid INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		column: "email",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		column: "step",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN step TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		column: "archived",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN archived INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		column: "payment_id",
+		stmts: []string{
+			`ALTER TABLE jobs ADD COLUMN payment_id TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// activeIndex allows a session one queued or running job at a time. Jobs
+// that broke the rule before it was enforced, all but the oldest active job
+// of their session, are cancelled first so that it can be created.
+const activeIndex = `
+UPDATE jobs SET state = 'cancelled', error = 'duplicate of an active job of the session'
+WHERE state IN ('queued', 'running') AND id > (
+	SELECT MIN(other.id) FROM jobs AS other
+	WHERE other.session_id = jobs.session_id AND other.state IN ('queued', 'running'));
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_session_active ON jobs(session_id) WHERE state IN ('queued', 'running');
+`
+
+// jobColumns lists the columns scanned by scanJob, in order.
+const jobColumns = `id, session_id, account_id, api_key_id, adventure_id, prompt, setting, style, episodes, images, pdf, tier, paid, payment_id, email, archived, priority, state, error, tokens, step, created_at, started_at, finished_at`
+
+// Open opens (or creates) the queue database at path.
+//
+// Parameters:
+//   - path: filesystem location of the SQLite database
+//
+// Returns:
+//   - *Queue: queue ready to accept jobs; call Start to begin processing
+//   - error: any error opening or migrating the database
+func Open(path string) (*Queue, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening queue database: %w", err)
+	}
+	// SQLite allows a single writer; serializing connections keeps the
+	// claim transaction free of SQLITE_BUSY errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating queue schema: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating queue schema: %w", err)
+	}
+	if _, err := db.Exec(activeIndex); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("indexing active jobs: %w", err)
+	}
+	return &Queue{
+		db:   db,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}, nil
+}
+
+func migrate(db *sql.DB) error {
+	columns := map[string]bool{}
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('jobs')`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+
+	for _, m := range migrations {
+		if columns[m.column] {
+			continue
+		}
+		for _, stmt := range m.stmts {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("adding %s: %w", m.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// scanJob reads a row selected with jobColumns.
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	job := &Job{}
+	var created, started, finished int64
+	err := row.Scan(&job.ID, &job.SessionID, &job.AccountID, &job.APIKeyID, &job.AdventureID, &job.Prompt, &job.Setting, &job.Style,
+		&job.Episodes, &job.Images, &job.PDF, &job.Tier, &job.Paid, &job.PaymentID, &job.Email, &job.Archived, &job.Priority, &job.State, &job.Error, &job.Tokens, &job.Step, &created, &started, &finished)
+	if err != nil {
+		return nil, err
+	}
+	job.CreatedAt = time.Unix(0, created)
+	if started != 0 {
+		job.StartedAt = time.Unix(0, started)
+	}
+	if finished != 0 {
+		job.FinishedAt = time.Unix(0, finished)
+	}
+	return job, nil
+}
+
+// Ping checks that the database is reachable.
+func (q *Queue) Ping(ctx context.Context) error {
+	return q.db.PingContext(ctx)
+}
+
+// Close releases the underlying database.
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Recover returns jobs left running by a previous process to the queue so
+// they are picked up again by the workers.
+//
+// Returns:
+//   - int: number of jobs requeued
+//   - error: any database error
+func (q *Queue) Recover() (int, error) {
+	res, err := q.db.Exec(`UPDATE jobs SET state = ?, started_at = 0 WHERE state = ?`, JobQueued, JobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("recovering jobs: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Enqueue persists a new job and wakes an idle worker. The check that the
+// session has no other active job is made by the database, so concurrent
+// requests of one session cannot both get a job in. A job with a PaymentID
+// uses the payment up in the same transaction, so each payment queues one
+// generation.
+//
+// Parameters:
+//   - job: job to store; ID, State and CreatedAt are filled in, and
+//     AdventureID defaults to SessionID when empty
+//
+// Returns:
+//   - int64: the new job ID
+//   - error: ErrSessionBusy if the session already has a job queued or
+//     running, ErrPaymentUsed if the payment was used before, or any
+//     database error
+func (q *Queue) Enqueue(job *Job) (int64, error) {
+	job.State = JobQueued
+	job.CreatedAt = time.Now()
+	if job.AdventureID == "" {
+		job.AdventureID = job.SessionID
+	}
+	tx, err := q.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO jobs (session_id, account_id, api_key_id, adventure_id, prompt, setting, style, episodes, images, pdf, tier, paid, payment_id, email, priority, state, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.SessionID, job.AccountID, job.APIKeyID, job.AdventureID, job.Prompt, job.Setting, job.Style,
+		job.Episodes, job.Images, job.PDF, job.Tier, job.Paid, job.PaymentID, job.Email, job.Priority, job.State, job.CreatedAt.UnixNano(),
+	)
+	if isSessionBusy(err) {
+		return 0, ErrSessionBusy
+	}
+	if err != nil {
+		return 0, fmt.Errorf("enqueueing job: %w", err)
+	}
+	if job.PaymentID != "" {
+		// Unlock payments are bound before they are paid, so any earlier
+		// row means the payment is spoken for.
+		redeemed, err := tx.Exec(
+			`INSERT INTO payments (payment_id, adventure_id, created_at, used_at) VALUES (?, ?, ?, ?) ON CONFLICT(payment_id) DO NOTHING`,
+			job.PaymentID, job.AdventureID, job.CreatedAt.UnixNano(), job.CreatedAt.UnixNano(),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("redeeming payment: %w", err)
+		}
+		if n, err := redeemed.RowsAffected(); err != nil {
+			return 0, err
+		} else if n == 0 {
+			return 0, ErrPaymentUsed
+		}
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("enqueueing job: %w", err)
+	}
+	job.ID = id
+	q.notify()
+	return job.ID, nil
+}
+
+// Position reports how many jobs will run before the session's oldest
+// queued job. A job that is next in line has position 1.
+//
+// Parameters:
+//   - sessionID: session whose job should be located
+//
+// Returns:
+//   - int: 1-based queue position
+//   - error: ErrNotQueued if the session has no waiting job
+func (q *Queue) Position(sessionID string) (int, error) {
+	var id int64
+	var priority int
+	err := q.db.QueryRow(
+		`SELECT id, priority FROM jobs WHERE session_id = ? AND state = ? ORDER BY id LIMIT 1`,
+		sessionID, JobQueued,
+	).Scan(&id, &priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotQueued
+	}
+	if err != nil {
+		return 0, fmt.Errorf("locating job: %w", err)
+	}
+	var ahead int
+	err = q.db.QueryRow(
+		`SELECT COUNT(*) FROM jobs WHERE state = ? AND (priority > ? OR (priority = ? AND id < ?))`,
+		JobQueued, priority, priority, id,
+	).Scan(&ahead)
+	if err != nil {
+		return 0, fmt.Errorf("counting queue: %w", err)
+	}
+	return ahead + 1, nil
+}
+
+// Latest returns the most recently created job for a session.
+//
+// Parameters:
+//   - sessionID: session to look up
+//
+// Returns:
+//   - *Job: the newest job, or nil if the session never queued one
+//   - error: any database error
+func (q *Queue) Latest(sessionID string) (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE session_id = ? ORDER BY id DESC LIMIT 1`,
+		sessionID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading job: %w", err)
+	}
+	return job, nil
+}
+
+// ActiveJob returns the session's queued or running job. It may be older
+// than the session's latest job, e.g. a paid preview queued to resume or a
+// job retried by an operator.
+//
+// Parameters:
+//   - sessionID: session to look up
+//
+// Returns:
+//   - *Job: the active job, or nil if the session has none
+//   - error: any database error
+func (q *Queue) ActiveJob(sessionID string) (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE session_id = ? AND state IN (?, ?) ORDER BY id LIMIT 1`,
+		sessionID, JobQueued, JobRunning,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading job: %w", err)
+	}
+	return job, nil
+}
+
+// Get returns the job that produces the given adventure.
+//
+// Parameters:
+//   - adventureID: adventure to look up
+//
+// Returns:
+//   - *Job: the job, or nil if there is none
+//   - error: any database error
+func (q *Queue) Get(adventureID string) (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE adventure_id = ?`,
+		adventureID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading job: %w", err)
+	}
+	return job, nil
+}
+
+// List returns every job owned by a session or account, newest first.
+//
+// Parameters:
+//   - sessionID: owning session
+//   - accountID: owning account, or zero for an anonymous session
+//
+// Returns:
+//   - []Job: the jobs
+//   - error: any database error
+func (q *Queue) List(sessionID string, accountID int64) ([]Job, error) {
+	rows, err := q.db.Query(
+		`SELECT `+jobColumns+` FROM jobs WHERE session_id = ? OR (account_id != 0 AND account_id = ?) ORDER BY id DESC`,
+		sessionID, accountID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// Claim assigns a session's anonymous jobs to an account, so they follow the
+// account to other devices.
+//
+// Parameters:
+//   - sessionID: session whose jobs should be claimed
+//   - accountID: account taking ownership
+//
+// Returns:
+//   - int: number of jobs claimed
+//   - error: any database error
+func (q *Queue) Claim(sessionID string, accountID int64) (int, error) {
+	res, err := q.db.Exec(`UPDATE jobs SET account_id = ? WHERE session_id = ? AND account_id = 0`, accountID, sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("claiming jobs: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// BindPayment records that a payment was started to unlock an adventure,
+// so that it can only ever unlock that one. A payment already bound keeps
+// its adventure.
+//
+// Parameters:
+//   - adventureID: adventure being unlocked
+//   - paymentID: ID of the paywall payment created for it
+//
+// Returns:
+//   - error: any database error
+func (q *Queue) BindPayment(adventureID, paymentID string) error {
+	_, err := q.db.Exec(
+		`INSERT INTO payments (payment_id, adventure_id, created_at) VALUES (?, ?, ?) ON CONFLICT(payment_id) DO NOTHING`,
+		paymentID, adventureID, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("binding payment: %w", err)
+	}
+	return nil
+}
+
+// PaymentAdventure returns the adventure a payment was bound to.
+//
+// Parameters:
+//   - paymentID: ID of the paywall payment
+//
+// Returns:
+//   - string: the adventure ID, or "" if the payment is not bound
+//   - error: any database error
+func (q *Queue) PaymentAdventure(paymentID string) (string, error) {
+	var adventureID string
+	err := q.db.QueryRow(`SELECT adventure_id FROM payments WHERE payment_id = ?`, paymentID).Scan(&adventureID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading payment: %w", err)
+	}
+	return adventureID, nil
+}
+
+// RedeemPayment uses up a confirmed payment to mark the full adventure
+// paid for. The payment must have been bound to the adventure with
+// BindPayment and not used before. A job waiting as a preview is queued to
+// resume, once its session has no other job queued or running.
+//
+// Parameters:
+//   - adventureID: adventure to unlock
+//   - paymentID: ID of the confirmed paywall payment
+//
+// Returns:
+//   - bool: false if the payment was made for another adventure, is
+//     unknown or was already used
+//   - error: any database error
+func (q *Queue) RedeemPayment(adventureID, paymentID string) (bool, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE payments SET used_at = ? WHERE payment_id = ? AND adventure_id = ? AND used_at = 0`,
+		time.Now().UnixNano(), paymentID, adventureID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("redeeming payment: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE jobs SET paid = 1 WHERE adventure_id = ?`, adventureID); err != nil {
+		return false, fmt.Errorf("marking job paid: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, q.resumePaid()
+}
+
+// MarkArchived records that the adventure's files were moved to the archive.
+//
+// Parameters:
+//   - adventureID: adventure that was archived
+//
+// Returns:
+//   - error: any database error
+func (q *Queue) MarkArchived(adventureID string) error {
+	if _, err := q.db.Exec(`UPDATE jobs SET archived = 1 WHERE adventure_id = ?`, adventureID); err != nil {
+		return fmt.Errorf("marking job archived: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a finished job. Queued or running jobs must be cancelled first.
+//
+// Parameters:
+//   - adventureID: adventure whose job should be removed
+//
+// Returns:
+//   - error: any database error
+func (q *Queue) Delete(adventureID string) error {
+	_, err := q.db.Exec(
+		`DELETE FROM jobs WHERE adventure_id = ? AND state NOT IN (?, ?)`,
+		adventureID, JobQueued, JobRunning,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting job: %w", err)
+	}
+	return nil
+}
+
+// CancelJob marks one adventure's job as cancelled if it is still waiting to
+// run. Running jobs are unaffected.
+//
+// Parameters:
+//   - adventureID: adventure whose job should be dropped
+//
+// Returns:
+//   - bool: true if the job was waiting and is now cancelled
+//   - error: any database error
+func (q *Queue) CancelJob(adventureID string) (bool, error) {
+	res, err := q.db.Exec(
+		`UPDATE jobs SET state = ?, error = ?, finished_at = ? WHERE adventure_id = ? AND state = ?`,
+		JobCancelled, "cancelled before start", time.Now().UnixNano(), adventureID, JobQueued,
+	)
+	if err != nil {
+		return false, fmt.Errorf("cancelling job: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, q.resumePaid()
+}
+
+// Retry puts a failed or cancelled job back in the queue. It runs again
+// from the start, adding to the tokens it has already used.
+//
+// Parameters:
+//   - adventureID: adventure whose job should run again
+//
+// Returns:
+//   - bool: false if the job does not exist or did not fail or get cancelled
+//   - error: ErrSessionBusy if its session has another job queued or
+//     running, or any database error
+func (q *Queue) Retry(adventureID string) (bool, error) {
+	res, err := q.db.Exec(
+		`UPDATE jobs SET state = ?, error = '', step = '', started_at = 0, finished_at = 0 WHERE adventure_id = ? AND state IN (?, ?)`,
+		JobQueued, adventureID, JobFailed, JobCancelled,
+	)
+	if isSessionBusy(err) {
+		return false, ErrSessionBusy
+	}
+	if err != nil {
+		return false, fmt.Errorf("retrying job: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		q.notify()
+	}
+	return n > 0, nil
+}
+
+// Active returns every running job, then every queued job in the order
+// they will run.
+//
+// Returns:
+//   - []Job: the jobs
+//   - error: any database error
+func (q *Queue) Active() ([]Job, error) {
+	return q.listJobs(
+		`SELECT `+jobColumns+` FROM jobs WHERE state IN (?, ?) ORDER BY state = ? DESC, priority DESC, id`,
+		JobRunning, JobQueued, JobRunning,
+	)
+}
+
+// Recent returns the most recent finished jobs of every session, newest
+// first.
+//
+// Parameters:
+//   - limit: maximum number of jobs returned
+//
+// Returns:
+//   - []Job: the jobs
+//   - error: any database error
+func (q *Queue) Recent(limit int) ([]Job, error) {
+	return q.listJobs(
+		`SELECT `+jobColumns+` FROM jobs WHERE state NOT IN (?, ?) ORDER BY id DESC LIMIT ?`,
+		JobRunning, JobQueued, limit,
+	)
+}
+
+// Finished returns every completed, failed or cancelled job, oldest first.
+//
+// Returns:
+//   - []Job: the jobs
+//   - error: any database error
+func (q *Queue) Finished() ([]Job, error) {
+	return q.listJobs(
+		`SELECT `+jobColumns+` FROM jobs WHERE state NOT IN (?, ?) ORDER BY id`,
+		JobRunning, JobQueued,
+	)
+}
+
+// listJobs runs a query selecting jobColumns.
+func (q *Queue) listJobs(query string, args ...any) ([]Job, error) {
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// DayStats counts the jobs created on one day.
+type DayStats struct {
+	Day       string `json:"day"`
+	Created   int    `json:"created"`
+	Completed int    `json:"completed"`
+	Failed    int    `json:"failed"`
+	Tokens    int64  `json:"tokens"`
+}
+
+// StepFailures counts the jobs that failed during one pipeline step.
+type StepFailures struct {
+	Step   string `json:"step"`
+	Failed int    `json:"failed"`
+}
+
+// Report aggregates finished jobs for operators. Jobs that failed before
+// steps were recorded are counted under an empty step name.
+type Report struct {
+	Days          []DayStats     `json:"days"`
+	FailedSteps   []StepFailures `json:"failed_steps"`
+	Finished      int            `json:"finished"`
+	Failed        int            `json:"failed"`
+	AverageTokens float64        `json:"average_tokens"`
+}
+
+// Report summarizes the jobs created since a given time.
+//
+// Parameters:
+//   - since: start of the period; days are counted in UTC
+//
+// Returns:
+//   - Report: per-day counts, failures by step and averages over the
+//     finished jobs
+//   - error: any database error
+func (q *Queue) Report(since time.Time) (Report, error) {
+	report := Report{Days: []DayStats{}, FailedSteps: []StepFailures{}}
+	rows, err := q.db.Query(
+		`SELECT date(created_at / 1000000000, 'unixepoch') AS day, COUNT(*),
+			SUM(state = ?), SUM(state = ?), SUM(tokens)
+		FROM jobs WHERE created_at >= ? GROUP BY day ORDER BY day DESC`,
+		JobCompleted, JobFailed, since.UnixNano(),
+	)
+	if err != nil {
+		return report, fmt.Errorf("reading daily stats: %w", err)
+	}
+	for rows.Next() {
+		var day DayStats
+		if err := rows.Scan(&day.Day, &day.Created, &day.Completed, &day.Failed, &day.Tokens); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Days = append(report.Days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	rows, err = q.db.Query(
+		`SELECT step, COUNT(*) AS failed FROM jobs WHERE state = ? AND created_at >= ? GROUP BY step ORDER BY failed DESC`,
+		JobFailed, since.UnixNano(),
+	)
+	if err != nil {
+		return report, fmt.Errorf("reading step failures: %w", err)
+	}
+	for rows.Next() {
+		var step StepFailures
+		if err := rows.Scan(&step.Step, &step.Failed); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.FailedSteps = append(report.FailedSteps, step)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	err = q.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(state = ?), 0), COALESCE(AVG(tokens), 0) FROM jobs WHERE state IN (?, ?, ?) AND created_at >= ?`,
+		JobFailed, JobCompleted, JobFailed, JobCancelled, since.UnixNano(),
+	).Scan(&report.Finished, &report.Failed, &report.AverageTokens)
+	if err != nil {
+		return report, fmt.Errorf("reading averages: %w", err)
+	}
+	return report, nil
+}
+
+// Stats returns per-state job counts.
+func (q *Queue) Stats() (Stats, error) {
+	stats := Stats{Workers: int(q.workers.Load())}
+	rows, err := q.db.Query(`SELECT state, COUNT(*) FROM jobs GROUP BY state`)
+	if err != nil {
+		return stats, fmt.Errorf("reading queue stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state JobState
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			return stats, err
+		}
+		switch state {
+		case JobQueued:
+			stats.Queued = count
+		case JobRunning:
+			stats.Running = count
+		case JobCompleted:
+			stats.Completed = count
+		case JobFailed:
+			stats.Failed = count
+		case JobCancelled:
+			stats.Cancelled = count
+		case JobPreview:
+			stats.Preview = count
+		}
+	}
+	return stats, rows.Err()
+}
+
+// Start launches the worker pool. Workers exit once Stop is called or ctx
+// is cancelled, after their current job has returned. A job whose handler
+// returns while ctx is cancelled is requeued, as is one left running by a
+// crash once Recover is called.
+//
+// Parameters:
+//   - ctx: lifetime of the pool
+//   - workers: number of concurrent jobs; values below 1 are treated as 1
+//   - handler: function run for every claimed job
+func (q *Queue) Start(ctx context.Context, workers int, handler Handler) {
+	if workers < 1 {
+		workers = 1
+	}
+	q.workers.Store(int32(workers))
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx, i, handler)
+	}
+	q.notify()
+}
+
+// Wait blocks until every worker started by Start has exited.
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// Stop makes the workers exit once their current job returns, leaving
+// queued jobs for the next start. It does not wait; see Drain.
+func (q *Queue) Stop() {
+	q.stopped.Do(func() { close(q.stop) })
+}
+
+// Drain stops the pool and waits for the running jobs to return.
+//
+// Parameters:
+//   - ctx: bounds the wait
+//
+// Returns:
+//   - error: ctx.Err() if jobs were still running when ctx ended
+func (q *Queue) Drain(ctx context.Context) error {
+	q.Stop()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work(ctx context.Context, n int, handler Handler) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.stop:
+			return
+		default:
+		}
+		job, err := q.claim()
+		if err != nil {
+			slog.Error("claiming job", "worker", n, "error", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.stop:
+				return
+			case <-q.wake:
+				continue
+			case <-time.After(30 * time.Second):
+				continue
+			}
+		}
+		// Another worker may be idle while this one is busy with a job.
+		q.notify()
+
+		slog.Info("running job", "worker", n, "job", job.ID, "session", job.SessionID, "adventure", job.AdventureID)
+		err = handler(ctx, job)
+		if errors.Is(err, ErrInterrupted) || ctx.Err() != nil {
+			// Requeue the job for the next start instead of recording a
+			// spurious failure.
+			if requeueErr := q.requeue(job); requeueErr != nil {
+				slog.Error("requeueing job", "worker", n, "job", job.ID, "error", requeueErr)
+			}
+			continue
+		}
+		if finishErr := q.finish(job, err); finishErr != nil {
+			slog.Error("recording job", "worker", n, "job", job.ID, "error", finishErr)
+		}
+	}
+}
+
+// claim atomically moves the highest priority queued job to running.
+func (q *Queue) claim() (*Job, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job, err := scanJob(tx.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE state = ? ORDER BY priority DESC, id LIMIT 1`,
+		JobQueued,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.StartedAt = time.Now()
+	job.State = JobRunning
+	if _, err := tx.Exec(`UPDATE jobs SET state = ?, started_at = ? WHERE id = ?`, job.State, job.StartedAt.UnixNano(), job.ID); err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// finish records the outcome of a job and the tokens its handler reported
+// in job.Tokens.
+func (q *Queue) finish(job *Job, jobErr error) error {
+	state, msg := JobCompleted, ""
+	switch {
+	case errors.Is(jobErr, ErrPreview):
+		state = JobPreview
+	case errors.Is(jobErr, context.Canceled):
+		state, msg = JobCancelled, jobErr.Error()
+	case jobErr != nil:
+		state, msg = JobFailed, jobErr.Error()
+	}
+	_, err := q.db.Exec(`UPDATE jobs SET state = ?, error = ?, tokens = ?, step = ?, finished_at = ? WHERE id = ?`, state, msg, job.Tokens, job.Step, time.Now().UnixNano(), job.ID)
+	if err != nil {
+		return err
+	}
+	return q.resumePaid()
+}
+
+// resumePaid queues the oldest paid-for preview of every session that has
+// no job queued or running, as a paid job. The others wait their turn.
+func (q *Queue) resumePaid() error {
+	res, err := q.db.Exec(`
+UPDATE jobs SET state = ?, priority = ?, started_at = 0, finished_at = 0
+WHERE id IN (
+	SELECT MIN(p.id) FROM jobs AS p
+	WHERE p.state = ? AND p.paid = 1 AND NOT EXISTS (
+		SELECT 1 FROM jobs AS a WHERE a.session_id = p.session_id AND a.state IN (?, ?))
+	GROUP BY p.session_id)`,
+		JobQueued, PriorityPaid, JobPreview, JobQueued, JobRunning,
+	)
+	if err != nil {
+		return fmt.Errorf("resuming paid previews: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		q.notify()
+	}
+	return nil
+}
+
+// requeue returns an interrupted job to the queue with the tokens it has
+// used so far.
+func (q *Queue) requeue(job *Job) error {
+	_, err := q.db.Exec(`UPDATE jobs SET state = ?, tokens = ?, step = ?, started_at = 0 WHERE id = ?`, JobQueued, job.Tokens, job.Step, job.ID)
+	return err
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// isSessionBusy reports whether err is a violation of the one active job
+// per session index.
+func isSessionBusy(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: jobs.session_id")
+}
@@ -0,0 +1,243 @@
+// Package retention decides which stored adventures to archive or delete so
+// that outputs do not grow forever: adventures expire with age, paid ones
+// later than free ones, and the oldest are evicted when a user or the whole
+// server exceeds its disk quota.
+package retention
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/config"
+)
+
+// Action is what happens to an adventure.
+type Action string
+
+const (
+	// ActionArchive moves the adventure to the public archive.
+	ActionArchive Action = "archive"
+	// ActionDelete removes the adventure's files.
+	ActionDelete Action = "delete"
+)
+
+// Reasons given for a Decision.
+const (
+	ReasonAge       = "age"
+	ReasonUserQuota = "user quota"
+	ReasonDiskQuota = "disk quota"
+)
+
+const megabyte = 1 << 20
+
+// Adventure is a stored adventure considered for retention.
+//
+// Owner groups the adventures counted against one user's quota. Paid
+// adventures follow the longer paid retention periods. Complete reports
+// whether the generation finished, and Locked marks a free preview whose
+// full download has not been paid for. Only complete, unlocked adventures
+// are archived, since the archive is served without the paywall; the others
+// are deleted when they would be archived.
+type Adventure struct {
+	ID       string
+	Owner    string
+	Created  time.Time
+	Paid     bool
+	Complete bool
+	Locked   bool
+	Archived bool
+	Size     int64
+}
+
+// Decision is the action planned for one adventure.
+type Decision struct {
+	AdventureID string `json:"adventure_id"`
+	Owner       string `json:"owner"`
+	Action      Action `json:"action"`
+	Reason      string `json:"reason"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// Plan lists the actions that bring the stored adventures within policy.
+type Plan struct {
+	Decisions []Decision `json:"decisions"`
+	// Stored is the size of every adventure considered, and Reclaimed the
+	// part of it the deletions free. Archiving moves files without freeing
+	// space.
+	Stored    int64 `json:"stored_bytes"`
+	Reclaimed int64 `json:"reclaimed_bytes"`
+	Archived  int64 `json:"archived_bytes"`
+}
+
+// NewPlan decides what to do with each adventure.
+//
+// Adventures past their age limit are archived or deleted first. Then, for
+// each user over cfg.MaxUserMB and finally for the server over
+// cfg.MaxTotalMB, adventures are deleted until the usage fits, unpaid ones
+// before paid ones and the oldest first. Archived adventures count towards
+// the quotas, since they stay on the same disk.
+//
+// Parameters:
+//   - cfg: the retention policy
+//   - adventures: every stored adventure
+//   - now: the time ages are measured at
+//
+// Returns:
+//   - Plan: the decisions, at most one per adventure
+func NewPlan(cfg config.Retention, adventures []Adventure, now time.Time) Plan {
+	var plan Plan
+	var kept []Adventure
+	for _, adv := range adventures {
+		plan.Stored += adv.Size
+		archiveAfter, deleteAfter := cfg.ArchiveAfter, cfg.DeleteAfter
+		if adv.Paid {
+			archiveAfter, deleteAfter = cfg.PaidArchiveAfter, cfg.PaidDeleteAfter
+		}
+		age := now.Sub(adv.Created)
+		switch {
+		case deleteAfter > 0 && age > deleteAfter:
+			plan.add(adv, ActionDelete, ReasonAge)
+		case !adv.Archived && archiveAfter > 0 && age > archiveAfter:
+			if adv.Complete && !adv.Locked {
+				plan.add(adv, ActionArchive, ReasonAge)
+				adv.Archived = true
+				kept = append(kept, adv)
+			} else {
+				plan.add(adv, ActionDelete, ReasonAge)
+			}
+		default:
+			kept = append(kept, adv)
+		}
+	}
+
+	// Evict unpaid adventures first, then the oldest.
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].Paid != kept[j].Paid {
+			return !kept[i].Paid
+		}
+		return kept[i].Created.Before(kept[j].Created)
+	})
+
+	if limit := cfg.MaxUserMB * megabyte; limit > 0 {
+		usage := map[string]int64{}
+		for _, adv := range kept {
+			usage[adv.Owner] += adv.Size
+		}
+		remaining := kept[:0:0]
+		for _, adv := range kept {
+			if usage[adv.Owner] > limit {
+				usage[adv.Owner] -= adv.Size
+				plan.replace(adv, ReasonUserQuota)
+				continue
+			}
+			remaining = append(remaining, adv)
+		}
+		kept = remaining
+	}
+
+	if limit := cfg.MaxTotalMB * megabyte; limit > 0 {
+		var usage int64
+		for _, adv := range kept {
+			usage += adv.Size
+		}
+		for _, adv := range kept {
+			if usage <= limit {
+				break
+			}
+			usage -= adv.Size
+			plan.replace(adv, ReasonDiskQuota)
+		}
+	}
+	return plan
+}
+
+// add records a decision for an adventure.
+func (p *Plan) add(adv Adventure, action Action, reason string) {
+	p.Decisions = append(p.Decisions, Decision{
+		AdventureID: adv.ID,
+		Owner:       adv.Owner,
+		Action:      action,
+		Reason:      reason,
+		Bytes:       adv.Size,
+	})
+	if action == ActionDelete {
+		p.Reclaimed += adv.Size
+	} else {
+		p.Archived += adv.Size
+	}
+}
+
+// replace deletes an adventure over quota, overriding a decision to archive
+// it.
+func (p *Plan) replace(adv Adventure, reason string) {
+	for i, d := range p.Decisions {
+		if d.AdventureID == adv.ID {
+			p.Archived -= d.Bytes
+			p.Decisions = append(p.Decisions[:i], p.Decisions[i+1:]...)
+			break
+		}
+	}
+	p.add(adv, ActionDelete, reason)
+}
+
+// Size returns the total size of the regular files at or below paths.
+// Missing paths count as empty.
+func Size(paths ...string) int64 {
+	var total int64
+	for _, path := range paths {
+		filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					total += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+// PruneDir removes the entries of dir last modified before cutoff.
+//
+// Parameters:
+//   - dir: directory to prune; a missing directory has nothing to prune
+//   - cutoff: entries modified earlier are removed
+//   - dryRun: only count what would be removed
+//
+// Returns:
+//   - int: entries removed
+//   - int64: bytes reclaimed
+//   - error: any error listing or removing entries
+func PruneDir(dir string, cutoff time.Time, dryRun bool) (int, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var removed int
+	var reclaimed int64
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		size := Size(path)
+		if !dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return removed, reclaimed, err
+			}
+		}
+		removed++
+		reclaimed += size
+	}
+	return removed, reclaimed, nil
+}
@@ -0,0 +1,358 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/opd-ai/dndbot/srv/auth"
+	"github.com/opd-ai/dndbot/srv/logging"
+)
+
+//go:embed templates/account.html
+var accountPage string
+
+var accountTemplate = template.Must(template.New("account").Parse(accountPage))
+
+// minPasswordLength is the shortest password accepted at registration.
+const minPasswordLength = 8
+
+// accountView is the data rendered by templates/account.html.
+type accountView struct {
+	CSRF     string
+	Account  *auth.Account
+	Passkeys int
+	APIKeys  []apiKeyView
+	Scopes   []auth.Scope
+	// NewKey is the secret of a just-created API key, shown only once.
+	NewKey string
+	Error  string
+}
+
+// openAccounts opens the account database and configures the WebAuthn
+// relying party for passkey logins. The site origin, e.g. https://dngn.me,
+// supplies the relying party ID, and an https scheme marks session cookies
+// Secure. New API keys get the quotas set in the configured limits.
+func (ui *GeneratorUI) openAccounts() {
+	origin := ui.cfg.SiteOrigin()
+	u, err := url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		logging.Fatal("invalid site origin", "origin", origin)
+	}
+	ui.secureCookies = u.Scheme == "https"
+	ui.webauthn, err = webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "DNDBot",
+		RPOrigins:     []string{origin},
+	})
+	if err != nil {
+		logging.Fatal("configuring passkeys", "error", err)
+	}
+
+	ui.accounts, err = auth.Open(ui.cfg.Storage.AccountsDB)
+	if err != nil {
+		logging.Fatal("opening accounts", "error", err)
+	}
+	ui.accounts.DailyAdventures = ui.cfg.Limits.APIKeyDailyAdventures
+	ui.accounts.MonthlyTokens = ui.cfg.Limits.APIKeyMonthlyTokens
+}
+
+// handleAccount renders the account page: login and registration forms for
+// anonymous visitors, passkey management and logout for logged-in users.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request carrying the caller's session
+func (ui *GeneratorUI) handleAccount(w http.ResponseWriter, r *http.Request) {
+	ui.renderAccount(w, r, "")
+}
+
+// renderAccount renders the account page with an optional error message.
+func (ui *GeneratorUI) renderAccount(w http.ResponseWriter, r *http.Request, message string) {
+	ui.renderAccountPage(w, r, accountView{Error: message})
+}
+
+// renderAccountPage fills in the caller's session and account details and
+// renders the account page. A view with an Error is sent with status 400.
+func (ui *GeneratorUI) renderAccountPage(w http.ResponseWriter, r *http.Request, view accountView) {
+	sess := currentSession(r)
+	view.CSRF = sess.CSRF
+	view.Scopes = auth.Scopes
+	if sess.AccountID != 0 {
+		account, err := ui.accounts.Account(sess.AccountID)
+		if err != nil {
+			slog.Error("reading account", "session", sess.ID, "error", err)
+			http.Error(w, "Account unavailable", http.StatusInternalServerError)
+			return
+		}
+		view.Account = account
+		view.Passkeys = len(account.Credentials)
+		if view.APIKeys, err = ui.accountAPIKeys(account.ID); err != nil {
+			slog.Error("listing API keys", "session", sess.ID, "error", err)
+			http.Error(w, "Account unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if view.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err := accountTemplate.Execute(w, view); err != nil {
+		slog.Error("rendering account", "session", sess.ID, "error", err)
+	}
+}
+
+// handleRegister creates an email/password account and logs the caller in,
+// claiming the adventures of their anonymous session.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTTP response
+//   - r: *http.Request with email and password form fields
+//
+// Error cases:
+//   - Re-renders the account page with 400 for an invalid email, a short
+//     password or an email that is already registered
+func (ui *GeneratorUI) handleRegister(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+	password := r.FormValue("password")
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		ui.renderAccount(w, r, "Please enter a valid email address.")
+		return
+	}
+	if len(password) < minPasswordLength {
+		ui.renderAccount(w, r, "Passwords must be at least 8 characters long.")
+		return
+	}
+
+	account, err := ui.accounts.CreateAccount(email, password)
+	if errors.Is(err, auth.ErrEmailTaken) {
+		ui.renderAccount(w, r, "An account with that email already exists.")
+		return
+	}
+	if err != nil {
+		slog.Error("creating account", "error", err)
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+	if ui.login(w, r, account.ID) {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	}
+}
+
+// handleLogin logs the caller in with an email and password.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTTP response
+//   - r: *http.Request with email and password form fields
+//
+// Error cases:
+//   - Re-renders the account page with 400 if the credentials do not match
+func (ui *GeneratorUI) handleLogin(w http.ResponseWriter, r *http.Request) {
+	account, err := ui.accounts.Authenticate(r.FormValue("email"), r.FormValue("password"))
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		ui.renderAccount(w, r, "Invalid email or password.")
+		return
+	}
+	if err != nil {
+		slog.Error("authenticating", "error", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	if ui.login(w, r, account.ID) {
+		http.Redirect(w, r, "/library", http.StatusSeeOther)
+	}
+}
+
+// handleLogout ends the caller's account session and starts an anonymous
+// one under a new session ID.
+func (ui *GeneratorUI) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sess, err := ui.accounts.Logout(currentSession(r))
+	if err != nil {
+		slog.Error("logging out", "error", err)
+		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		return
+	}
+	ui.setSessionCookie(w, sess)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// login replaces the caller's session with one bound to accountID and hands
+// the session's anonymous adventures to the account. It writes an error
+// response and returns false on failure.
+func (ui *GeneratorUI) login(w http.ResponseWriter, r *http.Request, accountID int64) bool {
+	sess, err := ui.accounts.Login(currentSession(r), accountID)
+	if err != nil {
+		slog.Error("starting session", "error", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return false
+	}
+	ui.setSessionCookie(w, sess)
+	if claimed, err := ui.jobs.Claim(sess.ID, accountID); err != nil {
+		slog.Error("claiming adventures", "session", sess.ID, "error", err)
+	} else if claimed > 0 {
+		slog.Info("claimed adventures", "session", sess.ID, "account", accountID, "count", claimed)
+	}
+	return true
+}
+
+// handlePasskeyRegisterBegin starts registering a passkey for the logged-in
+// account and returns the WebAuthn creation options as JSON.
+//
+// Error cases:
+//   - Returns 401 if the caller is not logged in
+func (ui *GeneratorUI) handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	account, ok := ui.sessionAccount(w, sess)
+	if !ok {
+		return
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(account.Credentials))
+	for _, cred := range account.Credentials {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	creation, ceremony, err := ui.webauthn.BeginRegistration(account,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		slog.Error("beginning passkey registration", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey registration failed", http.StatusInternalServerError)
+		return
+	}
+	ui.beginCeremony(w, sess, ceremony, creation)
+}
+
+// handlePasskeyRegisterFinish verifies the authenticator's response and
+// stores the new passkey.
+//
+// Error cases:
+//   - Returns 401 if the caller is not logged in
+//   - Returns 400 if no registration is in progress or verification fails
+func (ui *GeneratorUI) handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	account, ok := ui.sessionAccount(w, sess)
+	if !ok {
+		return
+	}
+	ceremony, ok := ui.endCeremony(w, sess)
+	if !ok {
+		return
+	}
+
+	cred, err := ui.webauthn.FinishRegistration(account, *ceremony, r)
+	if err != nil {
+		slog.Warn("passkey registration rejected", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey registration failed", http.StatusBadRequest)
+		return
+	}
+	if err := ui.accounts.SaveCredential(account.ID, cred); err != nil {
+		slog.Error("saving passkey", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey registration failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handlePasskeyLoginBegin starts a discoverable passkey login and returns
+// the WebAuthn request options as JSON.
+func (ui *GeneratorUI) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	assertion, ceremony, err := ui.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		slog.Error("beginning passkey login", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey login failed", http.StatusInternalServerError)
+		return
+	}
+	ui.beginCeremony(w, sess, ceremony, assertion)
+}
+
+// handlePasskeyLoginFinish verifies a passkey assertion and logs the caller
+// in to the account that owns it.
+//
+// Error cases:
+//   - Returns 400 if no login is in progress or verification fails
+func (ui *GeneratorUI) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	ceremony, ok := ui.endCeremony(w, sess)
+	if !ok {
+		return
+	}
+
+	var account *auth.Account
+	cred, err := ui.webauthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		account, err = ui.accounts.AccountByHandle(userHandle)
+		return account, err
+	}, *ceremony, r)
+	if err != nil {
+		slog.Warn("passkey login rejected", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey login failed", http.StatusBadRequest)
+		return
+	}
+	// Persist the updated signature counter so cloned authenticators are detected.
+	if err := ui.accounts.SaveCredential(account.ID, cred); err != nil {
+		slog.Error("updating passkey", "session", sess.ID, "error", err)
+	}
+	if ui.login(w, r, account.ID) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	}
+}
+
+// sessionAccount loads the account a session is logged in to, writing a 401
+// response when it is anonymous.
+func (ui *GeneratorUI) sessionAccount(w http.ResponseWriter, sess *auth.Session) (*auth.Account, bool) {
+	if sess.AccountID == 0 {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return nil, false
+	}
+	account, err := ui.accounts.Account(sess.AccountID)
+	if err != nil {
+		slog.Error("reading account", "session", sess.ID, "error", err)
+		http.Error(w, "Account unavailable", http.StatusInternalServerError)
+		return nil, false
+	}
+	return account, true
+}
+
+// beginCeremony stores a WebAuthn challenge on the session and sends the
+// matching options to the browser.
+func (ui *GeneratorUI) beginCeremony(w http.ResponseWriter, sess *auth.Session, ceremony *webauthn.SessionData, options any) {
+	if err := ui.accounts.SetCeremony(sess, ceremony); err != nil {
+		slog.Error("saving ceremony", "session", sess.ID, "error", err)
+		http.Error(w, "Passkey request failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, options)
+}
+
+// endCeremony takes the pending WebAuthn challenge off the session so it can
+// be answered only once, writing a 400 response when there is none.
+func (ui *GeneratorUI) endCeremony(w http.ResponseWriter, sess *auth.Session) (*webauthn.SessionData, bool) {
+	ceremony := sess.Ceremony
+	if ceremony == nil {
+		http.Error(w, "No passkey request in progress", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := ui.accounts.SetCeremony(sess, nil); err != nil {
+		slog.Error("clearing ceremony", "session", sess.ID, "error", err)
+	}
+	return ceremony, true
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encoding response", "error", err)
+	}
+}
@@ -0,0 +1,508 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/auth"
+	"github.com/opd-ai/dndbot/srv/generator"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/paywall"
+)
+
+//go:embed templates/admin.html
+var adminPage string
+
+var adminTemplate = template.Must(template.New("admin").Parse(adminPage))
+
+// Defaults for the dashboard query parameters.
+const (
+	adminDefaultJobs = 100
+	adminMaxJobs     = 1000
+	adminDefaultDays = 30
+	adminMaxDays     = 3650
+)
+
+// adminJob describes one job on the dashboard.
+type adminJob struct {
+	queue.Job
+	Title string
+	// Generation is the live state of a running job, or the state its
+	// queue state corresponds to.
+	Generation generator.GenerationState
+	// Elapsed is how long the job has waited, run or took to finish.
+	Elapsed     time.Duration
+	Cancellable bool
+	Retryable   bool
+	Deletable   bool
+	// CSRF and Back fill in the control forms; see adminBack.
+	CSRF string
+	Back string
+}
+
+// stepRate is the share of finished jobs that failed during one step.
+type stepRate struct {
+	queue.StepFailures
+	Percent string
+}
+
+// adminPayment is a paywall payment record and the tier it was made for.
+type adminPayment struct {
+	paywall.Payment
+	Tier string
+}
+
+// adminView is the data rendered by templates/admin.html.
+type adminView struct {
+	Active      []adminJob
+	Jobs        []adminJob
+	Stats       queue.Stats
+	Report      queue.Report
+	Days        int
+	FailureRate string
+	FailedSteps []stepRate
+	Paywall     bool
+	Payments    []adminPayment
+	// Current and Log are set on the page of a single adventure.
+	Current *adminJob
+	Log     template.HTML
+}
+
+// adminOnly restricts the /admin routes to operators: requests bearing the
+// configured admin token, or browser sessions logged in to one of the
+// configured admin accounts. Browser requests get a session and CSRF
+// protection like the rest of the site; token requests need neither.
+//
+// Parameters:
+//   - next: http.Handler serving the admin routes
+//
+// Returns:
+//   - http.Handler: Middleware that responds 404 when neither a token nor
+//     admin accounts are configured, 401 for a wrong token or a browser
+//     that is not logged in, and 403 for other accounts
+func (ui *GeneratorUI) adminOnly(next http.Handler) http.Handler {
+	browser := ui.sessionMiddleware(csrfMiddleware(ui.adminAccountOnly(next)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ui.cfg.Server.AdminToken
+		if token == "" && len(ui.cfg.Server.AdminAccounts) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			browser.ServeHTTP(w, r)
+			return
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAccountOnly lets through browser sessions logged in to an account
+// listed in server.admin_accounts.
+func (ui *GeneratorUI) adminAccountOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := currentSession(r)
+		if sess.AccountID == 0 {
+			http.Error(w, "Log in with an admin account at /account first", http.StatusUnauthorized)
+			return
+		}
+		account, err := ui.accounts.Account(sess.AccountID)
+		if err != nil {
+			slog.Error("reading account", "session", sess.ID, "error", err)
+			http.Error(w, "Account unavailable", http.StatusInternalServerError)
+			return
+		}
+		if !ui.isAdmin(account) {
+			slog.Warn("admin access denied", "account", account.ID)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether account is listed in server.admin_accounts. The
+// account's email is not trusted, since nobody confirmed it at registration.
+func (ui *GeneratorUI) isAdmin(account *auth.Account) bool {
+	return slices.Contains(ui.cfg.Server.AdminAccounts, account.ID)
+}
+
+// handleAdmin renders the operator dashboard: running and queued jobs,
+// recent finished jobs, aggregate statistics and paywall payments.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request with optional query parameters limit, the number of
+//     finished jobs listed (default 100), and days, the period covered by
+//     the statistics (default 30)
+//
+// Error cases:
+//   - Returns 500 if the jobs cannot be read
+func (ui *GeneratorUI) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	limit := queryInt(r, "limit", adminDefaultJobs, adminMaxJobs)
+	view := adminView{Days: queryInt(r, "days", adminDefaultDays, adminMaxDays), Paywall: ui.cfg.Paywall.Enabled}
+	csrf := adminCSRF(r)
+
+	active, err := ui.jobs.Active()
+	if err != nil {
+		slog.Error("listing active jobs", "error", err)
+		http.Error(w, "Jobs unavailable", http.StatusInternalServerError)
+		return
+	}
+	recent, err := ui.jobs.Recent(limit)
+	if err != nil {
+		slog.Error("listing jobs", "error", err)
+		http.Error(w, "Jobs unavailable", http.StatusInternalServerError)
+		return
+	}
+	for _, job := range active {
+		view.Active = append(view.Active, ui.newAdminJob(job, csrf))
+	}
+	for _, job := range recent {
+		view.Jobs = append(view.Jobs, ui.newAdminJob(job, csrf))
+	}
+
+	if view.Stats, err = ui.jobs.Stats(); err != nil {
+		slog.Error("reading queue stats", "error", err)
+	}
+	if view.Report, err = ui.jobs.Report(time.Now().AddDate(0, 0, -view.Days)); err != nil {
+		slog.Error("reading job report", "error", err)
+	}
+	if finished := view.Report.Finished; finished > 0 {
+		view.FailureRate = percent(view.Report.Failed, finished)
+		for _, step := range view.Report.FailedSteps {
+			view.FailedSteps = append(view.FailedSteps, stepRate{StepFailures: step, Percent: percent(step.Failed, finished)})
+		}
+	}
+	if view.Paywall {
+		if view.Payments, err = ui.paymentRecords(); err != nil {
+			slog.Error("reading payments", "error", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := adminTemplate.Execute(w, view); err != nil {
+		slog.Error("rendering admin dashboard", "error", err)
+	}
+}
+
+// handleAdminReport returns the queue statistics and aggregate report shown
+// on the dashboard as JSON.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON response
+//   - r: *http.Request with the optional days query parameter (default 30)
+//
+// Error cases:
+//   - Returns 500 if the jobs cannot be read
+func (ui *GeneratorUI) handleAdminReport(w http.ResponseWriter, r *http.Request) {
+	days := queryInt(r, "days", adminDefaultDays, adminMaxDays)
+	stats, err := ui.jobs.Stats()
+	if err != nil {
+		slog.Error("reading queue stats", "error", err)
+		http.Error(w, "Queue unavailable", http.StatusInternalServerError)
+		return
+	}
+	report, err := ui.jobs.Report(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		slog.Error("reading job report", "error", err)
+		http.Error(w, "Queue unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Queue  queue.Stats  `json:"queue"`
+		Days   int          `json:"days"`
+		Report queue.Report `json:"report"`
+	}{stats, days, report})
+}
+
+// handleAdminAdventure shows one job with its full message history.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if there is no such job
+func (ui *GeneratorUI) handleAdminAdventure(w http.ResponseWriter, r *http.Request) {
+	job, ok := ui.adminJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	messages, err := ui.history.Messages(job.AdventureID, 0, 0)
+	if err != nil {
+		slog.Error("reading history", "adventure", job.AdventureID, "error", err)
+		http.Error(w, "History unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	current := ui.newAdminJob(*job, adminCSRF(r))
+	current.Back = "adventure"
+	view := adminView{Current: &current, Log: template.HTML(formatMessages(messages))}
+	w.Header().Set("Content-Type", "text/html")
+	if err := adminTemplate.Execute(w, view); err != nil {
+		slog.Error("rendering admin adventure", "adventure", job.AdventureID, "error", err)
+	}
+}
+
+// handleAdminCancel stops a job, whether it is still queued or running.
+// A running job saves what it has produced so far.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the redirect
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if there is no such job
+//   - Returns 409 if the job has already finished
+func (ui *GeneratorUI) handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	job, ok := ui.adminJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	dropped, err := ui.jobs.CancelJob(job.AdventureID)
+	if err != nil {
+		slog.Error("cancelling queued job", "adventure", job.AdventureID, "error", err)
+		http.Error(w, "Could not cancel job", http.StatusInternalServerError)
+		return
+	}
+	if dropped {
+		ui.AddMessage(job.AdventureID, generator.NewMessage("update", string(generator.StateCancelled), "🛑 Adventure generation cancelled by an operator before it started", ""))
+		ui.notifyWebhook(job, queue.JobCancelled, errors.New("cancelled by an operator"), job.Tokens)
+	} else if progress := ui.runningProgress(job.AdventureID); progress == nil || !progress.Cancel() {
+		http.Error(w, "The job is not queued or running", http.StatusConflict)
+		return
+	}
+	slog.Info("job cancelled by operator", "adventure", job.AdventureID)
+	http.Redirect(w, r, adminBack(r), http.StatusSeeOther)
+}
+
+// handleAdminRetry queues a failed or cancelled job again. It starts over
+// from the first step.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the redirect
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if there is no such job
+//   - Returns 409 if the job did not fail or get cancelled, or its session
+//     has another job queued or running
+func (ui *GeneratorUI) handleAdminRetry(w http.ResponseWriter, r *http.Request) {
+	job, ok := ui.adminJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	retried, err := ui.jobs.Retry(job.AdventureID)
+	if errors.Is(err, queue.ErrSessionBusy) {
+		http.Error(w, "The session already has a generation in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("retrying job", "adventure", job.AdventureID, "error", err)
+		http.Error(w, "Could not retry job", http.StatusInternalServerError)
+		return
+	}
+	if !retried {
+		http.Error(w, "Only failed or cancelled jobs can be retried", http.StatusConflict)
+		return
+	}
+	ui.AddMessage(job.AdventureID, generator.NewMessage("update", string(generator.StateInitialized), "🔁 Adventure generation restarted by an operator", ""))
+	slog.Info("job retried by operator", "adventure", job.AdventureID)
+	http.Redirect(w, r, adminBack(r), http.StatusSeeOther)
+}
+
+// handleAdminDelete removes a finished job with its outputs, history and
+// webhook.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the redirect
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if there is no such job
+//   - Returns 409 if the job is still queued or running
+func (ui *GeneratorUI) handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	job, ok := ui.adminJobFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if job.State == queue.JobQueued || job.State == queue.JobRunning {
+		http.Error(w, "Cancel the job before deleting it", http.StatusConflict)
+		return
+	}
+	ui.deleteAdventure(job.AdventureID)
+	slog.Info("adventure deleted by operator", "adventure", job.AdventureID)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminJobFromRequest resolves the adventureID URL parameter to its job,
+// writing an error response when there is none.
+func (ui *GeneratorUI) adminJobFromRequest(w http.ResponseWriter, r *http.Request) (*queue.Job, bool) {
+	adventureID := chi.URLParam(r, "adventureID")
+	job, err := ui.jobs.Get(adventureID)
+	if err != nil {
+		slog.Error("reading job", "adventure", adventureID, "error", err)
+		http.Error(w, "Job unavailable", http.StatusInternalServerError)
+		return nil, false
+	}
+	if job == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return job, true
+}
+
+// adminCSRF returns the session's CSRF token for the control forms, or an
+// empty string for requests authenticated with the admin token.
+func adminCSRF(r *http.Request) string {
+	if sess := currentSession(r); sess != nil {
+		return sess.CSRF
+	}
+	return ""
+}
+
+// adminBack returns where a control form should lead back to: the page of
+// the adventure if it was submitted from there, the dashboard otherwise.
+func adminBack(r *http.Request) string {
+	if r.FormValue("back") == "adventure" {
+		return "/admin/adventures/" + chi.URLParam(r, "adventureID")
+	}
+	return "/admin"
+}
+
+// runningProgress returns the progress of an adventure being generated, or
+// nil if it is not running in this process.
+func (ui *GeneratorUI) runningProgress(adventureID string) *generator.GenerationProgress {
+	ui.generationsM.RLock()
+	defer ui.generationsM.RUnlock()
+	return ui.generations[adventureID]
+}
+
+// jobGenerationStates maps the states of jobs that are not running to the
+// generation state they ended in.
+var jobGenerationStates = map[queue.JobState]generator.GenerationState{
+	queue.JobQueued:    generator.StateInitialized,
+	queue.JobRunning:   generator.StateGenerating,
+	queue.JobCompleted: generator.StateCompleted,
+	queue.JobFailed:    generator.StateError,
+	queue.JobCancelled: generator.StateCancelled,
+	queue.JobPreview:   generator.StateCompleted,
+}
+
+// newAdminJob describes a job for the dashboard, with the live state, step
+// and token count of a running job.
+func (ui *GeneratorUI) newAdminJob(job queue.Job, csrf string) adminJob {
+	entry := adminJob{
+		Job:        job,
+		CSRF:       csrf,
+		Title:      adventureTitle(ui.jobDir(&job)),
+		Generation: jobGenerationStates[job.State],
+	}
+	if entry.Title == "" {
+		entry.Title = summarizePrompt(job.Prompt)
+	}
+	if job.State == queue.JobRunning {
+		if progress := ui.runningProgress(job.AdventureID); progress != nil {
+			entry.Generation = progress.GetState()
+			entry.Step = progress.CurrentStep()
+			entry.Tokens = progress.Tokens.Load()
+		}
+	}
+
+	switch {
+	case !job.FinishedAt.IsZero() && !job.StartedAt.IsZero():
+		entry.Elapsed = job.FinishedAt.Sub(job.StartedAt)
+	case !job.FinishedAt.IsZero():
+		entry.Elapsed = job.FinishedAt.Sub(job.CreatedAt)
+	case !job.StartedAt.IsZero():
+		entry.Elapsed = time.Since(job.StartedAt)
+	default:
+		entry.Elapsed = time.Since(job.CreatedAt)
+	}
+	entry.Elapsed = entry.Elapsed.Round(time.Second)
+
+	entry.Cancellable = job.State == queue.JobQueued || job.State == queue.JobRunning
+	entry.Retryable = job.State == queue.JobFailed || job.State == queue.JobCancelled
+	entry.Deletable = !entry.Cancellable
+	return entry
+}
+
+// paymentRecords reads the payments of every pricing tier, newest first.
+// Each tier's paywall keeps its payments as JSON files in its own
+// directory below paywall.store.
+//
+// Returns:
+//   - []adminPayment: the payments
+//   - error: any error listing a tier's directory; unreadable records are
+//     skipped
+func (ui *GeneratorUI) paymentRecords() ([]adminPayment, error) {
+	var payments []adminPayment
+	for _, tier := range ui.cfg.Paywall.Tiers {
+		dir := filepath.Join(ui.cfg.Paywall.Store, tier.Name)
+		files, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if filepath.Ext(file.Name()) != ".json" {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				slog.Warn("reading payment", "tier", tier.Name, "file", file.Name(), "error", err)
+				continue
+			}
+			payment := adminPayment{Tier: tier.Name}
+			if err := json.Unmarshal(data, &payment.Payment); err != nil {
+				slog.Warn("parsing payment", "tier", tier.Name, "file", file.Name(), "error", err)
+				continue
+			}
+			payments = append(payments, payment)
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.After(payments[j].CreatedAt)
+	})
+	return payments, nil
+}
+
+// queryInt reads a positive integer query parameter, falling back to def
+// when it is missing or malformed and capping it at max.
+func queryInt(r *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	return min(n, max)
+}
+
+// percent formats n out of total as a percentage.
+func percent(n, total int) string {
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
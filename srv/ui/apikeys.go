@@ -0,0 +1,232 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/auth"
+)
+
+type apiKeyKey struct{}
+
+// apiKeyMiddleware authenticates requests bearing an API key in the
+// Authorization header. The key's own session is attached in place of a
+// browser session, so sessionMiddleware and csrfMiddleware leave the request
+// alone, and the key's quota is reported in X-Quota-* headers.
+//
+// Parameters:
+//   - next: http.Handler to run for authenticated or cookie-based requests
+//
+// Returns:
+//   - http.Handler: Middleware that answers 401 for unknown or revoked keys
+func (ui *GeneratorUI) apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(secret, auth.APIKeyPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := ui.accounts.APIKey(secret)
+		if errors.Is(err, auth.ErrNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			slog.Error("reading API key", "error", err)
+			http.Error(w, "API key unavailable", http.StatusInternalServerError)
+			return
+		}
+		if usage, err := ui.accounts.Usage(key); err != nil {
+			slog.Error("reading usage", "key_id", key.ID, "error", err)
+		} else {
+			setQuotaHeaders(w, usage)
+		}
+
+		sess := &auth.Session{ID: key.SessionID, AccountID: key.AccountID}
+		ctx := context.WithValue(r.Context(), apiKeyKey{}, key)
+		ctx = context.WithValue(ctx, sessionKey{}, sess)
+		w.Header().Set("X-Session-Id", sess.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// currentAPIKey returns the API key attached by apiKeyMiddleware, or nil for
+// browser requests.
+func currentAPIKey(r *http.Request) *auth.APIKey {
+	key, _ := r.Context().Value(apiKeyKey{}).(*auth.APIKey)
+	return key
+}
+
+// requireScope restricts a handler to browser sessions and API keys granted scope.
+//
+// Parameters:
+//   - scope: permission the API key must hold
+//   - h: http.HandlerFunc to protect
+//
+// Returns:
+//   - http.HandlerFunc: Handler that responds 403 to keys lacking the scope
+func requireScope(scope auth.Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := currentAPIKey(r); key != nil && !key.Allows(scope) {
+			http.Error(w, "API key lacks the "+string(scope)+" scope", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// browserOnly rejects API keys on routes that manage the account itself,
+// so a leaked key cannot mint further keys or change credentials.
+func browserOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentAPIKey(r) != nil {
+			http.Error(w, "Not available to API keys", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setQuotaHeaders reports an API key's remaining quota. Unlimited quotas are
+// omitted; reset times are Unix seconds.
+func setQuotaHeaders(w http.ResponseWriter, usage auth.Usage) {
+	h := w.Header()
+	if remaining := usage.AdventuresRemaining(); remaining >= 0 {
+		h.Set("X-Quota-Adventures-Limit", strconv.Itoa(usage.AdventuresLimit))
+		h.Set("X-Quota-Adventures-Remaining", strconv.Itoa(remaining))
+		h.Set("X-Quota-Adventures-Reset", strconv.FormatInt(usage.AdventuresReset.Unix(), 10))
+	}
+	if remaining := usage.TokensRemaining(); remaining >= 0 {
+		h.Set("X-Quota-Tokens-Limit", strconv.FormatInt(usage.TokensLimit, 10))
+		h.Set("X-Quota-Tokens-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-Quota-Tokens-Reset", strconv.FormatInt(usage.TokensReset.Unix(), 10))
+	}
+}
+
+// handleUsage reports the calling API key's scopes and quota usage as JSON.
+//
+// Error cases:
+//   - Returns 401 when called without an API key
+func (ui *GeneratorUI) handleUsage(w http.ResponseWriter, r *http.Request) {
+	key := currentAPIKey(r)
+	if key == nil {
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return
+	}
+	usage, err := ui.accounts.Usage(key)
+	if err != nil {
+		slog.Error("reading usage", "key_id", key.ID, "error", err)
+		http.Error(w, "Usage unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"name":   key.Name,
+		"prefix": key.Prefix,
+		"scopes": key.Scopes,
+		"usage":  usage,
+	})
+}
+
+// apiKeyView describes one of the account's keys on the account page.
+type apiKeyView struct {
+	auth.APIKey
+	Usage auth.Usage
+}
+
+// accountAPIKeys loads the account's keys with their current usage.
+func (ui *GeneratorUI) accountAPIKeys(accountID int64) ([]apiKeyView, error) {
+	keys, err := ui.accounts.APIKeys(accountID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]apiKeyView, 0, len(keys))
+	for i := range keys {
+		usage, err := ui.accounts.Usage(&keys[i])
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, apiKeyView{APIKey: keys[i], Usage: usage})
+	}
+	return views, nil
+}
+
+// handleCreateAPIKey issues an API key for the logged-in account and shows
+// its secret once on the account page.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request with the name and scope form fields
+//
+// Error cases:
+//   - Returns 401 if the caller is not logged in
+//   - Re-renders the account page with 400 if no scope was selected
+func (ui *GeneratorUI) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	if _, ok := ui.sessionAccount(w, sess); !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	var scopes []auth.Scope
+	for _, scope := range auth.Scopes {
+		for _, requested := range r.Form["scope"] {
+			if auth.Scope(requested) == scope {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		ui.renderAccount(w, r, "Select at least one scope for the API key.")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = "API key"
+	}
+
+	_, secret, err := ui.accounts.CreateAPIKey(sess.AccountID, name, scopes)
+	if err != nil {
+		slog.Error("creating API key", "session", sess.ID, "error", err)
+		http.Error(w, "Could not create API key", http.StatusInternalServerError)
+		return
+	}
+	ui.renderAccountPage(w, r, accountView{NewKey: secret})
+}
+
+// handleRevokeAPIKey disables one of the logged-in account's API keys.
+//
+// Error cases:
+//   - Returns 401 if the caller is not logged in
+//   - Returns 404 if the key does not belong to the account
+func (ui *GeneratorUI) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	if _, ok := ui.sessionAccount(w, sess); !ok {
+		return
+	}
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = ui.accounts.RevokeAPIKey(sess.AccountID, keyID)
+	if errors.Is(err, auth.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("revoking API key", "session", sess.ID, "error", err)
+		http.Error(w, "Could not revoke API key", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
@@ -1 +1,112 @@
 package ui
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/queue"
+)
+
+// archiveDir returns the directory an archived adventure is kept in.
+func (ui *GeneratorUI) archiveDir(adventureID string) string {
+	return filepath.Join(ui.cfg.Storage.Archive, adventureID)
+}
+
+// adventureDir returns the directory holding an adventure's files and the
+// URL path they are served under: the outputs directory, or the archive once
+// the retention policy has moved them there.
+func (ui *GeneratorUI) adventureDir(adventureID string, archived bool) (dir, urlPath string) {
+	if archived {
+		return ui.archiveDir(adventureID), path.Join("/archive", adventureID)
+	}
+	return ui.gen.OutputDir(adventureID), path.Join("/outputs", adventureID)
+}
+
+// archiveAdventure moves a finished adventure's output directory and zip
+// archive to the archive directory and records the move on its job.
+//
+// Parameters:
+//   - adventureID: adventure to archive
+//
+// Returns:
+//   - error: any error moving the files or updating the job; files already
+//     moved stay in the archive
+func (ui *GeneratorUI) archiveAdventure(adventureID string) error {
+	if err := os.MkdirAll(ui.cfg.Storage.Archive, 0o755); err != nil {
+		return fmt.Errorf("creating archive: %w", err)
+	}
+	outDir, archDir := ui.gen.OutputDir(adventureID), ui.archiveDir(adventureID)
+	for _, suffix := range []string{"", ".zip"} {
+		err := os.Rename(outDir+suffix, archDir+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("moving %s: %w", outDir+suffix, err)
+		}
+	}
+	return ui.jobs.MarkArchived(adventureID)
+}
+
+// adventureFilesOnly answers 404 for requests that do not name an
+// adventure, such as the root of the outputs or archive directory, so that
+// the IDs of other users' adventures are never listed.
+//
+// Parameters:
+//   - next: http.Handler serving an adventure directory tree
+//
+// Returns:
+//   - http.Handler: Middleware that only passes on requests for the files
+//     of a single adventure
+func adventureFilesOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+chi.URLParam(r, "*")), "/")
+		adventureID, _, _ := strings.Cut(name, "/")
+		if !isValidSession(strings.TrimSuffix(adventureID, ".zip")) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectArchived sends requests for the files of archived adventures to
+// their new location under /archive, so links handed out before the move,
+// such as those in emails, webhooks and message histories, keep working.
+//
+// Parameters:
+//   - next: http.Handler serving the outputs directory
+//
+// Returns:
+//   - http.Handler: Middleware that redirects permanently when the
+//     requested adventure has been archived
+func (ui *GeneratorUI) redirectArchived(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+chi.URLParam(r, "*")), "/")
+		adventureID, _, _ := strings.Cut(name, "/")
+		adventureID = strings.TrimSuffix(adventureID, ".zip")
+		if _, err := os.Stat(ui.gen.OutputDir(adventureID)); err == nil || !isValidSession(adventureID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		job, err := ui.jobs.Get(adventureID)
+		if err != nil {
+			slog.Error("reading job", "adventure", adventureID, "error", err)
+		}
+		if job == nil || !job.Archived {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "/archive/"+name, http.StatusMovedPermanently)
+	})
+}
+
+// jobDir returns the directory holding a job's files; see adventureDir.
+func (ui *GeneratorUI) jobDir(job *queue.Job) string {
+	dir, _ := ui.adventureDir(job.AdventureID, job.Archived)
+	return dir
+}
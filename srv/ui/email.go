@@ -0,0 +1,169 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/email"
+	"github.com/opd-ai/dndbot/srv/queue"
+)
+
+// openMailer sets up email notifications when an SMTP relay is configured.
+func (ui *GeneratorUI) openMailer() {
+	if ui.cfg.Email.Enabled() {
+		ui.mailer = email.New(ui.cfg.Email)
+	}
+}
+
+// sendReadyEmail tells the address given with a completed job that its
+// adventure is ready, with its title, cover and a signed download link.
+//
+// Parameters:
+//   - job: the completed job; nothing is sent if it has no email address
+func (ui *GeneratorUI) sendReadyEmail(job *queue.Job) {
+	if job.Email == "" || ui.mailer == nil {
+		return
+	}
+	outDir := ui.gen.OutputDir(job.AdventureID)
+	expires := time.Now().Add(ui.cfg.Email.LinkTTL)
+	adventure := email.Adventure{
+		Title:    emailTitle(job, outDir),
+		Download: ui.downloadLink(job.AdventureID, expires),
+		Expires:  expires,
+		Locked:   ui.cfg.Paywall.Enabled && !job.Paid,
+		Library:  ui.cfg.SiteOrigin() + "/library",
+	}
+	if cover := coverFile(outDir); cover != "" {
+		data, err := os.ReadFile(cover)
+		if err != nil {
+			slog.Warn("reading cover for email", "adventure", job.AdventureID, "error", err)
+		} else {
+			adventure.Cover = &email.Inline{
+				ContentID:   "cover@" + job.AdventureID,
+				Filename:    filepath.Base(cover),
+				ContentType: mime.TypeByExtension(filepath.Ext(cover)),
+				Data:        data,
+			}
+		}
+	}
+
+	msg, err := email.Ready(job.Email, adventure)
+	if err != nil {
+		slog.Error("rendering email", "adventure", job.AdventureID, "error", err)
+		return
+	}
+	slog.Info("queueing ready email", "adventure", job.AdventureID)
+	ui.mailer.Queue(msg)
+}
+
+// sendFailedEmail tells the address given with a failed job that its
+// adventure could not be generated.
+//
+// Parameters:
+//   - job: the failed job; nothing is sent if it has no email address
+//   - jobErr: why it failed
+func (ui *GeneratorUI) sendFailedEmail(job *queue.Job, jobErr error) {
+	if job.Email == "" || ui.mailer == nil {
+		return
+	}
+	msg, err := email.Failed(job.Email, email.Adventure{
+		Title: emailTitle(job, ui.gen.OutputDir(job.AdventureID)),
+		Home:  ui.cfg.SiteOrigin() + "/",
+		Error: jobErr.Error(),
+	})
+	if err != nil {
+		slog.Error("rendering email", "adventure", job.AdventureID, "error", err)
+		return
+	}
+	slog.Info("queueing failure email", "adventure", job.AdventureID)
+	ui.mailer.Queue(msg)
+}
+
+// emailTitle names a job's adventure in emails: its generated title, or a
+// summary of its prompt before one exists.
+func emailTitle(job *queue.Job, outDir string) string {
+	if title := adventureTitle(outDir); title != "" {
+		return title
+	}
+	return summarizePrompt(job.Prompt)
+}
+
+// downloadSignature authenticates a download link for adventureID that
+// expires at the given Unix time.
+func (ui *GeneratorUI) downloadSignature(adventureID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(ui.cfg.Email.LinkSecret))
+	mac.Write([]byte(adventureID + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// downloadLink returns an absolute link to an adventure's zip archive that
+// works without a session until expires.
+func (ui *GeneratorUI) downloadLink(adventureID string, expires time.Time) string {
+	unix := expires.Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(unix, 10)},
+		"sig":     {ui.downloadSignature(adventureID, unix)},
+	}
+	return ui.cfg.SiteOrigin() + "/download/" + url.PathEscape(adventureID) + "?" + query.Encode()
+}
+
+// handleDownload serves an adventure's zip archive to the bearer of a signed
+// download link, as sent by email.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the archive
+//   - r: *http.Request with the adventureID URL parameter and the expires
+//     and sig query parameters
+//
+// Free previews redirect to the unlock page instead of serving the archive.
+//
+// Error cases:
+//   - Returns 404 if email links are disabled, the signature is wrong, or
+//     the adventure or its archive does not exist
+//   - Returns 410 if the link has expired
+func (ui *GeneratorUI) handleDownload(w http.ResponseWriter, r *http.Request) {
+	adventureID := chi.URLParam(r, "adventureID")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if !ui.cfg.Email.Enabled() || err != nil ||
+		!hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(ui.downloadSignature(adventureID, expires))) {
+		http.NotFound(w, r)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "This download link has expired; your adventure is still in your library", http.StatusGone)
+		return
+	}
+
+	job, err := ui.jobs.Get(adventureID)
+	if err != nil {
+		slog.Error("reading job", "adventure", adventureID, "error", err)
+		http.Error(w, "Download unavailable", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if ui.cfg.Paywall.Enabled && !job.Paid {
+		http.Redirect(w, r, "/library/"+adventureID+"/unlock", http.StatusSeeOther)
+		return
+	}
+	zip := ui.jobDir(job) + ".zip"
+	if _, err := os.Stat(zip); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": adventureID + ".zip"}))
+	http.ServeFile(w, r, zip)
+}
@@ -2,39 +2,66 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/opd-ai/dndbot/srv/auth"
+	"github.com/opd-ai/dndbot/srv/config"
 	"github.com/opd-ai/dndbot/srv/generator"
+	"github.com/opd-ai/dndbot/srv/metrics"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/dndbot/srv/webhook"
 )
 
 // handleGenerate processes adventure generation requests and manages the generation session.
 //
 // Parameters:
 //   - w: http.ResponseWriter to write the HTTP response
-//   - r: *http.Request containing the form data with the 'prompt' field
+//   - r: *http.Request containing the form data with the 'prompt' field and
+//     optional 'episodes', 'images' and 'pdf' options
 //
 // The function:
-//   - Creates a new session with UUID
-//   - Sets up session cookies and headers
-//   - Initializes generation progress tracking
-//   - Starts asynchronous adventure generation
+//   - Uses the caller's server-side session, attributing the job to their
+//     account when logged in
+//   - Counts the request against the caller's API key quota, if any
+//   - Records the pricing tier of the requested options and whether the
+//     adventure is paid for or a free preview
+//   - Registers the optional 'webhook_url' and 'webhook_secret' to be
+//     notified when the generation completes, fails or is cancelled
+//   - Records the optional 'email' address, sent a download link once the
+//     adventure is ready
+//   - Persists the request in the job queue as a new adventure, paid requests first
+//   - Reports the queue position and X-Adventure-Id header to the client
 //
 // Error cases:
 //   - Returns 400 if form parsing fails
 //   - Returns 400 if prompt is empty
+//   - Returns 400 if the options are malformed or no pricing tier covers them
+//   - Returns 400 if a webhook is given while webhooks are disabled, or its
+//     URL is not an absolute http or https URL
+//   - Returns 400 if an email address is given while email is disabled, or
+//     it is malformed
+//   - Returns 402 if the paywall payment already paid for another
+//     generation or was started to unlock an adventure
+//   - Returns 429 if the caller's API key quota is spent
+//   - Returns 500 if the job cannot be queued
 //   - Logs and handles generation errors via progress updates
 //
 // Related types:
 //   - generator.GenerationProgress
 //   - MessageHistory
 //
-// The generation process runs asynchronously and updates are tracked through
-// the GenerationProgress object. Client can monitor progress via WebSocket
-// connection using the provided session ID.
+// The generation process runs on the queue worker pool (see runJob) and
+// updates are tracked through the GenerationProgress object. Client can
+// monitor progress by polling the message history with the adventure ID.
+// A session may own any number of adventures but runs one at a time.
 func (ui *GeneratorUI) handleGenerate(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
@@ -49,61 +76,292 @@ func (ui *GeneratorUI) handleGenerate(w http.ResponseWriter, r *http.Request) {
 
 	setting := r.FormValue("setting")
 	style := r.FormValue("style")
+	opts, err := parseOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hookURL, hookSecret := r.FormValue("webhook_url"), r.FormValue("webhook_secret")
+	if hookURL != "" {
+		if !ui.cfg.Webhooks.Enabled {
+			http.Error(w, "Webhooks are disabled on this server", http.StatusBadRequest)
+			return
+		}
+		if !webhook.ValidURL(hookURL) {
+			http.Error(w, webhook.ErrInvalidURL.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var notify string
+	if raw := strings.TrimSpace(r.FormValue("email")); raw != "" {
+		if !ui.cfg.Email.Enabled() {
+			http.Error(w, "Email notifications are disabled on this server", http.StatusBadRequest)
+			return
+		}
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		notify = addr.Address
+	}
+	var tier config.PriceTier
+	if ui.cfg.Paywall.Enabled {
+		var ok bool
+		if tier, ok = tierFor(ui.cfg.Paywall, opts); !ok {
+			http.Error(w, "No pricing tier offers these options", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Create new session
-	sessionID := r.Header.Get("X-Session-Id")
-	if sessionID == "" {
-		log.Println("no client side sessionID:", sessionID)
-		// Try cookie as fallback
-		if cookie, err := r.Cookie("session_id"); err == nil && cookie.Value != "null" {
-			log.Println("cookie found", cookie.Value, err)
-			sessionID = cookie.Value
-		} else {
-			sessionID = uuid.New().String()
-			http.SetCookie(w, &http.Cookie{
-				Name:     "session_id",
-				Value:    sessionID,
-				Path:     "/",
-				MaxAge:   864000,
-				HttpOnly: false,
-				SameSite: http.SameSiteLaxMode,
-			})
-		}
-	}
-	w.Header().Set("X-Session-Id", sessionID)
-	if ui.historyCheck(sessionID) {
-		log.Println("Generation already in progress")
+	sess := currentSession(r)
+	sessionID := sess.ID
+	if ui.activeGeneration(sessionID) {
+		slog.Info("generation already in progress", "session", sessionID)
 		w.Write([]byte("Generation already in progress"))
 		return
 	}
 
-	// Create progress object
-	progress := &generator.GenerationProgress{
-		SessionID: sessionID,
-		Done:      make(chan bool),
-		StartTime: time.Now(),
-		State:     generator.StateInitialized,
-		IsActive:  true,
+	// API keys pay with their quota instead of the per-IP limit.
+	key := currentAPIKey(r)
+	if key != nil {
+		usage, err := ui.accounts.ReserveAdventure(key)
+		setQuotaHeaders(w, usage)
+		if errors.Is(err, auth.ErrQuotaExceeded) {
+			http.Error(w, "API key quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			slog.Error("reserving quota", "session", sessionID, "error", err)
+			http.Error(w, "Quota unavailable", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	ui.sessionsM.Lock()
-	ui.sessions[sessionID] = progress
-	if _, exists := ui.msgHistory[sessionID]; !exists {
-		ui.msgHistory[sessionID] = &MessageHistory{
-			Messages: make([]generator.Message, 0),
+	// Paid requests have already cleared the paywall middleware, so they
+	// jump ahead of free ones, and their payment is used up when the job
+	// is queued. Free previews are paid for on download.
+	priority, paid, paymentID := queue.PriorityNormal, true, ""
+	if ui.cfg.Paywall.Enabled {
+		if ui.cfg.Paywall.FreePreview {
+			paid = false
+		} else {
+			priority = queue.PriorityPaid
+			if cookie, err := r.Cookie("payment_id"); err == nil {
+				paymentID = cookie.Value
+			}
+		}
+	}
+	job := &queue.Job{
+		SessionID:   sessionID,
+		AccountID:   sess.AccountID,
+		AdventureID: uuid.New().String(),
+		Prompt:      prompt,
+		Setting:     setting,
+		Style:       style,
+		Episodes:    opts.Episodes,
+		Images:      opts.Images,
+		PDF:         opts.PDF,
+		Tier:        tier.Name,
+		Paid:        paid,
+		PaymentID:   paymentID,
+		Email:       notify,
+		Priority:    priority,
+	}
+	if key != nil {
+		job.APIKeyID = key.ID
+	}
+	if hookURL != "" {
+		if err := ui.webhooks.Register(job.AdventureID, hookURL, hookSecret); err != nil {
+			slog.Error("registering webhook", "session", sessionID, "error", err)
+			if key != nil {
+				if err := ui.accounts.ReleaseAdventure(key); err != nil {
+					slog.Error("releasing quota", "session", sessionID, "error", err)
+				}
+			}
+			http.Error(w, "Failed to register webhook", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := ui.jobs.Enqueue(job); err != nil {
+		if key != nil {
+			if err := ui.accounts.ReleaseAdventure(key); err != nil {
+				slog.Error("releasing quota", "session", sessionID, "error", err)
+			}
+		}
+		if hookURL != "" {
+			if err := ui.webhooks.Delete(job.AdventureID); err != nil {
+				slog.Error("removing webhook", "session", sessionID, "error", err)
+			}
 		}
+		// Another request of the session got its job in first.
+		if errors.Is(err, queue.ErrSessionBusy) {
+			slog.Info("generation already in progress", "session", sessionID)
+			w.Write([]byte("Generation already in progress"))
+			return
+		}
+		if errors.Is(err, queue.ErrPaymentUsed) {
+			slog.Warn("payment refused for generation", "session", sessionID, "tier", tier.Name)
+			clearPaymentCookie(w)
+			http.Error(w, "This payment has already been used. Submit the form again to start a new payment.", http.StatusPaymentRequired)
+			return
+		}
+		slog.Error("enqueueing generation", "session", sessionID, "error", err)
+		http.Error(w, "Failed to queue generation", http.StatusInternalServerError)
+		return
+	}
+
+	if paymentID != "" {
+		metrics.PaywallConversions.WithLabelValues(tier.Name, "generation").Inc()
+	}
+
+	status := "⏳ Your adventure has been queued"
+	if position, err := ui.jobs.Position(sessionID); err == nil {
+		status = fmt.Sprintf("⏳ Your adventure has been queued at position %d", position)
+	}
+	ui.AddMessage(job.AdventureID, generator.NewMessage("update", "queued", status, ""))
+	w.Header().Set("X-Adventure-Id", job.AdventureID)
+	w.Write([]byte(status))
+}
+
+// runJob executes a queued generation job. It is invoked by the queue worker
+// pool, which limits how many generations run at once.
+//
+// Parameters:
+//   - ctx: worker context, cancelled when the pool shuts down
+//   - job: the claimed job; a requeued job resumes from its checkpoint
+//
+// Returns:
+//   - error: the generation error, recorded against the job, or an error
+//     wrapping queue.ErrInterrupted if a shutdown stopped the generation
+func (ui *GeneratorUI) runJob(ctx context.Context, job *queue.Job) error {
+	sessionID := job.SessionID
+	progress := &generator.GenerationProgress{
+		SessionID:   sessionID,
+		AdventureID: job.AdventureID,
+		Done:        make(chan bool),
+		StartTime:   time.Now(),
+		State:       generator.StateInitialized,
+		IsActive:    true,
 	}
-	ui.sessionsM.Unlock()
+	// A resumed job carries the tokens used before it was interrupted.
+	progress.Tokens.Store(job.Tokens)
+	resumedTokens := job.Tokens
+
+	ui.generationsM.Lock()
+	ui.generations[job.AdventureID] = progress
+	ui.generationsM.Unlock()
+	defer ui.cleanupGeneration(progress)
+	defer ui.recordProgress(job, progress, resumedTokens)
 
-	// Start generation immediately, don't wait for WebSocket
-	go func() {
-		log.Printf("[Session %s] Starting generation", sessionID)
-		if err := generator.GenerateAdventure(progress, prompt, setting, style); err != nil {
-			log.Printf("[Session %s] Generation error: %v", sessionID, err)
-			progress.UpdateState(generator.StateError)
-			progress.SendUpdate(fmt.Sprintf("Error: %v", err))
+	logger := progress.Logger()
+	logger.Info("starting generation", "prompt", job.Prompt, "episodes", job.Episodes,
+		"images", job.Images, "pdf", job.PDF)
+	progress.UpdateState(generator.StateGenerating)
+	// Free previews stop after the table of contents and covers, and resume
+	// from there once paid for.
+	opts := jobOptions(job)
+	opts.Preview = ui.cfg.Paywall.Enabled && !job.Paid
+	if err := ui.gen.GenerateAdventure(progress.Context(ctx), progress, job.Prompt, job.Setting, job.Style, opts); err != nil {
+		if errors.Is(err, generator.ErrInterrupted) {
+			return fmt.Errorf("%w: %w", queue.ErrInterrupted, err)
+		}
+		if errors.Is(err, generator.ErrPreviewReady) {
+			logger.Info("free preview ready", "tokens", progress.Tokens.Load())
+			metrics.Generations.WithLabelValues("preview").Inc()
+			return fmt.Errorf("%w: %w", queue.ErrPreview, err)
+		}
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			logger.Info("generation cancelled", "error", err)
+			progress.UpdateState(generator.StateCancelled)
+			metrics.Generations.WithLabelValues("cancelled").Inc()
+			ui.notifyWebhook(job, queue.JobCancelled, err, progress.Tokens.Load())
+			return err
 		}
-	}()
+		if ctx.Err() == nil {
+			metrics.Generations.WithLabelValues("failed").Inc()
+			ui.notifyWebhook(job, queue.JobFailed, err, progress.Tokens.Load())
+			ui.sendFailedEmail(job, err)
+		}
+		logger.Error("generation failed", "error", err)
+		progress.UpdateState(generator.StateError)
+		progress.SendUpdate(fmt.Sprintf("Error: %v", err))
+		return err
+	}
+	progress.UpdateState(generator.StateCompleted)
+	metrics.Generations.WithLabelValues("completed").Inc()
+	logger.Info("generation completed", "duration", time.Since(progress.StartTime), "tokens", progress.Tokens.Load())
+	ui.notifyWebhook(job, queue.JobCompleted, nil, progress.Tokens.Load())
+	ui.sendReadyEmail(job)
+	return nil
+}
+
+// recordProgress reports the tokens a generation consumed and the step it
+// reached to the queue and, for jobs submitted with an API key, counts the
+// tokens used since it was resumed against the key's monthly quota.
+func (ui *GeneratorUI) recordProgress(job *queue.Job, progress *generator.GenerationProgress, resumed int64) {
+	job.Tokens = progress.Tokens.Load()
+	if step := progress.CurrentStep(); step != "" {
+		job.Step = step
+	}
+	used := job.Tokens - resumed
+	if job.APIKeyID == 0 || used == 0 {
+		return
+	}
+	if err := ui.accounts.AddTokens(job.APIKeyID, used); err != nil {
+		slog.Error("recording tokens", "session", job.SessionID, "error", err)
+	}
+}
+
+// handleCancel stops the caller's active generation, whether it is still
+// waiting in the queue or already running. The active job need not be the
+// session's latest: a paid preview resumes, and a retried job runs again,
+// after newer jobs of the session.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTTP response
+//   - r: *http.Request carrying the caller's session
+//
+// A running generation saves whatever it has produced before stopping. Once
+// cancelled, the session may start a new generation.
+//
+// Error cases:
+//   - Returns 400 if the session is missing or malformed
+//   - Returns 404 if the session has nothing to cancel
+//   - Returns 500 if the session's jobs cannot be read or updated
+func (ui *GeneratorUI) handleCancel(w http.ResponseWriter, r *http.Request) {
+	sessionID := sessionFromRequest(r)
+	if !isValidSession(sessionID) {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
 
-	// components.GenerationStatus(sessionID).Render(r.Context(), w)
+	job, err := ui.jobs.ActiveJob(sessionID)
+	if err != nil {
+		slog.Error("reading jobs", "session", sessionID, "error", err)
+		http.Error(w, "Could not cancel generation", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "No generation in progress", http.StatusNotFound)
+		return
+	}
+	dropped, err := ui.jobs.CancelJob(job.AdventureID)
+	if err != nil {
+		slog.Error("cancelling queued job", "adventure", job.AdventureID, "error", err)
+		http.Error(w, "Could not cancel generation", http.StatusInternalServerError)
+		return
+	}
+	if dropped {
+		ui.AddMessage(job.AdventureID, generator.NewMessage("update", string(generator.StateCancelled), "🛑 Adventure generation cancelled before it started", ""))
+		ui.notifyWebhook(job, queue.JobCancelled, errors.New("cancelled before start"), job.Tokens)
+		w.Write([]byte("Generation cancelled"))
+		return
+	}
+
+	if progress := ui.runningProgress(job.AdventureID); progress == nil || !progress.Cancel() {
+		http.Error(w, "No generation in progress", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("Cancelling generation, partial results will be saved"))
 }
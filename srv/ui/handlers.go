@@ -4,16 +4,42 @@ package ui
 import (
 	_ "embed"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
+	"github.com/opd-ai/dndbot/srv/config"
 )
 
 //go:embed templates/index.html
-var index []byte
+var index string
+
+var indexTemplate = template.Must(template.New("html").Parse(index))
+
+// homeView is the data rendered by templates/index.html. The session ID and
+// CSRF token are handed to client.js through meta tags, since the session
+// cookie itself is not readable by scripts.
+type homeView struct {
+	SessionID string
+	CSRF      string
+	LoggedIn  bool
+	// Prices lists the pricing tiers when the paywall is enabled.
+	Prices      []tierPrice
+	Currency    string
+	FreePreview bool
+	// EmailEnabled shows the optional email field on the form.
+	EmailEnabled bool
+}
+
+// tierPrice is a pricing tier with its price formatted for display.
+type tierPrice struct {
+	config.PriceTier
+	Price string
+}
 
 // handleHome handles requests to the root endpoint, rendering the main application layout
 // and generator form.
@@ -22,32 +48,25 @@ var index []byte
 //   - w: http.ResponseWriter to write the HTTP response
 //   - r: *http.Request containing the incoming request details
 func (ui *GeneratorUI) handleHome(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.Header.Get("X-Session-Id")
-	if sessionID == "" {
-		log.Println("no client side sessionID:", sessionID)
-		// Try cookie as fallback
-		if cookie, err := r.Cookie("session_id"); err == nil && cookie.Value != "null" {
-			log.Println("cookie found", cookie.Value, err)
-			sessionID = cookie.Value
-		} else {
-			sessionID = uuid.New().String()
-			http.SetCookie(w, &http.Cookie{
-				Name:     "session_id",
-				Value:    sessionID,
-				Path:     "/",
-				MaxAge:   864000,
-				HttpOnly: false,
-				SameSite: http.SameSiteLaxMode,
-			})
+	sess := currentSession(r)
+	view := homeView{
+		SessionID:    sess.ID,
+		CSRF:         sess.CSRF,
+		LoggedIn:     sess.AccountID != 0,
+		EmailEnabled: ui.cfg.Email.Enabled(),
+	}
+	pay := ui.cfg.Paywall
+	if pay.Enabled {
+		view.Currency = strings.ToUpper(pay.Currency)
+		view.FreePreview = pay.FreePreview
+		for _, tier := range pay.Tiers {
+			price := strconv.FormatFloat(tier.Price(pay.Currency), 'f', -1, 64)
+			view.Prices = append(view.Prices, tierPrice{PriceTier: tier, Price: price})
 		}
 	}
-	w.Header().Set("X-Session-Id", sessionID)
-
-	t, err := template.New("html").Parse(string(index))
-	if err != nil {
-		panic(err)
+	if err := indexTemplate.Execute(w, view); err != nil {
+		slog.Error("rendering home", "session", sess.ID, "error", err)
 	}
-	t.Execute(w, "")
 }
 
 // handleGetMessages retrieves and formats message history for a given session.
@@ -56,37 +75,58 @@ func (ui *GeneratorUI) handleHome(w http.ResponseWriter, r *http.Request) {
 //   - w: http.ResponseWriter to write the HTTP response
 //   - r: *http.Request containing the incoming request details
 //
-// The function extracts the sessionID from URL parameters, looks up the message history,
+// The function extracts the ID from URL parameters, looks up the message history,
 // and returns formatted messages as HTML. Returns empty string if session not found.
+// The ID may name one of the caller's adventures or the caller's own
+// session, which resolves to its most recent adventure; any other ID is not
+// found. The optional offset and limit query parameters page through long
+// histories.
 //
-// Related: formatMessages()
+// Related: formatMessages(), ownedAdventureID()
 func (ui *GeneratorUI) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	sessionID := chi.URLParam(r, "sessionID")
+	if sessionID == currentSession(r).ID {
+		if job, err := ui.jobs.Latest(sessionID); err == nil && job != nil {
+			sessionID = job.AdventureID
+		}
+	} else {
+		entry, ok := ui.ownedAdventureID(w, r, sessionID)
+		if !ok {
+			return
+		}
+		sessionID = entry.AdventureID
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
 
-	ui.sessionsM.RLock()
-	history, exists := ui.msgHistory[sessionID]
-	ui.sessionsM.RUnlock()
-
-	if !exists {
+	history, err := ui.history.Messages(sessionID, offset, limit)
+	if err != nil {
+		slog.Error("reading history", "session", sessionID, "error", err)
+		http.Error(w, "History unavailable", http.StatusInternalServerError)
+		return
+	}
+	if len(history) == 0 {
 		w.Write([]byte(""))
 		return
 	}
-	messages := formatMessages(history.GetMessages())
+	messages := formatMessages(history)
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(messages))
 }
 
-// one adventure per session
-func (ui *GeneratorUI) historyCheck(sessionID string) bool {
-	ui.sessionsM.RLock()
-	history, exists := ui.msgHistory[sessionID]
-	ui.sessionsM.RUnlock()
-
-	if !exists {
-		return false
+// activeGeneration reports whether the session already has a generation
+// queued or running. Sessions run one generation at a time but may start
+// another once it finishes, fails or is cancelled.
+func (ui *GeneratorUI) activeGeneration(sessionID string) bool {
+	job, err := ui.jobs.ActiveJob(sessionID)
+	if err != nil {
+		slog.Error("reading jobs", "session", sessionID, "error", err)
+		return true
 	}
-
-	return len(history.GetMessages()) > 0
+	return job != nil
 }
 
 // handleCheckSession validates and checks the existence of a session.
@@ -95,32 +135,26 @@ func (ui *GeneratorUI) historyCheck(sessionID string) bool {
 //   - w: http.ResponseWriter to write the HTTP response
 //   - r: *http.Request containing the incoming request details
 //
-// The function attempts to get sessionID from X-Session-Id header or session_id cookie.
+// The session ID comes from the caller's server-side session.
 // Validates the session and checks if it exists in memory or cache.
 // Renders appropriate generation status based on session validity.
 //
 // Related: isValidSession()
 func (ui *GeneratorUI) handleCheckSession(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.Header.Get("X-Session-Id")
-	if sessionID == "" {
-		// Try cookie as fallback
-		if cookie, err := r.Cookie("session_id"); err == nil {
-			sessionID = cookie.Value
-		}
-	}
-
+	sessionID := sessionFromRequest(r)
 	if !isValidSession(sessionID) {
 		w.Write([]byte(""))
 		return
 	}
 
-	// Check if session exists in memory or cache
-	ui.sessionsM.RLock()
-	_, exists := ui.sessions[sessionID]
-	ui.sessionsM.RUnlock()
-
-	if !exists {
-		if _, found := ui.cache.Get(sessionID); !found {
+	// Check if the session's latest generation exists in memory or cache
+	latest, err := ui.jobs.Latest(sessionID)
+	if err != nil || latest == nil {
+		w.Write([]byte(""))
+		return
+	}
+	if ui.runningProgress(latest.AdventureID) == nil {
+		if _, found := ui.cache.Get(latest.AdventureID); !found {
 			// components.GenerationStatus("").Render(r.Context(), w)
 			w.Write([]byte(""))
 			return
@@ -139,10 +173,10 @@ func (ui *GeneratorUI) handleCheckSession(w http.ResponseWriter, r *http.Request
 //
 // Returns the favicon.ico file contents or a placeholder if file cannot be read.
 // Logs any errors encountered when reading the favicon file.
-func handleFavicon(w http.ResponseWriter, r *http.Request) {
-	faviconBytes, err := os.ReadFile("static/favicon.ico")
+func (ui *GeneratorUI) handleFavicon(w http.ResponseWriter, r *http.Request) {
+	faviconBytes, err := os.ReadFile(filepath.Join(ui.cfg.Storage.Static, "favicon.ico"))
 	if err != nil {
-		log.Printf("favicon error %s", err)
+		slog.Error("reading favicon", "error", err)
 		w.Write([]byte("XXXXXXXXXXXXXXXXXXXXXXX"))
 		return
 	}
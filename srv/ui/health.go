@@ -0,0 +1,90 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/metrics"
+)
+
+// readyTimeout bounds the checks made by /readyz.
+const readyTimeout = 5 * time.Second
+
+// handleHealth reports that the process is up and serving requests.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTTP response
+//   - r: *http.Request for the liveness probe
+func (ui *GeneratorUI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady reports whether the server can take generation requests: it
+// must not be shutting down, the job, history, account and webhook databases must
+// respond and, when configured, the LLM and image backends too.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON check results
+//   - r: *http.Request for the readiness probe
+//
+// Error cases:
+//   - Returns 503 with the failing checks if any check fails
+func (ui *GeneratorUI) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"jobs":     ui.jobs.Ping,
+		"history":  ui.history.Ping,
+		"accounts": ui.accounts.Ping,
+		"webhooks": ui.webhooks.Ping,
+	}
+	if ui.cfg.Server.ReadyCheckBackends {
+		checks["backends"] = ui.gen.Check
+	}
+
+	results := make(map[string]string, len(checks))
+	status := http.StatusOK
+	if ui.draining.Load() {
+		results["server"] = "shutting down"
+		status = http.StatusServiceUnavailable
+	}
+	for name, check := range checks {
+		results[name] = "ok"
+		if err := check(ctx); err != nil {
+			results[name] = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleMetrics serves the Prometheus metrics, requiring the configured
+// metrics token as a bearer token when one is set.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the metrics
+//   - r: *http.Request from the scraper
+//
+// Error cases:
+//   - Returns 401 if a metrics token is configured and not presented
+func (ui *GeneratorUI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if token := ui.cfg.Server.MetricsToken; token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
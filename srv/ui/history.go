@@ -2,13 +2,47 @@
 package ui
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/opd-ai/dndbot/srv/generator"
+
+	_ "modernc.org/sqlite"
 )
 
+// HistoryStore persists the progress messages emitted for each generation session.
+// Histories are keyed by adventure ID; adventures created before a session
+// could own several use the session ID. Implementations must be safe for
+// concurrent use.
+type HistoryStore interface {
+	// Append records a message at the end of a session's history.
+	Append(sessionID string, msg generator.Message) error
+	// Messages returns up to limit messages starting at offset, oldest first.
+	// A limit of zero or less returns every remaining message.
+	Messages(sessionID string, offset, limit int) ([]generator.Message, error)
+	// Count returns the number of messages recorded for a session.
+	Count(sessionID string) (int, error)
+	// Prune removes every session whose most recent message is older than cutoff.
+	Prune(cutoff time.Time) (int, error)
+	// Delete removes a session's entire history.
+	Delete(sessionID string) error
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the store's resources.
+	Close() error
+}
+
 // MessageHistory maintains a thread-safe list of WebSocket messages for a generation session.
 // It provides concurrent-safe operations for adding and retrieving messages.
+//
+// It is the in-memory form used by the legacy session_history.json file and
+// is kept so ImportJSONHistory can read those files.
 type MessageHistory struct {
 	Messages []generator.Message
 	mu       sync.RWMutex
@@ -42,3 +76,170 @@ func (h *MessageHistory) GetMessages() []generator.Message {
 	copy(messages, h.Messages)
 	return messages
 }
+
+// SQLiteHistory is a HistoryStore backed by an append-only SQLite table
+// indexed by session.
+type SQLiteHistory struct {
+	db *sql.DB
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	status     TEXT    NOT NULL,
+	message    TEXT    NOT NULL,
+	output     TEXT    NOT NULL,
+	timestamp  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_session ON messages(session_id, id);
+`
+
+// OpenSQLiteHistory opens (or creates) a message history database.
+//
+// Parameters:
+//   - path: filesystem location of the SQLite database
+//
+// Returns:
+//   - *SQLiteHistory: ready-to-use store
+//   - error: any error opening or migrating the database
+func OpenSQLiteHistory(path string) (*SQLiteHistory, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening history database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating history schema: %w", err)
+	}
+	return &SQLiteHistory{db: db}, nil
+}
+
+// Append implements HistoryStore.
+func (s *SQLiteHistory) Append(sessionID string, msg generator.Message) error {
+	_, err := s.db.Exec(
+		`INSERT INTO messages (session_id, type, status, message, output, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+		sessionID, msg.Type, msg.Status, msg.Message, msg.Output, msg.Timestamp.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("appending message: %w", err)
+	}
+	return nil
+}
+
+// Messages implements HistoryStore.
+func (s *SQLiteHistory) Messages(sessionID string, offset, limit int) ([]generator.Message, error) {
+	if limit <= 0 {
+		limit = -1 // SQLite: no limit
+	}
+	rows, err := s.db.Query(
+		`SELECT type, status, message, output, timestamp FROM messages WHERE session_id = ? ORDER BY id LIMIT ? OFFSET ?`,
+		sessionID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("reading messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []generator.Message
+	for rows.Next() {
+		var msg generator.Message
+		var ts int64
+		if err := rows.Scan(&msg.Type, &msg.Status, &msg.Message, &msg.Output, &ts); err != nil {
+			return nil, err
+		}
+		msg.Timestamp = time.Unix(0, ts)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// Count implements HistoryStore.
+func (s *SQLiteHistory) Count(sessionID string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE session_id = ?`, sessionID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("counting messages: %w", err)
+	}
+	return n, nil
+}
+
+// Prune implements HistoryStore.
+func (s *SQLiteHistory) Prune(cutoff time.Time) (int, error) {
+	res, err := s.db.Exec(
+		`DELETE FROM messages WHERE session_id IN (
+			SELECT session_id FROM messages GROUP BY session_id HAVING MAX(timestamp) < ?
+		)`,
+		cutoff.UnixNano(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("pruning history: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Delete implements HistoryStore.
+func (s *SQLiteHistory) Delete(sessionID string) error {
+	if _, err := s.db.Exec(`DELETE FROM messages WHERE session_id = ?`, sessionID); err != nil {
+		return fmt.Errorf("deleting history: %w", err)
+	}
+	return nil
+}
+
+// Ping implements HistoryStore.
+func (s *SQLiteHistory) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close implements HistoryStore.
+func (s *SQLiteHistory) Close() error {
+	return s.db.Close()
+}
+
+// ImportJSONHistory migrates a legacy session_history.json file into store.
+// On success the file is renamed with an ".imported" suffix so the import
+// runs only once.
+//
+// Parameters:
+//   - store: destination HistoryStore
+//   - path: location of the JSON history file
+//
+// Returns:
+//   - int: number of messages imported; zero if the file does not exist
+//   - error: any error reading, decoding or storing the history
+func ImportJSONHistory(store HistoryStore, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	imported := 0
+	if len(data) > 0 {
+		var history map[string]*MessageHistory
+		if err := json.Unmarshal(data, &history); err != nil {
+			return 0, fmt.Errorf("decoding %s: %w", path, err)
+		}
+		for sessionID, h := range history {
+			if h == nil {
+				continue
+			}
+			for _, msg := range h.GetMessages() {
+				if err := store.Append(sessionID, msg); err != nil {
+					return imported, err
+				}
+				imported++
+			}
+		}
+	}
+
+	if err := os.Rename(path, path+".imported"); err != nil {
+		return imported, fmt.Errorf("marking %s imported: %w", path, err)
+	}
+	return imported, nil
+}
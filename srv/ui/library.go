@@ -0,0 +1,306 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"bufio"
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	dndbot "github.com/opd-ai/dndbot/src"
+	"github.com/opd-ai/dndbot/srv/auth"
+	"github.com/opd-ai/dndbot/srv/queue"
+)
+
+//go:embed templates/library.html
+var libraryPage string
+
+var libraryTemplate = template.Must(template.New("library").Parse(libraryPage))
+
+// libraryEntry describes one adventure on the library page.
+type libraryEntry struct {
+	AdventureID string
+	Title       string
+	Created     time.Time
+	State       string
+	Cover       string
+	PDF         string
+	Zip         string
+	Deletable   bool
+	// Locked marks a free preview whose full download needs payment.
+	Locked bool
+}
+
+// libraryView is the data rendered by templates/library.html.
+type libraryView struct {
+	Entries []libraryEntry
+	Log     template.HTML
+	Current *libraryEntry
+	// CSRF is the session's token for the delete forms.
+	CSRF     string
+	LoggedIn bool
+}
+
+// handleLibrary lists every adventure created by the caller's session or,
+// when logged in, their account.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request carrying the caller's session
+//
+// Each entry shows the title, creation date, status, cover thumbnail and
+// download links, with controls to reopen the progress log or delete it.
+func (ui *GeneratorUI) handleLibrary(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	sessionID := sess.ID
+	entries, err := ui.libraryEntries(sess)
+	if err != nil {
+		slog.Error("listing library", "session", sessionID, "error", err)
+		http.Error(w, "Library unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := libraryTemplate.Execute(w, libraryView{Entries: entries, CSRF: sess.CSRF, LoggedIn: sess.AccountID != 0}); err != nil {
+		slog.Error("rendering library", "session", sessionID, "error", err)
+	}
+}
+
+// handleLibraryLog reopens the full progress log of one of the caller's adventures.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTML page
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if the adventure does not belong to the caller
+func (ui *GeneratorUI) handleLibraryLog(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ui.ownedAdventure(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := ui.history.Messages(entry.AdventureID, 0, 0)
+	if err != nil {
+		slog.Error("reading history", "adventure", entry.AdventureID, "error", err)
+		http.Error(w, "History unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	view := libraryView{
+		Current: entry,
+		Log:     template.HTML(formatMessages(messages)),
+	}
+	if err := libraryTemplate.Execute(w, view); err != nil {
+		slog.Error("rendering log", "adventure", entry.AdventureID, "error", err)
+	}
+}
+
+// handleLibraryDelete removes one of the caller's adventures: its output
+// directory, zip archive, message history, job record and webhook.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the HTTP response
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if the adventure does not belong to the caller
+//   - Returns 409 if the adventure is still queued or running
+func (ui *GeneratorUI) handleLibraryDelete(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ui.ownedAdventure(w, r)
+	if !ok {
+		return
+	}
+	if !entry.Deletable {
+		http.Error(w, "Cancel the generation before deleting it", http.StatusConflict)
+		return
+	}
+
+	ui.deleteAdventure(entry.AdventureID)
+	http.Redirect(w, r, "/library", http.StatusSeeOther)
+}
+
+// deleteAdventure removes a finished adventure's output directory, zip
+// archive, message history, job record and webhook, whether or not its
+// files were moved to the archive. Failures are logged and the rest is
+// still removed.
+func (ui *GeneratorUI) deleteAdventure(adventureID string) {
+	for _, dir := range []string{ui.gen.OutputDir(adventureID), ui.archiveDir(adventureID)} {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("removing outputs", "adventure", adventureID, "error", err)
+		}
+		if err := os.Remove(dir + ".zip"); err != nil && !os.IsNotExist(err) {
+			slog.Error("removing archive", "adventure", adventureID, "error", err)
+		}
+	}
+	if err := ui.history.Delete(adventureID); err != nil {
+		slog.Error("removing history", "adventure", adventureID, "error", err)
+	}
+	if err := ui.jobs.Delete(adventureID); err != nil {
+		slog.Error("removing job", "adventure", adventureID, "error", err)
+	}
+	if err := ui.webhooks.Delete(adventureID); err != nil {
+		slog.Error("removing webhook", "adventure", adventureID, "error", err)
+	}
+}
+
+// ownedAdventure resolves the adventureID URL parameter to an adventure
+// owned by the caller, writing a 404 response when it is not.
+func (ui *GeneratorUI) ownedAdventure(w http.ResponseWriter, r *http.Request) (*libraryEntry, bool) {
+	return ui.ownedAdventureID(w, r, chi.URLParam(r, "adventureID"))
+}
+
+// ownedAdventureID resolves adventureID to an adventure owned by the
+// caller, writing a 404 response when it is not.
+func (ui *GeneratorUI) ownedAdventureID(w http.ResponseWriter, r *http.Request, adventureID string) (*libraryEntry, bool) {
+	entries, err := ui.libraryEntries(currentSession(r))
+	if err != nil {
+		slog.Error("listing library", "adventure", adventureID, "error", err)
+		http.Error(w, "Library unavailable", http.StatusInternalServerError)
+		return nil, false
+	}
+	for i := range entries {
+		if entries[i].AdventureID == adventureID {
+			return &entries[i], true
+		}
+	}
+	http.NotFound(w, r)
+	return nil, false
+}
+
+// libraryEntries builds the library for a session from its jobs and those
+// of its account. A session whose only adventure predates the job queue is
+// listed from its message history instead.
+//
+// Parameters:
+//   - sess: the caller's session
+//
+// Returns:
+//   - []libraryEntry: the caller's adventures, newest first
+//   - error: any error reading jobs or history
+func (ui *GeneratorUI) libraryEntries(sess *auth.Session) ([]libraryEntry, error) {
+	sessionID := sess.ID
+	if !isValidSession(sessionID) {
+		return nil, nil
+	}
+	jobs, err := ui.jobs.List(sessionID, sess.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []libraryEntry
+	legacy := true
+	for _, job := range jobs {
+		if job.AdventureID == sessionID {
+			legacy = false
+		}
+		entry := ui.newLibraryEntry(job.AdventureID, job.Prompt, job.CreatedAt, job.State, job.Archived)
+		entry.Locked = ui.cfg.Paywall.Enabled && !job.Paid
+		entries = append(entries, entry)
+	}
+
+	if legacy {
+		messages, err := ui.history.Messages(sessionID, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			entries = append(entries, ui.newLibraryEntry(sessionID, "", messages[0].Timestamp, queue.JobCompleted, false))
+		}
+	}
+	return entries, nil
+}
+
+// newLibraryEntry describes an adventure from its job fields and whatever
+// has been written to its output directory, or the archive, so far.
+func (ui *GeneratorUI) newLibraryEntry(adventureID, prompt string, created time.Time, state queue.JobState, archived bool) libraryEntry {
+	outDir, urlPath := ui.adventureDir(adventureID, archived)
+	entry := libraryEntry{
+		AdventureID: adventureID,
+		Title:       adventureTitle(outDir),
+		Created:     created,
+		State:       string(state),
+		Cover:       coverImage(outDir, urlPath),
+		Deletable:   state != queue.JobQueued && state != queue.JobRunning,
+	}
+	if entry.Title == "" {
+		entry.Title = summarizePrompt(prompt)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "adventure.pdf")); err == nil {
+		entry.PDF = path.Join(urlPath, "adventure.pdf")
+	}
+	if _, err := os.Stat(outDir + ".zip"); err == nil {
+		entry.Zip = urlPath + ".zip"
+	}
+	return entry
+}
+
+// adventureTitle reads the title recorded in an adventure's Prompt.md.
+func adventureTitle(outDir string) string {
+	file, err := os.Open(filepath.Join(outDir, "Prompt.md"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if scanner.Scan() {
+		return strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "# Title:"))
+	}
+	return ""
+}
+
+// coverImage returns the URL of the first cover illustration of an adventure
+// served under urlPath, preferring its thumbnail, or an empty string if none
+// has been generated yet.
+func coverImage(outDir, urlPath string) string {
+	file := coverFile(outDir)
+	if file == "" {
+		return ""
+	}
+	thumb := dndbot.ThumbnailPath(file)
+	if _, err := os.Stat(thumb); err == nil {
+		file = thumb
+	}
+	return path.Join(urlPath, "00_Contents", filepath.Base(file))
+}
+
+// coverFile returns the path of the first cover illustration of an
+// adventure, or an empty string if none has been generated yet.
+func coverFile(outDir string) string {
+	dir := filepath.Join(outDir, "00_Contents")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, file := range files {
+		if dndbot.IsThumbnail(file.Name()) {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(file.Name())) {
+		case ".png", ".jpg", ".jpeg", ".webp":
+			return filepath.Join(dir, file.Name())
+		}
+	}
+	return ""
+}
+
+// summarizePrompt shortens a prompt for use as a placeholder title.
+func summarizePrompt(prompt string) string {
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return "Untitled adventure"
+	}
+	if runes := []rune(prompt); len(runes) > 60 {
+		return string(runes[:60]) + "…"
+	}
+	return prompt
+}
@@ -0,0 +1,336 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/config"
+	"github.com/opd-ai/dndbot/srv/generator"
+	"github.com/opd-ai/dndbot/srv/logging"
+	"github.com/opd-ai/dndbot/srv/metrics"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/paywall"
+)
+
+// covers reports whether tier includes everything opts asks for.
+func covers(tier config.PriceTier, opts generator.Options) bool {
+	if tier.MaxEpisodes > 0 && (opts.Episodes == 0 || opts.Episodes > tier.MaxEpisodes) {
+		return false
+	}
+	return (tier.Images || !opts.Images) && (tier.PDF || !opts.PDF)
+}
+
+// tierFor picks the cheapest tier covering opts.
+//
+// Returns:
+//   - config.PriceTier: the tier to charge
+//   - bool: false if no tier covers the options
+func tierFor(pay config.Paywall, opts generator.Options) (config.PriceTier, bool) {
+	var best config.PriceTier
+	found := false
+	for _, t := range pay.Tiers {
+		if covers(t, opts) && (!found || t.Price(pay.Currency) < best.Price(pay.Currency)) {
+			best, found = t, true
+		}
+	}
+	return best, found
+}
+
+// openPaywalls starts one paywall per pricing tier. It is a no-op when the
+// paywall is disabled.
+func (ui *GeneratorUI) openPaywalls() {
+	if !ui.cfg.Paywall.Enabled {
+		return
+	}
+	ui.paywalls = make(map[string]*paywall.Paywall, len(ui.cfg.Paywall.Tiers))
+	for _, tier := range ui.cfg.Paywall.Tiers {
+		cfg := paywall.Config{
+			PaymentTimeout:   ui.cfg.Paywall.PaymentTimeout,
+			MinConfirmations: ui.cfg.Paywall.MinConfirmations,
+			TestNet:          ui.cfg.Paywall.TestNet,
+			Store:            paywall.NewFileStore(filepath.Join(ui.cfg.Paywall.Store, tier.Name)),
+			XMRUser:          ui.cfg.Paywall.XMRUser,
+			XMRPassword:      ui.cfg.Paywall.XMRPassword,
+			XMRRPC:           ui.cfg.Paywall.XMRRPC,
+		}
+		if ui.cfg.Paywall.Currency == "xmr" {
+			cfg.PriceInXMR = tier.XMR
+		} else {
+			cfg.PriceInBTC = tier.BTC
+			if cfg.XMRPassword == "" {
+				// The paywall insists on Monero credentials even when
+				// Monero is not offered; without a daemon it stays disabled.
+				cfg.XMRPassword = "unused-xmr"
+			}
+		}
+		pw, err := paywall.NewPaywall(cfg)
+		if err != nil {
+			logging.Fatal("starting paywall", "tier", tier.Name, "error", err)
+		}
+		ui.paywalls[tier.Name] = pw
+	}
+}
+
+// paywalled protects h with pw. The paywall package sets its cookie as
+// __Host-payment_id but looks for payment_id, so the cookie is mirrored
+// before the paywall sees the request.
+func paywalled(pw *paywall.Paywall, h http.HandlerFunc) http.HandlerFunc {
+	protected := pw.MiddlewareFuncFunc(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(paymentCookie); err == nil {
+			if _, err := r.Cookie("payment_id"); err != nil {
+				r.AddCookie(&http.Cookie{Name: "payment_id", Value: cookie.Value})
+			}
+		}
+		protected(w, r)
+	}
+}
+
+// chargeForGeneration puts generation requests behind the paywall of the
+// tier their options fall under, unless the paywall is off or only charges
+// for downloads. The payment is used up by handleGenerate when it queues
+// the job.
+//
+// Parameters:
+//   - h: http.HandlerFunc that queues the generation
+//
+// Returns:
+//   - http.HandlerFunc: Handler that answers 400 for options no tier covers
+func (ui *GeneratorUI) chargeForGeneration(h http.HandlerFunc) http.HandlerFunc {
+	if !ui.cfg.Paywall.Enabled || ui.cfg.Paywall.FreePreview {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tier, ok := tierFor(ui.cfg.Paywall, opts)
+		if !ok {
+			http.Error(w, "No pricing tier offers these options", http.StatusBadRequest)
+			return
+		}
+		paywalled(ui.paywalls[tier.Name], h)(w, r)
+	}
+}
+
+// parseOptions reads the generation options of a /generate request. Missing
+// fields take their defaults.
+//
+// Parameters:
+//   - r: *http.Request with optional episodes, images and pdf form fields
+//
+// Returns:
+//   - generator.Options: the requested options
+//   - error: a malformed or out of range field
+func parseOptions(r *http.Request) (generator.Options, error) {
+	opts := generator.DefaultOptions()
+	if v := r.FormValue("episodes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > config.MaxEpisodes {
+			return opts, fmt.Errorf("episodes must be between 1 and %d", config.MaxEpisodes)
+		}
+		opts.Episodes = n
+	}
+	for field, dst := range map[string]*bool{"images": &opts.Images, "pdf": &opts.PDF} {
+		if v := r.FormValue(field); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be true or false", field)
+			}
+			*dst = b
+		}
+	}
+	return opts, nil
+}
+
+// previewFile reports whether a path inside an adventure's output directory
+// belongs to the free preview: the table of contents and cover pages.
+func previewFile(name string) bool {
+	return name == "Prompt.md" || strings.HasPrefix(name, "00_Contents/")
+}
+
+// serveOutputs serves generated adventures from files, withholding all but
+// the preview of adventures that have not been paid for. It guards the
+// outputs and the archive alike.
+//
+// Parameters:
+//   - files: http.Handler serving the outputs or archive directory
+//
+// Returns:
+//   - http.HandlerFunc: Handler that answers 402 for locked files
+func (ui *GeneratorUI) serveOutputs(files http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ui.cfg.Paywall.Enabled {
+			files.ServeHTTP(w, r)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+chi.URLParam(r, "*")), "/")
+		adventureID, rest, _ := strings.Cut(name, "/")
+		if previewFile(rest) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		adventureID = strings.TrimSuffix(adventureID, ".zip")
+		job, err := ui.jobs.Get(adventureID)
+		if err != nil {
+			slog.Error("reading job", "adventure", adventureID, "error", err)
+			http.Error(w, "Download unavailable", http.StatusInternalServerError)
+			return
+		}
+		if job != nil && !job.Paid {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Fprintf(w, `<p>This adventure is a free preview. <a href="/library/%s/unlock">Unlock the full adventure</a> to download it.</p>`,
+				template.HTMLEscapeString(adventureID))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}
+}
+
+// paymentCookie is the cookie the paywall sets when it starts a payment.
+const paymentCookie = "__Host-payment_id"
+
+// checkoutRecorder binds the payment a paywall starts while serving a
+// request to the adventure being unlocked, by reading the paywall's cookie
+// from the response before it is sent.
+type checkoutRecorder struct {
+	http.ResponseWriter
+	bind  func(paymentID string)
+	bound bool
+}
+
+func (c *checkoutRecorder) WriteHeader(status int) {
+	c.record()
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *checkoutRecorder) Write(b []byte) (int, error) {
+	c.record()
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *checkoutRecorder) record() {
+	if c.bound {
+		return
+	}
+	c.bound = true
+	for _, cookie := range (&http.Response{Header: c.Header()}).Cookies() {
+		if cookie.Name == paymentCookie && cookie.Value != "" {
+			c.bind(cookie.Value)
+		}
+	}
+}
+
+// handleUnlock takes payment for one of the caller's preview adventures at
+// the price of its tier, then makes the full adventure downloadable. Each
+// payment is bound to the adventure it was started for and unlocks it once:
+// a payment confirmed for another adventure, or already used, is refused
+// and its cookie cleared so that the next visit starts a new payment.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the payment page or redirect
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if the adventure does not belong to the caller
+//   - Returns 400 if no tier covers the adventure's options
+//   - Returns 402 if the payment was made for another adventure or used
+func (ui *GeneratorUI) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ui.ownedAdventure(w, r)
+	if !ok {
+		return
+	}
+	back := "/library/" + entry.AdventureID
+	job, err := ui.jobs.Get(entry.AdventureID)
+	if err != nil {
+		slog.Error("reading job", "adventure", entry.AdventureID, "error", err)
+		http.Error(w, "Adventure unavailable", http.StatusInternalServerError)
+		return
+	}
+	if !ui.cfg.Paywall.Enabled || job == nil || job.Paid {
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	tierName := job.Tier
+	pw, ok := ui.paywalls[tierName]
+	if !ok {
+		// The tier was renamed or removed since the job was queued.
+		tier, found := tierFor(ui.cfg.Paywall, jobOptions(job))
+		if !found {
+			http.Error(w, "No pricing tier offers this adventure", http.StatusBadRequest)
+			return
+		}
+		tierName = tier.Name
+		pw = ui.paywalls[tierName]
+	}
+	// A payment started for another adventure must not be shown, and paid,
+	// here: without its cookie the paywall starts a new payment.
+	if cookie, err := r.Cookie(paymentCookie); err == nil {
+		if bound, err := ui.jobs.PaymentAdventure(cookie.Value); err == nil && bound != "" && bound != job.AdventureID {
+			withoutCookie(r, paymentCookie)
+		}
+	}
+	recorder := &checkoutRecorder{ResponseWriter: w, bind: func(paymentID string) {
+		if err := ui.jobs.BindPayment(job.AdventureID, paymentID); err != nil {
+			slog.Error("binding payment", "adventure", job.AdventureID, "error", err)
+		}
+	}}
+	paywalled(pw, func(w http.ResponseWriter, r *http.Request) {
+		var paymentID string
+		if cookie, err := r.Cookie("payment_id"); err == nil {
+			paymentID = cookie.Value
+		}
+		redeemed, err := ui.jobs.RedeemPayment(job.AdventureID, paymentID)
+		if err != nil {
+			slog.Error("recording payment", "adventure", job.AdventureID, "error", err)
+			http.Error(w, "Could not unlock adventure", http.StatusInternalServerError)
+			return
+		}
+		if !redeemed {
+			slog.Warn("payment refused for adventure", "adventure", job.AdventureID, "tier", tierName)
+			clearPaymentCookie(w)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Fprintf(w, `<p>This payment was made for another adventure or has already been used. <a href="/library/%s/unlock">Start a new payment</a> for this one.</p>`,
+				template.HTMLEscapeString(job.AdventureID))
+			return
+		}
+		metrics.PaywallConversions.WithLabelValues(tierName, "unlock").Inc()
+		slog.Info("adventure unlocked", "adventure", job.AdventureID, "tier", tierName)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	})(recorder, r)
+}
+
+// jobOptions returns the generation options a job was queued with.
+func jobOptions(job *queue.Job) generator.Options {
+	return generator.Options{Episodes: job.Episodes, Images: job.Images, PDF: job.PDF}
+}
+
+// clearPaymentCookie drops the paywall's cookie so that the browser's next
+// request starts a new payment.
+func clearPaymentCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: paymentCookie, Path: "/", MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+}
+
+// withoutCookie removes the named cookie from the request.
+func withoutCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
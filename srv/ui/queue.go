@@ -0,0 +1,55 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/opd-ai/dndbot/srv/queue"
+)
+
+// handleQueuePosition reports where a session's job sits in the generation queue.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON response
+//   - r: *http.Request with the sessionID URL parameter
+//
+// Responds with {"position": n}, where position 0 means the session has no
+// waiting job (it is running, finished or was never queued).
+func (ui *GeneratorUI) handleQueuePosition(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "sessionID")
+	if !isValidSession(sessionID) {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+
+	position, err := ui.jobs.Position(sessionID)
+	if err != nil && !errors.Is(err, queue.ErrNotQueued) {
+		slog.Error("looking up queue position", "session", sessionID, "error", err)
+		http.Error(w, "Queue unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"position": position})
+}
+
+// handleQueueStats returns the queue depth and per-state job counts for operators.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON response
+//   - r: *http.Request containing the incoming request details
+func (ui *GeneratorUI) handleQueueStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := ui.jobs.Stats()
+	if err != nil {
+		slog.Error("reading queue stats", "error", err)
+		http.Error(w, "Queue unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,208 @@
+package ui
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/metrics"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/dndbot/srv/retention"
+)
+
+// scratchDir is where the dndbot package saves adventures while they are
+// being generated.
+const scratchDir = "tmp"
+
+// retentionReport is the outcome of a retention run, as returned by
+// /admin/retention.
+type retentionReport struct {
+	retention.Plan
+	DryRun bool `json:"dry_run"`
+	// ScratchFiles and ScratchReclaimed count the stale entries of the
+	// scratch directory and their size.
+	ScratchFiles     int   `json:"scratch_files"`
+	ScratchReclaimed int64 `json:"scratch_reclaimed_bytes"`
+	// Failed counts the decisions that could not be carried out.
+	Failed int `json:"failed"`
+}
+
+// runRetention applies the retention policy on behalf of the cleanup
+// routine, only logging the plan when the policy is a dry run.
+func (ui *GeneratorUI) runRetention() {
+	report, err := ui.applyRetention(ui.cfg.Retention.DryRun)
+	if err != nil {
+		slog.Error("applying retention policy", "error", err)
+		return
+	}
+	if len(report.Decisions) == 0 && report.ScratchFiles == 0 {
+		return
+	}
+	slog.Info("applied retention policy",
+		"dry_run", report.DryRun,
+		"decisions", len(report.Decisions),
+		"failed", report.Failed,
+		"stored_bytes", report.Stored,
+		"reclaimed_bytes", report.Reclaimed+report.ScratchReclaimed,
+		"archived_bytes", report.Archived,
+	)
+}
+
+// applyRetention plans which adventures to archive and delete and, unless
+// dryRun is set, carries the plan out along with the pruning of stale
+// scratch files. Runs are serialized.
+//
+// Parameters:
+//   - dryRun: only report what would be done
+//
+// Returns:
+//   - retentionReport: the plan and what became of it
+//   - error: any error listing the stored adventures
+func (ui *GeneratorUI) applyRetention(dryRun bool) (retentionReport, error) {
+	ui.retentionM.Lock()
+	defer ui.retentionM.Unlock()
+
+	now := time.Now()
+	adventures, err := ui.storedAdventures()
+	if err != nil {
+		return retentionReport{}, err
+	}
+	report := retentionReport{
+		Plan:   retention.NewPlan(ui.cfg.Retention, adventures, now),
+		DryRun: dryRun,
+	}
+	if after := ui.cfg.Retention.TmpAfter; after > 0 {
+		report.ScratchFiles, report.ScratchReclaimed, err = retention.PruneDir(scratchDir, now.Add(-after), dryRun)
+		if err != nil {
+			slog.Error("pruning scratch files", "dir", scratchDir, "error", err)
+		}
+	}
+	metrics.StoredBytes.Set(float64(report.Stored))
+	metrics.RetentionPlanned.Set(float64(report.Reclaimed + report.ScratchReclaimed))
+	if dryRun {
+		return report, nil
+	}
+
+	metrics.RetentionReclaimed.WithLabelValues("scratch").Add(float64(report.ScratchReclaimed))
+	for _, d := range report.Decisions {
+		if d.Action == retention.ActionArchive {
+			if err := ui.archiveAdventure(d.AdventureID); err != nil {
+				slog.Error("archiving adventure", "adventure", d.AdventureID, "error", err)
+				report.Failed++
+				continue
+			}
+		} else {
+			ui.deleteAdventure(d.AdventureID)
+			metrics.RetentionReclaimed.WithLabelValues(d.Reason).Add(float64(d.Bytes))
+		}
+		metrics.RetentionAdventures.WithLabelValues(string(d.Action), d.Reason).Inc()
+		slog.Info("retention", "adventure", d.AdventureID, "action", d.Action, "reason", d.Reason, "bytes", d.Bytes)
+	}
+	return report, nil
+}
+
+// storedAdventures lists the adventures the retention policy applies to:
+// those of finished jobs, plus output directories left by releases that
+// predate the job queue, which are deleted rather than archived. Queued and
+// running jobs are never touched.
+func (ui *GeneratorUI) storedAdventures() ([]retention.Adventure, error) {
+	jobs, err := ui.jobs.Finished()
+	if err != nil {
+		return nil, err
+	}
+	var adventures []retention.Adventure
+	known := map[string]bool{}
+	for _, job := range jobs {
+		known[job.AdventureID] = true
+		dir := ui.jobDir(&job)
+		adventures = append(adventures, retention.Adventure{
+			ID:       job.AdventureID,
+			Owner:    jobOwner(job),
+			Created:  job.CreatedAt,
+			Paid:     ui.cfg.Paywall.Enabled && job.Paid,
+			Complete: job.State == queue.JobCompleted,
+			Locked:   !job.Paid,
+			Archived: job.Archived,
+			Size:     retention.Size(dir, dir+".zip"),
+		})
+	}
+
+	entries, err := os.ReadDir(ui.cfg.Storage.Outputs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("listing outputs: %w", err)
+	}
+	for _, entry := range entries {
+		adventureID := strings.TrimSuffix(entry.Name(), ".zip")
+		if known[adventureID] || !isValidSession(adventureID) {
+			continue
+		}
+		known[adventureID] = true
+		if job, err := ui.jobs.Get(adventureID); err != nil || job != nil {
+			continue // queued or running
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dir := ui.gen.OutputDir(adventureID)
+		adventures = append(adventures, retention.Adventure{
+			ID:      adventureID,
+			Owner:   adventureID,
+			Created: info.ModTime(),
+			Size:    retention.Size(dir, dir+".zip"),
+		})
+	}
+	return adventures, nil
+}
+
+// jobOwner names the user a job's adventure counts against: its account,
+// or its browser session when it was created anonymously.
+func jobOwner(job queue.Job) string {
+	if job.AccountID != 0 {
+		return "account:" + strconv.FormatInt(job.AccountID, 10)
+	}
+	return job.SessionID
+}
+
+// handleAdminRetention reports what the retention policy would archive and
+// delete as JSON, without touching any file.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON response
+//   - r: *http.Request from an operator
+//
+// Error cases:
+//   - Returns 500 if the stored adventures cannot be listed
+func (ui *GeneratorUI) handleAdminRetention(w http.ResponseWriter, r *http.Request) {
+	report, err := ui.applyRetention(true)
+	if err != nil {
+		slog.Error("planning retention", "error", err)
+		http.Error(w, "Retention report unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// handleAdminRetentionRun applies the retention policy immediately, even
+// when retention.dry_run is set, and returns what was done as JSON.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON response
+//   - r: *http.Request from an operator
+//
+// Error cases:
+//   - Returns 500 if the stored adventures cannot be listed
+func (ui *GeneratorUI) handleAdminRetentionRun(w http.ResponseWriter, r *http.Request) {
+	report, err := ui.applyRetention(false)
+	if err != nil {
+		slog.Error("applying retention policy", "error", err)
+		http.Error(w, "Retention run failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("retention run by operator", "decisions", len(report.Decisions), "failed", report.Failed)
+	writeJSON(w, report)
+}
@@ -0,0 +1,135 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/opd-ai/dndbot/srv/auth"
+)
+
+// sessionCookie names the HttpOnly cookie carrying the server-side session token.
+const sessionCookie = "dndbot_session"
+
+// legacySessionCookie is the script-readable cookie that used to hold the
+// session ID itself. It is adopted once and then cleared.
+const legacySessionCookie = "session_id"
+
+type sessionKey struct{}
+
+// sessionMiddleware resolves the caller's server-side session from the
+// session cookie, creating one when the browser has none, and stores it in
+// the request context for currentSession.
+//
+// Parameters:
+//   - next: http.Handler to run with the session attached
+//
+// Returns:
+//   - http.Handler: Middleware that attaches the session and sets X-Session-Id
+//
+// A browser still carrying the legacy session_id cookie keeps its session ID,
+// and so its adventures, when it is upgraded to a server-side session.
+// Requests already authenticated by apiKeyMiddleware pass through unchanged.
+func (ui *GeneratorUI) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentSession(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var sess *auth.Session
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			sess, err = ui.accounts.Session(cookie.Value)
+			if err != nil && !errors.Is(err, auth.ErrNotFound) {
+				slog.Error("reading session", "error", err)
+				http.Error(w, "Session unavailable", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if sess == nil {
+			sessionID := uuid.New().String()
+			if cookie, err := r.Cookie(legacySessionCookie); err == nil && isValidSession(cookie.Value) {
+				sessionID = cookie.Value
+				http.SetCookie(w, &http.Cookie{Name: legacySessionCookie, Path: "/", MaxAge: -1})
+			}
+			var err error
+			if sess, err = ui.accounts.NewSession(sessionID); err != nil {
+				slog.Error("creating session", "session", sessionID, "error", err)
+				http.Error(w, "Session unavailable", http.StatusInternalServerError)
+				return
+			}
+			ui.setSessionCookie(w, sess)
+		}
+
+		w.Header().Set("X-Session-Id", sess.ID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, sess)))
+	})
+}
+
+// setSessionCookie hands a session token to the browser.
+//
+// Parameters:
+//   - w: http.ResponseWriter to set the cookie on
+//   - sess: session whose Token should be stored
+func (ui *GeneratorUI) setSessionCookie(w http.ResponseWriter, sess *auth.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.Token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   ui.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// currentSession returns the session attached by sessionMiddleware.
+//
+// Parameters:
+//   - r: *http.Request that passed through sessionMiddleware
+//
+// Returns:
+//   - *auth.Session: the caller's session, or nil outside the middleware
+func currentSession(r *http.Request) *auth.Session {
+	sess, _ := r.Context().Value(sessionKey{}).(*auth.Session)
+	return sess
+}
+
+// csrfMiddleware rejects state-changing requests that do not carry the
+// session's CSRF token in the X-CSRF-Token header or csrf_token form field.
+// API key requests are exempt: browsers never attach the key on their own.
+//
+// Parameters:
+//   - next: http.Handler to protect
+//
+// Returns:
+//   - http.Handler: Middleware that answers 403 on a missing or wrong token
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if currentAPIKey(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess := currentSession(r)
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			token = r.FormValue("csrf_token")
+		}
+		if sess == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
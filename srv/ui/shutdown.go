@@ -0,0 +1,85 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/opd-ai/dndbot/srv/generator"
+	"github.com/opd-ai/dndbot/srv/metrics"
+)
+
+// acceptingJobs wraps a handler that queues generations so that it answers
+// 503 once shutdown has begun, before any payment is taken.
+//
+// Parameters:
+//   - h: http.HandlerFunc that queues a generation
+//
+// Returns:
+//   - http.HandlerFunc: Handler that refuses new jobs while shutting down
+func (ui *GeneratorUI) acceptingJobs(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ui.draining.Load() {
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "Server is restarting, please try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// Shutdown stops generating adventures. New generation requests are refused
+// and /readyz starts failing. Running generations finish their current step
+// and stop; any still running when ctx ends are interrupted. Either way they
+// are checkpointed and requeued, and resume from their last finished step on
+// the next start. Queued jobs stay queued.
+//
+// The HTTP server may keep serving while Shutdown runs, so clients can follow
+// the progress of the draining generations. Call Close afterwards.
+//
+// Parameters:
+//   - ctx: bounds how long running steps may take to finish
+//
+// Returns:
+//   - error: ctx.Err() if generations had to be interrupted
+func (ui *GeneratorUI) Shutdown(ctx context.Context) error {
+	ui.draining.Store(true)
+	ui.gen.Drain()
+	err := ui.jobs.Drain(ctx)
+	if err != nil {
+		slog.Warn("interrupting running generations", "error", err)
+		ui.stopWorkers(generator.ErrInterrupted)
+		ui.jobs.Wait()
+	}
+	slog.Info("generation workers stopped")
+	return err
+}
+
+// Close writes the final metrics snapshot, if configured, waits for emails
+// being sent, stops webhook deliveries, leaving pending ones for the next
+// start, and closes the job, history, account and webhook databases,
+// flushing them to disk. Call it after Shutdown once the HTTP server has
+// stopped.
+//
+// Returns:
+//   - error: every error met while flushing and closing
+func (ui *GeneratorUI) Close() error {
+	var errs []error
+	if path := ui.cfg.Storage.MetricsFile; path != "" {
+		if err := metrics.WriteFile(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	closers := []interface{ Close() error }{ui.webhooks, ui.jobs, ui.history, ui.accounts}
+	if ui.mailer != nil {
+		closers = append([]interface{ Close() error }{ui.mailer}, closers...)
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
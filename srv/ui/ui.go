@@ -2,22 +2,29 @@
 package ui
 
 import (
-	"encoding/json"
-	"io"
-	"log"
+	"context"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httprate"
-	"github.com/google/uuid"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/patrickmn/go-cache"
 
+	dndbot "github.com/opd-ai/dndbot/src"
+	"github.com/opd-ai/dndbot/srv/auth"
+	"github.com/opd-ai/dndbot/srv/config"
+	"github.com/opd-ai/dndbot/srv/email"
 	"github.com/opd-ai/dndbot/srv/generator"
+	"github.com/opd-ai/dndbot/srv/logging"
+	"github.com/opd-ai/dndbot/srv/metrics"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/dndbot/srv/webhook"
 	"github.com/opd-ai/paywall"
 
 	secure "github.com/srikrsna/security-headers"
@@ -26,31 +33,55 @@ import (
 // GeneratorUI manages the web interface for the DND adventure generator.
 // It handles session management, message history, and HTTP routing.
 type GeneratorUI struct {
-	router      chi.Router
-	sessions    map[string]*generator.GenerationProgress
-	sessionsM   sync.RWMutex
-	msgHistory  map[string]*MessageHistory
-	cache       *cache.Cache
-	historyFile string
-	zoltar      *paywall.Paywall
-	usePaywall  bool
+	router chi.Router
+	// generations holds the progress of the generations running in this
+	// process, keyed by adventure ID.
+	generations  map[string]*generator.GenerationProgress
+	generationsM sync.RWMutex
+	history      HistoryStore
+	cache        *cache.Cache
+	cfg          *config.Config
+	gen          *generator.Generator
+	// requests records recent anonymous generation requests for rateLimit.
+	requests *requestLog
+	// paywalls holds one paywall per pricing tier, keyed by tier name.
+	paywalls map[string]*paywall.Paywall
+	jobs     *queue.Queue
+	accounts *auth.Store
+	webauthn *webauthn.WebAuthn
+	// secureCookies marks session cookies Secure when the site is served over HTTPS.
+	secureCookies bool
+	webhooks      *webhook.Dispatcher
+	// mailer sends the ready emails; nil unless an SMTP relay is configured.
+	mailer *email.Sender
+	// stopWorkers interrupts running jobs; draining is set once Shutdown
+	// has begun.
+	stopWorkers context.CancelCauseFunc
+	draining    atomic.Bool
+	// retentionM serializes retention runs.
+	retentionM sync.Mutex
 }
 
 // NewGeneratorUI creates and initializes a new GeneratorUI instance.
 //
+// Parameters:
+//   - cfg: validated server configuration; storage paths, limits, paywall
+//     and generator settings are all taken from it
+//
 // Returns:
 //   - *GeneratorUI: Configured UI handler with initialized routes and session management
 //
-// Sets up message handling, loads history, initializes cleanup routines,
-// and configures HTTP routes.
-func NewGeneratorUI(usePaywall bool) *GeneratorUI {
+// Sets up message handling, loads history and accounts, starts the paywalls,
+// webhook deliveries and email notifications, initializes cleanup routines,
+// recovers interrupted jobs, starts the worker pool and configures HTTP routes.
+func NewGeneratorUI(cfg *config.Config) *GeneratorUI {
 	ui := &GeneratorUI{
 		router:      chi.NewRouter(),
-		sessions:    make(map[string]*generator.GenerationProgress),
-		msgHistory:  make(map[string]*MessageHistory),
+		generations: make(map[string]*generator.GenerationProgress),
 		cache:       cache.New(24*time.Hour, 1*time.Hour),
-		historyFile: "session_history.json",
-		usePaywall:  usePaywall,
+		cfg:         cfg,
+		gen:         generator.New(cfg.Generator, cfg.Storage.Outputs, cfg.Log.SessionFiles),
+		requests:    &requestLog{requests: make(map[string][]time.Time)},
 	}
 
 	// Set up message emitter
@@ -58,156 +89,117 @@ func NewGeneratorUI(usePaywall bool) *GeneratorUI {
 		ui.AddMessage(sessionID, msg)
 		return nil
 	})
-
-	ui.loadHistory()
+	dndbot.SetObserver(metrics.Backends{})
+
+	ui.openHistory()
+	ui.openAccounts()
+	ui.openPaywalls()
+	ui.openWebhooks()
+	ui.openMailer()
+	ui.startQueue()
 	ui.setupRoutes()
 	ui.startCleanup()
 	return ui
 }
 
-// startCleanup initiates background goroutines for periodic maintenance tasks.
-// Runs two concurrent tasks:
-// - Session cleanup every 100 minutes
-// - History saving every 50 minutes
-func (ui *GeneratorUI) startCleanup() {
-	go func() {
-		cleanupTicker := time.NewTicker(100 * time.Minute)
-		saveTicker := time.NewTicker(50 * time.Minute)
-		defer cleanupTicker.Stop()
-		defer saveTicker.Stop()
-
-		for {
-			select {
-			case <-cleanupTicker.C:
-				ui.cleanupOldSessions()
-			case <-saveTicker.C:
-				ui.saveHistory()
-			}
-		}
-	}()
-}
-
-// cleanupOldSessions removes sessions that have been inactive for more than 1 hour.
-// Saves history if any sessions are removed.
-func (ui *GeneratorUI) cleanupOldSessions() {
-	ui.sessionsM.Lock()
-	defer ui.sessionsM.Unlock()
-
-	changed := false
-	for sessionID, history := range ui.msgHistory {
-		history.mu.RLock()
-		if len(history.Messages) > 0 {
-			lastMsg := history.Messages[len(history.Messages)-1]
-			if time.Since(lastMsg.Timestamp) > 1*time.Hour {
-				delete(ui.msgHistory, sessionID)
-				changed = true
-			}
-		}
-		history.mu.RUnlock()
+// startQueue opens the persistent job queue, requeues any jobs interrupted by
+// a previous shutdown and starts the configured number of generation workers.
+func (ui *GeneratorUI) startQueue() {
+	jobs, err := queue.Open(ui.cfg.Storage.JobsDB)
+	if err != nil {
+		logging.Fatal("opening job queue", "error", err)
 	}
-
-	// Save history if any sessions were cleaned up
-	if changed {
-		ui.saveHistory()
+	recovered, err := jobs.Recover()
+	if err != nil {
+		logging.Fatal("recovering jobs", "error", err)
+	}
+	if recovered > 0 {
+		slog.Info("requeued interrupted generation jobs", "count", recovered)
 	}
+	ui.jobs = jobs
+	metrics.WatchQueue(jobs)
+	ctx, stop := context.WithCancelCause(context.Background())
+	ui.stopWorkers = stop
+	ui.jobs.Start(ctx, ui.cfg.Server.Workers, ui.runJob)
 }
 
-// loadHistory restores message history from persistent storage and cache.
-// Attempts to load from file first, then updates with any newer cache data.
-// Creates history file if it doesn't exist.
-func (ui *GeneratorUI) loadHistory() {
-	// Load from persistent storage first
-	file, err := os.OpenFile(ui.historyFile, os.O_RDONLY|os.O_CREATE, 0o644)
+// openHistory opens the SQLite message history store and migrates any
+// legacy JSON history file into it.
+func (ui *GeneratorUI) openHistory() {
+	store, err := OpenSQLiteHistory(ui.cfg.Storage.HistoryDB)
 	if err != nil {
-		log.Printf("Error opening history file: %v", err)
-		return
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	var history map[string]*MessageHistory
-	if err := decoder.Decode(&history); err != nil && err != io.EOF {
-		log.Printf("Error decoding history: %v", err)
-	} else if err == nil {
-		ui.msgHistory = history
+		logging.Fatal("opening history", "error", err)
 	}
-
-	// Then check cache for any newer data
-	data, ok := ui.cache.Get("message_history")
-	if ok {
-		if history, ok := data.(map[string]*MessageHistory); ok {
-			ui.msgHistory = history
-		}
+	legacy := ui.cfg.Storage.LegacyHistory
+	imported, err := ImportJSONHistory(store, legacy)
+	if err != nil {
+		slog.Error("importing legacy history", "error", err)
+	} else if imported > 0 {
+		slog.Info("imported legacy history", "count", imported, "path", legacy)
 	}
+	ui.history = store
 }
 
-// saveHistory persists the current message history to both cache and file storage.
-// Thread-safe operation that maintains message history in two locations:
-// - In-memory cache for quick access
-// - JSON file for persistence across restarts
-func (ui *GeneratorUI) saveHistory() {
-	ui.sessionsM.Lock()
-	defer ui.sessionsM.Unlock()
+// startCleanup initiates a background goroutine that applies the history
+// and output retention policies and drops expired sessions every cleanup
+// interval.
+func (ui *GeneratorUI) startCleanup() {
+	go func() {
+		cleanupTicker := time.NewTicker(ui.cfg.Storage.CleanupInterval)
+		defer cleanupTicker.Stop()
 
-	// Save to cache
-	ui.cache.Set("message_history", ui.msgHistory, cache.DefaultExpiration)
+		for range cleanupTicker.C {
+			ui.pruneHistory()
+			ui.runRetention()
+			ui.requests.prune(ui.cfg.Limits.GenerationWindow)
+			if _, err := ui.accounts.PruneSessions(); err != nil {
+				slog.Error("pruning sessions", "error", err)
+			}
+		}
+	}()
+}
 
-	// Save to file
-	file, err := os.OpenFile(ui.historyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+// pruneHistory removes the history of sessions that have been inactive for
+// longer than the retention period.
+func (ui *GeneratorUI) pruneHistory() {
+	retention := ui.cfg.Storage.HistoryRetention
+	removed, err := ui.history.Prune(time.Now().Add(-retention))
 	if err != nil {
-		log.Printf("Error opening history file for writing: %v", err)
+		slog.Error("pruning history", "error", err)
 		return
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(ui.msgHistory); err != nil {
-		log.Printf("Error encoding history: %v", err)
+	if removed > 0 {
+		slog.Info("pruned history", "count", removed, "retention", retention)
 	}
 }
 
-// AddMessage adds a new message to a session's history and persists the update.
+// AddMessage appends a new message to a session's persistent history.
 //
 // Parameters:
 //   - sessionID: string identifier for the session
 //   - msg: generator.Message to add to history
-//
-// Creates new history if session doesn't exist.
 func (ui *GeneratorUI) AddMessage(sessionID string, msg generator.Message) {
-	ui.sessionsM.Lock()
-	history, exists := ui.msgHistory[sessionID]
-	if !exists {
-		history = &MessageHistory{
-			Messages: make([]generator.Message, 0),
-		}
-		ui.msgHistory[sessionID] = history
+	if err := ui.history.Append(sessionID, msg); err != nil {
+		slog.Error("saving message", "session", sessionID, "error", err)
 	}
-	ui.sessionsM.Unlock()
-
-	history.AddMessage(msg)
-	ui.saveHistory()
 }
 
-// cleanupSession handles the graceful shutdown of a generation session.
+// cleanupGeneration handles the graceful shutdown of a generation.
 //
 // Parameters:
-//   - sessionID: string identifier for the session to cleanup
-//   - progress: *generator.GenerationProgress associated with the session
+//   - progress: *generator.GenerationProgress of the generation
 //
-// Closes WebSocket connections, removes from active sessions,
-// caches progress, and saves history.
-func (ui *GeneratorUI) cleanupSession(sessionID string, progress *generator.GenerationProgress) {
+// Closes WebSocket connections, removes the generation from the running
+// ones and caches its progress under its adventure ID.
+func (ui *GeneratorUI) cleanupGeneration(progress *generator.GenerationProgress) {
 	progress.SetActive(false)
 
-	ui.sessionsM.Lock()
-	delete(ui.sessions, sessionID)
-	ui.sessionsM.Unlock()
+	ui.generationsM.Lock()
+	delete(ui.generations, progress.AdventureID)
+	ui.generationsM.Unlock()
 
 	// Cache the progress for later retrieval
-	ui.cache.Set(sessionID, progress, 24*time.Hour)
-
-	// Save history after cleanup
-	ui.saveHistory()
+	ui.cache.Set(progress.AdventureID, progress, 24*time.Hour)
 
 	close(progress.Done)
 }
@@ -232,9 +224,11 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With, HX-Request, HX-Current-URL")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-CSRF-Token, X-Requested-With, HX-Request, HX-Current-URL")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Expose-Headers", "X-Session-Id")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Session-Id, X-Adventure-Id, "+
+			"X-Quota-Adventures-Limit, X-Quota-Adventures-Remaining, X-Quota-Adventures-Reset, "+
+			"X-Quota-Tokens-Limit, X-Quota-Tokens-Remaining, X-Quota-Tokens-Reset")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 
 		if r.Method == "OPTIONS" {
@@ -246,6 +240,42 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// quietPaths are probed often by monitoring, so their requests are only
+// logged at debug level.
+var quietPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// requestLogger logs every request with its status, size and duration.
+//
+// Parameters:
+//   - next: http.Handler to wrap with request logging
+//
+// Returns:
+//   - http.Handler: Middleware that logs each request once it completes
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		level := slog.LevelInfo
+		if quietPaths[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", ww.Status(),
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
 func hstsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
@@ -256,177 +286,174 @@ func hstsMiddleware(next http.Handler) http.Handler {
 // setupRoutes configures all HTTP routes and middleware for the UI.
 // Sets up:
 // - Standard middleware (logging, recovery, CORS)
-// - Session management
+// - Server-side sessions and CSRF protection
+// - Per-tier paywalls on generation or, in free preview mode, on downloads
 // - Static file serving
 // - API endpoints
+// - Health probes and Prometheus metrics
+// - The operator dashboard and retention report
 func (ui *GeneratorUI) setupRoutes() {
-	csp := &secure.CSP{
-		Value: `default-src 'self'; script-src 'self' {{nonce}} 'sha256-6O8L648x8Xhmzia0qI/zQdbTlpVaGehLozFzz/i2dIE=' 'sha256-EekPIHyJRz0hoIvCnNHdTpzW+jhqMbyTyTu2nXJO7b0=' 'sha256-UI0Byo+Bdsa/9HfswzVRrNuMaEt5s26sucqVpf8iPxw=' 'sha256-61RzUnEfEIq/j80eD9kxIi6+FHZECO1+ZjF5aAkRgcI=' 'sha256-2j5Uk7r3oOJ3KJIcT7QE7NrJ0DmojlDl0qjjoQbPsz8=' https://cdnjs.cloudflare.com https://cdn.jsdelivr.net; style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://fonts.googleapis.com; font-src 'self' https://fonts.gstatic.com; img-src 'self' data:;`,
-	}
-	log.Println("csp", csp)
-	// r := chi.NewRouter()
 
 	// Apply middleware
-	ui.router.Use(middleware.Logger)
+	ui.router.Use(requestLogger)
 	ui.router.Use(middleware.Recoverer)
 	ui.router.Use(corsMiddleware)
 	ui.router.Use(httprate.Limit(
-		40,          // requests
-		time.Minute, // per duration
+		ui.cfg.Limits.RequestsPerMinute, // requests
+		time.Minute,                     // per duration
 		httprate.WithKeyFuncs(httprate.KeyByIP, httprate.KeyByEndpoint),
 	))
 	ui.router.Use(hstsMiddleware)
-	// ui.router.Use(csp.Middleware())
-
-	// Session management middleware
-	ui.router.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Ensure session cookie exists
-			sessionID := r.Header.Get("X-Session-Id")
-			if sessionID == "" {
-				log.Println("no client side sessionID:", sessionID)
-				// Try cookie as fallback
-				if cookie, err := r.Cookie("session_id"); err == nil && cookie.Value != "null" {
-					log.Println("cookie found", cookie.Value, err)
-					sessionID = cookie.Value
-				} else {
-					sessionID = uuid.New().String()
-					http.SetCookie(w, &http.Cookie{
-						Name:     "session_id",
-						Value:    sessionID,
-						Path:     "/",
-						MaxAge:   864000,
-						HttpOnly: false,
-						SameSite: http.SameSiteLaxMode,
-					})
-				}
-			}
-			w.Header().Set("X-Session-Id", sessionID)
-			next.ServeHTTP(w, r)
-		})
-	})
-	var err error
-
-	ui.zoltar, err = paywall.NewPaywall(paywall.Config{
-		PriceInBTC:       0.0001, // 0.0001 BTC
-		PriceInXMR:       0.0000, // 0.0001 XMR
-		TestNet:          false,
-		Store:            paywall.NewFileStore("./paywallet"), // Required for payment tracking
-		PaymentTimeout:   time.Hour * 24,
-		MinConfirmations: 1,
-		XMRUser:          "user", // XMR disabled for now
-		XMRPassword:      "password",
-		XMRRPC:           "http://localhost:18081/",
-	})
-	if err != nil {
-		log.Fatal(err)
+	if ui.cfg.Server.EnforceCSP {
+		csp := &secure.CSP{Value: ui.cfg.Server.CSP}
+		ui.router.Use(csp.Middleware())
 	}
 
 	// Routes
-	ui.router.Get("/", ui.handleHome)
-	if ui.usePaywall {
-		ui.router.Post("/generate", ui.zoltar.MiddlewareFuncFunc(rateLimit(ui.handleGenerate)))
-	} else {
-		ui.router.Post("/generate", rateLimit(ui.handleGenerate))
-	}
-	ui.router.Get("/api/messages/{sessionID}", ui.handleGetMessages)
-	ui.router.Get("/check-session", ui.handleCheckSession)
+	ui.router.Group(func(r chi.Router) {
+		// Pages and APIs acting on behalf of a browser session or API key.
+		// Every state-changing browser request must carry the session's
+		// CSRF token; API keys are limited to their scopes.
+		r.Use(ui.apiKeyMiddleware)
+		r.Use(ui.sessionMiddleware)
+		r.Use(csrfMiddleware)
+
+		r.Get("/", ui.handleHome)
+		generate := ui.acceptingJobs(ui.chargeForGeneration(ui.rateLimit(ui.handleGenerate)))
+		r.Post("/generate", requireScope(auth.ScopeGenerate, generate))
+		r.Post("/cancel", requireScope(auth.ScopeGenerate, ui.handleCancel))
+		r.Get("/library", requireScope(auth.ScopeRead, ui.handleLibrary))
+		r.Get("/library/{adventureID}", requireScope(auth.ScopeRead, ui.handleLibraryLog))
+		r.Post("/library/{adventureID}/delete", requireScope(auth.ScopeDelete, ui.handleLibraryDelete))
+		r.Get("/library/{adventureID}/unlock", requireScope(auth.ScopeRead, ui.handleUnlock))
+		r.Get("/library/{adventureID}/webhooks", requireScope(auth.ScopeRead, ui.handleWebhookDeliveries))
+		r.Get("/api/messages/{sessionID}", requireScope(auth.ScopeRead, ui.handleGetMessages))
+		r.Get("/api/usage", requireScope(auth.ScopeRead, ui.handleUsage))
+		r.Get("/check-session", ui.handleCheckSession)
+
+		r.Group(func(r chi.Router) {
+			r.Use(browserOnly)
+			r.Get("/account", ui.handleAccount)
+			r.Post("/account/register", ui.handleRegister)
+			r.Post("/account/login", ui.handleLogin)
+			r.Post("/account/logout", ui.handleLogout)
+			r.Post("/account/passkey/register/begin", ui.handlePasskeyRegisterBegin)
+			r.Post("/account/passkey/register/finish", ui.handlePasskeyRegisterFinish)
+			r.Post("/account/passkey/login/begin", ui.handlePasskeyLoginBegin)
+			r.Post("/account/passkey/login/finish", ui.handlePasskeyLoginFinish)
+			r.Post("/account/keys", ui.handleCreateAPIKey)
+			r.Post("/account/keys/{keyID}/revoke", ui.handleRevokeAPIKey)
+		})
+	})
+	ui.router.Get("/healthz", ui.handleHealth)
+	ui.router.Get("/readyz", ui.handleReady)
+	ui.router.Get("/metrics", ui.handleMetrics)
+	ui.router.Get("/api/queue/{sessionID}", ui.handleQueuePosition)
+	ui.router.Get("/download/{adventureID}", ui.handleDownload)
+	ui.router.Route("/admin", func(r chi.Router) {
+		// Operators only; see adminOnly.
+		r.Use(ui.adminOnly)
+		r.Get("/", ui.handleAdmin)
+		r.Get("/queue", ui.handleQueueStats)
+		r.Get("/report", ui.handleAdminReport)
+		r.Get("/retention", ui.handleAdminRetention)
+		r.Post("/retention", ui.handleAdminRetentionRun)
+		r.Get("/adventures/{adventureID}", ui.handleAdminAdventure)
+		r.Post("/adventures/{adventureID}/cancel", ui.handleAdminCancel)
+		r.Post("/adventures/{adventureID}/retry", ui.handleAdminRetry)
+		r.Post("/adventures/{adventureID}/delete", ui.handleAdminDelete)
+	})
 
-	fileServer := http.FileServer(http.Dir("static"))
+	storage := ui.cfg.Storage
+	fileServer := http.FileServer(http.Dir(storage.Static))
 	ui.router.Handle("/static/*", http.StripPrefix("/static/", fileServer))
-	ui.router.Get("/favicon.ico", handleFavicon)
-	outputServer := http.FileServer(http.Dir("outputs"))
-	ui.router.Handle("/outputs/*", http.StripPrefix("/outputs/", outputServer))
-	archiveServer := http.FileServer(http.Dir("archive"))
-	ui.router.Handle("/archive/*", http.StripPrefix("/archive/", archiveServer))
+	ui.router.Get("/favicon.ico", ui.handleFavicon)
+	outputServer := http.FileServer(http.Dir(storage.Outputs))
+	ui.router.Handle("/outputs/*", adventureFilesOnly(ui.redirectArchived(ui.serveOutputs(http.StripPrefix("/outputs/", outputServer)))))
+	archiveServer := http.FileServer(http.Dir(storage.Archive))
+	ui.router.Handle("/archive/*", adventureFilesOnly(ui.serveOutputs(http.StripPrefix("/archive/", archiveServer))))
 }
 
-// logRequest represents a time-ordered list of request timestamps
-// used for rate limiting.
-type logRequest []time.Time
-
-// update records a new request timestamp.
-//
-// Returns:
-//   - error: any error encountered during update
-func (l logRequest) update() error {
-	l = append(l, time.Now())
-	return nil
+// requestLog records recent generation requests per client so rateLimit can
+// throttle them. It is safe for concurrent use.
+type requestLog struct {
+	mu       sync.Mutex
+	requests map[string][]time.Time
 }
 
-// newLogRequest creates a new request log with the current timestamp.
+// allow records a request from key and reports whether it is within limit
+// requests per window.
 //
-// Returns:
-//   - logRequest: initialized with current time
-func newLogRequest() logRequest {
-	var lr []time.Time
-	lr = append(lr, time.Now())
-	return lr
-}
-
-// limit checks if the request count exceeds 3 requests in the last 4 hours.
+// Parameters:
+//   - key: client identifier, usually the remote IP
+//   - limit: maximum requests allowed in the window
+//   - window: sliding time window
 //
 // Returns:
-//   - bool: true if limit exceeded, false otherwise
-func (l logRequest) limit() bool {
-	count := 0
-	for i := range l {
-		reversei := len(l) - 1 - i
-		lastTime := l[reversei]
-		fourHoursAgo := time.Now().Add(time.Duration(-4) * time.Hour)
-		if lastTime.After(fourHoursAgo) {
-			count++
-		}
-		if count >= 3 {
-			return true
+//   - bool: true if the request is allowed; rejected requests are not recorded
+func (l *requestLog) allow(key string, limit int, window time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-window)
+	recent := l.requests[key][:0]
+	for _, t := range l.requests[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
 		}
 	}
-	l.update()
-	return false
+	if len(recent) >= limit {
+		l.requests[key] = recent
+		return false
+	}
+	l.requests[key] = append(recent, time.Now())
+	return true
 }
 
-var loggedRequests map[net.Addr]logRequest
+// prune forgets clients with no requests inside window.
+func (l *requestLog) prune(window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-func init() {
-	loggedRequests = make(map[net.Addr]logRequest)
+	cutoff := time.Now().Add(-window)
+	for key, times := range l.requests {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(l.requests, key)
+		}
+	}
 }
 
-// rateLimit wraps an http.HandlerFunc with request rate limiting.
+// rateLimit wraps an http.HandlerFunc with per-IP request rate limiting:
+// anonymous clients get the configured number of generations per window.
+// Requests authenticated with an API key are governed by the key's quota
+// instead.
 //
 // Parameters:
 //   - h: http.HandlerFunc to protect with rate limiting
 //
 // Returns:
 //   - http.HandlerFunc: Handler that enforces rate limits
-func rateLimit(h http.HandlerFunc) http.HandlerFunc {
+func (ui *GeneratorUI) rateLimit(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		remoteIP := r.Header.Get("REMOTE_ADDR")
-		if limit, err := exceededTheLimit(remoteIP); err != nil || limit {
-			w.WriteHeader(429)
-			// it then returns, not passing the request down the chain
-		} else {
+		if currentAPIKey(r) != nil {
 			h.ServeHTTP(w, r)
+			return
 		}
+		limits := ui.cfg.Limits
+		if !ui.requests.allow(clientIP(r), limits.GenerationsPerWindow, limits.GenerationWindow) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
 	}
 }
 
-// exceededTheLimit checks if a given IP has exceeded the rate limit.
-//
-// Parameters:
-//   - remoteIP: string IP address to check
-//
-// Returns:
-//   - bool: true if limit exceeded
-//   - error: any error in IP resolution
-func exceededTheLimit(remoteIP string) (bool, error) {
-	ipAddr, err := net.ResolveIPAddr("ip", remoteIP)
+// clientIP returns the IP address of the connection that sent r. Headers
+// such as X-Forwarded-For are ignored since clients can set them freely.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return true, err
-	}
-	logs, ok := loggedRequests[ipAddr]
-	if !ok {
-		loggedRequests[ipAddr] = newLogRequest()
-		return false, nil
+		return r.RemoteAddr
 	}
-	return logs.limit(), nil
+	return host
 }
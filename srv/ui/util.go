@@ -3,6 +3,7 @@ package ui
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/google/uuid"
@@ -28,6 +29,22 @@ func isValidSession(sessionID string) bool {
 	return err == nil
 }
 
+// sessionFromRequest returns the caller's session ID from the server-side
+// session attached by sessionMiddleware. Client-supplied X-Session-Id
+// headers are not trusted.
+//
+// Parameters:
+//   - r: *http.Request to inspect
+//
+// Returns:
+//   - string: the session ID, or empty outside the session middleware
+func sessionFromRequest(r *http.Request) string {
+	if sess := currentSession(r); sess != nil {
+		return sess.ID
+	}
+	return ""
+}
+
 // formatMessages converts a slice of WebSocket messages into HTML representation.
 //
 // Parameters:
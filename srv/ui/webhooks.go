@@ -0,0 +1,115 @@
+// Package ui provides the web user interface handlers for the DND bot generator
+package ui
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opd-ai/dndbot/srv/logging"
+	"github.com/opd-ai/dndbot/srv/queue"
+	"github.com/opd-ai/dndbot/srv/webhook"
+)
+
+// openWebhooks opens the webhook database and starts delivering, resuming
+// any deliveries left pending by a previous process.
+func (ui *GeneratorUI) openWebhooks() {
+	hooks, err := webhook.Open(ui.cfg.Storage.WebhooksDB)
+	if err != nil {
+		logging.Fatal("opening webhooks", "error", err)
+	}
+	cfg := ui.cfg.Webhooks
+	if cfg.Enabled {
+		hooks.Client = webhook.NewClient(cfg.Timeout, cfg.AllowPrivateNetworks)
+		hooks.MaxAttempts = cfg.MaxAttempts
+		hooks.Backoff = cfg.Backoff
+	}
+	hooks.Start()
+	ui.webhooks = hooks
+}
+
+// webhookEvents maps the final state of a job to the event reported for it.
+var webhookEvents = map[queue.JobState]webhook.Event{
+	queue.JobCompleted: webhook.EventCompleted,
+	queue.JobFailed:    webhook.EventFailed,
+	queue.JobCancelled: webhook.EventCancelled,
+}
+
+// notifyWebhook queues a notification of a finished job for the webhook
+// registered with it, if any.
+//
+// Parameters:
+//   - job: the finished job
+//   - state: its final state
+//   - jobErr: why it failed or was cancelled, or nil
+//   - tokens: Claude tokens it used in total
+func (ui *GeneratorUI) notifyWebhook(job *queue.Job, state queue.JobState, jobErr error, tokens int64) {
+	finished := time.Now()
+	payload := webhook.Payload{
+		Event:       webhookEvents[state],
+		AdventureID: job.AdventureID,
+		State:       string(state),
+		CreatedAt:   job.CreatedAt,
+		FinishedAt:  finished,
+		Usage: webhook.Usage{
+			Tokens:   tokens,
+			Episodes: job.Episodes,
+			Images:   job.Images,
+			PDF:      job.PDF,
+			Tier:     job.Tier,
+		},
+	}
+	if jobErr != nil {
+		payload.Error = jobErr.Error()
+	}
+	if !job.StartedAt.IsZero() {
+		payload.Usage.DurationSeconds = finished.Sub(job.StartedAt).Seconds()
+	}
+
+	outDir := ui.gen.OutputDir(job.AdventureID)
+	if _, err := os.Stat(outDir + ".zip"); err == nil {
+		origin := ui.cfg.SiteOrigin()
+		payload.Downloads = &webhook.Downloads{
+			Zip:    origin + "/outputs/" + job.AdventureID + ".zip",
+			Locked: ui.cfg.Paywall.Enabled && !job.Paid,
+		}
+		if _, err := os.Stat(filepath.Join(outDir, "adventure.pdf")); err == nil {
+			payload.Downloads.PDF = origin + "/outputs/" + job.AdventureID + "/adventure.pdf"
+		}
+	}
+
+	if err := ui.webhooks.Notify(payload); err != nil {
+		slog.Error("queueing webhook", "adventure", job.AdventureID, "error", err)
+	}
+}
+
+// handleWebhookDeliveries lists the webhook deliveries made for one of the
+// caller's adventures, with the outcome of each one's latest attempt.
+//
+// Parameters:
+//   - w: http.ResponseWriter to write the JSON delivery log
+//   - r: *http.Request with the adventureID URL parameter
+//
+// Error cases:
+//   - Returns 404 if the adventure does not belong to the caller
+//   - Returns 500 if the log cannot be read
+func (ui *GeneratorUI) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	entry, ok := ui.ownedAdventure(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := ui.webhooks.Deliveries(entry.AdventureID)
+	if err != nil {
+		slog.Error("reading webhook deliveries", "adventure", entry.AdventureID, "error", err)
+		http.Error(w, "Delivery log unavailable", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []webhook.Delivery{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,529 @@
+// Package webhook notifies clients that a generation has finished by POSTing
+// a signed JSON payload to the URL they registered with the job. Deliveries
+// are stored in SQLite and retried with exponential backoff, so they survive
+// restarts, and every attempt is kept as a delivery log.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Event names what happened to a generation.
+type Event string
+
+const (
+	EventCompleted Event = "generation.completed"
+	EventFailed    Event = "generation.failed"
+	EventCancelled Event = "generation.cancelled"
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook's secret.
+const (
+	HeaderEvent     = "X-Dndbot-Event"
+	HeaderDelivery  = "X-Dndbot-Delivery"
+	HeaderTimestamp = "X-Dndbot-Timestamp"
+	HeaderSignature = "X-Dndbot-Signature"
+)
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	Event       Event     `json:"event"`
+	AdventureID string    `json:"adventure_id"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	// Downloads is omitted when nothing was produced.
+	Downloads *Downloads `json:"downloads,omitempty"`
+	Usage     Usage      `json:"usage"`
+}
+
+// Downloads links to the files of a generation.
+type Downloads struct {
+	Zip string `json:"zip"`
+	PDF string `json:"pdf,omitempty"`
+	// Locked marks a free preview whose full download needs payment first.
+	Locked bool `json:"locked,omitempty"`
+}
+
+// Usage summarizes what a generation consumed.
+type Usage struct {
+	Tokens          int64   `json:"tokens"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Episodes        int     `json:"episodes"`
+	Images          bool    `json:"images"`
+	PDF             bool    `json:"pdf"`
+	Tier            string  `json:"tier,omitempty"`
+}
+
+// DeliveryState tracks a delivery through its attempts.
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// Delivery is one notification and the outcome of its latest attempt.
+type Delivery struct {
+	ID          int64         `json:"id"`
+	AdventureID string        `json:"adventure_id"`
+	Event       Event         `json:"event"`
+	URL         string        `json:"url"`
+	State       DeliveryState `json:"state"`
+	Attempts    int           `json:"attempts"`
+	StatusCode  int           `json:"status_code,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	// NextAttempt is set while the delivery is pending, DeliveredAt once
+	// it succeeded.
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// ErrInvalidURL is returned by Register for URLs that are not absolute http
+// or https URLs.
+var ErrInvalidURL = errors.New("webhook URL must be an absolute http or https URL")
+
+// maxBackoff caps the delay between two attempts.
+const maxBackoff = time.Hour
+
+// Dispatcher stores webhook registrations and delivers their notifications.
+// It is safe for concurrent use.
+type Dispatcher struct {
+	db *sql.DB
+	// Client sends the deliveries.
+	Client *http.Client
+	// MaxAttempts is how many times a delivery is tried before it fails.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each
+	// further retry up to an hour.
+	Backoff time.Duration
+
+	wake chan struct{}
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	adventure_id TEXT    PRIMARY KEY,
+	url          TEXT    NOT NULL,
+	secret       TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS deliveries (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	adventure_id    TEXT    NOT NULL,
+	event           TEXT    NOT NULL,
+	url             TEXT    NOT NULL,
+	body            BLOB    NOT NULL,
+	state           TEXT    NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	status_code     INTEGER NOT NULL DEFAULT 0,
+	error           TEXT    NOT NULL DEFAULT '',
+	created_at      INTEGER NOT NULL,
+	next_attempt_at INTEGER NOT NULL DEFAULT 0,
+	delivered_at    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS deliveries_due ON deliveries(state, next_attempt_at);
+CREATE INDEX IF NOT EXISTS deliveries_adventure ON deliveries(adventure_id, id);
+`
+
+// Open opens (or creates) the webhook database at path. Deliveries are only
+// sent once Start is called.
+//
+// Parameters:
+//   - path: filesystem location of the SQLite database
+//
+// Returns:
+//   - *Dispatcher: dispatcher using http.DefaultClient, 5 attempts and a
+//     30 second backoff until configured otherwise
+//   - error: any error opening or migrating the database
+func Open(path string) (*Dispatcher, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening webhook database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating webhook schema: %w", err)
+	}
+	return &Dispatcher{
+		db:          db,
+		Client:      http.DefaultClient,
+		MaxAttempts: 5,
+		Backoff:     30 * time.Second,
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+// NewClient returns an HTTP client for deliveries. Unless allowPrivate is
+// set it refuses to connect to loopback, private, link-local and other
+// non-public addresses, checked after DNS resolution so a hostname cannot
+// smuggle one in. Redirects are not followed.
+//
+// Parameters:
+//   - timeout: bounds each request, including reading the response
+//   - allowPrivate: permit non-public addresses
+//
+// Returns:
+//   - *http.Client: client to set as Dispatcher.Client
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Sign computes the signature header value of a delivery.
+//
+// Parameters:
+//   - secret: the webhook's secret
+//   - timestamp: Unix time sent in the timestamp header
+//   - body: the request body
+//
+// Returns:
+//   - string: "sha256=" followed by the hex HMAC-SHA256
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidURL reports whether raw is acceptable as a webhook URL.
+func ValidURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// Ping checks that the database is reachable.
+func (d *Dispatcher) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// Register sets the webhook notified about an adventure, replacing any
+// earlier one.
+//
+// Parameters:
+//   - adventureID: adventure whose generation should be reported
+//   - rawURL: receiver URL
+//   - secret: key for the HMAC signature; may be empty, leaving the
+//     deliveries unsigned
+//
+// Returns:
+//   - error: ErrInvalidURL, or any database error
+func (d *Dispatcher) Register(adventureID, rawURL, secret string) error {
+	if !ValidURL(rawURL) {
+		return ErrInvalidURL
+	}
+	_, err := d.db.Exec(
+		`INSERT INTO webhooks (adventure_id, url, secret, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(adventure_id) DO UPDATE SET url = excluded.url, secret = excluded.secret`,
+		adventureID, rawURL, secret, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("registering webhook: %w", err)
+	}
+	return nil
+}
+
+// Notify queues a delivery of p to the webhook registered for its
+// adventure, if any.
+//
+// Parameters:
+//   - p: the payload; p.AdventureID selects the webhook
+//
+// Returns:
+//   - error: any database or encoding error
+func (d *Dispatcher) Notify(p Payload) error {
+	var target string
+	err := d.db.QueryRow(`SELECT url FROM webhooks WHERE adventure_id = ?`, p.AdventureID).Scan(&target)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading webhook: %w", err)
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	_, err = d.db.Exec(
+		`INSERT INTO deliveries (adventure_id, event, url, body, state, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.AdventureID, p.Event, target, body, DeliveryPending, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("queueing delivery: %w", err)
+	}
+	d.notify()
+	return nil
+}
+
+// Deliveries returns the delivery log of an adventure, oldest first.
+//
+// Parameters:
+//   - adventureID: adventure to look up
+//
+// Returns:
+//   - []Delivery: the deliveries
+//   - error: any database error
+func (d *Dispatcher) Deliveries(adventureID string) ([]Delivery, error) {
+	rows, err := d.db.Query(
+		`SELECT id, adventure_id, event, url, state, attempts, status_code, error, created_at, next_attempt_at, delivered_at
+		FROM deliveries WHERE adventure_id = ? ORDER BY id`,
+		adventureID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var dl Delivery
+		var created, next, delivered int64
+		err := rows.Scan(&dl.ID, &dl.AdventureID, &dl.Event, &dl.URL, &dl.State, &dl.Attempts, &dl.StatusCode, &dl.Error,
+			&created, &next, &delivered)
+		if err != nil {
+			return nil, err
+		}
+		dl.CreatedAt = time.Unix(0, created)
+		if dl.State == DeliveryPending {
+			t := time.Unix(0, next)
+			dl.NextAttempt = &t
+		}
+		if delivered != 0 {
+			t := time.Unix(0, delivered)
+			dl.DeliveredAt = &t
+		}
+		deliveries = append(deliveries, dl)
+	}
+	return deliveries, rows.Err()
+}
+
+// Delete removes an adventure's webhook and delivery log.
+//
+// Parameters:
+//   - adventureID: adventure being deleted
+//
+// Returns:
+//   - error: any database error
+func (d *Dispatcher) Delete(adventureID string) error {
+	for _, stmt := range []string{
+		`DELETE FROM webhooks WHERE adventure_id = ?`,
+		`DELETE FROM deliveries WHERE adventure_id = ?`,
+	} {
+		if _, err := d.db.Exec(stmt, adventureID); err != nil {
+			return fmt.Errorf("deleting webhook: %w", err)
+		}
+	}
+	return nil
+}
+
+// Start launches the goroutine that sends due deliveries, including those
+// left pending by a previous process.
+func (d *Dispatcher) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	d.stop = stop
+	d.wg.Add(1)
+	go d.run(ctx)
+}
+
+// Close stops delivering, abandoning any attempt in flight, and closes the
+// database. Pending deliveries are retried after the next Start.
+func (d *Dispatcher) Close() error {
+	if d.stop != nil {
+		d.stop()
+		d.wg.Wait()
+	}
+	return d.db.Close()
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	defer d.wg.Done()
+	for {
+		if err := d.deliverDue(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("delivering webhooks", "error", err)
+		}
+		wait := time.Minute
+		var next sql.NullInt64
+		if err := d.db.QueryRow(`SELECT MIN(next_attempt_at) FROM deliveries WHERE state = ?`, DeliveryPending).Scan(&next); err == nil && next.Valid {
+			wait = min(wait, max(time.Until(time.Unix(0, next.Int64)), 0))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pendingDelivery is a due delivery with what is needed to send it.
+type pendingDelivery struct {
+	id       int64
+	event    Event
+	url      string
+	secret   string
+	body     []byte
+	attempts int
+}
+
+// deliverDue attempts every delivery whose next attempt is due.
+func (d *Dispatcher) deliverDue(ctx context.Context) error {
+	rows, err := d.db.Query(
+		`SELECT d.id, d.event, d.url, COALESCE(w.secret, ''), d.body, d.attempts
+		FROM deliveries d LEFT JOIN webhooks w ON w.adventure_id = d.adventure_id
+		WHERE d.state = ? AND d.next_attempt_at <= ? ORDER BY d.id LIMIT 50`,
+		DeliveryPending, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+	var due []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		if err := rows.Scan(&p.id, &p.event, &p.url, &p.secret, &p.body, &p.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := d.attempt(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt sends one delivery and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, p pendingDelivery) error {
+	status, sendErr := d.send(ctx, p)
+	if ctx.Err() != nil {
+		// Shutting down; the attempt does not count.
+		return nil
+	}
+	p.attempts++
+	logger := slog.With("delivery", p.id, "event", p.event, "attempt", p.attempts)
+	now := time.Now()
+	if sendErr == nil {
+		logger.Info("webhook delivered", "status", status)
+		_, err := d.db.Exec(`UPDATE deliveries SET state = ?, attempts = ?, status_code = ?, error = '', delivered_at = ? WHERE id = ?`,
+			DeliveryDelivered, p.attempts, status, now.UnixNano(), p.id)
+		return err
+	}
+
+	state, next := DeliveryPending, now.Add(d.backoff(p.attempts))
+	if p.attempts >= d.MaxAttempts {
+		state = DeliveryFailed
+		logger.Warn("webhook delivery failed, giving up", "status", status, "error", sendErr)
+	} else {
+		logger.Warn("webhook delivery failed, will retry", "status", status, "error", sendErr, "retry_at", next)
+	}
+	_, err := d.db.Exec(`UPDATE deliveries SET state = ?, attempts = ?, status_code = ?, error = ?, next_attempt_at = ? WHERE id = ?`,
+		state, p.attempts, status, sendErr.Error(), next.UnixNano(), p.id)
+	return err
+}
+
+// send POSTs a delivery. Any 2xx response counts as success.
+//
+// Returns:
+//   - int: the response status, or zero if there was none
+//   - error: why the delivery did not succeed
+func (d *Dispatcher) send(ctx context.Context, p pendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(p.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dndbot-webhook")
+	req.Header.Set(HeaderEvent, string(p.event))
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(p.id, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	if p.secret != "" {
+		req.Header.Set(HeaderSignature, Sign(p.secret, timestamp, p.body))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff is the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
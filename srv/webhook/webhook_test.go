@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// received is one request seen by a test receiver.
+type received struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// receiver is an httptest server answering each request with the next of
+// statuses, repeating the last one, and recording what it received.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	rc := &receiver{statuses: statuses}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mu.Lock()
+		status := rc.statuses[min(len(rc.requests), len(rc.statuses)-1)]
+		rc.requests = append(rc.requests, received{header: r.Header.Clone(), body: body, at: time.Now()})
+		rc.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *receiver) received() []received {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]received(nil), rc.requests...)
+}
+
+// openDispatcher opens a dispatcher on a temporary database with a short
+// backoff, closed when the test ends.
+func openDispatcher(t *testing.T, attempts int, backoff time.Duration) *Dispatcher {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "webhooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.MaxAttempts = attempts
+	d.Backoff = backoff
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// waitForState polls the adventure's first delivery until it reaches state.
+func waitForState(t *testing.T, d *Dispatcher, adventureID string, state DeliveryState) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err := d.Deliveries(adventureID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 1 && deliveries[0].State == state {
+			return deliveries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery did not become %s: %+v", state, deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliverySignedPayload(t *testing.T) {
+	rc := newReceiver(t, http.StatusNoContent)
+	d := openDispatcher(t, 3, time.Second)
+	if err := d.Register("adv-1", rc.URL+"/hook", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	finished := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sent := Payload{
+		Event:       EventCompleted,
+		AdventureID: "adv-1",
+		State:       "completed",
+		CreatedAt:   finished.Add(-time.Hour),
+		FinishedAt:  finished,
+		Downloads:   &Downloads{Zip: "https://example.com/outputs/adv-1.zip"},
+		Usage:       Usage{Tokens: 1234, Episodes: 3, Images: true},
+	}
+	if err := d.Notify(sent); err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+
+	delivery := waitForState(t, d, "adv-1", DeliveryDelivered)
+	if delivery.Attempts != 1 || delivery.StatusCode != http.StatusNoContent {
+		t.Errorf("delivery = %+v, want one attempt answered 204", delivery)
+	}
+	requests := rc.received()
+	if len(requests) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if got := req.header.Get(HeaderEvent); got != string(EventCompleted) {
+		t.Errorf("%s = %q, want %q", HeaderEvent, got, EventCompleted)
+	}
+	if got := req.header.Get(HeaderDelivery); got != strconv.FormatInt(delivery.ID, 10) {
+		t.Errorf("%s = %q, want %d", HeaderDelivery, got, delivery.ID)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	timestamp, err := strconv.ParseInt(req.header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("bad %s: %v", HeaderTimestamp, err)
+	}
+	if want := Sign("s3cret", timestamp, req.body); req.header.Get(HeaderSignature) != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, req.header.Get(HeaderSignature), want)
+	}
+	if Sign("other", timestamp, req.body) == req.header.Get(HeaderSignature) {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var got Payload
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != sent.Event || got.AdventureID != sent.AdventureID || got.State != sent.State ||
+		!got.FinishedAt.Equal(sent.FinishedAt) || got.Downloads == nil || *got.Downloads != *sent.Downloads ||
+		got.Usage != sent.Usage {
+		t.Errorf("payload = %+v, want %+v", got, sent)
+	}
+}
+
+func TestDeliveryUnsignedWithoutSecret(t *testing.T) {
+	rc := newReceiver(t, http.StatusOK)
+	d := openDispatcher(t, 3, time.Second)
+	if err := d.Register("adv-1", rc.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(Payload{Event: EventFailed, AdventureID: "adv-1", State: "failed"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+
+	waitForState(t, d, "adv-1", DeliveryDelivered)
+	if sig := rc.received()[0].header.Get(HeaderSignature); sig != "" {
+		t.Errorf("unsigned delivery carries %s %q", HeaderSignature, sig)
+	}
+}
+
+func TestDeliveryRetriesServerErrors(t *testing.T) {
+	const backoff = 50 * time.Millisecond
+	rc := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	d := openDispatcher(t, 5, backoff)
+	if err := d.Register("adv-1", rc.URL, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(Payload{Event: EventCompleted, AdventureID: "adv-1", State: "completed"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+
+	delivery := waitForState(t, d, "adv-1", DeliveryDelivered)
+	if delivery.Attempts != 3 || delivery.StatusCode != http.StatusOK || delivery.DeliveredAt == nil {
+		t.Errorf("delivery = %+v, want delivered on the third attempt", delivery)
+	}
+	requests := rc.received()
+	if len(requests) != 3 {
+		t.Fatalf("receiver got %d requests, want 3", len(requests))
+	}
+	// The first retry waits the backoff, the second twice as long.
+	for i, want := range []time.Duration{backoff, 2 * backoff} {
+		if gap := requests[i+1].at.Sub(requests[i].at); gap < want {
+			t.Errorf("retry %d came after %s, want at least %s", i+1, gap, want)
+		}
+	}
+	// Every attempt is signed with the same body.
+	for i, req := range requests {
+		if req.header.Get(HeaderDelivery) != strconv.FormatInt(delivery.ID, 10) || string(req.body) != string(requests[0].body) {
+			t.Errorf("attempt %d differs from the first", i+1)
+		}
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	rc := newReceiver(t, http.StatusServiceUnavailable)
+	d := openDispatcher(t, 2, 10*time.Millisecond)
+	if err := d.Register("adv-1", rc.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(Payload{Event: EventCancelled, AdventureID: "adv-1", State: "cancelled"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+
+	delivery := waitForState(t, d, "adv-1", DeliveryFailed)
+	if delivery.Attempts != 2 || delivery.StatusCode != http.StatusServiceUnavailable || delivery.Error == "" {
+		t.Errorf("delivery = %+v, want two attempts ending in 503", delivery)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(rc.received()); n != 2 {
+		t.Errorf("receiver got %d requests after giving up, want 2", n)
+	}
+}
+
+func TestNotifyWithoutWebhook(t *testing.T) {
+	d := openDispatcher(t, 3, time.Second)
+	if err := d.Notify(Payload{Event: EventCompleted, AdventureID: "adv-1"}); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := d.Deliveries("adv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("deliveries = %+v, want none", deliveries)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Backoff: 30 * time.Second}
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		4:  4 * time.Minute,
+		8:  maxBackoff,
+		50: maxBackoff,
+	} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestValidURL(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"https://example.com/hook":     true,
+		"http://example.com:8080/":     true,
+		"ftp://example.com/":           false,
+		"/relative":                    false,
+		"https://user:pw@example.com/": false,
+		"":                             false,
+	} {
+		if got := ValidURL(raw); got != want {
+			t.Errorf("ValidURL(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/**
+ * Passkey (WebAuthn) registration and login for the account page.
+ * The server sends and expects binary fields as base64url strings.
+ */
+const csrfToken = document.querySelector('meta[name="csrf-token"]')?.content || '';
+
+function base64urlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+    return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    const bytes = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(bytes).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+async function postJSON(url, body) {
+    const response = await fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-CSRF-Token': csrfToken
+        },
+        credentials: 'include',
+        body: body === undefined ? undefined : JSON.stringify(body)
+    });
+    if (!response.ok) {
+        throw new Error((await response.text()) || `HTTP error! status: ${response.status}`);
+    }
+    return response.json();
+}
+
+async function registerPasskey() {
+    const options = await postJSON('/account/passkey/register/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach(cred => {
+        cred.id = base64urlToBuffer(cred.id);
+    });
+
+    const credential = await navigator.credentials.create({ publicKey });
+    await postJSON('/account/passkey/register/finish', {
+        id: credential.id,
+        rawId: bufferToBase64url(credential.rawId),
+        type: credential.type,
+        response: {
+            attestationObject: bufferToBase64url(credential.response.attestationObject),
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+            transports: credential.response.getTransports ? credential.response.getTransports() : []
+        }
+    });
+    window.location.reload();
+}
+
+async function loginWithPasskey() {
+    const options = await postJSON('/account/passkey/login/begin');
+    const publicKey = options.publicKey;
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+    (publicKey.allowCredentials || []).forEach(cred => {
+        cred.id = base64urlToBuffer(cred.id);
+    });
+
+    const assertion = await navigator.credentials.get({ publicKey });
+    await postJSON('/account/passkey/login/finish', {
+        id: assertion.id,
+        rawId: bufferToBase64url(assertion.rawId),
+        type: assertion.type,
+        response: {
+            authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+            clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+            signature: bufferToBase64url(assertion.response.signature),
+            userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null
+        }
+    });
+    window.location.href = '/library';
+}
+
+function showPasskeyError(error) {
+    const element = document.getElementById('passkey-error');
+    element.textContent = `Passkey request failed: ${error.message}`;
+    element.hidden = false;
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const supported = !!window.PublicKeyCredential;
+    [['passkey-register', registerPasskey], ['passkey-login', loginWithPasskey]].forEach(([id, action]) => {
+        const button = document.getElementById(id);
+        if (!button) {
+            return;
+        }
+        if (!supported) {
+            button.disabled = true;
+            button.title = 'This browser does not support passkeys';
+            return;
+        }
+        button.addEventListener('click', () => action().catch(showPasskeyError));
+    });
+});
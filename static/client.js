@@ -82,31 +82,48 @@ class DndApiClient {
         this.baseUrl = baseUrl;
         this.logger = new Logger('DndApiClient');
         this.sessionId = this.getStoredSessionId();
+        this.adventureId = null;
         this.logger.info('API Client initialized', { baseUrl, sessionId: this.sessionId });
     }
 
     getStoredSessionId() {
-        this.logger.debug('Examining stored session ID: ' + document.cookie + '/');
-        this.logger.debug('Examining cookies: ' + document.cookie + '/');
-        this.logger.debug('Retrieving stored session ID: '+ document.cookie + '/');
-        const sessionId = document.cookie.split('; ')
-            .find(row => row.startsWith('session_id='))
-            ?.split('=')[1] || null;
+        // The session cookie is HttpOnly; the server hands the session ID
+        // and CSRF token to the page through meta tags instead.
+        const sessionId = document.querySelector('meta[name="session-id"]')?.content || null;
         this.logger.debug('Session ID retrieved', { sessionId });
         return sessionId;
     }
 
-    async generateAdventure(prompt, setting, style) {
+    getCsrfToken() {
+        return document.querySelector('meta[name="csrf-token"]')?.content || '';
+    }
+
+    generateParams(prompt, setting, style, options) {
+        const params = new URLSearchParams({
+            prompt,
+            setting,
+            style,
+            episodes: options.episodes ?? 5,
+            images: options.images ?? true,
+            pdf: options.pdf ?? true
+        });
+        if (options.email) {
+            params.set('email', options.email);
+        }
+        return params;
+    }
+
+    async generateAdventure(prompt, setting, style, options = {}) {
         this.logger.info('Generating adventure', { prompt });
         try {
             const response = await fetch(`${this.baseUrl}generate`, {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/x-www-form-urlencoded',
-                    'X-Session-Id': this.sessionId
+                    'X-CSRF-Token': this.getCsrfToken()
                 },
                 credentials: 'include',
-                body: `prompt=${encodeURIComponent(prompt)}&setting=${encodeURIComponent(setting)}&style=${encodeURIComponent(style)}`
+                body: this.generateParams(prompt, setting, style, options).toString()
             });
 
             this.logger.debug('Generation response received', {
@@ -119,9 +136,11 @@ class DndApiClient {
             }
 
             this.sessionId = response.headers.get('X-Session-Id');
+            this.adventureId = response.headers.get('X-Adventure-Id') || this.adventureId;
             const result = await response.text();
             this.logger.info('Adventure generated successfully', {
                 newSessionId: this.sessionId,
+                adventureId: this.adventureId,
                 responseLength: result.length
             });
             return result;
@@ -131,7 +150,29 @@ class DndApiClient {
         }
     }
 
-    async getMessageHistory(sessionId = this.sessionId) {
+    async cancelGeneration() {
+        this.logger.info('Cancelling generation', { sessionId: this.sessionId });
+        try {
+            const response = await fetch(`${this.baseUrl}cancel`, {
+                method: 'POST',
+                headers: {
+                    'X-CSRF-Token': this.getCsrfToken()
+                },
+                credentials: 'include'
+            });
+            const result = await response.text();
+            if (!response.ok) {
+                throw new Error(result || `HTTP error! status: ${response.status}`);
+            }
+            this.logger.info('Generation cancelled', { sessionId: this.sessionId });
+            return result;
+        } catch (error) {
+            this.logger.error('Cancel failed', error, { sessionId: this.sessionId });
+            throw error;
+        }
+    }
+
+    async getMessageHistory(sessionId = this.adventureId || this.sessionId) {
         this.logger.debug('Fetching message history', { sessionId });
         try {
             const response = await fetch(`${this.baseUrl}api/messages/${sessionId}`, {
@@ -174,18 +215,25 @@ class DndGeneratorUI {
             prompt: document.getElementById('prompt-input'),
             setting: document.getElementById('setting-input'),
             style: document.getElementById('style-input'),
+            episodes: document.getElementById('episodes-input'),
+            images: document.getElementById('images-input'),
+            pdf: document.getElementById('pdf-input'),
+            email: document.getElementById('email-input'),
             output: document.getElementById('output-area'),
-            status: document.getElementById('status-message')
+            status: document.getElementById('status-message'),
+            cancel: document.getElementById('cancel-button')
         };
 
-        // Log if any elements are missing
+        // Log if any elements are missing; the email field is only rendered
+        // when the server can send mail
         Object.entries(this.elements).forEach(([key, element]) => {
-            if (!element) {
+            if (!element && key !== 'email') {
                 this.logger.warn(`UI element not found: ${key}`);
             }
         });
 
         this.elements.form.addEventListener('submit', (e) => this.handleSubmit(e));
+        this.elements.cancel.addEventListener('click', (e) => this.handleCancel(e));
         this.logger.info('UI initialization complete');
         this.startPolling();
     }
@@ -199,7 +247,13 @@ class DndGeneratorUI {
         const prompt = this.elements.prompt.value.trim();
         const setting = this.elements.setting.value.trim();
         const style = this.elements.style.value.trim();
-        this.logger.info('Form submitted', { promptLength: prompt.length });
+        const options = {
+            episodes: this.elements.episodes.value || 5,
+            images: this.elements.images.checked,
+            pdf: this.elements.pdf.checked,
+            email: this.elements.email?.value.trim() || ''
+        };
+        this.logger.info('Form submitted', { promptLength: prompt.length, options });
 
         if (!prompt) {
             this.logger.warn('Empty prompt submitted');
@@ -213,8 +267,9 @@ class DndGeneratorUI {
             this.stopPolling();
             
             this.logger.debug('Starting adventure generation');
-            const result = await this.apiClient.generateAdventure(prompt, setting, style);
+            const result = await this.apiClient.generateAdventure(prompt, setting, style, options);
             this.updateOutput(result);
+            this.elements.cancel.hidden = false;
             
             // Reset polling state and start fresh
             this.pollingState.emptyResponseCount = 0;
@@ -232,6 +287,29 @@ class DndGeneratorUI {
         }
     }
 
+    /**
+     * Handles the cancel button, stopping the current generation
+     * @param {Event} event Click event
+     */
+    async handleCancel(event) {
+        event.preventDefault();
+        if (!confirm('Cancel this generation? Anything produced so far will be saved.')) {
+            return;
+        }
+        this.elements.cancel.disabled = true;
+        try {
+            const result = await this.apiClient.cancelGeneration();
+            this.elements.status.textContent = result;
+            this.elements.status.className = 'status-cancelled';
+            this.elements.cancel.hidden = true;
+            this.resumePolling();
+        } catch (error) {
+            this.showError(error.message);
+        } finally {
+            this.elements.cancel.disabled = false;
+        }
+    }
+
     handleError(error){
         this.logger.error("Error caught:", error)
     }